@@ -0,0 +1,162 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/server"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+var (
+	// ErrBackupDirNotEmpty indicates that the destination directory of the
+	// backup is not empty.
+	ErrBackupDirNotEmpty = errors.New("backup directory is not empty")
+)
+
+// BackupShard describes the exported snapshot of a replica included in a
+// backup.
+type BackupShard = server.BackupShard
+
+// BackupInfo describes a backup created by NodeHost.Backup.
+type BackupInfo = server.BackupManifest
+
+// Backup creates a backup of all replicas hosted by the NodeHost in the
+// specified dest directory. The backup contains an exported snapshot for each
+// hosted replica and a manifest with the NodeHostID, the RaftAddress and the
+// membership of each shard. Witness replicas are not included as they do not
+// have any state machine state.
+//
+// Each exported snapshot is created after a ReadIndex operation on the shard,
+// it thus contains all entries committed before Backup is called. Snapshots
+// of different shards are captured independently at different points in time.
+// The manifest is written after all snapshots are exported, a backup directory
+// without the manifest is incomplete.
+//
+// The dest directory must be empty or not exist. The input context object
+// must have its deadline set. The backup can be restored by the RestoreBackup
+// function in the tools package.
+func (nh *NodeHost) Backup(ctx context.Context, dest string) (*BackupInfo, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	if _, err := getTimeoutFromContext(ctx); err != nil {
+		return nil, err
+	}
+	if err := nh.prepareBackupDir(dest); err != nil {
+		return nil, err
+	}
+	var nodes []*node
+	nh.forEachShard(func(shardID uint64, n *node) bool {
+		if !n.isWitness() {
+			nodes = append(nodes, n)
+		}
+		return true
+	})
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].shardID < nodes[j].shardID
+	})
+	info := &BackupInfo{
+		Version:      server.BackupVersion,
+		NodeHostID:   nh.ID(),
+		RaftAddress:  nh.RaftAddress(),
+		DeploymentID: nh.nhConfig.GetDeploymentID(),
+		CreatedAt:    time.Now().UnixNano(),
+	}
+	for _, n := range nodes {
+		shard, err := nh.backupShard(ctx, dest, n)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to backup %s", n.id())
+		}
+		info.Shards = append(info.Shards, shard)
+	}
+	if err := server.SaveBackupManifest(dest, *info, nh.fs); err != nil {
+		return nil, err
+	}
+	plog.Infof("backup of %d shards created in %s", len(info.Shards), dest)
+	return info, nil
+}
+
+func (nh *NodeHost) prepareBackupDir(dest string) error {
+	exist, err := fileutil.Exist(dest, nh.fs)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return fileutil.MkdirAll(dest, nh.fs)
+	}
+	files, err := nh.fs.List(dest)
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		return errors.Wrapf(ErrBackupDirNotEmpty, "%s", dest)
+	}
+	return nil
+}
+
+func (nh *NodeHost) backupShard(ctx context.Context,
+	dest string, n *node) (BackupShard, error) {
+	if _, err := nh.linearizableRead(ctx, n.shardID,
+		func(*node) (interface{}, error) { return nil, nil }); err != nil {
+		return BackupShard{}, err
+	}
+	dir := server.GetBackupShardDir(n.shardID)
+	path := nh.fs.PathJoin(dest, dir)
+	if err := fileutil.Mkdir(path, nh.fs); err != nil {
+		return BackupShard{}, err
+	}
+	opt := SnapshotOption{Exported: true, ExportPath: path}
+	var index uint64
+	for {
+		var err error
+		index, err = nh.SyncRequestSnapshot(ctx, n.shardID, opt)
+		if err == nil {
+			break
+		}
+		// snapshot being concurrently created by the replica
+		if !errors.Is(err, ErrRejected) && !errors.Is(err, ErrSystemBusy) {
+			return BackupShard{}, err
+		}
+		select {
+		case <-ctx.Done():
+			return BackupShard{}, ErrTimeout
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	ssDir := server.GetSnapshotDirName(index)
+	var ss pb.Snapshot
+	if err := fileutil.GetFlagFileContent(nh.fs.PathJoin(path, ssDir),
+		server.MetadataFilename, &ss, nh.fs); err != nil {
+		return BackupShard{}, err
+	}
+	return BackupShard{
+		ShardID:    n.shardID,
+		ReplicaID:  n.replicaID,
+		Index:      ss.Index,
+		Term:       ss.Term,
+		Dir:        nh.fs.PathJoin(dir, ssDir),
+		Members:    ss.Membership.Addresses,
+		NonVotings: ss.Membership.NonVotings,
+		Witnesses:  ss.Membership.Witnesses,
+	}, nil
+}
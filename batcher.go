@@ -0,0 +1,100 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"time"
+)
+
+const (
+	// weight of the latest sample in the estimated proposal rate
+	batchRateWeight  = 0.25
+	minBatchInterval = time.Microsecond
+)
+
+// proposalBatcher decides whether incoming proposals should be held for a
+// short period of time so they can be proposed as larger batches. Proposals
+// are only held when the estimated proposal rate suggests that more proposals
+// are going to arrive before the max delay expires. proposalBatcher is only
+// accessed from the step worker.
+type proposalBatcher struct {
+	delay time.Duration
+	size  uint64
+	limit uint64
+	now   func() time.Time
+	// estimated number of proposals per second
+	rate    float64
+	last    time.Time
+	start   time.Time
+	holding bool
+}
+
+// newProposalBatcher returns a proposalBatcher instance that holds proposals
+// for up to delay, until their total payload size reaches size or until there
+// are limit proposals. nil is returned when delay is 0.
+func newProposalBatcher(delay time.Duration,
+	size uint64, limit uint64) *proposalBatcher {
+	if delay <= 0 {
+		return nil
+	}
+	return &proposalBatcher{
+		delay: delay,
+		size:  size,
+		limit: limit,
+		now:   time.Now,
+	}
+}
+
+// hold returns the time to wait for more proposals before releasing the count
+// pending proposals with a total payload size of bytes. 0 is returned when
+// pending proposals should be released now.
+func (b *proposalBatcher) hold(count uint64, bytes uint64) time.Duration {
+	if b == nil || count == 0 {
+		return 0
+	}
+	now := b.now()
+	if !b.holding {
+		b.holding = true
+		b.start = now
+	}
+	remaining := b.delay - now.Sub(b.start)
+	if remaining <= 0 ||
+		(b.limit > 0 && count >= b.limit) ||
+		(b.size > 0 && bytes >= b.size) {
+		return 0
+	}
+	if b.rate*remaining.Seconds() < 1 {
+		return 0
+	}
+	return remaining
+}
+
+// released records that count proposals have been released.
+func (b *proposalBatcher) released(count uint64) {
+	if b == nil || count == 0 {
+		return
+	}
+	now := b.now()
+	if !b.last.IsZero() {
+		interval := now.Sub(b.last)
+		if interval < minBatchInterval {
+			interval = minBatchInterval
+		}
+		sample := float64(count) / interval.Seconds()
+		b.rate = batchRateWeight*sample + (1-batchRateWeight)*b.rate
+	}
+	b.last = now
+	b.holding = false
+}
@@ -0,0 +1,200 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/faultfs"
+)
+
+// FaultInjector injects errors and latency into all filesystem operations of
+// the faultfs.FS created by NewFaultFS. It can be reconfigured at runtime,
+// finer grained faults can be injected using the FS method.
+type FaultInjector struct {
+	fs *faultfs.FS
+}
+
+// NewFaultFS returns a faultfs.FS backed by fs with faults injected by the
+// returned FaultInjector, the default filesystem is used when fs is nil. The
+// returned filesystem is expected to be used as the Expert.FS field of
+// config.NodeHostConfig in tests. NodeHost instances using a faultfs.FS run
+// in error injection mode, injected LogDB errors crash the NodeHost as
+// reported by the Crashed method of Chaos rather than panicking the process.
+func NewFaultFS(fs config.IFS) (config.IFS, *FaultInjector) {
+	ffs := faultfs.New(fs)
+	return ffs, &FaultInjector{fs: ffs}
+}
+
+// FS returns the faultfs.FS the faults are injected into. It can be used for
+// injecting faults into selected paths, torn writes and simulated crashes.
+func (f *FaultInjector) FS() *faultfs.FS {
+	return f.fs
+}
+
+func (f *FaultInjector) set(name string, fault faultfs.Fault, enabled bool) {
+	if enabled {
+		f.fs.Inject(name, fault)
+	} else {
+		f.fs.RemoveFault(name)
+	}
+}
+
+// FailReads makes all read operations fail with err, nil err stops the
+// error injection.
+func (f *FaultInjector) FailReads(err error) {
+	f.set("read-error", faultfs.Fault{Op: faultfs.OpRead, Err: err}, err != nil)
+}
+
+// FailWrites makes all write operations fail with err, nil err stops the
+// error injection.
+func (f *FaultInjector) FailWrites(err error) {
+	f.set("write-error", faultfs.Fault{Op: faultfs.OpWrite, Err: err}, err != nil)
+}
+
+// FailSyncs makes all fsync operations fail with err, nil err stops the
+// error injection.
+func (f *FaultInjector) FailSyncs(err error) {
+	f.set("sync-error", faultfs.Fault{Op: faultfs.OpSync, Err: err}, err != nil)
+}
+
+// DelayWrites delays all write operations by d, 0 stops the delay.
+func (f *FaultInjector) DelayWrites(d time.Duration) {
+	f.set("write-latency", faultfs.Fault{Op: faultfs.OpWrite, Latency: d}, d > 0)
+}
+
+// DelaySyncs delays all fsync operations by d, 0 stops the delay.
+func (f *FaultInjector) DelaySyncs(d time.Duration) {
+	f.set("sync-latency", faultfs.Fault{Op: faultfs.OpSync, Latency: d}, d > 0)
+}
+
+// Reset stops all fault injections, including those injected using the
+// returned value of the FS method.
+func (f *FaultInjector) Reset() {
+	f.fs.ClearFaults()
+}
+
+// Chaos is the fault injection API of a NodeHost, it is intended to be used
+// in integration tests for reproducing failure modes seen in production.
+// Faults injected into replicas are cleared when the replicas are stopped,
+// including when they are unloaded for hibernation.
+type Chaos struct {
+	nh *NodeHost
+}
+
+// Chaos returns the fault injection API of the NodeHost.
+func (nh *NodeHost) Chaos() *Chaos {
+	return &Chaos{nh: nh}
+}
+
+// Partition disconnects the NodeHost from all other NodeHost instances, all
+// incoming and outgoing Raft messages are dropped.
+func (c *Chaos) Partition() {
+	plog.Infof("%s partitioned", c.nh.describe())
+	atomic.StoreInt32(&c.nh.partitioned, 1)
+}
+
+// Heal reconnects the partitioned NodeHost.
+func (c *Chaos) Heal() {
+	plog.Infof("%s partition healed", c.nh.describe())
+	atomic.StoreInt32(&c.nh.partitioned, 0)
+}
+
+// IsPartitioned returns a boolean value indicating whether the NodeHost is
+// partitioned.
+func (c *Chaos) IsPartitioned() bool {
+	return c.nh.isPartitioned()
+}
+
+// DelayApply delays the apply of each batch of committed entries of the
+// specified shard by d, 0 stops the delay.
+func (c *Chaos) DelayApply(shardID uint64, d time.Duration) error {
+	n, ok := c.nh.getShard(shardID)
+	if !ok {
+		return ErrShardNotFound
+	}
+	atomic.StoreInt64(&n.chaos.applyDelay, int64(d))
+	return nil
+}
+
+// CrashOnSnapshot crashes the local replica of the specified shard when it
+// saves its next snapshot. The replica is stopped after the snapshot data
+// has been written but before the snapshot is committed, leaving the partially
+// saved snapshot on disk as a real crash would do. The replica can be
+// restarted using StartReplica once it has been unloaded by the execution
+// engine, StartReplica returns ErrShardAlreadyExist before that.
+func (c *Chaos) CrashOnSnapshot(shardID uint64) error {
+	n, ok := c.nh.getShard(shardID)
+	if !ok {
+		return ErrShardNotFound
+	}
+	nh := c.nh
+	replicaID := n.replicaID
+	n.chaos.setCrash(func() {
+		go func() {
+			if err := nh.StopReplica(shardID, replicaID); err != nil {
+				plog.Errorf("failed to stop crashed replica %s, %v",
+					dn(shardID, replicaID), err)
+			}
+		}()
+	})
+	return nil
+}
+
+// Crashed returns a channel that receives the error that crashed the
+// NodeHost when it uses a filesystem created by NewFaultFS. nil is returned
+// for other NodeHost instances.
+func (c *Chaos) Crashed() <-chan error {
+	return c.nh.engine.ec
+}
+
+func (nh *NodeHost) isPartitioned() bool {
+	return atomic.LoadInt32(&nh.partitioned) == 1
+}
+
+// nodeChaos contains faults injected into a replica.
+type nodeChaos struct {
+	applyDelay int64
+	mu         sync.Mutex
+	crash      func()
+}
+
+func (c *nodeChaos) delayApply() {
+	if d := time.Duration(atomic.LoadInt64(&c.applyDelay)); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (c *nodeChaos) setCrash(f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.crash = f
+}
+
+// crashed returns a boolean value indicating whether the replica is expected
+// to crash now.
+func (c *nodeChaos) crashed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.crash == nil {
+		return false
+	}
+	c.crash()
+	c.crash = nil
+	return true
+}
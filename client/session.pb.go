@@ -49,6 +49,9 @@ type Session struct {
 	ClientID    uint64
 	SeriesID    uint64
 	RespondedTo uint64
+	// tenant is the tenant key plus one for tenant sessions, it is local to
+	// the Session instance and never marshaled, see tenant.go
+	tenant uint64
 }
 
 func (*Session) ProtoMessage() {}
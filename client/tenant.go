@@ -0,0 +1,49 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"github.com/lni/goutils/random"
+)
+
+// NewTenantSession returns a NoOP client session for the specified tenant.
+// Proposals made using tenant sessions of the same tenant share the same
+// proposal rate limit, see the MaxProposalRate field of config.Config. Other
+// than that, tenant sessions are regular NoOP sessions with random client IDs.
+// The tenant key is local to the returned Session instance, it is neither
+// marshaled nor sent to other replicas.
+func NewTenantSession(shardID uint64, tenantKey uint32) *Session {
+	s := NewNoOPSession(shardID, random.LockGuardedRand)
+	s.tenant = uint64(tenantKey) + 1
+	return s
+}
+
+// IsTenantSession returns a boolean value indicating whether the session is
+// a tenant session created by NewTenantSession.
+func (m *Session) IsTenantSession() bool {
+	return m.IsNoOPSession() && m.tenant != 0
+}
+
+// RateLimitKey returns the key used for limiting the proposal rate of the
+// client session. The returned tenant flag indicates whether the key is the
+// tenant key of a tenant session, tenant keys and client IDs are limited
+// separately. Other client sessions, including other NoOP sessions, are
+// limited by their client IDs.
+func (m *Session) RateLimitKey() (key uint64, tenant bool) {
+	if m.IsTenantSession() {
+		return m.tenant - 1, true
+	}
+	return m.ClientID, false
+}
@@ -0,0 +1,70 @@
+// Copyright 2017-2019 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"testing"
+
+	"github.com/lni/goutils/random"
+)
+
+func TestTenantSession(t *testing.T) {
+	for _, key := range []uint32{0, 1, ^uint32(0)} {
+		s := NewTenantSession(120, key)
+		if !s.IsNoOPSession() || !s.IsTenantSession() {
+			t.Errorf("%d, not a tenant session", key)
+		}
+		if s.ClientID == NotSessionManagedClientID {
+			t.Errorf("%d, invalid client id", key)
+		}
+		if k, tenant := s.RateLimitKey(); k != uint64(key) || !tenant {
+			t.Errorf("%d, unexpected rate limit key %d, %t", key, k, tenant)
+		}
+	}
+	s1, s2 := NewTenantSession(120, 1), NewTenantSession(120, 1)
+	if s1.ClientID == s2.ClientID {
+		t.Errorf("tenant key used as client id")
+	}
+	data, err := s1.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal, %v", err)
+	}
+	var rs Session
+	if err := rs.Unmarshal(data); err != nil {
+		t.Fatalf("failed to unmarshal, %v", err)
+	}
+	if rs.IsTenantSession() {
+		t.Errorf("tenant key unexpectedly marshaled")
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	s1 := NewNoOPSession(120, random.LockGuardedRand)
+	s2 := NewNoOPSession(120, random.LockGuardedRand)
+	if s1.IsTenantSession() || s2.IsTenantSession() {
+		t.Fatalf("unexpected tenant session")
+	}
+	// NoOP sessions are limited by their own client ids
+	if k, tenant := s1.RateLimitKey(); k != s1.ClientID || tenant {
+		t.Errorf("client id not used as the rate limit key")
+	}
+	if k1, _ := s1.RateLimitKey(); k1 == s2.ClientID {
+		t.Errorf("NoOP sessions share the same rate limit key")
+	}
+	s1.SeriesID = SeriesIDFirstProposal
+	if k, tenant := s1.RateLimitKey(); k != s1.ClientID || tenant {
+		t.Errorf("client id not used as the rate limit key")
+	}
+}
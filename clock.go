@@ -0,0 +1,170 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/registry"
+	"github.com/lni/dragonboat/v4/internal/transport"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// clockPollInterval is the interval between checks on snapshot operations
+// that are still in progress when the NodeHost is driven by a clock.
+const clockPollInterval = 100 * time.Microsecond
+
+// clockDriver is the config.IClockDriver used for driving a NodeHost that has
+// the Expert.Clock field of its NodeHostConfig set. The tick, step, commit and
+// apply workers and the node monitor of such NodeHost are not started, their
+// work is done by the clockDriver on the goroutine of the clock instead.
+type clockDriver struct {
+	nh *NodeHost
+	ts tickState
+}
+
+var _ config.IClockDriver = (*clockDriver)(nil)
+
+func (d *clockDriver) Tick() {
+	if atomic.LoadInt32(&d.nh.closed) != 0 {
+		return
+	}
+	d.nh.tickShards(&d.ts)
+}
+
+func (d *clockDriver) Run() bool {
+	if atomic.LoadInt32(&d.nh.closed) != 0 {
+		return false
+	}
+	processed := false
+	for {
+		d.nh.stopClosedNodes()
+		ok, err := d.nh.engine.run()
+		if err != nil {
+			panicNow(err)
+		}
+		if ok {
+			processed = true
+			continue
+		}
+		// snapshot operations are handled by the snapshot workers and the
+		// transport, they are waited for so their results are always picked up
+		// on the same run
+		if !d.nh.engine.snapshotInProgress() &&
+			d.nh.transport.(*clockTransport).SnapshotJobs() == 0 {
+			return processed
+		}
+		time.Sleep(clockPollInterval)
+	}
+}
+
+// stopClosedNodes stops those nodes that requested to be removed, it replaces
+// the node monitor when the NodeHost is driven by a clock.
+func (nh *NodeHost) stopClosedNodes() {
+	var closed []*node
+	nh.forEachShard(func(cid uint64, n *node) bool {
+		if n.stopped() {
+			closed = append(closed, n)
+		}
+		return true
+	})
+	for _, n := range closed {
+		if err := nh.stopNode(n.shardID, n.replicaID, true); err != nil {
+			plog.Debugf("stopNode failed %v", err)
+		}
+	}
+}
+
+// newClockRandomSource returns the random source used by the specified Raft
+// node when the NodeHost is driven by a clock.
+func newClockRandomSource(seed int64,
+	shardID uint64, replicaID uint64) *rand.Rand {
+	v := uint64(seed) ^ (shardID * 0x9e3779b97f4a7c15) ^ (replicaID << 32)
+	return rand.New(rand.NewSource(int64(v)))
+}
+
+// clockTransport sends Raft messages on the goroutine that drives the NodeHost
+// rather than on the send queue workers of the underlying transport, so
+// messages reach the transport module in the order they are sent. Snapshots
+// are sent by the underlying transport.
+type clockTransport struct {
+	*transport.Transport
+	resolver registry.INodeRegistry
+	sourceID string
+	did      uint64
+	mu       sync.Mutex
+	conns    map[string]raftio.IConnection
+}
+
+var _ transport.ITransport = (*clockTransport)(nil)
+
+func newClockTransport(t *transport.Transport,
+	resolver registry.INodeRegistry, sourceID string,
+	did uint64) *clockTransport {
+	return &clockTransport{
+		Transport: t,
+		resolver:  resolver,
+		sourceID:  sourceID,
+		did:       did,
+		conns:     make(map[string]raftio.IConnection),
+	}
+}
+
+func (t *clockTransport) Send(m pb.Message) bool {
+	addr, _, err := t.resolver.Resolve(m.ShardID, m.To)
+	if err != nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conn, ok := t.conns[addr]
+	if !ok {
+		conn, err = t.GetTrans().GetConnection(context.Background(), addr)
+		if err != nil {
+			plog.Warningf("failed to get a connection to %s, %v", addr, err)
+			return false
+		}
+		t.conns[addr] = conn
+	}
+	batch := pb.MessageBatch{
+		Requests:      []pb.Message{m},
+		DeploymentId:  t.did,
+		SourceAddress: t.sourceID,
+		BinVer:        raftio.TransportBinVersion,
+	}
+	if err := conn.SendMessageBatch(batch); err != nil {
+		plog.Warningf("failed to send message to %s, %v", addr, err)
+		conn.Close()
+		delete(t.conns, addr)
+		return false
+	}
+	return true
+}
+
+func (t *clockTransport) Close() error {
+	t.mu.Lock()
+	for addr, conn := range t.conns {
+		conn.Close()
+		delete(t.conns, addr)
+	}
+	t.mu.Unlock()
+	return t.Transport.Close()
+}
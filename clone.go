@@ -0,0 +1,404 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// CloneShard creates a new Raft shard identified by dstShardID with its initial
+// state being identical to the current state of the srcShardID shard. The
+// srcShardID shard must have a replica running on the NodeHost. The members
+// parameter is a map of replica ID to replica target for all initial members
+// of the new shard, exactly one of them must be on the current NodeHost.
+//
+// CloneShard requests an exported snapshot from the srcShardID shard and
+// bootstraps the local replica of the new shard from it, in the same way as a
+// replica started with the InitialSnapshot field of config.Config set. Once
+// CloneShard returns, the local replica of the new shard can be started by
+// calling StartReplica, StartConcurrentReplica or StartOnDiskReplica with an
+// empty initialMembers map and its ShardID and ReplicaID set to the values used
+// here. The state machine type must be the same as the one used by srcShardID.
+//
+// When members contains more than one replica, the exportPath parameter must
+// be set to a directory where the exported snapshot is kept, ErrInvalidOption
+// is returned otherwise. The returned value is the path of the exported
+// snapshot directory. Each other member must be started on its NodeHost with
+// the join flag set to false, its initialMembers set to members and the
+// InitialSnapshot field of its config.Config set to the returned path, or to a
+// copy of that directory accessible from its NodeHost. The InitialSnapshotStore
+// field can be used instead when the directory is only available remotely. The
+// returned path is empty when exportPath is not set.
+//
+// The input context object must have its deadline set.
+func (nh *NodeHost) CloneShard(ctx context.Context, srcShardID uint64,
+	dstShardID uint64, members map[uint64]Target, exportPath string) (string, error) {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return "", ErrClosed
+	}
+	if srcShardID == dstShardID {
+		return "", ErrInvalidOption
+	}
+	if len(exportPath) == 0 && len(members) > 1 {
+		return "", ErrInvalidOption
+	}
+	replicaID, err := nh.getLocalReplicaID(members)
+	if err != nil {
+		return "", err
+	}
+	if err := nh.checkTombstone(dstShardID, replicaID); err != nil {
+		return "", err
+	}
+	if _, ok := nh.getShard(dstShardID); ok {
+		return "", ErrShardAlreadyExist
+	}
+	if nh.HasNodeInfo(dstShardID, replicaID) {
+		return "", ErrShardAlreadyExist
+	}
+	exportDir := exportPath
+	if len(exportDir) == 0 {
+		exportDir, err = fileutil.TempDir(nh.nhConfig.NodeHostDir, "clone", nh.fs)
+		if err != nil {
+			return "", err
+		}
+		defer func() {
+			if err := nh.fs.RemoveAll(exportDir); err != nil {
+				plog.Errorf("failed to remove %s, %v", exportDir, err)
+			}
+		}()
+	}
+	opt := SnapshotOption{Exported: true, ExportPath: exportDir}
+	index, err := nh.SyncRequestSnapshot(ctx, srcShardID, opt)
+	if err != nil {
+		return "", err
+	}
+	srcDir := nh.fs.PathJoin(exportDir, server.GetSnapshotDirName(index))
+	var ss pb.Snapshot
+	if err := fileutil.GetFlagFileContent(srcDir,
+		server.MetadataFilename, &ss, nh.fs); err != nil {
+		return "", err
+	}
+	plog.Infof("%s cloning shard %d index %d as shard %d",
+		nh.describe(), srcShardID, index, dstShardID)
+	cfg := config.Config{ShardID: dstShardID, ReplicaID: replicaID}
+	// the private exported snapshot is moved rather than copied into the
+	// snapshot directory of the new replica
+	staged := &stagedSnapshot{dir: srcDir, ss: ss}
+	if len(exportPath) > 0 {
+		// the exported snapshot is kept for other members, the local replica is
+		// bootstrapped from its copy
+		dir, err := fileutil.TempDir(nh.nhConfig.NodeHostDir, "import", nh.fs)
+		if err != nil {
+			return "", err
+		}
+		staged = &stagedSnapshot{dir: dir}
+		defer nh.removeStagedSnapshot(staged)
+		store := &dirSnapshotStore{dir: srcDir, fs: nh.fs}
+		if err := nh.stageSnapshot(store, staged, cfg, ss.Type); err != nil {
+			return "", err
+		}
+	}
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return "", ErrClosed
+	}
+	if _, ok := nh.mu.shards.Load(dstShardID); ok {
+		return "", ErrShardAlreadyExist
+	}
+	if nh.engine.nodeLoaded(dstShardID, replicaID) {
+		return "", ErrShardAlreadyExist
+	}
+	if err := nh.bootstrapFromSnapshot(staged, members, cfg); err != nil {
+		return "", err
+	}
+	if len(exportPath) == 0 {
+		return "", nil
+	}
+	return srcDir, nil
+}
+
+// dirSnapshotStore is the ISnapshotStore for exported snapshots found in a
+// directory of the local filesystem.
+type dirSnapshotStore struct {
+	dir string
+	fs  vfs.IFS
+}
+
+var _ config.ISnapshotStore = (*dirSnapshotStore)(nil)
+
+func (s *dirSnapshotStore) Open(name string) (io.ReadCloser, error) {
+	return s.fs.Open(s.fs.PathJoin(s.dir, name))
+}
+
+func getInitialSnapshotStore(cfg config.Config,
+	fs vfs.IFS) config.ISnapshotStore {
+	if cfg.InitialSnapshotStore != nil {
+		return cfg.InitialSnapshotStore
+	}
+	if len(cfg.InitialSnapshot) > 0 {
+		return &dirSnapshotStore{dir: cfg.InitialSnapshot, fs: fs}
+	}
+	return nil
+}
+
+// stagedSnapshot is an initial snapshot copied into a temporary directory of
+// the NodeHost, it is waiting to be imported.
+type stagedSnapshot struct {
+	dir string
+	ss  pb.Snapshot
+}
+
+// stageInitialSnapshot copies the initial snapshot specified in cfg into a
+// temporary directory. Copying a large snapshot can take a long time, it is
+// done without nh.mu locked. nil is returned when there is no initial
+// snapshot to import.
+func (nh *NodeHost) stageInitialSnapshot(initialMembers map[uint64]Target,
+	join bool, cfg config.Config, smType pb.StateMachineType) (*stagedSnapshot, error) {
+	store := getInitialSnapshotStore(cfg, nh.fs)
+	if store == nil {
+		return nil, nil
+	}
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	if join {
+		return nil, ErrInvalidShardSettings
+	}
+	if err := nh.checkTombstone(cfg.ShardID, cfg.ReplicaID); err != nil {
+		return nil, err
+	}
+	if nh.HasNodeInfo(cfg.ShardID, cfg.ReplicaID) {
+		return nil, nil
+	}
+	if len(initialMembers) == 0 {
+		return nil, ErrShardNotBootstrapped
+	}
+	if _, ok := initialMembers[cfg.ReplicaID]; !ok {
+		return nil, ErrInvalidShardSettings
+	}
+	if _, ok := nh.getShard(cfg.ShardID); ok {
+		return nil, ErrShardAlreadyExist
+	}
+	dir, err := fileutil.TempDir(nh.nhConfig.NodeHostDir, "import", nh.fs)
+	if err != nil {
+		return nil, err
+	}
+	staged := &stagedSnapshot{dir: dir}
+	if err := nh.stageSnapshot(store, staged, cfg, smType); err != nil {
+		nh.removeStagedSnapshot(staged)
+		return nil, err
+	}
+	return staged, nil
+}
+
+func (nh *NodeHost) stageSnapshot(store config.ISnapshotStore,
+	staged *stagedSnapshot, cfg config.Config, smType pb.StateMachineType) error {
+	if err := nh.copyFromStore(store,
+		server.MetadataFilename, staged.dir); err != nil {
+		return err
+	}
+	ss := &staged.ss
+	if err := fileutil.GetFlagFileContent(staged.dir,
+		server.MetadataFilename, ss, nh.fs); err != nil {
+		return err
+	}
+	if ss.Type != smType || ss.Dummy || ss.Witness {
+		plog.Errorf("%s invalid initial snapshot, type %s, dummy %t, witness %t",
+			dn(cfg.ShardID, cfg.ReplicaID), ss.Type, ss.Dummy, ss.Witness)
+		return ErrInvalidShardSettings
+	}
+	plog.Infof("%s copying initial snapshot, index %d",
+		dn(cfg.ShardID, cfg.ReplicaID), ss.Index)
+	names := []string{nh.fs.PathBase(ss.Filepath)}
+	for _, f := range ss.Files {
+		names = append(names, nh.fs.PathBase(f.Filepath))
+	}
+	for _, name := range names {
+		if err := nh.copyFromStore(store, name, staged.dir); err != nil {
+			return err
+		}
+	}
+	return fileutil.SyncDir(staged.dir, nh.fs)
+}
+
+func (nh *NodeHost) removeStagedSnapshot(staged *stagedSnapshot) {
+	if staged == nil {
+		return
+	}
+	if err := nh.fs.RemoveAll(staged.dir); err != nil {
+		plog.Errorf("failed to remove %s, %v", staged.dir, err)
+	}
+}
+
+// bootstrapFromSnapshot imports the staged initial snapshot as the initial
+// state of a new replica. It is a no-op when the replica has already been
+// bootstrapped. nh.mu must be locked by the caller.
+func (nh *NodeHost) bootstrapFromSnapshot(staged *stagedSnapshot,
+	initialMembers map[uint64]Target, cfg config.Config) error {
+	_, err := nh.mu.logdb.GetBootstrapInfo(cfg.ShardID, cfg.ReplicaID)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, raftio.ErrNoBootstrapInfo) {
+		return err
+	}
+	plog.Infof("%s bootstrapping from initial snapshot, index %d",
+		dn(cfg.ShardID, cfg.ReplicaID), staged.ss.Index)
+	return nh.importSnapshot(staged.dir,
+		getClonedSnapshot(staged.ss, cfg.ShardID, initialMembers), cfg.ReplicaID)
+}
+
+// getLocalReplicaID returns the replica ID of the only member located on the
+// current NodeHost.
+func (nh *NodeHost) getLocalReplicaID(members map[uint64]Target) (uint64, error) {
+	validator := nh.nhConfig.GetTargetValidator()
+	local := nh.RaftAddress()
+	if nh.nhConfig.AddressByNodeHostID {
+		local = nh.ID()
+	}
+	replicaID := uint64(0)
+	for rid, target := range members {
+		if rid == 0 || !validator(target) {
+			return 0, ErrInvalidTarget
+		}
+		if target == local {
+			if replicaID != 0 {
+				return 0, ErrInvalidShardSettings
+			}
+			replicaID = rid
+		}
+	}
+	if replicaID == 0 {
+		return 0, ErrInvalidShardSettings
+	}
+	return replicaID, nil
+}
+
+// getClonedSnapshot returns the snapshot record to be used by the specified
+// new shard with its membership set to the specified members.
+func getClonedSnapshot(ss pb.Snapshot,
+	shardID uint64, members map[uint64]Target) pb.Snapshot {
+	result := pb.Snapshot{
+		Filepath: ss.Filepath,
+		FileSize: ss.FileSize,
+		Index:    ss.Index,
+		Term:     ss.Term,
+		Checksum: ss.Checksum,
+		Dummy:    ss.Dummy,
+		Membership: pb.Membership{
+			ConfigChangeId: ss.Index,
+			Removed:        make(map[uint64]bool),
+			NonVotings:     make(map[uint64]string),
+			Addresses:      make(map[uint64]string),
+			Witnesses:      make(map[uint64]string),
+		},
+		Files:    ss.Files,
+		Type:     ss.Type,
+		ShardID:  shardID,
+		Imported: true,
+	}
+	for replicaID, target := range members {
+		result.Membership.Addresses[replicaID] = target
+	}
+	return result
+}
+
+// importSnapshot moves the snapshot image found in srcDir into the snapshot
+// directory of the specified replica and records the snapshot in LogDB as the
+// bootstrapped state of the replica. srcDir must be located on the same
+// filesystem as the NodeHostDir, it is removed once the snapshot is imported.
+// The ShardID and Membership fields of the input snapshot record are expected
+// to have been set for the replica. nh.mu must be locked by the caller and the
+// replica must not be running.
+func (nh *NodeHost) importSnapshot(srcDir string,
+	ss pb.Snapshot, replicaID uint64) error {
+	shardID := ss.ShardID
+	did := nh.nhConfig.GetDeploymentID()
+	if err := nh.env.CreateSnapshotDir(did, shardID, replicaID); err != nil {
+		return err
+	}
+	getSnapshotDir := func(cid uint64, nid uint64) string {
+		return nh.env.GetSnapshotDir(did, cid, nid)
+	}
+	env := server.NewSSEnv(getSnapshotDir,
+		shardID, replicaID, ss.Index, replicaID, server.SnapshotMode, nh.fs)
+	// the metadata of the exported snapshot is replaced by the flag file
+	mfp := nh.fs.PathJoin(srcDir, server.MetadataFilename)
+	if err := nh.fs.RemoveAll(mfp); err != nil {
+		return err
+	}
+	if err := env.RemoveTempDir(); err != nil {
+		return err
+	}
+	tmpDir := env.GetTempDir()
+	if err := nh.fs.Rename(srcDir, tmpDir); err != nil {
+		return err
+	}
+	if err := fileutil.SyncDir(env.GetRootDir(), nh.fs); err != nil {
+		return err
+	}
+	finalDir := env.GetFinalDir()
+	files := make([]*pb.SnapshotFile, 0, len(ss.Files))
+	for _, f := range ss.Files {
+		file := *f
+		file.Filepath = nh.fs.PathJoin(finalDir, nh.fs.PathBase(f.Filepath))
+		files = append(files, &file)
+	}
+	ss.Filepath = nh.fs.PathJoin(finalDir, nh.fs.PathBase(ss.Filepath))
+	ss.Files = files
+	if err := env.FinalizeSnapshot(&ss); err != nil {
+		return err
+	}
+	if err := nh.mu.logdb.ImportSnapshot(ss, replicaID); err != nil {
+		return err
+	}
+	return env.RemoveFlagFile()
+}
+
+// copyFromStore copies the file with the specified name from the store into
+// the dst directory.
+func (nh *NodeHost) copyFromStore(store config.ISnapshotStore,
+	name string, dst string) (err error) {
+	in, err := store.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = firstError(err, in.Close())
+	}()
+	out, err := nh.fs.Create(nh.fs.PathJoin(dst, name))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = firstError(err, out.Close())
+	}()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
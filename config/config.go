@@ -20,6 +20,7 @@ package config
 
 import (
 	"crypto/tls"
+	"io"
 	"net"
 	"path/filepath"
 	"reflect"
@@ -61,6 +62,20 @@ const (
 	Snappy CompressionType = pb.Snappy
 )
 
+// Priority is the scheduling priority class of a shard.
+type Priority uint8
+
+const (
+	// NormalPriority is the default priority class, shards of this class share
+	// the step, commit and apply workers of the execution engine.
+	NormalPriority Priority = iota
+	// HighPriority is the priority class of latency critical shards. Such shards
+	// are processed by dedicated workers of the execution engine so they can
+	// not be starved by busy NormalPriority shards, see the PriorityShards
+	// field of EngineConfig.
+	HighPriority
+)
+
 // Config is used to configure Raft nodes.
 type Config struct {
 	// ReplicaID is a non-zero value used to identify a node within a Raft shard.
@@ -196,6 +211,95 @@ type Config struct {
 	// WaitReady specifies whether to wait for the node to transition
 	// from recovering to ready state before returning from StartReplica.
 	WaitReady bool
+	// InitialSnapshot is the path of a snapshot directory exported by
+	// NodeHost.SyncRequestSnapshot. When set, a new replica started as an
+	// initial member of the shard has the exported snapshot imported as its
+	// initial state before it is started, the state machine is restored from
+	// the snapshot rather than replaying all Raft log entries. This allows large
+	// datasets to be bulk loaded into a new shard. All initial members of the
+	// shard should be started using copies of the same exported snapshot and
+	// the same initialMembers map. InitialSnapshot is ignored when the replica
+	// has already been bootstrapped.
+	InitialSnapshot string
+	// InitialSnapshotStore is the store of an exported snapshot located outside
+	// of the local filesystem, e.g. in an object store. It is used in the same
+	// way as InitialSnapshot, at most one of them can be set.
+	InitialSnapshotStore ISnapshotStore
+	// Priority is the scheduling priority class of the shard. The default value
+	// is NormalPriority. HighPriority shards are processed as NormalPriority
+	// shards when the PriorityShards field of EngineConfig is 0.
+	Priority Priority
+	// HibernateRTT is the number of RTTs a quiesced replica is allowed to stay
+	// idle before it is hibernated. A hibernated replica has its state machine
+	// and Raft instance unloaded from memory, only a small stub is kept by the
+	// NodeHost. The replica is restarted when it receives a Raft message or a
+	// client request. Client requests wait for the replica to be restarted up to
+	// their own timeouts, they fail with the temporary ErrShardNotReady error
+	// when the replica is not restarted in time. The default value 0 disables
+	// hibernation. Quiesce must be enabled when HibernateRTT is set.
+	//
+	// Hibernation support is currently experimental.
+	HibernateRTT uint64
+	// WakeTimeout is the max time to wait for a hibernated replica to be fully
+	// unloaded from memory before it is restarted. The default value 0 means 10
+	// seconds.
+	WakeTimeout time.Duration
+	// MaxProposalRate is the max number of proposals per second accepted by the
+	// local replica from each client session. Proposals made using tenant
+	// sessions of the same tenant, see client.NewTenantSession, share the same
+	// limit. All other NoOP sessions, e.g. those returned by the GetNoOPSession
+	// method of NodeHost, are limited by their own client IDs. Proposals
+	// dropped for other reasons, e.g. ErrSystemBusy, are not counted towards
+	// the limit. Proposals exceeding the limit are rejected with an error that
+	// can be checked using errors.Is(err, dragonboat.ErrRateLimited). The
+	// default value 0 disables such rate limiting.
+	MaxProposalRate uint64
+	// ProposalBurst is the max number of proposals that can be accepted in a
+	// burst from each client session or tenant when MaxProposalRate is set. It
+	// defaults to MaxProposalRate when set to a smaller value.
+	ProposalBurst uint64
+	// ProposalChunkSize is the max size in bytes of the payload stored in each
+	// Raft log entry. When set, proposals with larger payloads are transparently
+	// split into multiple Raft log entries, they are reassembled before being
+	// applied into the state machine, each such proposal is still applied
+	// atomically and exactly once. This allows occasional large payloads to be
+	// proposed without keeping them in a single Raft log entry. Chunks are
+	// queued a few at a time to bound the memory used for replicating them,
+	// other proposals are rejected with ErrSystemBusy until all chunks of the
+	// proposal have been queued. Chunked proposals are reassembled in memory
+	// before being applied unless the state machine implements the
+	// statemachine.IChunkedUpdater interface, their payloads are limited by the
+	// MaxChunkedProposalSize soft setting rather than MaxInMemLogSize.
+	// Snapshots can not be created when the chunks of a proposal are only
+	// partially applied.
+	// All replicas of the shard must be running a Dragonboat version that
+	// supports chunked proposals. The default value 0 disables such chunking.
+	//
+	// Chunked proposal support is currently experimental.
+	ProposalChunkSize uint64
+	// MaxInflightBytes is the max total size in bytes of Raft log entries sent
+	// by the leader to each remote replica that have not been acknowledged yet.
+	// It implements a byte based sliding window for pipelined replication, a
+	// larger value allows followers on high-bandwidth high-latency links to be
+	// saturated, a smaller value prevents slow followers from being buried by
+	// in-flight entries. The replication state of remote replicas, including
+	// their in-flight bytes, are available in the ShardInfo returned by the
+	// GetNodeHostInfo method of NodeHost when MaxInflightBytes is set. The
+	// default value 0 means there is no such limit.
+	MaxInflightBytes uint64
+	// ProposalBatchDelay is the max time incoming proposals can be held by the
+	// local replica so they can be appended to the Raft log and replicated in
+	// fewer but larger batches. Proposals are only held when the recently
+	// observed proposal rate suggests that more proposals are going to arrive
+	// before the delay expires, idle or lightly loaded shards are thus not
+	// affected. The default value 0 disables such batching. It is intended for
+	// throughput oriented shards that can tolerate small extra latencies.
+	ProposalBatchDelay time.Duration
+	// ProposalBatchSize is the target total size in bytes of proposal payloads
+	// in each batch when ProposalBatchDelay is set. Held proposals are released
+	// once such target size is reached. The default value 0 means there is no
+	// such target size.
+	ProposalBatchSize uint64
 }
 
 // Validate validates the Config instance and return an error when any member
@@ -237,6 +341,34 @@ func (c *Config) Validate() error {
 	if c.IsWitness && c.IsNonVoting {
 		return errors.New("witness node can not be a non-voting node")
 	}
+	if len(c.InitialSnapshot) > 0 && c.InitialSnapshotStore != nil {
+		return errors.New("both InitialSnapshot and InitialSnapshotStore are set")
+	}
+	if c.IsWitness &&
+		(len(c.InitialSnapshot) > 0 || c.InitialSnapshotStore != nil) {
+		return errors.New("witness node can not have initial snapshot")
+	}
+	if c.Priority != NormalPriority && c.Priority != HighPriority {
+		return errors.New("unknown priority class")
+	}
+	if c.HibernateRTT > 0 && !c.Quiesce {
+		return errors.New("hibernation requires quiesce to be enabled")
+	}
+	if c.WakeTimeout < 0 {
+		return errors.New("invalid WakeTimeout")
+	}
+	if c.MaxInMemLogSize > 0 && c.ProposalChunkSize > c.MaxInMemLogSize/2 {
+		return errors.New("ProposalChunkSize must be <= MaxInMemLogSize/2")
+	}
+	if c.ProposalBurst > 0 && c.MaxProposalRate == 0 {
+		return errors.New("ProposalBurst requires MaxProposalRate to be set")
+	}
+	if c.ProposalBatchDelay < 0 {
+		return errors.New("invalid ProposalBatchDelay")
+	}
+	if c.ProposalBatchSize > 0 && c.ProposalBatchDelay == 0 {
+		return errors.New("ProposalBatchSize requires ProposalBatchDelay to be set")
+	}
 	return nil
 }
 
@@ -371,11 +503,50 @@ type NodeHostConfig struct {
 	// dropped to restrict memory usage. When set to 0, it means the queue size
 	// is unlimited.
 	MaxReceiveQueueSize uint64
+	// MaxMemoryBudget is the maximum total size in bytes of memory allowed to be
+	// used by the in memory Raft logs, the incoming proposal queues and the
+	// receive queues of all replicas managed by the NodeHost. Once the budget is
+	// exhausted, replicas using at least their fair share of the budget reject
+	// new proposals with ErrMemoryBudgetExceeded and drop incoming replication
+	// messages until the usage drops. Snapshot chunks are not accounted as they
+	// are streamed to disk. When set to 0, it means the memory usage of the
+	// NodeHost is not budgeted.
+	MaxMemoryBudget uint64
+	// MinFreeDiskSpace is the minimum free disk space in bytes required on the
+	// filesystems of NodeHostDir and WALDir for accepting new proposals. Once
+	// the free disk space drops below MinFreeDiskSpace, new proposals are
+	// rejected with ErrDiskSpaceLow while reads, log compactions and snapshots
+	// continue to be allowed. When set to 0, proposals are never rejected for
+	// low disk space.
+	MinFreeDiskSpace uint64
+	// CriticalFreeDiskSpace is the free disk space in bytes below which the
+	// NodeHost steps down to avoid crashing when its disk becomes full, local
+	// replicas transfer their leadership to other replicas and are then
+	// stopped. Stopped replicas are automatically restarted once the free disk
+	// space is back above CriticalFreeDiskSpace. When set to 0, replicas are
+	// never stopped for low disk space.
+	CriticalFreeDiskSpace uint64
 	// NotifyCommit specifies whether clients should be notified when their
 	// regular proposals and config change requests are committed. By default,
 	// commits are not notified, clients are only notified when their proposals
 	// are both committed and applied.
 	NotifyCommit bool
+	// OrphanCleanupDelay is the minimum amount of time a replica must have been
+	// continuously seen as orphaned before its data is automatically removed
+	// from the NodeHost. A replica is considered as orphaned when it is not
+	// running on the NodeHost and its shard or replica ID has been tombstoned by
+	// the NodeHost.DeleteShard or NodeHost.SyncRequestDeleteReplica methods.
+	// Tombstones are shared among NodeHost instances by the gossip service when
+	// AddressByNodeHostID is enabled. When set to 0, orphaned replicas are only
+	// reported in NodeHostInfo and their data is never automatically removed.
+	OrphanCleanupDelay time.Duration
+	// TombstoneRetention is the amount of time tombstones are kept by the
+	// NodeHost before they expire and are removed. Replicas covered by expired
+	// tombstones are no longer considered as orphaned and their shards can be
+	// started again. TombstoneRetention is always extended to be longer than
+	// OrphanCleanupDelay plus the time required for tombstones to be gossiped
+	// to all NodeHost instances. The default value 0 means 7 days.
+	TombstoneRetention time.Duration
 	// Gossip contains configurations for the gossip service. When the
 	// AddressByNodeHostID field is set to true, each NodeHost instance will use
 	// an internal gossip service to exchange knowledges of known NodeHost
@@ -471,6 +642,14 @@ type NodeHostConfig struct {
 // IFS is the filesystem interface used by tests.
 type IFS = vfs.IFS
 
+// ISnapshotStore is the interface used for accessing a snapshot exported by
+// NodeHost.SyncRequestSnapshot.
+type ISnapshotStore interface {
+	// Open opens the file with the specified name found in the exported
+	// snapshot directory for reading.
+	Open(name string) (io.ReadCloser, error)
+}
+
 // TargetValidator is the validtor used to validate user specified target values.
 type TargetValidator func(string) bool
 
@@ -500,6 +679,31 @@ type TransportFactory interface {
 	Validate(string) bool
 }
 
+// IClock is the interface of a virtual clock used for driving NodeHost
+// instances in simulation tests.
+type IClock interface {
+	// Attach is invoked when the NodeHost is created. The NodeHost doesn't run
+	// its tick, step, commit and apply workers, it is driven by the IClock
+	// instance via the specified IClockDriver instead.
+	Attach(IClockDriver)
+	// Detach is invoked when the NodeHost is closed.
+	Detach(IClockDriver)
+	// Seed returns the seed used for making all random decisions of the
+	// NodeHost, e.g. the randomized election timeouts of its Raft nodes.
+	Seed() int64
+}
+
+// IClockDriver is used by IClock to drive a NodeHost.
+type IClockDriver interface {
+	// Tick moves the logical clock of all Raft nodes managed by the NodeHost
+	// forward by one tick.
+	Tick()
+	// Run processes all pending work of the NodeHost on the calling goroutine
+	// in a deterministic order. It returns a boolean value indicating whether
+	// there was any pending work.
+	Run() bool
+}
+
 // LogDBInfo is the info provided when LogDBCallback is invoked.
 type LogDBInfo struct {
 	Shard uint64
@@ -558,6 +762,13 @@ func (c *NodeHostConfig) Validate() error {
 		c.MaxReceiveQueueSize < settings.EntryNonCmdFieldsSize+1 {
 		return errors.New("MaxReceiveSize value is too small")
 	}
+	if c.MaxMemoryBudget > 0 &&
+		c.MaxMemoryBudget < settings.EntryNonCmdFieldsSize+1 {
+		return errors.New("MaxMemoryBudget value is too small")
+	}
+	if c.MinFreeDiskSpace > 0 && c.CriticalFreeDiskSpace > c.MinFreeDiskSpace {
+		return errors.New("CriticalFreeDiskSpace > MinFreeDiskSpace")
+	}
 	if c.RaftRPCFactory != nil && c.Expert.TransportFactory != nil {
 		return errors.New("both TransportFactory and RaftRPCFactory specified")
 	}
@@ -567,6 +778,12 @@ func (c *NodeHostConfig) Validate() error {
 	if c.AddressByNodeHostID && c.Gossip.IsEmpty() {
 		return errors.New("gossip service not configured")
 	}
+	if c.OrphanCleanupDelay < 0 {
+		return errors.New("invalid OrphanCleanupDelay")
+	}
+	if c.TombstoneRetention < 0 {
+		return errors.New("invalid TombstoneRetention")
+	}
 	validate := c.GetRaftAddressValidator()
 	if !validate(c.RaftAddress) {
 		return errors.New("invalid NodeHost address")
@@ -879,6 +1096,39 @@ type EngineConfig struct {
 	// CloseShards is the number of close shards used for closing stopped
 	// state machines. Default value is 32.
 	CloseShards uint64
+	// PriorityShards is the number of additional execution, commit and apply
+	// shards dedicated to shards configured with HighPriority. Default value is
+	// 0, which means HighPriority shards share the same shards with all other
+	// shards. When set, the custom LogDB implementation, if any, must be able
+	// to handle up to ExecShards + PriorityShards concurrent SaveRaftState
+	// callers.
+	PriorityShards uint64
+	// AdaptiveWorkers specifies whether the numbers of execution, commit,
+	// apply, snapshot and close shards should be automatically adjusted at
+	// runtime based on the observed queue latency of those shards and the CPU
+	// utilization of the process. When enabled, CommitShards, ApplyShards,
+	// SnapshotShards and CloseShards are used as the minimum numbers of their
+	// shards while ExecShards is used as the maximum number of execution
+	// shards.
+	AdaptiveWorkers bool
+	// MinExecShards is the minimum number of execution shards when
+	// AdaptiveWorkers is enabled. Default value is ExecShards / 4 or 1,
+	// whichever is larger. The LogDB is always partitioned based on
+	// ExecShards, the number of execution shards can only be reduced at
+	// runtime.
+	MinExecShards uint64
+	// MaxCommitShards is the maximum number of commit shards when
+	// AdaptiveWorkers is enabled. Default value is 4 * CommitShards.
+	MaxCommitShards uint64
+	// MaxApplyShards is the maximum number of apply shards when
+	// AdaptiveWorkers is enabled. Default value is 4 * ApplyShards.
+	MaxApplyShards uint64
+	// MaxSnapshotShards is the maximum number of snapshot shards when
+	// AdaptiveWorkers is enabled. Default value is 4 * SnapshotShards.
+	MaxSnapshotShards uint64
+	// MaxCloseShards is the maximum number of close shards when
+	// AdaptiveWorkers is enabled. Default value is 4 * CloseShards.
+	MaxCloseShards uint64
 }
 
 // GetDefaultEngineConfig returns the default EngineConfig instance.
@@ -904,9 +1154,64 @@ func (ec EngineConfig) Validate() error {
 		ec.SnapshotShards == 0 || ec.CloseShards == 0 {
 		return errors.New("invalid engine configuration")
 	}
+	if ec.GetMinExecShards() > ec.ExecShards ||
+		ec.GetMaxCommitShards() < ec.CommitShards ||
+		ec.GetMaxApplyShards() < ec.ApplyShards ||
+		ec.GetMaxSnapshotShards() < ec.SnapshotShards ||
+		ec.GetMaxCloseShards() < ec.CloseShards {
+		return errors.New("invalid adaptive engine configuration")
+	}
 	return nil
 }
 
+// GetMinExecShards returns the minimum number of execution shards allowed
+// when AdaptiveWorkers is enabled.
+func (ec EngineConfig) GetMinExecShards() uint64 {
+	if ec.MinExecShards == 0 {
+		if ec.ExecShards < 4 {
+			return 1
+		}
+		return ec.ExecShards / 4
+	}
+	return ec.MinExecShards
+}
+
+// GetMaxCommitShards returns the maximum number of commit shards allowed when
+// AdaptiveWorkers is enabled.
+func (ec EngineConfig) GetMaxCommitShards() uint64 {
+	if ec.MaxCommitShards == 0 {
+		return ec.CommitShards * 4
+	}
+	return ec.MaxCommitShards
+}
+
+// GetMaxApplyShards returns the maximum number of apply shards allowed when
+// AdaptiveWorkers is enabled.
+func (ec EngineConfig) GetMaxApplyShards() uint64 {
+	if ec.MaxApplyShards == 0 {
+		return ec.ApplyShards * 4
+	}
+	return ec.MaxApplyShards
+}
+
+// GetMaxSnapshotShards returns the maximum number of snapshot shards allowed
+// when AdaptiveWorkers is enabled.
+func (ec EngineConfig) GetMaxSnapshotShards() uint64 {
+	if ec.MaxSnapshotShards == 0 {
+		return ec.SnapshotShards * 4
+	}
+	return ec.MaxSnapshotShards
+}
+
+// GetMaxCloseShards returns the maximum number of close shards allowed when
+// AdaptiveWorkers is enabled.
+func (ec EngineConfig) GetMaxCloseShards() uint64 {
+	if ec.MaxCloseShards == 0 {
+		return ec.CloseShards * 4
+	}
+	return ec.MaxCloseShards
+}
+
 // GetDefaultExpertConfig returns the default ExpertConfig.
 func GetDefaultExpertConfig() ExpertConfig {
 	return ExpertConfig{
@@ -936,6 +1241,11 @@ type ExpertConfig struct {
 	LogDB LogDBConfig
 	// FS is the filesystem instance used in tests.
 	FS IFS
+	// Clock is the virtual clock used for driving the NodeHost in simulation
+	// tests. When set, replicas are never hibernated and Config.WaitReady is
+	// expected to be false as replicas only make progress when the clock runs
+	// the NodeHost.
+	Clock IClock
 	// TestGossipProbeInterval defines the probe interval used by the gossip
 	// service in tests.
 	TestGossipProbeInterval time.Duration
@@ -15,9 +15,12 @@
 package config
 
 import (
+	"io"
 	"reflect"
 	"testing"
 
+	"github.com/cockroachdb/errors"
+
 	"github.com/lni/dragonboat/v4/raftio"
 )
 
@@ -120,6 +123,107 @@ func TestWitnessCanNotTakeSnapshot(t *testing.T) {
 	}
 }
 
+type testSnapshotStore struct{}
+
+func (s *testSnapshotStore) Open(string) (io.ReadCloser, error) {
+	return nil, errors.New("not found")
+}
+
+func TestInitialSnapshotCanOnlyHaveOneSource(t *testing.T) {
+	cfg := Config{
+		ShardID:              1,
+		ReplicaID:            1,
+		ElectionRTT:          10,
+		HeartbeatRTT:         1,
+		InitialSnapshot:      "snapshot-0000000000000012",
+		InitialSnapshotStore: &testSnapshotStore{},
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("both initial snapshot sources set")
+	}
+	cfg.InitialSnapshot = ""
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("failed to validate, %v", err)
+	}
+}
+
+func TestHibernationRequiresQuiesce(t *testing.T) {
+	cfg := Config{
+		ShardID:      1,
+		ReplicaID:    1,
+		ElectionRTT:  10,
+		HeartbeatRTT: 1,
+		HibernateRTT: 100,
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("hibernation can not be enabled without quiesce")
+	}
+	cfg.Quiesce = true
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("failed to validate config, %v", err)
+	}
+	cfg.WakeTimeout = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("negative WakeTimeout not rejected")
+	}
+}
+
+func TestProposalBurstRequiresMaxProposalRate(t *testing.T) {
+	cfg := Config{
+		ShardID:       1,
+		ReplicaID:     1,
+		ElectionRTT:   10,
+		HeartbeatRTT:  1,
+		ProposalBurst: 100,
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("ProposalBurst can not be set without MaxProposalRate")
+	}
+	cfg.MaxProposalRate = 10
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("failed to validate config, %v", err)
+	}
+}
+
+func TestProposalBatchSizeRequiresProposalBatchDelay(t *testing.T) {
+	cfg := Config{
+		ShardID:           1,
+		ReplicaID:         1,
+		ElectionRTT:       10,
+		HeartbeatRTT:      1,
+		ProposalBatchSize: 1024,
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("ProposalBatchSize can not be set without ProposalBatchDelay")
+	}
+	cfg.ProposalBatchDelay = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("negative ProposalBatchDelay not rejected")
+	}
+	cfg.ProposalBatchDelay = 1
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("failed to validate config, %v", err)
+	}
+}
+
+func TestProposalChunkSizeIsLimitedByMaxInMemLogSize(t *testing.T) {
+	cfg := Config{
+		ShardID:           1,
+		ReplicaID:         1,
+		ElectionRTT:       10,
+		HeartbeatRTT:      1,
+		MaxInMemLogSize:   1024 * 1024,
+		ProposalChunkSize: 1024*512 + 1,
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("ProposalChunkSize not limited by MaxInMemLogSize")
+	}
+	cfg.ProposalChunkSize = 1024 * 512
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("failed to validate config, %v", err)
+	}
+}
+
 func TestLogDBConfigIsEmpty(t *testing.T) {
 	cfg := LogDBConfig{}
 	if !cfg.IsEmpty() {
@@ -213,6 +317,27 @@ func TestGossipMustBeConfiguredWhenAddressByNodeHostID(t *testing.T) {
 	}
 }
 
+func TestCriticalFreeDiskSpaceIsValidated(t *testing.T) {
+	c := NodeHostConfig{
+		RaftAddress:           "localhost:9010",
+		RTTMillisecond:        100,
+		NodeHostDir:           "/data",
+		MinFreeDiskSpace:      1024,
+		CriticalFreeDiskSpace: 2048,
+	}
+	if err := c.Validate(); err == nil {
+		t.Fatalf("CriticalFreeDiskSpace > MinFreeDiskSpace not rejected")
+	}
+	c.CriticalFreeDiskSpace = 512
+	if err := c.Validate(); err != nil {
+		t.Fatalf("invalid config, %v", err)
+	}
+	c.MinFreeDiskSpace = 0
+	if err := c.Validate(); err != nil {
+		t.Fatalf("invalid config, %v", err)
+	}
+}
+
 func TestGossipConfigIsEmtpy(t *testing.T) {
 	gc := &GossipConfig{}
 	if !gc.IsEmpty() {
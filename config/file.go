@@ -0,0 +1,543 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// NodeHostConfigEnvPrefix is the prefix of environment variables used for
+	// overriding NodeHostConfig fields loaded from configuration files. The
+	// environment variable of a field is named by joining the prefix and the
+	// upper case names of the field and its parents with underscores, e.g.
+	// DRAGONBOAT_NODEHOST_RAFTADDRESS for the RaftAddress field and
+	// DRAGONBOAT_NODEHOST_EXPERT_LOGDB_SHARDS for the Expert.LogDB.Shards field.
+	NodeHostConfigEnvPrefix = "DRAGONBOAT_NODEHOST"
+	// ConfigEnvPrefix is the prefix of environment variables used for
+	// overriding Config fields loaded from configuration files, e.g.
+	// DRAGONBOAT_SHARD_ELECTIONRTT for the ElectionRTT field.
+	ConfigEnvPrefix = "DRAGONBOAT_SHARD"
+)
+
+// FileFormat is the format of configuration files.
+type FileFormat string
+
+const (
+	// TOML is the TOML configuration file format. Multi-line strings,
+	// date-times and arrays of tables are not supported.
+	TOML FileFormat = "toml"
+	// YAML is the YAML configuration file format.
+	YAML FileFormat = "yaml"
+	// JSON is the JSON configuration file format.
+	JSON FileFormat = "json"
+)
+
+var (
+	// ErrUnknownKey indicates that the configuration file contains keys that
+	// do not match any configurable field.
+	ErrUnknownKey = errors.New("unknown configuration key")
+	// ErrUnknownFileFormat indicates that the format of the configuration file
+	// can not be determined from its file extension.
+	ErrUnknownFileFormat = errors.New("unknown configuration file format")
+)
+
+// logDBPresetKey is the key of the Expert table used for selecting the LogDB
+// configuration preset.
+const logDBPresetKey = "LogDBPreset"
+
+var logDBPresets = map[string]func() LogDBConfig{
+	"default": GetDefaultLogDBConfig,
+	"tiny":    GetTinyMemLogDBConfig,
+	"small":   GetSmallMemLogDBConfig,
+	"medium":  GetMediumMemLogDBConfig,
+	"large":   GetLargeMemLogDBConfig,
+}
+
+// GetFileFormat returns the FileFormat of the specified configuration file
+// based on its file extension.
+func GetFileFormat(fn string) (FileFormat, error) {
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".toml":
+		return TOML, nil
+	case ".yaml", ".yml":
+		return YAML, nil
+	case ".json":
+		return JSON, nil
+	}
+	return "", errors.Wrapf(ErrUnknownFileFormat, "%s", fn)
+}
+
+// LoadNodeHostConfig loads the NodeHostConfig from the specified TOML, YAML
+// or JSON file. See ParseNodeHostConfig for details.
+func LoadNodeHostConfig(fn string) (NodeHostConfig, error) {
+	format, err := GetFileFormat(fn)
+	if err != nil {
+		return NodeHostConfig{}, err
+	}
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return NodeHostConfig{}, err
+	}
+	nhConfig, err := ParseNodeHostConfig(data, format)
+	if err != nil {
+		return NodeHostConfig{}, errors.Wrapf(err, "%s", fn)
+	}
+	return nhConfig, nil
+}
+
+// ParseNodeHostConfig parses the NodeHostConfig from data in the specified
+// format. Keys are field names of NodeHostConfig matched case insensitively
+// with underscores and dashes ignored, nested structs such as Expert.LogDB
+// are specified as tables. Durations are specified as strings such as "10s".
+//
+// The Expert.Engine and Expert.LogDB fields default to the values returned by
+// GetDefaultEngineConfig and GetDefaultLogDBConfig. The Expert.LogDBPreset key
+// selects the LogDB preset used as the base for Expert.LogDB, valid presets
+// are default, tiny, small, medium and large.
+//
+// Fields are then overridden by environment variables named after
+// NodeHostConfigEnvPrefix. The returned NodeHostConfig is validated. Keys that
+// do not match any configurable field are reported as ErrUnknownKey.
+func ParseNodeHostConfig(data []byte, format FileFormat) (NodeHostConfig, error) {
+	values, err := parseFile(data, format)
+	if err != nil {
+		return NodeHostConfig{}, err
+	}
+	preset, err := takeLogDBPreset(values)
+	if err != nil {
+		return NodeHostConfig{}, err
+	}
+	nhConfig := NodeHostConfig{Expert: GetDefaultExpertConfig()}
+	nhConfig.Expert.LogDB = preset
+	if err := decodeFile(&nhConfig, values, NodeHostConfigEnvPrefix); err != nil {
+		return NodeHostConfig{}, err
+	}
+	if err := nhConfig.Validate(); err != nil {
+		return NodeHostConfig{}, err
+	}
+	return nhConfig, nil
+}
+
+// LoadConfig loads the Config from the specified TOML, YAML or JSON file. See
+// ParseConfig for details.
+func LoadConfig(fn string) (Config, error) {
+	format, err := GetFileFormat(fn)
+	if err != nil {
+		return Config{}, err
+	}
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg, err := ParseConfig(data, format)
+	if err != nil {
+		return Config{}, errors.Wrapf(err, "%s", fn)
+	}
+	return cfg, nil
+}
+
+// ParseConfig parses the Config from data in the specified format. Keys are
+// matched against field names of Config in the same way as
+// ParseNodeHostConfig, compression types and priorities can be specified by
+// their names, e.g. "Snappy" and "High". Fields are then overridden by
+// environment variables named after ConfigEnvPrefix. The returned Config is
+// validated.
+func ParseConfig(data []byte, format FileFormat) (Config, error) {
+	values, err := parseFile(data, format)
+	if err != nil {
+		return Config{}, err
+	}
+	var cfg Config
+	if err := decodeFile(&cfg, values, ConfigEnvPrefix); err != nil {
+		return Config{}, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+func parseFile(data []byte,
+	format FileFormat) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	switch format {
+	case TOML:
+		return parseTOML(data)
+	case YAML:
+		if err := yaml.Unmarshal(data, &values); err != nil {
+			return nil, err
+		}
+	case JSON:
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		if err := d.Decode(&values); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.Wrapf(ErrUnknownFileFormat, "%s", format)
+	}
+	return values, nil
+}
+
+// normalizeKey returns the key used for matching keys against field names.
+func normalizeKey(key string) string {
+	key = strings.ReplaceAll(key, "_", "")
+	key = strings.ReplaceAll(key, "-", "")
+	return strings.ToLower(key)
+}
+
+func lookupKey(values map[string]interface{}, name string) (string, bool) {
+	for key := range values {
+		if normalizeKey(key) == normalizeKey(name) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// takeLogDBPreset removes the LogDB preset from the Expert table and returns
+// the selected LogDBConfig.
+func takeLogDBPreset(values map[string]interface{}) (LogDBConfig, error) {
+	name := "default"
+	if key, ok := lookupKey(values, "Expert"); ok {
+		if expert, ok := values[key].(map[string]interface{}); ok {
+			if key, ok := lookupKey(expert, logDBPresetKey); ok {
+				v, ok := expert[key].(string)
+				if !ok {
+					return LogDBConfig{}, errors.Newf("invalid Expert.%s", logDBPresetKey)
+				}
+				name = v
+				delete(expert, key)
+			}
+		}
+	}
+	env := NodeHostConfigEnvPrefix + "_EXPERT_" + strings.ToUpper(logDBPresetKey)
+	if v, ok := os.LookupEnv(env); ok {
+		name = v
+	}
+	preset, ok := logDBPresets[strings.ToLower(name)]
+	if !ok {
+		return LogDBConfig{}, errors.Newf("unknown LogDB preset %s", name)
+	}
+	return preset(), nil
+}
+
+func decodeFile(v interface{},
+	values map[string]interface{}, envPrefix string) error {
+	d := &decoder{}
+	rv := reflect.ValueOf(v).Elem()
+	if err := d.decodeStruct(rv, values, ""); err != nil {
+		return err
+	}
+	if len(d.unknown) > 0 {
+		sort.Strings(d.unknown)
+		return errors.Wrapf(ErrUnknownKey, "%s", strings.Join(d.unknown, ", "))
+	}
+	return applyEnv(rv, envPrefix, "")
+}
+
+var (
+	durationType        = reflect.TypeOf(time.Duration(0))
+	compressionTypeType = reflect.TypeOf(CompressionType(0))
+	priorityType        = reflect.TypeOf(Priority(0))
+)
+
+// namedValues contains names of values of enum like types.
+var namedValues = map[reflect.Type]map[string]int64{
+	compressionTypeType: {
+		"nocompression": int64(NoCompression),
+		"snappy":        int64(Snappy),
+	},
+	priorityType: {
+		"normal":         int64(NormalPriority),
+		"normalpriority": int64(NormalPriority),
+		"high":           int64(HighPriority),
+		"highpriority":   int64(HighPriority),
+	},
+}
+
+// isConfigurable returns a boolean value indicating whether fields of the
+// specified type can be set in configuration files.
+func isConfigurable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.String, reflect.Struct,
+		reflect.Int64, reflect.Int32,
+		reflect.Uint64, reflect.Uint32, reflect.Uint16, reflect.Uint8:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.String || t.Elem().Kind() == reflect.Uint8
+	}
+	return false
+}
+
+type decoder struct {
+	unknown []string
+}
+
+func (d *decoder) decodeStruct(v reflect.Value,
+	values map[string]interface{}, path string) error {
+	fields := make(map[string]int)
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.PkgPath == "" && isConfigurable(f.Type) {
+			fields[normalizeKey(f.Name)] = i
+		}
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		idx, ok := fields[normalizeKey(key)]
+		if !ok {
+			d.unknown = append(d.unknown, path+key)
+			continue
+		}
+		name := path + v.Type().Field(idx).Name
+		if err := d.decodeValue(v.Field(idx), values[key], name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *decoder) decodeValue(v reflect.Value,
+	value interface{}, name string) error {
+	if v.Type() == durationType {
+		switch dv := value.(type) {
+		case string:
+			return setString(v, dv, name)
+		default:
+			n, err := toInt(value, name)
+			if err != nil {
+				return err
+			}
+			v.SetInt(n)
+			return nil
+		}
+	}
+	if s, ok := value.(string); ok {
+		if _, ok := namedValues[v.Type()]; ok {
+			return setString(v, s, name)
+		}
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		values, ok := value.(map[string]interface{})
+		if !ok {
+			return errors.Newf("%s must be a table", name)
+		}
+		return d.decodeStruct(v, values, name+".")
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return errors.Newf("%s must be a boolean", name)
+		}
+		v.SetBool(b)
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return errors.Newf("%s must be a string", name)
+		}
+		v.SetString(s)
+	case reflect.Int64, reflect.Int32:
+		n, err := toInt(value, name)
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(n) {
+			return errors.Newf("%s is out of range", name)
+		}
+		v.SetInt(n)
+	case reflect.Uint64, reflect.Uint32, reflect.Uint16, reflect.Uint8:
+		n, err := toUint(value, name)
+		if err != nil {
+			return err
+		}
+		if v.OverflowUint(n) {
+			return errors.Newf("%s is out of range", name)
+		}
+		v.SetUint(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			s, ok := value.(string)
+			if !ok {
+				return errors.Newf("%s must be a string", name)
+			}
+			v.SetBytes([]byte(s))
+			return nil
+		}
+		values, ok := value.([]interface{})
+		if !ok {
+			return errors.Newf("%s must be an array of strings", name)
+		}
+		result := make([]string, 0, len(values))
+		for _, e := range values {
+			s, ok := e.(string)
+			if !ok {
+				return errors.Newf("%s must be an array of strings", name)
+			}
+			result = append(result, s)
+		}
+		v.Set(reflect.ValueOf(result))
+	default:
+		panic("unexpected kind")
+	}
+	return nil
+}
+
+func toInt(value interface{}, name string) (int64, error) {
+	switch n := value.(type) {
+	case int:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case uint64:
+		if n <= math.MaxInt64 {
+			return int64(n), nil
+		}
+	case float64:
+		if n == math.Trunc(n) && n >= math.MinInt64 && n <= math.MaxInt64 {
+			return int64(n), nil
+		}
+	case json.Number:
+		if v, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+			return v, nil
+		}
+	}
+	return 0, errors.Newf("%s must be an integer", name)
+}
+
+func toUint(value interface{}, name string) (uint64, error) {
+	switch n := value.(type) {
+	case int:
+		if n >= 0 {
+			return uint64(n), nil
+		}
+	case int64:
+		if n >= 0 {
+			return uint64(n), nil
+		}
+	case uint64:
+		return n, nil
+	case float64:
+		if n == math.Trunc(n) && n >= 0 && n <= math.MaxUint64 {
+			return uint64(n), nil
+		}
+	case json.Number:
+		if v, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+			return v, nil
+		}
+	}
+	return 0, errors.Newf("%s must be a non-negative integer", name)
+}
+
+// setString sets the field from its string representation used in
+// environment variables.
+func setString(v reflect.Value, s string, name string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return errors.Wrapf(err, "invalid %s", name)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	if names, ok := namedValues[v.Type()]; ok {
+		if n, ok := names[strings.ToLower(s)]; ok {
+			if v.Kind() == reflect.Int32 {
+				v.SetInt(n)
+			} else {
+				v.SetUint(uint64(n))
+			}
+			return nil
+		}
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return errors.Wrapf(err, "invalid %s", name)
+		}
+		v.SetBool(b)
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int64, reflect.Int32:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return errors.Wrapf(err, "invalid %s", name)
+		}
+		v.SetInt(n)
+	case reflect.Uint64, reflect.Uint32, reflect.Uint16, reflect.Uint8:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return errors.Wrapf(err, "invalid %s", name)
+		}
+		v.SetUint(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes([]byte(s))
+			return nil
+		}
+		var result []string
+		for _, e := range strings.Split(s, ",") {
+			if e = strings.TrimSpace(e); len(e) > 0 {
+				result = append(result, e)
+			}
+		}
+		v.Set(reflect.ValueOf(result))
+	default:
+		panic("unexpected kind")
+	}
+	return nil
+}
+
+// applyEnv overrides fields with values of their environment variables.
+func applyEnv(v reflect.Value, prefix string, path string) error {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.PkgPath != "" || !isConfigurable(f.Type) {
+			continue
+		}
+		name := path + f.Name
+		env := prefix + "_" + strings.ToUpper(f.Name)
+		if f.Type.Kind() == reflect.Struct {
+			if err := applyEnv(v.Field(i), env, name+"."); err != nil {
+				return err
+			}
+			continue
+		}
+		if s, ok := os.LookupEnv(env); ok {
+			if err := setString(v.Field(i), s, name); err != nil {
+				return errors.Wrapf(err, "environment variable %s", env)
+			}
+		}
+	}
+	return nil
+}
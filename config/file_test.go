@@ -0,0 +1,298 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+)
+
+const testNodeHostTOML = `
+# NodeHost config
+NodeHostDir = "/data/nh"
+RTTMillisecond = 200
+raft_address = "localhost:9010"
+OrphanCleanupDelay = "1m"
+
+[Gossip]
+BindAddress = "localhost:9011"
+Seed = ["localhost:9012", 'localhost:9013']
+
+[Expert]
+LogDBPreset = "tiny"
+Engine = { ExecShards = 8, CommitShards = 4 }
+
+[Expert.LogDB]
+Shards = 2
+`
+
+const testNodeHostYAML = `
+nodeHostDir: /data/nh
+rttMillisecond: 200
+raft_address: localhost:9010
+orphanCleanupDelay: 1m
+gossip:
+  bindAddress: localhost:9011
+  seed:
+    - localhost:9012
+    - localhost:9013
+expert:
+  logDBPreset: tiny
+  engine:
+    execShards: 8
+    commitShards: 4
+  logDB:
+    shards: 2
+`
+
+const testNodeHostJSON = `{
+  "NodeHostDir": "/data/nh",
+  "RTTMillisecond": 200,
+  "RaftAddress": "localhost:9010",
+  "OrphanCleanupDelay": "1m",
+  "Gossip": {
+    "BindAddress": "localhost:9011",
+    "Seed": ["localhost:9012", "localhost:9013"]
+  },
+  "Expert": {
+    "LogDBPreset": "tiny",
+    "Engine": {"ExecShards": 8, "CommitShards": 4},
+    "LogDB": {"Shards": 2}
+  }
+}`
+
+func getTestNodeHostConfig() NodeHostConfig {
+	nhConfig := NodeHostConfig{
+		NodeHostDir:        "/data/nh",
+		RTTMillisecond:     200,
+		RaftAddress:        "localhost:9010",
+		OrphanCleanupDelay: time.Minute,
+		Gossip: GossipConfig{
+			BindAddress: "localhost:9011",
+			Seed:        []string{"localhost:9012", "localhost:9013"},
+		},
+		Expert: GetDefaultExpertConfig(),
+	}
+	nhConfig.Expert.Engine.ExecShards = 8
+	nhConfig.Expert.Engine.CommitShards = 4
+	nhConfig.Expert.LogDB = GetTinyMemLogDBConfig()
+	nhConfig.Expert.LogDB.Shards = 2
+	return nhConfig
+}
+
+func TestLoadNodeHostConfig(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"nh.toml": testNodeHostTOML,
+		"nh.yaml": testNodeHostYAML,
+		"nh.json": testNodeHostJSON,
+	}
+	expected := getTestNodeHostConfig()
+	for name, data := range files {
+		fn := filepath.Join(dir, name)
+		if err := os.WriteFile(fn, []byte(data), 0644); err != nil {
+			t.Fatalf("failed to write file, %v", err)
+		}
+		nhConfig, err := LoadNodeHostConfig(fn)
+		if err != nil {
+			t.Fatalf("%s, failed to load, %v", name, err)
+		}
+		if !reflect.DeepEqual(expected, nhConfig) {
+			t.Errorf("%s, got %+v, want %+v", name, nhConfig, expected)
+		}
+	}
+}
+
+func TestLoadConfigRejectsUnknownFileFormat(t *testing.T) {
+	if _, err := LoadConfig("shard.ini"); !errors.Is(err, ErrUnknownFileFormat) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestParseNodeHostConfigDefaults(t *testing.T) {
+	data := `
+NodeHostDir = "/data/nh"
+RTTMillisecond = 200
+RaftAddress = "localhost:9010"
+`
+	nhConfig, err := ParseNodeHostConfig([]byte(data), TOML)
+	if err != nil {
+		t.Fatalf("failed to parse, %v", err)
+	}
+	if !reflect.DeepEqual(GetDefaultExpertConfig(), nhConfig.Expert) {
+		t.Errorf("unexpected expert config %+v", nhConfig.Expert)
+	}
+}
+
+func TestUnknownKeysAreReported(t *testing.T) {
+	data := `
+NodeHostDir = "/data/nh"
+RTTMillisecond = 200
+RaftAddress = "localhost:9010"
+RaftAddr = "localhost:9010"
+RaftEventListener = "listener"
+
+[Expert.LogDB]
+Shard = 2
+`
+	_, err := ParseNodeHostConfig([]byte(data), TOML)
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := "Expert.LogDB.Shard, RaftAddr, RaftEventListener: " +
+		"unknown configuration key"
+	if err.Error() != expected {
+		t.Errorf("got %s, want %s", err.Error(), expected)
+	}
+}
+
+func TestEnvOverridesFileValues(t *testing.T) {
+	t.Setenv("DRAGONBOAT_NODEHOST_RAFTADDRESS", "localhost:9020")
+	t.Setenv("DRAGONBOAT_NODEHOST_GOSSIP_SEED", "localhost:9022, localhost:9023")
+	t.Setenv("DRAGONBOAT_NODEHOST_EXPERT_LOGDBPRESET", "small")
+	t.Setenv("DRAGONBOAT_NODEHOST_EXPERT_ENGINE_APPLYSHARDS", "2")
+	nhConfig, err := ParseNodeHostConfig([]byte(testNodeHostTOML), TOML)
+	if err != nil {
+		t.Fatalf("failed to parse, %v", err)
+	}
+	expected := getTestNodeHostConfig()
+	expected.RaftAddress = "localhost:9020"
+	expected.Gossip.Seed = []string{"localhost:9022", "localhost:9023"}
+	expected.Expert.Engine.ApplyShards = 2
+	expected.Expert.LogDB = GetSmallMemLogDBConfig()
+	expected.Expert.LogDB.Shards = 2
+	if !reflect.DeepEqual(expected, nhConfig) {
+		t.Errorf("got %+v, want %+v", nhConfig, expected)
+	}
+	t.Setenv("DRAGONBOAT_NODEHOST_RTTMILLISECOND", "fast")
+	if _, err := ParseNodeHostConfig([]byte(testNodeHostTOML), TOML); err == nil {
+		t.Errorf("invalid env value not reported")
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	data := `
+ReplicaID: 1
+ShardID: 100
+ElectionRTT: 10
+HeartbeatRTT: 1
+CheckQuorum: true
+SnapshotCompressionType: Snappy
+Priority: high
+ProposalBatchDelay: 2ms
+ProposalBatchSize: 1024
+`
+	t.Setenv("DRAGONBOAT_SHARD_SNAPSHOTENTRIES", "10000")
+	cfg, err := ParseConfig([]byte(data), YAML)
+	if err != nil {
+		t.Fatalf("failed to parse, %v", err)
+	}
+	expected := Config{
+		ReplicaID:               1,
+		ShardID:                 100,
+		ElectionRTT:             10,
+		HeartbeatRTT:            1,
+		CheckQuorum:             true,
+		SnapshotEntries:         10000,
+		SnapshotCompressionType: Snappy,
+		Priority:                HighPriority,
+		ProposalBatchDelay:      2 * time.Millisecond,
+		ProposalBatchSize:       1024,
+	}
+	if !reflect.DeepEqual(expected, cfg) {
+		t.Errorf("got %+v, want %+v", cfg, expected)
+	}
+}
+
+func TestParseConfigValidatesConfig(t *testing.T) {
+	tests := []string{
+		`{"ReplicaID": 1, "ElectionRTT": 2, "HeartbeatRTT": 1}`,
+		`{"ReplicaID": -1, "ElectionRTT": 10, "HeartbeatRTT": 1}`,
+		`{"ReplicaID": 1.5, "ElectionRTT": 10, "HeartbeatRTT": 1}`,
+		`{"ReplicaID": "1", "ElectionRTT": 10, "HeartbeatRTT": 1}`,
+		`{"ReplicaID": 1, "ElectionRTT": 10, "HeartbeatRTT": 1, "Priority": 256}`,
+		`{"ReplicaID": 1, "ElectionRTT": 10, "HeartbeatRTT": 1, "Priority": "low"}`,
+	}
+	for idx, data := range tests {
+		if _, err := ParseConfig([]byte(data), JSON); err == nil {
+			t.Errorf("%d, error not reported", idx)
+		}
+	}
+}
+
+func TestParseTOML(t *testing.T) {
+	data := `
+a = 1 # comment
+b.c = "x\ty\u00e9"
+"d.e" = 'C:\path'
+f = [
+  1_000,
+  0x10, # hex
+  -2.5,
+]
+g = { h = true, i.j = false }
+k = 18446744073709551615
+
+[l.m]
+n = []
+`
+	values, err := parseTOML([]byte(data))
+	if err != nil {
+		t.Fatalf("failed to parse, %v", err)
+	}
+	expected := map[string]interface{}{
+		"a":   int64(1),
+		"b":   map[string]interface{}{"c": "x\tyé"},
+		"d.e": `C:\path`,
+		"f":   []interface{}{int64(1000), int64(16), -2.5},
+		"g": map[string]interface{}{
+			"h": true,
+			"i": map[string]interface{}{"j": false},
+		},
+		"k": uint64(18446744073709551615),
+		"l": map[string]interface{}{
+			"m": map[string]interface{}{"n": []interface{}{}},
+		},
+	}
+	if !reflect.DeepEqual(expected, values) {
+		t.Errorf("got %v, want %v", values, expected)
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := []string{
+		"a = 1\na = 2",
+		"[a]\n[a]",
+		"a = 1\n[a]",
+		"[[a]]",
+		`a = """x"""`,
+		"a = 1979-05-27T07:32:00Z",
+		`a = "x`,
+		"a = [1, 2",
+		"a = 1 b = 2",
+		"a",
+		`a = "\q"`,
+	}
+	for _, data := range tests {
+		if _, err := parseTOML([]byte(data)); err == nil {
+			t.Errorf("%q, error not reported", data)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+// tomlParser parses the subset of TOML used by configuration files. Tables,
+// dotted keys, inline tables, arrays, basic and literal strings, integers,
+// floats and booleans are supported. Multi-line strings, date-times and
+// arrays of tables are not supported.
+type tomlParser struct {
+	s       string
+	pos     int
+	line    int
+	root    map[string]interface{}
+	tables  map[string]struct{}
+	current map[string]interface{}
+}
+
+func parseTOML(data []byte) (map[string]interface{}, error) {
+	p := &tomlParser{
+		s:      string(data),
+		line:   1,
+		root:   make(map[string]interface{}),
+		tables: make(map[string]struct{}),
+	}
+	p.current = p.root
+	if err := p.parse(); err != nil {
+		return nil, errors.Wrapf(err, "toml: line %d", p.line)
+	}
+	return p.root, nil
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *tomlParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *tomlParser) skipSpaces() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.pos++
+	}
+}
+
+func (p *tomlParser) skipComment() {
+	if p.peek() == '#' {
+		for !p.eof() && p.peek() != '\n' {
+			p.pos++
+		}
+	}
+}
+
+// skipBlank skips whitespaces, comments and newlines.
+func (p *tomlParser) skipBlank() {
+	for {
+		p.skipSpaces()
+		p.skipComment()
+		if p.peek() == '\r' {
+			p.pos++
+		} else if p.peek() == '\n' {
+			p.pos++
+			p.line++
+		} else {
+			return
+		}
+	}
+}
+
+func (p *tomlParser) endOfLine() error {
+	p.skipSpaces()
+	p.skipComment()
+	if p.peek() == '\r' {
+		p.pos++
+	}
+	if p.eof() {
+		return nil
+	}
+	if p.peek() != '\n' {
+		return errors.Newf("unexpected character %q", p.peek())
+	}
+	return nil
+}
+
+func (p *tomlParser) parse() error {
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return nil
+		}
+		if p.peek() == '[' {
+			if err := p.parseTable(); err != nil {
+				return err
+			}
+		} else {
+			if err := p.parseKeyValue(p.current); err != nil {
+				return err
+			}
+		}
+		if err := p.endOfLine(); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *tomlParser) parseTable() error {
+	p.pos++
+	if p.peek() == '[' {
+		return errors.New("arrays of tables are not supported")
+	}
+	keys, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+	if p.peek() != ']' {
+		return errors.New("unterminated table header")
+	}
+	p.pos++
+	name := strings.Join(keys, ".")
+	if _, ok := p.tables[name]; ok {
+		return errors.Newf("table %s defined more than once", name)
+	}
+	p.tables[name] = struct{}{}
+	table, err := p.table(p.root, keys)
+	if err != nil {
+		return err
+	}
+	p.current = table
+	return nil
+}
+
+// table returns the table specified by keys, missing tables are created.
+func (p *tomlParser) table(t map[string]interface{},
+	keys []string) (map[string]interface{}, error) {
+	for _, key := range keys {
+		v, ok := t[key]
+		if !ok {
+			v = make(map[string]interface{})
+			t[key] = v
+		}
+		next, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errors.Newf("key %s is not a table", key)
+		}
+		t = next
+	}
+	return t, nil
+}
+
+func (p *tomlParser) parseKeyValue(t map[string]interface{}) error {
+	keys, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+	if p.peek() != '=' {
+		return errors.Newf("expected = after key %s", strings.Join(keys, "."))
+	}
+	p.pos++
+	p.skipSpaces()
+	v, err := p.parseValue()
+	if err != nil {
+		return err
+	}
+	t, err = p.table(t, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	key := keys[len(keys)-1]
+	if _, ok := t[key]; ok {
+		return errors.Newf("key %s defined more than once", strings.Join(keys, "."))
+	}
+	t[key] = v
+	return nil
+}
+
+func isBareKeyChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9') || c == '_' || c == '-'
+}
+
+// parseKey parses a possibly dotted key, trailing whitespaces are skipped.
+func (p *tomlParser) parseKey() ([]string, error) {
+	var keys []string
+	for {
+		p.skipSpaces()
+		var key string
+		switch c := p.peek(); {
+		case c == '"':
+			s, err := p.parseBasicString()
+			if err != nil {
+				return nil, err
+			}
+			key = s
+		case c == '\'':
+			s, err := p.parseLiteralString()
+			if err != nil {
+				return nil, err
+			}
+			key = s
+		default:
+			start := p.pos
+			for !p.eof() && isBareKeyChar(p.peek()) {
+				p.pos++
+			}
+			if start == p.pos {
+				return nil, errors.Newf("unexpected character %q in key", c)
+			}
+			key = p.s[start:p.pos]
+		}
+		keys = append(keys, key)
+		p.skipSpaces()
+		if p.peek() != '.' {
+			return keys, nil
+		}
+		p.pos++
+	}
+}
+
+func (p *tomlParser) parseValue() (interface{}, error) {
+	switch c := p.peek(); {
+	case c == '"':
+		return p.parseBasicString()
+	case c == '\'':
+		return p.parseLiteralString()
+	case c == '[':
+		return p.parseArray()
+	case c == '{':
+		return p.parseInlineTable()
+	case strings.HasPrefix(p.s[p.pos:], "true"):
+		p.pos += len("true")
+		return true, nil
+	case strings.HasPrefix(p.s[p.pos:], "false"):
+		p.pos += len("false")
+		return false, nil
+	default:
+		return p.parseNumber()
+	}
+}
+
+func (p *tomlParser) parseBasicString() (string, error) {
+	if strings.HasPrefix(p.s[p.pos:], `"""`) {
+		return "", errors.New("multi-line strings are not supported")
+	}
+	p.pos++
+	var sb strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", errors.New("unterminated string")
+		}
+		c := p.s[p.pos]
+		p.pos++
+		if c == '"' {
+			return sb.String(), nil
+		}
+		if c != '\\' {
+			sb.WriteByte(c)
+			continue
+		}
+		if p.eof() {
+			return "", errors.New("unterminated string")
+		}
+		e := p.s[p.pos]
+		p.pos++
+		switch e {
+		case 'b':
+			sb.WriteByte('\b')
+		case 't':
+			sb.WriteByte('\t')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'r':
+			sb.WriteByte('\r')
+		case '"', '\\':
+			sb.WriteByte(e)
+		case 'u', 'U':
+			n := 4
+			if e == 'U' {
+				n = 8
+			}
+			if p.pos+n > len(p.s) {
+				return "", errors.New("invalid unicode escape")
+			}
+			r, err := strconv.ParseUint(p.s[p.pos:p.pos+n], 16, 32)
+			if err != nil {
+				return "", errors.New("invalid unicode escape")
+			}
+			p.pos += n
+			sb.WriteRune(rune(r))
+		default:
+			return "", errors.Newf("invalid escape character %q", e)
+		}
+	}
+}
+
+func (p *tomlParser) parseLiteralString() (string, error) {
+	if strings.HasPrefix(p.s[p.pos:], "'''") {
+		return "", errors.New("multi-line strings are not supported")
+	}
+	p.pos++
+	start := p.pos
+	for !p.eof() && p.peek() != '\'' && p.peek() != '\n' {
+		p.pos++
+	}
+	if p.peek() != '\'' {
+		return "", errors.New("unterminated string")
+	}
+	s := p.s[start:p.pos]
+	p.pos++
+	return s, nil
+}
+
+func (p *tomlParser) parseArray() ([]interface{}, error) {
+	p.pos++
+	result := make([]interface{}, 0)
+	for {
+		p.skipBlank()
+		if p.peek() == ']' {
+			p.pos++
+			return result, nil
+		}
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, v)
+		p.skipBlank()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+		default:
+			return nil, errors.New("unterminated array")
+		}
+	}
+}
+
+func (p *tomlParser) parseInlineTable() (map[string]interface{}, error) {
+	p.pos++
+	result := make(map[string]interface{})
+	p.skipSpaces()
+	if p.peek() == '}' {
+		p.pos++
+		return result, nil
+	}
+	for {
+		if err := p.parseKeyValue(result); err != nil {
+			return nil, err
+		}
+		p.skipSpaces()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			return result, nil
+		default:
+			return nil, errors.New("unterminated inline table")
+		}
+	}
+}
+
+func (p *tomlParser) parseNumber() (interface{}, error) {
+	start := p.pos
+	for !p.eof() && (isBareKeyChar(p.peek()) ||
+		p.peek() == '+' || p.peek() == '.' || p.peek() == ':') {
+		p.pos++
+	}
+	s := p.s[start:p.pos]
+	if len(s) == 0 {
+		return nil, errors.Newf("unexpected character %q", p.peek())
+	}
+	if strings.ContainsRune(s, ':') {
+		return nil, errors.Newf("date-time value %s is not supported", s)
+	}
+	n := strings.ReplaceAll(s, "_", "")
+	if v, err := strconv.ParseInt(n, 0, 64); err == nil {
+		return v, nil
+	}
+	if v, err := strconv.ParseUint(n, 0, 64); err == nil {
+		return v, nil
+	}
+	if v, err := strconv.ParseFloat(n, 64); err == nil {
+		return v, nil
+	}
+	return nil, errors.Newf("invalid value %s", s)
+}
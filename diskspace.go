@@ -0,0 +1,212 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+)
+
+var (
+	diskCheckInterval = time.Second
+)
+
+const (
+	diskSpaceOK int32 = iota
+	diskSpaceLow
+	diskSpaceCritical
+)
+
+// diskMonitor tracks the free disk space of the filesystems used by the
+// NodeHost.
+type diskMonitor struct {
+	dirs     []string
+	soft     uint64
+	hard     uint64
+	state    int32
+	failed   bool
+	getAvail func(dir string) (uint64, error)
+	// leaders that have been asked to transfer their leadership
+	transferring map[uint64]struct{}
+	// replicas stopped because of critical disk space, keyed by shard ID
+	stopped map[uint64]*replicaStub
+}
+
+func newDiskMonitor(fs vfs.IFS, nhConfig config.NodeHostConfig) *diskMonitor {
+	dirs := []string{nhConfig.NodeHostDir}
+	if len(nhConfig.WALDir) > 0 && nhConfig.WALDir != nhConfig.NodeHostDir {
+		dirs = append(dirs, nhConfig.WALDir)
+	}
+	return &diskMonitor{
+		dirs: dirs,
+		soft: nhConfig.MinFreeDiskSpace,
+		hard: nhConfig.CriticalFreeDiskSpace,
+		getAvail: func(dir string) (uint64, error) {
+			du, err := fs.GetDiskUsage(dir)
+			if err != nil {
+				return 0, err
+			}
+			return du.AvailBytes, nil
+		},
+		transferring: make(map[uint64]struct{}),
+		stopped:      make(map[uint64]*replicaStub),
+	}
+}
+
+func (d *diskMonitor) enabled() bool {
+	return d != nil && (d.soft > 0 || d.hard > 0)
+}
+
+// low returns a boolean value indicating whether the free disk space is
+// below the soft threshold.
+func (d *diskMonitor) low() bool {
+	return d != nil && atomic.LoadInt32(&d.state) != diskSpaceOK
+}
+
+// check updates the disk space state, it returns the new state and a boolean
+// value indicating whether the state changed.
+func (d *diskMonitor) check() (int32, bool) {
+	avail := uint64(0)
+	for idx, dir := range d.dirs {
+		v, err := d.getAvail(dir)
+		if err != nil {
+			// e.g. the filesystem doesn't support disk usage queries
+			if !d.failed {
+				plog.Warningf("failed to get disk usage of %s, %v", dir, err)
+				d.failed = true
+			}
+			return atomic.LoadInt32(&d.state), false
+		}
+		if idx == 0 || v < avail {
+			avail = v
+		}
+	}
+	state := diskSpaceOK
+	if d.hard > 0 && avail < d.hard {
+		state = diskSpaceCritical
+	} else if d.soft > 0 && avail < d.soft {
+		state = diskSpaceLow
+	}
+	prev := atomic.SwapInt32(&d.state, state)
+	if prev != state {
+		plog.Warningf("free disk space %d bytes, state changed from %d to %d",
+			avail, prev, state)
+	}
+	return state, prev != state
+}
+
+func (nh *NodeHost) diskMonitorMain() {
+	ticker := time.NewTicker(diskCheckInterval)
+	defer ticker.Stop()
+	for {
+		nh.checkDiskSpace()
+		select {
+		case <-ticker.C:
+		case <-nh.stopper.ShouldStop():
+			return
+		}
+	}
+}
+
+func (nh *NodeHost) checkDiskSpace() {
+	if state, _ := nh.disk.check(); state == diskSpaceCritical {
+		nh.stepDown()
+		return
+	}
+	if len(nh.disk.transferring) > 0 {
+		nh.disk.transferring = make(map[uint64]struct{})
+	}
+	if len(nh.disk.stopped) > 0 {
+		nh.restartStopped()
+	}
+}
+
+// stepDown stops all local replicas as the disk is about to become full.
+// Leaders are asked to transfer their leadership first, they are stopped on
+// the next check regardless of the outcome of the transfer.
+func (nh *NodeHost) stepDown() {
+	var nodes []*node
+	nh.forEachShard(func(shardID uint64, n *node) bool {
+		nodes = append(nodes, n)
+		return true
+	})
+	for _, n := range nodes {
+		if _, ok := nh.disk.transferring[n.shardID]; !ok && n.isLeader() {
+			if target, ok := getTransferTarget(n); ok {
+				if err := n.requestLeaderTransfer(target); err == nil {
+					nh.engine.setStepReady(n.shardID)
+					nh.disk.transferring[n.shardID] = struct{}{}
+					plog.Warningf("%s transferring leadership to %d, disk space critical",
+						n.id(), target)
+					continue
+				}
+			}
+		}
+		delete(nh.disk.transferring, n.shardID)
+		if err := nh.stopNode(n.shardID, n.replicaID, true); err != nil {
+			plog.Errorf("%s failed to stop, %v", n.id(), err)
+			continue
+		}
+		nh.disk.stopped[n.shardID] = n.stub
+		plog.Warningf("%s stopped, disk space critical", n.id())
+	}
+}
+
+// restartStopped restarts replicas stopped by stepDown once the free disk space
+// is no longer critical. Replicas not yet fully unloaded are restarted on the
+// next check.
+func (nh *NodeHost) restartStopped() {
+	for shardID, s := range nh.disk.stopped {
+		if _, ok := nh.getShard(shardID); ok {
+			delete(nh.disk.stopped, shardID)
+			continue
+		}
+		cfg := s.config
+		cfg.WaitReady = false
+		err := nh.startShard(nil, false, s.createSM, cfg, s.smType)
+		if errors.Is(err, ErrShardAlreadyExist) {
+			continue
+		}
+		delete(nh.disk.stopped, shardID)
+		if err != nil {
+			plog.Errorf("%s failed to restart, %v",
+				dn(shardID, cfg.ReplicaID), err)
+			continue
+		}
+		plog.Infof("%s restarted, disk space recovered", dn(shardID, cfg.ReplicaID))
+	}
+}
+
+// getTransferTarget returns a voting member other than the local replica.
+func getTransferTarget(n *node) (uint64, bool) {
+	m := n.sm.GetMembership()
+	ids := make([]uint64, 0, len(m.Addresses))
+	for replicaID := range m.Addresses {
+		if replicaID != n.replicaID {
+			ids = append(ids, replicaID)
+		}
+	}
+	if len(ids) == 0 {
+		return 0, false
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids[0], true
+}
@@ -16,7 +16,9 @@ package dragonboat
 
 import (
 	"reflect"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/lni/goutils/syncutil"
@@ -129,6 +131,7 @@ type workReady struct {
 	partitioner server.IPartitioner
 	maps        []*readyShard
 	channels    []chan struct{}
+	notified    []int64
 	count       uint64
 }
 
@@ -146,6 +149,55 @@ func newWorkReady(count uint64) *workReady {
 	return wr
 }
 
+// newPriorityWorkReady creates a workReady instance for count workers shared
+// by normal priority shards followed by priorityCount workers dedicated to
+// high priority shards.
+func newPriorityWorkReady(count uint64,
+	priorityCount uint64, priorities *shardPriorities) *workReady {
+	wr := newWorkReady(count + priorityCount)
+	wr.partitioner = &priorityPartitioner{
+		priorities:    priorities,
+		count:         count,
+		priorityCount: priorityCount,
+	}
+	return wr
+}
+
+// shardPriorities records shards configured with config.HighPriority.
+type shardPriorities struct {
+	shards sync.Map
+}
+
+func (sp *shardPriorities) set(shardID uint64, priority config.Priority) {
+	if priority == config.HighPriority {
+		sp.shards.Store(shardID, struct{}{})
+	} else {
+		sp.shards.Delete(shardID)
+	}
+}
+
+func (sp *shardPriorities) high(shardID uint64) bool {
+	_, ok := sp.shards.Load(shardID)
+	return ok
+}
+
+// priorityPartitioner is the IPartitioner that places high priority shards
+// onto the dedicated workers after the count workers used by all other shards.
+type priorityPartitioner struct {
+	priorities    *shardPriorities
+	count         uint64
+	priorityCount uint64
+}
+
+var _ server.IPartitioner = (*priorityPartitioner)(nil)
+
+func (p *priorityPartitioner) GetPartitionID(shardID uint64) uint64 {
+	if p.priorityCount > 0 && p.priorities.high(shardID) {
+		return p.count + shardID%p.priorityCount
+	}
+	return shardID % p.count
+}
+
 func (wr *workReady) getPartitioner() server.IPartitioner {
 	return wr.partitioner
 }
@@ -153,10 +205,31 @@ func (wr *workReady) getPartitioner() server.IPartitioner {
 func (wr *workReady) notify(idx uint64) {
 	select {
 	case wr.channels[idx] <- struct{}{}:
+		if wr.notified != nil {
+			atomic.StoreInt64(&wr.notified[idx], time.Now().UnixNano())
+		}
 	default:
 	}
 }
 
+func (wr *workReady) notifyAll() {
+	for idx := range wr.channels {
+		wr.notify(uint64(idx))
+	}
+}
+
+// waited returns how long the worker has been waiting since it was notified.
+func (wr *workReady) waited(workerID uint64) time.Duration {
+	if wr.notified == nil || workerID > uint64(len(wr.notified)) {
+		return 0
+	}
+	v := atomic.SwapInt64(&wr.notified[workerID-1], 0)
+	if v == 0 {
+		return 0
+	}
+	return time.Duration(time.Now().UnixNano() - v)
+}
+
 func (wr *workReady) shardReadyByUpdates(updates []pb.Update) {
 	var notified bitmap
 	for _, ud := range updates {
@@ -217,6 +290,11 @@ func (wr *workReady) shardReady(shardID uint64) {
 }
 
 func (wr *workReady) waitCh(workerID uint64) chan struct{} {
+	// workers removed from a resized stage might still be looking for their
+	// channels
+	if workerID > uint64(len(wr.channels)) {
+		return nil
+	}
 	return wr.channels[workerID-1]
 }
 
@@ -235,6 +313,7 @@ type job struct {
 
 type ssWorker struct {
 	stopper    *syncutil.Stopper
+	stopC      chan struct{}
 	requestC   chan job
 	completedC chan struct{}
 	workerID   uint64
@@ -244,6 +323,7 @@ func newSSWorker(workerID uint64, stopper *syncutil.Stopper) *ssWorker {
 	w := &ssWorker{
 		workerID:   workerID,
 		stopper:    stopper,
+		stopC:      make(chan struct{}),
 		requestC:   make(chan job, 1),
 		completedC: make(chan struct{}, 1),
 	}
@@ -258,6 +338,8 @@ func (w *ssWorker) workerMain() {
 		select {
 		case <-w.stopper.ShouldStop():
 			return
+		case <-w.stopC:
+			return
 		case job := <-w.requestC:
 			if job.node == nil {
 				panic("req.node == nil")
@@ -327,7 +409,9 @@ type workerPool struct {
 	poolStopper   *syncutil.Stopper
 	pending       []job
 	workers       []*ssWorker
+	size          *poolSize
 	cci           uint64
+	running       int64
 }
 
 func newWorkerPool(nh nodeLoader,
@@ -346,6 +430,7 @@ func newWorkerPool(nh nodeLoader,
 		recovering:    make(map[uint64]struct{}, snapshotWorkerCount),
 		streaming:     make(map[uint64]uint64, snapshotWorkerCount),
 		pending:       make([]job, 0),
+		size:          newPoolSize(snapshotWorkerCount),
 		workerStopper: syncutil.NewStopper(),
 		poolStopper:   syncutil.NewStopper(),
 	}
@@ -364,7 +449,11 @@ func (p *workerPool) close() error {
 }
 
 func (p *workerPool) getWorker() *ssWorker {
+	size := p.size.get()
 	for _, w := range p.workers {
+		if w.workerID >= size {
+			break
+		}
 		if _, busy := p.busy[w.workerID]; !busy {
 			return w
 		}
@@ -372,12 +461,33 @@ func (p *workerPool) getWorker() *ssWorker {
 	return nil
 }
 
+// resize adds or removes workers to match the requested pool size. Busy
+// workers are only removed once they complete their jobs.
+func (p *workerPool) resize() {
+	size := p.size.get()
+	for uint64(len(p.workers)) < size {
+		workerID := uint64(len(p.workers))
+		p.workers = append(p.workers, newSSWorker(workerID, p.workerStopper))
+	}
+	for uint64(len(p.workers)) > size {
+		w := p.workers[len(p.workers)-1]
+		if _, busy := p.busy[w.workerID]; busy {
+			return
+		}
+		close(w.stopC)
+		p.workers = p.workers[:len(p.workers)-1]
+	}
+}
+
 func (p *workerPool) workerPoolMain() {
 	ticker := time.NewTicker(200 * time.Millisecond)
 	defer ticker.Stop()
-	cases := make([]reflect.SelectCase, len(p.workers)+6)
+	var cases []reflect.SelectCase
 	for {
 		toSchedule := false
+		if len(cases) != len(p.workers)+7 {
+			cases = make([]reflect.SelectCase, len(p.workers)+7)
+		}
 		// 0 - pool stopper stopc
 		// 1 - p.saveReady.waitCh(1)
 		// 2 - p.recoverReady.waitCh(1)
@@ -385,6 +495,7 @@ func (p *workerPool) workerPoolMain() {
 		// 4 - p.cciReady.waitCh(1)
 		// 5 - worker completedC
 		// 5 + len(workers) - ticker.C
+		// 6 + len(workers) - p.size.resizeC
 		cases[0] = reflect.SelectCase{
 			Dir:  reflect.SelectRecv,
 			Chan: reflect.ValueOf(p.poolStopper.ShouldStop()),
@@ -415,6 +526,10 @@ func (p *workerPool) workerPoolMain() {
 			Dir:  reflect.SelectRecv,
 			Chan: reflect.ValueOf(ticker.C),
 		}
+		cases[6+len(p.workers)] = reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(p.size.resizeC),
+		}
 		chosen, _, _ := reflect.Select(cases)
 		if chosen == 0 {
 			p.workerStopper.Stop()
@@ -456,15 +571,19 @@ func (p *workerPool) workerPoolMain() {
 			workerID := uint64(chosen - 5)
 			p.completed(workerID)
 			toSchedule = true
-		} else if chosen == len(cases)-1 {
+		} else if chosen == len(cases)-2 {
 			p.loadNodes()
+		} else if chosen == len(cases)-1 {
+			toSchedule = true
 		} else {
 			plog.Panicf("chosen %d, unexpected case", chosen)
 		}
 		if toSchedule {
+			p.resize()
 			p.loadNodes()
 			p.schedule()
 		}
+		p.size.observe(len(p.busy))
 	}
 }
 
@@ -590,17 +709,25 @@ func (p *workerPool) setIdle(workerID uint64) {
 	delete(p.busy, workerID)
 	p.updateLoadedBusyNodes()
 	n.offloaded()
+	atomic.AddInt64(&p.running, -1)
 }
 
 func (p *workerPool) setBusy(n *node, workerID uint64) {
 	if _, ok := p.busy[workerID]; ok {
 		plog.Panicf("trying to use a busy worker")
 	}
+	atomic.AddInt64(&p.running, 1)
 	n.loaded()
 	p.busy[workerID] = n
 	p.updateLoadedBusyNodes()
 }
 
+// hasRunningJobs returns a boolean value indicating whether any worker is
+// still busy with a snapshot job.
+func (p *workerPool) hasRunningJobs() bool {
+	return atomic.LoadInt64(&p.running) > 0
+}
+
 func (p *workerPool) startStreaming(n *node) {
 	if count, ok := p.streaming[n.shardID]; !ok {
 		p.streaming[n.shardID] = 1
@@ -651,6 +778,7 @@ func (p *workerPool) scheduleWorker() bool {
 	w := p.getWorker()
 	if w == nil {
 		plog.Debugf("%s no more worker", p.nh.describe())
+		p.size.starve()
 		return false
 	}
 	for idx, j := range p.pending {
@@ -743,6 +871,7 @@ type closeReq struct {
 
 type closeWorker struct {
 	stopper    *syncutil.Stopper
+	stopC      chan struct{}
 	requestC   chan closeReq
 	completedC chan struct{}
 	workerID   uint64
@@ -752,6 +881,7 @@ func newCloseWorker(workerID uint64, stopper *syncutil.Stopper) *closeWorker {
 	w := &closeWorker{
 		workerID:   workerID,
 		stopper:    stopper,
+		stopC:      make(chan struct{}),
 		requestC:   make(chan closeReq, 1),
 		completedC: make(chan struct{}, 1),
 	}
@@ -766,6 +896,8 @@ func (w *closeWorker) workerMain() {
 		select {
 		case <-w.stopper.ShouldStop():
 			return
+		case <-w.stopC:
+			return
 		case req := <-w.requestC:
 			if err := w.handle(req); err != nil {
 				panicNow(err)
@@ -794,6 +926,7 @@ type closeWorkerPool struct {
 	poolStopper   *syncutil.Stopper
 	workers       []*closeWorker
 	pending       []*node
+	size          *poolSize
 }
 
 func newCloseWorkerPool(closeWorkerCount uint64) *closeWorkerPool {
@@ -803,6 +936,7 @@ func newCloseWorkerPool(closeWorkerCount uint64) *closeWorkerPool {
 		busy:          make(map[uint64]uint64, closeWorkerCount),
 		processing:    make(map[uint64]struct{}, closeWorkerCount),
 		pending:       make([]*node, 0),
+		size:          newPoolSize(closeWorkerCount),
 		workerStopper: syncutil.NewStopper(),
 		poolStopper:   syncutil.NewStopper(),
 	}
@@ -822,10 +956,14 @@ func (p *closeWorkerPool) close() error {
 }
 
 func (p *closeWorkerPool) workerPoolMain() {
-	cases := make([]reflect.SelectCase, len(p.workers)+2)
+	var cases []reflect.SelectCase
 	for {
+		if len(cases) != len(p.workers)+3 {
+			cases = make([]reflect.SelectCase, len(p.workers)+3)
+		}
 		// 0 - pool stopper stopc
 		// 1 - node ready for destroy
+		// 2 - p.size.resizeC
 		cases[0] = reflect.SelectCase{
 			Dir:  reflect.SelectRecv,
 			Chan: reflect.ValueOf(p.poolStopper.ShouldStop()),
@@ -834,8 +972,12 @@ func (p *closeWorkerPool) workerPoolMain() {
 			Dir:  reflect.SelectRecv,
 			Chan: reflect.ValueOf(p.ready),
 		}
+		cases[2] = reflect.SelectCase{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(p.size.resizeC),
+		}
 		for idx, w := range p.workers {
-			cases[2+idx] = reflect.SelectCase{
+			cases[3+idx] = reflect.SelectCase{
 				Dir:  reflect.SelectRecv,
 				Chan: reflect.ValueOf(w.completedC),
 			}
@@ -847,13 +989,17 @@ func (p *closeWorkerPool) workerPoolMain() {
 		} else if chosen == 1 {
 			node := v.Interface().(closeReq).node
 			p.pending = append(p.pending, node)
-		} else if chosen > 1 && chosen < len(p.workers)+2 {
-			workerID := uint64(chosen - 2)
+		} else if chosen == 2 {
+			p.resize()
+		} else if chosen > 2 && chosen < len(p.workers)+3 {
+			workerID := uint64(chosen - 3)
 			p.completed(workerID)
+			p.resize()
 		} else {
 			plog.Panicf("chosen %d, unknown case", chosen)
 		}
 		p.schedule()
+		p.size.observe(len(p.busy))
 	}
 }
 
@@ -875,8 +1021,8 @@ func (p *closeWorkerPool) timedWait() {
 	default:
 	}
 	p.schedule()
-	cases := make([]reflect.SelectCase, len(p.workers)+1)
 	for !p.isIdle() {
+		cases := make([]reflect.SelectCase, len(p.workers)+1)
 		cases[0] = reflect.SelectCase{
 			Dir:  reflect.SelectRecv,
 			Chan: reflect.ValueOf(timer.C),
@@ -900,6 +1046,7 @@ func (p *closeWorkerPool) timedWait() {
 			}
 			workerID := uint64(chosen - 1)
 			p.completed(workerID)
+			p.resize()
 			p.schedule()
 		} else {
 			plog.Panicf("chosen %d, unknown case", chosen)
@@ -929,7 +1076,11 @@ func (p *closeWorkerPool) setBusy(workerID uint64, shardID uint64) {
 }
 
 func (p *closeWorkerPool) getWorker() *closeWorker {
+	size := p.size.get()
 	for _, w := range p.workers {
+		if w.workerID >= size {
+			break
+		}
 		if _, busy := p.busy[w.workerID]; !busy {
 			return w
 		}
@@ -937,6 +1088,24 @@ func (p *closeWorkerPool) getWorker() *closeWorker {
 	return nil
 }
 
+// resize adds or removes workers to match the requested pool size. Busy
+// workers are only removed once they complete their requests.
+func (p *closeWorkerPool) resize() {
+	size := p.size.get()
+	for uint64(len(p.workers)) < size {
+		workerID := uint64(len(p.workers))
+		p.workers = append(p.workers, newCloseWorker(workerID, p.workerStopper))
+	}
+	for uint64(len(p.workers)) > size {
+		w := p.workers[len(p.workers)-1]
+		if _, busy := p.busy[w.workerID]; busy {
+			return
+		}
+		close(w.stopC)
+		p.workers = p.workers[:len(p.workers)-1]
+	}
+}
+
 func (p *closeWorkerPool) schedule() {
 	for {
 		if !p.scheduleWorker() {
@@ -953,6 +1122,9 @@ func (p *closeWorkerPool) canSchedule(n *node) bool {
 func (p *closeWorkerPool) scheduleWorker() bool {
 	w := p.getWorker()
 	if w == nil {
+		if len(p.pending) > 0 {
+			p.size.starve()
+		}
 		return false
 	}
 
@@ -986,79 +1158,90 @@ func (p *closeWorkerPool) removeFromPending(idx int) {
 }
 
 type engine struct {
-	nodeStopper     *syncutil.Stopper
-	commitStopper   *syncutil.Stopper
-	taskStopper     *syncutil.Stopper
+	adaptiveStopper *syncutil.Stopper
 	nh              nodeLoader
 	loaded          *loadedNodes
 	env             *server.Env
 	logdb           raftio.ILogDB
-	stepWorkReady   *workReady
-	stepCCIReady    *workReady
-	commitWorkReady *workReady
-	commitCCIReady  *workReady
-	applyWorkReady  *workReady
-	applyCCIReady   *workReady
+	stepStage       *workerStage
+	commitStage     *workerStage
+	applyStage      *workerStage
 	wp              *workerPool
 	cp              *closeWorkerPool
+	priorities      *shardPriorities
 	ec              chan error
+	execShards      uint64
 	notifyCommit    bool
-}
-
+	clocked         bool
+	// fields below are used by run when the engine is driven by a clock
+	nodes   map[uint64]*node
+	csi     uint64
+	updates []pb.Update
+	batch   []rsm.Task
+	entries []sm.Entry
+}
+
+// newExecEngine creates the execution engine. When clocked is true, no step,
+// commit or apply worker is started, the engine is expected to be driven by
+// calling its run method instead.
 func newExecEngine(nh nodeLoader, cfg config.EngineConfig, notifyCommit bool,
-	errorInjection bool, env *server.Env, logdb raftio.ILogDB) *engine {
+	errorInjection bool, clocked bool, env *server.Env,
+	logdb raftio.ILogDB) *engine {
 	if cfg.ExecShards == 0 {
 		panic("ExecShards == 0")
 	}
 	loaded := newLoadedNodes()
+	sp := &shardPriorities{}
+	pc := cfg.PriorityShards
 	s := &engine{
 		nh:              nh,
 		env:             env,
 		logdb:           logdb,
 		loaded:          loaded,
-		nodeStopper:     syncutil.NewStopper(),
-		commitStopper:   syncutil.NewStopper(),
-		taskStopper:     syncutil.NewStopper(),
-		stepWorkReady:   newWorkReady(cfg.ExecShards),
-		stepCCIReady:    newWorkReady(cfg.ExecShards),
-		commitWorkReady: newWorkReady(cfg.CommitShards),
-		commitCCIReady:  newWorkReady(cfg.CommitShards),
-		applyWorkReady:  newWorkReady(cfg.ApplyShards),
-		applyCCIReady:   newWorkReady(cfg.ApplyShards),
-		wp:              newWorkerPool(nh, cfg.SnapshotShards, loaded),
-		cp:              newCloseWorkerPool(cfg.CloseShards),
-		notifyCommit:    notifyCommit,
+		adaptiveStopper: syncutil.NewStopper(),
+		stepStage: newWorkerStage(cfg.ExecShards,
+			pc, sp, cfg.AdaptiveWorkers),
+		commitStage: newWorkerStage(cfg.CommitShards,
+			pc, sp, cfg.AdaptiveWorkers),
+		applyStage: newWorkerStage(cfg.ApplyShards,
+			pc, sp, cfg.AdaptiveWorkers),
+		wp:           newWorkerPool(nh, cfg.SnapshotShards, loaded),
+		cp:           newCloseWorkerPool(cfg.CloseShards),
+		priorities:   sp,
+		execShards:   cfg.ExecShards,
+		notifyCommit: notifyCommit,
+		clocked:      clocked,
 	}
 	if errorInjection {
 		s.ec = make(chan error, 1)
 	}
-	for i := uint64(1); i <= cfg.ExecShards; i++ {
-		workerID := i
-		s.nodeStopper.RunWorker(func() {
-			if errorInjection {
-				defer func() {
-					if r := recover(); r != nil {
-						if ce, ok := r.(error); ok {
-							s.crash(ce)
-						}
+	if clocked {
+		s.nodes = make(map[uint64]*node)
+		s.updates = make([]pb.Update, 0)
+		s.batch = make([]rsm.Task, 0, taskBatchSize)
+		s.entries = make([]sm.Entry, 0, taskBatchSize)
+		return s
+	}
+	s.stepStage.start(func(workerID uint64,
+		instanceID uint64, quitC chan struct{}) {
+		if errorInjection {
+			defer func() {
+				if r := recover(); r != nil {
+					if ce, ok := r.(error); ok {
+						s.crash(ce)
 					}
-				}()
-			}
-			s.stepWorkerMain(workerID)
-		})
-	}
-	if notifyCommit {
-		for i := uint64(1); i <= cfg.CommitShards; i++ {
-			commitWorkerID := i
-			s.commitStopper.RunWorker(func() {
-				s.commitWorkerMain(commitWorkerID)
-			})
+				}
+			}()
 		}
+		s.stepWorkerMain(workerID, instanceID, quitC)
+	})
+	if notifyCommit {
+		s.commitStage.start(s.commitWorkerMain)
 	}
-	for i := uint64(1); i <= cfg.ApplyShards; i++ {
-		applyWorkerID := i
-		s.taskStopper.RunWorker(func() {
-			s.applyWorkerMain(applyWorkerID)
+	s.applyStage.start(s.applyWorkerMain)
+	if cfg.AdaptiveWorkers {
+		s.adaptiveStopper.RunWorker(func() {
+			s.adaptiveWorkerMain(cfg)
 		})
 	}
 	return s
@@ -1072,14 +1255,24 @@ func (e *engine) crash(err error) {
 }
 
 func (e *engine) close() error {
-	e.nodeStopper.Stop()
-	e.commitStopper.Stop()
-	e.taskStopper.Stop()
+	if e.clocked {
+		e.offloadNodeMap(e.nodes)
+	}
+	e.adaptiveStopper.Stop()
+	e.stepStage.stop()
+	e.commitStage.stop()
+	e.applyStage.stop()
 	var err error
 	err = firstError(err, e.wp.close())
 	return firstError(err, e.cp.close())
 }
 
+// setPriority sets the priority class of the specified shard, it must be
+// called before the shard is made visible to workers.
+func (e *engine) setPriority(shardID uint64, priority config.Priority) {
+	e.priorities.set(shardID, priority)
+}
+
 func (e *engine) nodeLoaded(shardID uint64, replicaID uint64) bool {
 	return e.loaded.get(shardID, replicaID) != nil
 }
@@ -1091,46 +1284,89 @@ func (e *engine) destroyedC(shardID uint64, replicaID uint64) <-chan struct{} {
 	return nil
 }
 
-func (e *engine) load(workerID uint64,
+// load loads nodes managed by the specified worker, loaded nodes are recorded
+// by the unique instance ID of the worker as worker IDs are reused once the
+// stage is resized.
+func (e *engine) load(workerID uint64, instanceID uint64,
 	cci uint64, nodes map[uint64]*node,
 	from from, ready *workReady) (map[uint64]*node, uint64) {
 	result, offloaded, cci := e.loadBucketNodes(workerID, cci, nodes,
 		ready.getPartitioner(), from)
-	e.loaded.update(workerID, from, result)
+	e.loaded.update(instanceID, from, result)
 	for _, n := range offloaded {
 		n.offloaded()
 	}
 	return result, cci
 }
 
-func (e *engine) commitWorkerMain(workerID uint64) {
+func (e *engine) commitWorkerMain(workerID uint64,
+	instanceID uint64, quitC chan struct{}) {
 	nodes := make(map[uint64]*node)
 	ticker := time.NewTicker(nodeReloadInterval)
 	defer ticker.Stop()
 	cci := uint64(0)
+	epoch := uint64(0)
 	for {
 		select {
-		case <-e.commitStopper.ShouldStop():
+		case <-e.commitStage.shouldStop():
+			e.offloadNodeMap(nodes)
+			return
+		case <-quitC:
 			e.offloadNodeMap(nodes)
+			e.loaded.update(instanceID, fromCommitWorker, nil)
 			return
 		case <-ticker.C:
-			nodes, cci = e.loadCommitNodes(workerID, cci, nodes)
+			l, resized := e.commitStage.enter(quitC, &epoch)
+			if l == nil {
+				continue
+			}
+			start := time.Now()
+			if resized {
+				cci = 0
+			}
+			nodes, cci = e.loadCommitNodes(workerID, instanceID, l.work, cci, nodes)
 			e.processCommits(make(map[uint64]struct{}), nodes)
-		case <-e.commitCCIReady.waitCh(workerID):
-			nodes, cci = e.loadCommitNodes(workerID, cci, nodes)
-		case <-e.commitWorkReady.waitCh(workerID):
+			e.commitStage.exit(l, start)
+		case <-e.commitStage.cciReady().waitCh(workerID):
+			l, resized := e.commitStage.enter(quitC, &epoch)
+			if l == nil {
+				continue
+			}
+			start := time.Now()
+			if resized {
+				cci = 0
+			}
+			nodes, cci = e.loadCommitNodes(workerID, instanceID, l.work, cci, nodes)
+			if resized {
+				e.processCommits(make(map[uint64]struct{}), nodes)
+			}
+			e.commitStage.exit(l, start)
+		case <-e.commitStage.workReady().waitCh(workerID):
+			l, resized := e.commitStage.enter(quitC, &epoch)
+			if l == nil {
+				continue
+			}
+			start := time.Now()
+			wr := l.work
+			e.commitStage.woken(wr, workerID)
+			active := wr.getReadyMap(workerID)
+			if resized {
+				cci = 0
+				active = make(map[uint64]struct{})
+			}
 			if cci == 0 || len(nodes) == 0 {
-				nodes, cci = e.loadCommitNodes(workerID, cci, nodes)
+				nodes, cci = e.loadCommitNodes(workerID, instanceID, l.work, cci, nodes)
 			}
-			active := e.commitWorkReady.getReadyMap(workerID)
 			e.processCommits(active, nodes)
+			e.commitStage.exit(l, start)
 		}
 	}
 }
 
-func (e *engine) loadCommitNodes(workerID uint64, cci uint64,
+func (e *engine) loadCommitNodes(workerID uint64, instanceID uint64,
+	wr *workReady, cci uint64,
 	nodes map[uint64]*node) (map[uint64]*node, uint64) {
-	return e.load(workerID, cci, nodes, fromCommitWorker, e.commitWorkReady)
+	return e.load(workerID, instanceID, cci, nodes, fromCommitWorker, wr)
 }
 
 func (e *engine) processCommits(idmap map[uint64]struct{},
@@ -1149,7 +1385,8 @@ func (e *engine) processCommits(idmap map[uint64]struct{},
 	}
 }
 
-func (e *engine) applyWorkerMain(workerID uint64) {
+func (e *engine) applyWorkerMain(workerID uint64,
+	instanceID uint64, quitC chan struct{}) {
 	nodes := make(map[uint64]*node)
 	ticker := time.NewTicker(nodeReloadInterval)
 	defer ticker.Stop()
@@ -1157,39 +1394,141 @@ func (e *engine) applyWorkerMain(workerID uint64) {
 	entries := make([]sm.Entry, 0, taskBatchSize)
 	cci := uint64(0)
 	count := uint64(0)
+	epoch := uint64(0)
 	for {
 		select {
-		case <-e.taskStopper.ShouldStop():
+		case <-e.applyStage.shouldStop():
+			e.offloadNodeMap(nodes)
+			return
+		case <-quitC:
 			e.offloadNodeMap(nodes)
+			e.loaded.update(instanceID, fromApplyWorker, nil)
 			return
 		case <-ticker.C:
-			nodes, cci = e.loadApplyNodes(workerID, cci, nodes)
+			l, resized := e.applyStage.enter(quitC, &epoch)
+			if l == nil {
+				continue
+			}
+			start := time.Now()
+			if resized {
+				cci = 0
+			}
+			nodes, cci = e.loadApplyNodes(workerID, instanceID, l.work, cci, nodes)
 			a := make(map[uint64]struct{})
 			if err := e.processApplies(a, nodes, batch, entries); err != nil {
 				panicNow(err)
 			}
+			e.applyStage.exit(l, start)
 			count++
 			if count%200 == 0 {
 				batch = make([]rsm.Task, 0, taskBatchSize)
 				entries = make([]sm.Entry, 0, taskBatchSize)
 			}
-		case <-e.applyCCIReady.waitCh(workerID):
-			nodes, cci = e.loadApplyNodes(workerID, cci, nodes)
-		case <-e.applyWorkReady.waitCh(workerID):
+		case <-e.applyStage.cciReady().waitCh(workerID):
+			l, resized := e.applyStage.enter(quitC, &epoch)
+			if l == nil {
+				continue
+			}
+			start := time.Now()
+			if resized {
+				cci = 0
+			}
+			nodes, cci = e.loadApplyNodes(workerID, instanceID, l.work, cci, nodes)
+			if resized {
+				a := make(map[uint64]struct{})
+				if err := e.processApplies(a, nodes, batch, entries); err != nil {
+					panicNow(err)
+				}
+			}
+			e.applyStage.exit(l, start)
+		case <-e.applyStage.workReady().waitCh(workerID):
+			l, resized := e.applyStage.enter(quitC, &epoch)
+			if l == nil {
+				continue
+			}
+			start := time.Now()
+			wr := l.work
+			e.applyStage.woken(wr, workerID)
+			a := wr.getReadyMap(workerID)
+			if resized {
+				cci = 0
+				a = make(map[uint64]struct{})
+			}
 			if cci == 0 || len(nodes) == 0 {
-				nodes, cci = e.loadApplyNodes(workerID, cci, nodes)
+				nodes, cci = e.loadApplyNodes(workerID, instanceID, l.work, cci, nodes)
 			}
-			a := e.applyWorkReady.getReadyMap(workerID)
 			if err := e.processApplies(a, nodes, batch, entries); err != nil {
 				panicNow(err)
 			}
+			e.applyStage.exit(l, start)
 		}
 	}
 }
 
-func (e *engine) loadApplyNodes(workerID uint64, cci uint64,
+func (e *engine) loadApplyNodes(workerID uint64, instanceID uint64,
+	wr *workReady, cci uint64,
 	nodes map[uint64]*node) (map[uint64]*node, uint64) {
-	return e.load(workerID, cci, nodes, fromApplyWorker, e.applyWorkReady)
+	return e.load(workerID, instanceID, cci, nodes, fromApplyWorker, wr)
+}
+
+// resize changes the numbers of step, commit and apply workers used by normal
+// priority shards and the numbers of snapshot and close workers.
+func (e *engine) resize(cfg config.EngineConfig) {
+	e.stepStage.resize(cfg.ExecShards)
+	e.commitStage.resize(cfg.CommitShards)
+	e.applyStage.resize(cfg.ApplyShards)
+	e.wp.size.set(cfg.SnapshotShards)
+	e.cp.size.set(cfg.CloseShards)
+}
+
+// adaptiveWorkerMain periodically resizes the engine stages and worker pools
+// based on their observed load, the numbers of workers are kept within the
+// ranges specified in the EngineConfig.
+func (e *engine) adaptiveWorkerMain(cfg config.EngineConfig) {
+	ticker := time.NewTicker(adaptiveInterval)
+	defer ticker.Stop()
+	cpu := newCPUSampler()
+	for {
+		select {
+		case <-e.adaptiveStopper.ShouldStop():
+			return
+		case <-ticker.C:
+			u := cpu.utilization()
+			e.adapt(e.stepStage, cfg.GetMinExecShards(), cfg.ExecShards, u)
+			if e.notifyCommit {
+				e.adapt(e.commitStage,
+					cfg.CommitShards, cfg.GetMaxCommitShards(), u)
+			}
+			e.adapt(e.applyStage, cfg.ApplyShards, cfg.GetMaxApplyShards(), u)
+			e.adaptPool("snapshot", e.wp.size,
+				cfg.SnapshotShards, cfg.GetMaxSnapshotShards(), u)
+			e.adaptPool("close", e.cp.size,
+				cfg.CloseShards, cfg.GetMaxCloseShards(), u)
+		}
+	}
+}
+
+func (e *engine) adapt(s *workerStage, min uint64, max uint64, cpu float64) {
+	current := s.size()
+	st := s.getStats(adaptiveInterval)
+	if sz := adaptiveSize(current, min, max, st, cpu); sz != current {
+		plog.Infof("%s resizing engine stage from %d to %d workers, "+
+			"utilization %.2f, latency %s, cpu %.2f",
+			e.nh.describe(), current, sz, st.utilization, st.latency, cpu)
+		s.resize(sz)
+	}
+}
+
+func (e *engine) adaptPool(name string,
+	p *poolSize, min uint64, max uint64, cpu float64) {
+	current := p.get()
+	starved, peak := p.getStats()
+	if sz := adaptivePoolSize(current, min, max, starved, peak, cpu); sz != current {
+		plog.Infof("%s resizing %s worker pool from %d to %d workers, "+
+			"starved %t, peak busy %d, cpu %.2f",
+			e.nh.describe(), name, current, sz, starved, peak, cpu)
+		p.set(sz)
+	}
 }
 
 // S: save snapshot
@@ -1226,41 +1565,160 @@ func (e *engine) processApplies(idmap map[uint64]struct{},
 	return nil
 }
 
-func (e *engine) stepWorkerMain(workerID uint64) {
+func (e *engine) stepWorkerMain(workerID uint64,
+	instanceID uint64, quitC chan struct{}) {
 	nodes := make(map[uint64]*node)
 	ticker := time.NewTicker(nodeReloadInterval)
 	defer ticker.Stop()
 	cci := uint64(0)
-	stopC := e.nodeStopper.ShouldStop()
+	epoch := uint64(0)
+	stopC := e.stepStage.shouldStop()
 	updates := make([]pb.Update, 0)
+	// the stage is released when the worker panics, such panics are recovered
+	// when errors are injected
+	var entered *stageLayout
+	defer func() {
+		if entered != nil {
+			e.stepStage.exit(entered, time.Now())
+		}
+	}()
 	for {
 		select {
 		case <-stopC:
 			e.offloadNodeMap(nodes)
 			return
+		case <-quitC:
+			e.offloadNodeMap(nodes)
+			e.loaded.update(instanceID, fromStepWorker, nil)
+			return
 		case <-ticker.C:
-			nodes, cci = e.loadStepNodes(workerID, cci, nodes)
+			l, resized := e.stepStage.enter(quitC, &epoch)
+			if l == nil {
+				continue
+			}
+			entered = l
+			start := time.Now()
+			if resized {
+				cci = 0
+			}
+			nodes, cci = e.loadStepNodes(workerID, instanceID, l.work, cci, nodes)
 			a := make(map[uint64]struct{})
-			if err := e.processSteps(workerID, a, nodes, updates, stopC); err != nil {
+			if err := e.processStepGroups(workerID, l.count, a, nodes, updates, stopC); err != nil {
 				panicNow(err)
 			}
-		case <-e.stepCCIReady.waitCh(workerID):
-			nodes, cci = e.loadStepNodes(workerID, cci, nodes)
-		case <-e.stepWorkReady.waitCh(workerID):
+			entered = nil
+			e.stepStage.exit(l, start)
+		case <-e.stepStage.cciReady().waitCh(workerID):
+			l, resized := e.stepStage.enter(quitC, &epoch)
+			if l == nil {
+				continue
+			}
+			entered = l
+			start := time.Now()
+			if resized {
+				cci = 0
+			}
+			nodes, cci = e.loadStepNodes(workerID, instanceID, l.work, cci, nodes)
+			if resized {
+				a := make(map[uint64]struct{})
+				if err := e.processStepGroups(workerID, l.count, a, nodes, updates, stopC); err != nil {
+					panicNow(err)
+				}
+			}
+			entered = nil
+			e.stepStage.exit(l, start)
+		case <-e.stepStage.workReady().waitCh(workerID):
+			l, resized := e.stepStage.enter(quitC, &epoch)
+			if l == nil {
+				continue
+			}
+			entered = l
+			start := time.Now()
+			wr := l.work
+			e.stepStage.woken(wr, workerID)
+			a := wr.getReadyMap(workerID)
+			if resized {
+				cci = 0
+				a = make(map[uint64]struct{})
+			}
 			if cci == 0 || len(nodes) == 0 {
-				nodes, cci = e.loadStepNodes(workerID, cci, nodes)
+				nodes, cci = e.loadStepNodes(workerID, instanceID, l.work, cci, nodes)
 			}
-			a := e.stepWorkReady.getReadyMap(workerID)
-			if err := e.processSteps(workerID, a, nodes, updates, stopC); err != nil {
+			if err := e.processStepGroups(workerID, l.count, a, nodes, updates, stopC); err != nil {
 				panicNow(err)
 			}
+			entered = nil
+			e.stepStage.exit(l, start)
+		}
+	}
+}
+
+// run processes all shards marked as ready by the step, commit and apply
+// stages on the calling goroutine in the ascending order of their shard IDs,
+// it is used in place of the workers when the engine is driven by a clock.
+// It returns a boolean value indicating whether any shard was processed.
+func (e *engine) run() (bool, error) {
+	nodes, offloaded, csi := e.loadBucketNodes(1, e.csi, e.nodes,
+		server.NewFixedPartitioner(1), fromStepWorker)
+	e.loaded.update(1, fromStepWorker, nodes)
+	for _, n := range offloaded {
+		n.offloaded()
+	}
+	e.nodes, e.csi = nodes, csi
+	processed := false
+	for _, cid := range e.stepStage.ready() {
+		processed = true
+		a := map[uint64]struct{}{cid: {}}
+		if err := e.processSteps(1, a, nodes, e.updates, nil); err != nil {
+			return false, err
+		}
+	}
+	if e.notifyCommit {
+		for _, cid := range e.commitStage.ready() {
+			processed = true
+			e.processCommits(map[uint64]struct{}{cid: {}}, nodes)
+		}
+	}
+	// completed snapshot operations are picked up by the apply pass
+	ready := e.applyStage.ready()
+	for cid, n := range nodes {
+		if n.ss.hasCompleted() {
+			ready = append(ready, cid)
+		}
+	}
+	sort.Slice(ready, func(i, j int) bool { return ready[i] < ready[j] })
+	for idx, cid := range ready {
+		if idx > 0 && ready[idx-1] == cid {
+			continue
+		}
+		processed = true
+		a := map[uint64]struct{}{cid: {}}
+		if err := e.processApplies(a, nodes, e.batch, e.entries); err != nil {
+			return false, err
+		}
+	}
+	return processed, nil
+}
+
+// snapshotInProgress returns a boolean value indicating whether any snapshot
+// operation requested by the shards is still being handled by the snapshot
+// workers.
+func (e *engine) snapshotInProgress() bool {
+	if e.wp.hasRunningJobs() {
+		return true
+	}
+	for _, n := range e.nodes {
+		if n.ss.inProgress() {
+			return true
 		}
 	}
+	return false
 }
 
-func (e *engine) loadStepNodes(workerID uint64,
-	cci uint64, nodes map[uint64]*node) (map[uint64]*node, uint64) {
-	return e.load(workerID, cci, nodes, fromStepWorker, e.stepWorkReady)
+func (e *engine) loadStepNodes(workerID uint64, instanceID uint64,
+	wr *workReady, cci uint64,
+	nodes map[uint64]*node) (map[uint64]*node, uint64) {
+	return e.load(workerID, instanceID, cci, nodes, fromStepWorker, wr)
 }
 
 func (e *engine) loadBucketNodes(workerID uint64,
@@ -1300,6 +1758,40 @@ func (e *engine) loadBucketNodes(workerID uint64,
 	return nodes, offloaded, csi
 }
 
+// processStepGroups processes the active nodes of the step worker. Nodes
+// managed by a step worker dedicated to high priority shards or by a step
+// worker of a resized step stage may belong to different LogDB partitions,
+// they are grouped in the same way as they are grouped by the ExecShards
+// regular step workers so each group can be saved into the LogDB as a single
+// batch.
+func (e *engine) processStepGroups(workerID uint64, count uint64,
+	active map[uint64]struct{},
+	nodes map[uint64]*node, nodeUpdates []pb.Update, stopC chan struct{}) error {
+	if count == e.execShards && workerID <= e.execShards {
+		return e.processSteps(workerID, active, nodes, nodeUpdates, stopC)
+	}
+	if len(active) == 0 {
+		for cid := range nodes {
+			active[cid] = struct{}{}
+		}
+	}
+	groups := make(map[uint64]map[uint64]struct{})
+	for cid := range active {
+		g, ok := groups[cid%e.execShards]
+		if !ok {
+			g = make(map[uint64]struct{})
+			groups[cid%e.execShards] = g
+		}
+		g[cid] = struct{}{}
+	}
+	for _, g := range groups {
+		if err := e.processSteps(workerID, g, nodes, nodeUpdates, stopC); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (e *engine) processSteps(workerID uint64,
 	active map[uint64]struct{},
 	nodes map[uint64]*node, nodeUpdates []pb.Update, stopC chan struct{}) error {
@@ -1420,31 +1912,31 @@ func (e *engine) setCloseReady(n *node) {
 }
 
 func (e *engine) setStepReadyByMessageBatch(mb pb.MessageBatch) {
-	e.stepWorkReady.shardReadyByMessageBatch(mb)
+	e.stepStage.workReady().shardReadyByMessageBatch(mb)
 }
 
 func (e *engine) setAllStepReady(nodes []*node) {
-	e.stepWorkReady.allShardsReady(nodes)
+	e.stepStage.workReady().allShardsReady(nodes)
 }
 
 func (e *engine) setStepReady(shardID uint64) {
-	e.stepWorkReady.shardReady(shardID)
+	e.stepStage.workReady().shardReady(shardID)
 }
 
 func (e *engine) setCommitReadyByUpdates(updates []pb.Update) {
-	e.commitWorkReady.shardReadyByUpdates(updates)
+	e.commitStage.workReady().shardReadyByUpdates(updates)
 }
 
 func (e *engine) setCommitReady(shardID uint64) {
-	e.commitWorkReady.shardReady(shardID)
+	e.commitStage.workReady().shardReady(shardID)
 }
 
 func (e *engine) setApplyReadyByUpdates(updates []pb.Update) {
-	e.applyWorkReady.shardReadyByUpdates(updates)
+	e.applyStage.workReady().shardReadyByUpdates(updates)
 }
 
 func (e *engine) setApplyReady(shardID uint64) {
-	e.applyWorkReady.shardReady(shardID)
+	e.applyStage.workReady().shardReady(shardID)
 }
 
 func (e *engine) setStreamReady(shardID uint64) {
@@ -1460,9 +1952,9 @@ func (e *engine) setRecoverReady(shardID uint64) {
 }
 
 func (e *engine) setCCIReady(shardID uint64) {
-	e.stepCCIReady.shardReady(shardID)
-	e.commitCCIReady.shardReady(shardID)
-	e.applyCCIReady.shardReady(shardID)
+	e.stepStage.cciReady().shardReady(shardID)
+	e.commitStage.cciReady().shardReady(shardID)
+	e.applyStage.cciReady().shardReady(shardID)
 	e.wp.cciReady.shardReady(shardID)
 }
 
@@ -15,7 +15,14 @@
 package dragonboat
 
 import (
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/lni/goutils/syncutil"
+
+	"github.com/lni/dragonboat/v4/config"
 )
 
 func TestBitmapAdd(t *testing.T) {
@@ -69,6 +76,316 @@ func TestPartitionerWorksAsExpected(t *testing.T) {
 	}
 }
 
+func TestPriorityPartitionerWorksAsExpected(t *testing.T) {
+	sp := &shardPriorities{}
+	wr := newPriorityWorkReady(4, 2, sp)
+	if len(wr.maps) != 6 || len(wr.channels) != 6 {
+		t.Errorf("unexpected ready list len")
+	}
+	for i := uint64(0); i < uint64(128); i++ {
+		if i%3 == 0 {
+			sp.set(i, config.HighPriority)
+		}
+	}
+	p := wr.getPartitioner()
+	for i := uint64(0); i < uint64(128); i++ {
+		idx := p.GetPartitionID(i)
+		if i%3 == 0 && idx < 4 {
+			t.Errorf("high priority shard %d assigned to %d", i, idx)
+		}
+		if i%3 != 0 && idx >= 4 {
+			t.Errorf("normal priority shard %d assigned to %d", i, idx)
+		}
+	}
+	sp.set(3, config.NormalPriority)
+	if idx := p.GetPartitionID(3); idx != 3 {
+		t.Errorf("shard 3 assigned to %d", idx)
+	}
+	wr = newPriorityWorkReady(4, 0, sp)
+	if idx := wr.getPartitioner().GetPartitionID(6); idx != 2 {
+		t.Errorf("shard 6 assigned to %d", idx)
+	}
+}
+
+func TestWorkerStageCanBeResized(t *testing.T) {
+	s := newWorkerStage(4, 1, &shardPriorities{}, false)
+	running := int64(0)
+	s.start(func(workerID uint64, instanceID uint64, quitC chan struct{}) {
+		atomic.AddInt64(&running, 1)
+		defer atomic.AddInt64(&running, -1)
+		select {
+		case <-quitC:
+		case <-s.shouldStop():
+		}
+	})
+	waitRunning := func(n int64) {
+		for i := 0; i < 1000; i++ {
+			if atomic.LoadInt64(&running) == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("running %d, want %d", atomic.LoadInt64(&running), n)
+	}
+	waitRunning(5)
+	for _, sz := range []uint64{2, 6, 6, 1} {
+		s.resize(sz)
+		waitRunning(int64(sz + 1))
+		if s.size() != sz {
+			t.Errorf("size %d, want %d", s.size(), sz)
+		}
+		if len(s.workReady().channels) != int(sz+1) ||
+			len(s.cciReady().channels) != int(sz+1) {
+			t.Errorf("work ready not resized")
+		}
+	}
+	s.stop()
+	waitRunning(0)
+	// no-op once stopped
+	s.resize(3)
+	if s.size() != 1 {
+		t.Errorf("stopped stage resized")
+	}
+}
+
+func TestWorkerStageEpochIsObserved(t *testing.T) {
+	s := newWorkerStage(2, 0, &shardPriorities{}, false)
+	quitC := make(chan struct{})
+	epoch := uint64(0)
+	l, resized := s.enter(quitC, &epoch)
+	if l == nil || resized {
+		t.Fatalf("layout %v, resized %t", l, resized)
+	}
+	s.exit(l, time.Now())
+	s.resize(3)
+	l, resized = s.enter(quitC, &epoch)
+	if l == nil || !resized || l.count != 3 {
+		t.Fatalf("layout %v, resized %t", l, resized)
+	}
+	s.exit(l, time.Now())
+	close(quitC)
+	if l, _ := s.enter(quitC, &epoch); l != nil {
+		t.Errorf("removed worker allowed to enter")
+	}
+}
+
+func TestWorkerStageResizeDoesNotWaitForActivePasses(t *testing.T) {
+	s := newWorkerStage(2, 0, &shardPriorities{}, false)
+	quitC := make(chan struct{})
+	epoch := uint64(0)
+	prev, _ := s.enter(quitC, &epoch)
+	resized := make(chan struct{})
+	go func() {
+		s.resize(3)
+		close(resized)
+	}()
+	select {
+	case <-resized:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("resize blocked by an active pass")
+	}
+	entered := make(chan *stageLayout, 1)
+	go func() {
+		e := uint64(0)
+		l, _ := s.enter(quitC, &e)
+		entered <- l
+	}()
+	select {
+	case <-entered:
+		t.Fatalf("entered the new layout before the previous pass completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.exit(prev, time.Now())
+	select {
+	case l := <-entered:
+		if l.count != 3 {
+			t.Errorf("count %d, want 3", l.count)
+		}
+		s.exit(l, time.Now())
+	case <-time.After(5 * time.Second):
+		t.Fatalf("failed to enter the new layout")
+	}
+}
+
+func TestWorkerStageInstanceIDsAreNotReused(t *testing.T) {
+	s := newWorkerStage(2, 0, &shardPriorities{}, false)
+	var mu sync.Mutex
+	instances := make(map[uint64]uint64)
+	s.start(func(workerID uint64, instanceID uint64, quitC chan struct{}) {
+		mu.Lock()
+		if _, ok := instances[instanceID]; ok {
+			t.Errorf("instance ID %d reused", instanceID)
+		}
+		instances[instanceID] = workerID
+		mu.Unlock()
+		select {
+		case <-quitC:
+		case <-s.shouldStop():
+		}
+	})
+	s.resize(1)
+	s.resize(2)
+	s.stop()
+	if len(instances) != 3 {
+		t.Errorf("%d instances, want 3", len(instances))
+	}
+}
+
+func TestAdaptiveSize(t *testing.T) {
+	tests := []struct {
+		current     uint64
+		utilization float64
+		latency     time.Duration
+		cpu         float64
+		result      uint64
+	}{
+		{4, 0.9, 0, 0.5, 5},
+		{4, 0.5, 10 * time.Millisecond, 0.5, 5},
+		{4, 0.9, 0, 0.95, 4},
+		{8, 0.9, 0, 0.5, 8},
+		{4, 0.5, 0, 0.5, 4},
+		{4, 0.1, 0, 0.5, 3},
+		{2, 0.1, 0, 0.5, 2},
+		{4, 0.1, 10 * time.Millisecond, 0.5, 5},
+	}
+	for idx, tt := range tests {
+		st := stageStats{utilization: tt.utilization, latency: tt.latency}
+		if v := adaptiveSize(tt.current, 2, 8, st, tt.cpu); v != tt.result {
+			t.Errorf("%d, got %d, want %d", idx, v, tt.result)
+		}
+	}
+}
+
+func TestAdaptivePoolSize(t *testing.T) {
+	tests := []struct {
+		current uint64
+		starved bool
+		peak    uint64
+		cpu     float64
+		result  uint64
+	}{
+		{4, true, 4, 0.5, 5},
+		{4, true, 4, 0.95, 4},
+		{8, true, 8, 0.5, 8},
+		{4, false, 4, 0.5, 4},
+		{8, false, 1, 0.5, 7},
+		{2, false, 0, 0.5, 2},
+	}
+	for idx, tt := range tests {
+		v := adaptivePoolSize(tt.current, 2, 8, tt.starved, tt.peak, tt.cpu)
+		if v != tt.result {
+			t.Errorf("%d, got %d, want %d", idx, v, tt.result)
+		}
+	}
+}
+
+func TestPoolSizeStats(t *testing.T) {
+	p := newPoolSize(4)
+	p.observe(2)
+	p.observe(3)
+	p.observe(1)
+	p.starve()
+	if starved, peak := p.getStats(); !starved || peak != 3 {
+		t.Errorf("starved %t, peak %d", starved, peak)
+	}
+	if starved, peak := p.getStats(); starved || peak != 0 {
+		t.Errorf("stats not reset, starved %t, peak %d", starved, peak)
+	}
+	p.set(6)
+	if p.get() != 6 {
+		t.Errorf("size %d, want 6", p.get())
+	}
+	select {
+	case <-p.resizeC:
+	default:
+		t.Errorf("resize not notified")
+	}
+}
+
+func TestCloseWorkerPoolCanBeResized(t *testing.T) {
+	p := &closeWorkerPool{
+		busy:          make(map[uint64]uint64),
+		workerStopper: syncutil.NewStopper(),
+		size:          newPoolSize(2),
+	}
+	defer p.workerStopper.Stop()
+	p.resize()
+	if len(p.workers) != 2 {
+		t.Fatalf("workers %d, want 2", len(p.workers))
+	}
+	p.size.set(4)
+	p.resize()
+	if len(p.workers) != 4 {
+		t.Fatalf("workers %d, want 4", len(p.workers))
+	}
+	p.busy[2] = 1
+	p.size.set(1)
+	p.resize()
+	if len(p.workers) != 3 {
+		t.Fatalf("workers %d, want 3", len(p.workers))
+	}
+	if w := p.getWorker(); w == nil || w.workerID != 0 {
+		t.Errorf("unexpected worker %v", w)
+	}
+	delete(p.busy, 2)
+	p.resize()
+	if len(p.workers) != 1 {
+		t.Fatalf("workers %d, want 1", len(p.workers))
+	}
+}
+
+func TestSnapshotWorkerPoolCanBeResized(t *testing.T) {
+	p := &workerPool{
+		busy:          make(map[uint64]*node),
+		workerStopper: syncutil.NewStopper(),
+		size:          newPoolSize(3),
+	}
+	defer p.workerStopper.Stop()
+	p.resize()
+	if len(p.workers) != 3 {
+		t.Fatalf("workers %d, want 3", len(p.workers))
+	}
+	p.busy[0] = &node{}
+	p.busy[2] = &node{}
+	p.size.set(1)
+	p.resize()
+	if len(p.workers) != 3 {
+		t.Fatalf("workers %d, want 3", len(p.workers))
+	}
+	if w := p.getWorker(); w != nil {
+		t.Errorf("unexpected worker %d", w.workerID)
+	}
+	delete(p.busy, 2)
+	p.resize()
+	if len(p.workers) != 1 {
+		t.Fatalf("workers %d, want 1", len(p.workers))
+	}
+}
+
+func TestCPUSampler(t *testing.T) {
+	if _, ok := processCPUTime(); !ok {
+		t.Skip("process CPU time not available")
+	}
+	c := newCPUSampler()
+	v := uint64(0)
+	for start := time.Now(); time.Since(start) < 50*time.Millisecond; {
+		v++
+	}
+	if u := c.utilization(); u <= 0 {
+		t.Errorf("unexpected utilization %f, %d", u, v)
+	}
+}
+
+func TestCPUSamplerFallback(t *testing.T) {
+	c := newCPUSamplerWith(func() (time.Duration, bool) {
+		return 0, false
+	})
+	time.Sleep(time.Millisecond)
+	if u := c.utilization(); u != 0 {
+		t.Errorf("unexpected utilization %f", u)
+	}
+}
+
 func TestAllShardsReady(t *testing.T) {
 	wr := newWorkReady(4)
 	nodes := make([]*node, 0)
@@ -49,6 +49,21 @@ type raftEventListener struct {
 	metrics             bool
 }
 
+func newMemoryBudget(maxSize uint64, useMetrics bool) *server.MemoryBudget {
+	b := server.NewMemoryBudget(maxSize)
+	if useMetrics && b.Enabled() {
+		name := "dragonboat_nodehost_memory_budget_bytes"
+		metrics.GetOrCreateGauge(name, func() float64 {
+			return float64(b.MaxSize())
+		})
+		name = "dragonboat_nodehost_memory_budget_used_bytes"
+		metrics.GetOrCreateGauge(name, func() float64 {
+			return float64(b.Get())
+		})
+	}
+	return b
+}
+
 var _ server.IRaftEventListener = (*raftEventListener)(nil)
 
 func newRaftEventListener(shardID uint64, replicaID uint64,
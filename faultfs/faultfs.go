@@ -0,0 +1,74 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package faultfs provides a filesystem that injects faults into filesystem
+operations for testing purposes.
+
+An FS wraps a config.IFS and injects errors, torn writes and latency into
+operations on selected paths or of selected types. Faults are named and can be
+injected or removed at runtime. An FS also simulates the loss of data not
+synced to disk when the process crashes, which can be used to test the crash
+consistency of on-disk state machines and other on-disk state.
+
+A typical crash consistency test writes some data using the FS, calls Crash
+to mark the point of the simulated crash, closes all users of the FS and then
+calls Recover before reopening the data. All data not synced before the
+simulated crash is dropped by Recover.
+
+The NewFaultFS function of the dragonboat package creates an FS together with
+a dragonboat.FaultInjector for injecting faults into all operations, it is the
+recommended way of using an FS as the Expert.FS field of config.NodeHostConfig.
+The NodeHost then runs in error injection mode as described in NewFaultFS.
+*/
+package faultfs
+
+import (
+	gvfs "github.com/lni/vfs"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+)
+
+// FS is a config.IFS implementation that injects faults into operations of
+// the underlying filesystem.
+type FS = vfs.FaultFS
+
+// Fault describes a fault injected into FS operations.
+type Fault = vfs.Fault
+
+// Op is the type of filesystem operations.
+type Op = gvfs.Op
+
+const (
+	// OpRead describes read operations.
+	OpRead = gvfs.OpRead
+	// OpWrite describes write operations.
+	OpWrite = gvfs.OpWrite
+	// OpSync describes the fsync operation.
+	OpSync = gvfs.OpSync
+)
+
+// ErrInjected is the error returned by torn writes when the Err field of the
+// Fault is not set.
+var ErrInjected = vfs.ErrInjected
+
+// New returns a new FS backed by fs, the default filesystem is used when fs
+// is nil.
+func New(fs config.IFS) *FS {
+	if fs == nil {
+		fs = vfs.DefaultFS
+	}
+	return vfs.NewFaultFS(fs)
+}
@@ -0,0 +1,80 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package faultfs
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/lni/dragonboat/v4/internal/vfs"
+)
+
+func appendRecord(fs *FS, name string, data string, sync bool) error {
+	open := fs.OpenForAppend
+	if _, err := fs.Stat(name); vfs.IsNotExist(err) {
+		open = fs.Create
+	}
+	f, err := open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte(data)); err != nil {
+		return err
+	}
+	if sync {
+		return f.Sync()
+	}
+	return nil
+}
+
+func TestUnsyncedRecordsAreLostOnCrash(t *testing.T) {
+	fs := New(vfs.NewMemFS())
+	if err := appendRecord(fs, "data", "a", true); err != nil {
+		t.Fatalf("failed to append, %v", err)
+	}
+	if err := appendRecord(fs, "data", "b", false); err != nil {
+		t.Fatalf("failed to append, %v", err)
+	}
+	fs.Crash()
+	if err := fs.Recover(); err != nil {
+		t.Fatalf("failed to recover, %v", err)
+	}
+	f, err := fs.Open("data")
+	if err != nil {
+		t.Fatalf("failed to open, %v", err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("failed to read, %v", err)
+	}
+	if string(data) != "a" {
+		t.Errorf("unexpected data %s", data)
+	}
+}
+
+func TestSyncFailure(t *testing.T) {
+	fs := New(vfs.NewMemFS())
+	fs.Inject("sync", Fault{Op: OpSync, Path: "data", Err: ErrInjected})
+	if err := appendRecord(fs, "data", "a", true); !errors.Is(err, ErrInjected) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	fs.RemoveFault("sync")
+	if err := appendRecord(fs, "data", "b", true); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
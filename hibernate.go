@@ -0,0 +1,313 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+var (
+	// wakeRetryInterval is the interval between attempts to restart a
+	// hibernated replica that has not been fully unloaded yet.
+	wakeRetryInterval = 10 * time.Millisecond
+	// defaultWakeTimeout is the max time to wait for a hibernated replica to be
+	// fully unloaded before it is restarted when the WakeTimeout field of
+	// config.Config is not set.
+	defaultWakeTimeout = 10 * time.Second
+)
+
+// hibernateQueueSize is the max number of idle replicas waiting to be
+// hibernated by the hibernate worker.
+const hibernateQueueSize = 1024
+
+// replicaStub contains everything required to restart a replica, it is the
+// small stub kept by the NodeHost for each hibernated replica and each replica
+// stopped because of critical disk space.
+type replicaStub struct {
+	createSM rsm.ManagedStateMachineFactory
+	config   config.Config
+	smType   pb.StateMachineType
+	// mu serializes hibernating and waking up the replica
+	mu sync.Mutex
+	// info is the ShardInfo observed when the replica was hibernated
+	info   atomic.Value
+	queued int32
+	woken  bool
+	// waking is the ongoing attempt to wake up the replica, it is protected by
+	// wakeMu as mu is held for the whole attempt
+	wakeMu sync.Mutex
+	waking *wakeAttempt
+}
+
+// wakeAttempt is an attempt to wake up a hibernated replica, done is closed
+// once the attempt is completed, err is the outcome of the attempt.
+type wakeAttempt struct {
+	done chan struct{}
+	err  error
+}
+
+func (s *replicaStub) wakeTimeout() time.Duration {
+	if s.config.WakeTimeout > 0 {
+		return s.config.WakeTimeout
+	}
+	return defaultWakeTimeout
+}
+
+// complete records the outcome of the specified wake attempt. The replica can
+// be woken up again by a new attempt once the current one failed.
+func (s *replicaStub) complete(a *wakeAttempt, err error) {
+	s.wakeMu.Lock()
+	defer s.wakeMu.Unlock()
+	if err != nil && s.waking == a {
+		s.waking = nil
+	}
+	a.err = err
+	close(a.done)
+}
+
+func newReplicaStub(createSM rsm.ManagedStateMachineFactory,
+	cfg config.Config, smType pb.StateMachineType) *replicaStub {
+	return &replicaStub{createSM: createSM, config: cfg, smType: smType}
+}
+
+// queueHibernation hands the specified idle node to the hibernate worker, it
+// is called by the tick worker so the node is never stopped on the tick
+// worker itself.
+func (nh *NodeHost) queueHibernation(n *node) {
+	if n.stub == nil || !atomic.CompareAndSwapInt32(&n.stub.queued, 0, 1) {
+		return
+	}
+	select {
+	case nh.hibernateC <- n:
+	default:
+		// retried on the next tick
+		atomic.StoreInt32(&n.stub.queued, 0)
+	}
+}
+
+func (nh *NodeHost) hibernateWorkerMain() {
+	for {
+		select {
+		case <-nh.stopper.ShouldStop():
+			return
+		case n := <-nh.hibernateC:
+			nh.hibernate(n)
+			atomic.StoreInt32(&n.stub.queued, 0)
+		}
+	}
+}
+
+// hibernate unloads the specified node from the NodeHost after replacing it
+// with its stub.
+func (nh *NodeHost) hibernate(n *node) {
+	if atomic.LoadInt32(&nh.closed) != 0 || n.stub == nil {
+		return
+	}
+	s := n.stub
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if current, ok := nh.getShard(n.shardID); !ok || current != n {
+		return
+	}
+	// a message or request might have arrived after the node was queued
+	if !n.hibernationDue() {
+		return
+	}
+	info := n.getShardInfo()
+	info.Replication = nil
+	info.Hibernated = true
+	s.info.Store(info)
+	nh.hibernated.Store(n.shardID, s)
+	if err := nh.stopNode(n.shardID, n.replicaID, true); err != nil {
+		nh.hibernated.Delete(n.shardID)
+		plog.Warningf("%s failed to hibernate, %v", n.id(), err)
+		return
+	}
+	plog.Infof("%s hibernated", n.id())
+}
+
+// isHibernated returns a boolean value indicating whether the specified
+// replica is hibernated.
+func (nh *NodeHost) isHibernated(shardID uint64, replicaID uint64) bool {
+	if v, ok := nh.hibernated.Load(shardID); ok {
+		return v.(*replicaStub).config.ReplicaID == replicaID
+	}
+	return false
+}
+
+// getHibernatedShardInfo returns the ShardInfo of the specified hibernated
+// replica as observed when it was hibernated.
+func (nh *NodeHost) getHibernatedShardInfo(shardID uint64) (ShardInfo, bool) {
+	v, ok := nh.hibernated.Load(shardID)
+	if !ok {
+		return ShardInfo{}, false
+	}
+	info := v.(*replicaStub).info.Load()
+	if info == nil {
+		return ShardInfo{}, false
+	}
+	return info.(ShardInfo), true
+}
+
+// dropHibernated forgets the specified hibernated replica so it will not be
+// woken up again. It returns a boolean value indicating whether such
+// hibernated replica was found.
+func (nh *NodeHost) dropHibernated(shardID uint64,
+	replicaID uint64, check bool) bool {
+	v, ok := nh.hibernated.Load(shardID)
+	if !ok {
+		return false
+	}
+	s := v.(*replicaStub)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.woken || (check && s.config.ReplicaID != replicaID) {
+		return false
+	}
+	s.woken = true
+	nh.hibernated.Delete(shardID)
+	plog.Infof("%s hibernated replica dropped",
+		dn(shardID, s.config.ReplicaID))
+	return true
+}
+
+// wakeAsync wakes up the specified hibernated replica in the background. It
+// returns the ongoing wake attempt, or nil when the replica can not be woken
+// up.
+func (nh *NodeHost) wakeAsync(shardID uint64, replicaID uint64) *wakeAttempt {
+	v, ok := nh.hibernated.Load(shardID)
+	if !ok {
+		return nil
+	}
+	s := v.(*replicaStub)
+	if s.config.ReplicaID != replicaID {
+		return nil
+	}
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil
+	}
+	s.wakeMu.Lock()
+	defer s.wakeMu.Unlock()
+	if s.waking == nil {
+		a := &wakeAttempt{done: make(chan struct{})}
+		s.waking = a
+		nh.stopper.RunWorker(func() {
+			s.complete(a, nh.wake(shardID, s))
+		})
+	}
+	return s.waking
+}
+
+// wake restarts the specified hibernated replica. It blocks until the state
+// machine of the replica has been recovered.
+func (nh *NodeHost) wake(shardID uint64, s *replicaStub) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.woken {
+		return nil
+	}
+	replicaID := s.config.ReplicaID
+	timeout := s.wakeTimeout()
+	if c := nh.engine.destroyedC(shardID, replicaID); c != nil {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-c:
+		case <-timer.C:
+		case <-nh.stopper.ShouldStop():
+			return ErrClosed
+		}
+	}
+	cfg := s.config
+	cfg.WaitReady = true
+	deadline := time.Now().Add(timeout)
+	for {
+		err := nh.startShard(nil, false, s.createSM, cfg, s.smType)
+		if err == nil {
+			break
+		}
+		if errors.Is(err, ErrShardAlreadyExist) {
+			if _, ok := nh.getShard(shardID); ok {
+				break
+			}
+			if time.Now().Before(deadline) {
+				time.Sleep(wakeRetryInterval)
+				continue
+			}
+		}
+		if !errors.Is(err, ErrClosed) {
+			plog.Errorf("%s failed to wake up, %v", dn(shardID, replicaID), err)
+		}
+		return err
+	}
+	s.woken = true
+	nh.hibernated.Delete(shardID)
+	plog.Infof("%s woken up", dn(shardID, replicaID))
+	return nil
+}
+
+// getActiveShard returns the node of the specified shard. ErrShardNotReady is
+// returned when the shard is hibernated, the hibernated replica is woken up
+// in the background so the request can be retried shortly after.
+func (nh *NodeHost) getActiveShard(shardID uint64) (*node, error) {
+	n, _, err := nh.waitActiveShard(shardID, 0)
+	return n, err
+}
+
+// waitActiveShard returns the node of the specified shard. When the shard is
+// hibernated, the hibernated replica is woken up and waitActiveShard waits up
+// to timeout for it to be ready, ErrShardNotReady is returned when the replica
+// is not woken up in time or it failed to be woken up. The returned duration
+// is what remains of timeout after such wait.
+func (nh *NodeHost) waitActiveShard(shardID uint64,
+	timeout time.Duration) (*node, time.Duration, error) {
+	if n, ok := nh.getShard(shardID); ok {
+		return n, timeout, nil
+	}
+	v, ok := nh.hibernated.Load(shardID)
+	if !ok {
+		return nil, timeout, ErrShardNotFound
+	}
+	a := nh.wakeAsync(shardID, v.(*replicaStub).config.ReplicaID)
+	if a == nil || timeout <= 0 {
+		return nil, timeout, ErrShardNotReady
+	}
+	start := time.Now()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-a.done:
+	case <-timer.C:
+		return nil, 0, ErrShardNotReady
+	case <-nh.stopper.ShouldStop():
+		return nil, 0, ErrClosed
+	}
+	remaining := timeout - time.Since(start)
+	if a.err != nil || remaining <= 0 {
+		return nil, 0, ErrShardNotReady
+	}
+	if n, ok := nh.getShard(shardID); ok {
+		return n, remaining, nil
+	}
+	return nil, remaining, ErrShardNotReady
+}
@@ -1,4 +1,4 @@
-// Copyright 2017-2019 Lei Ni (nilei81@gmail.com) and other contributors.
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
 //
 // Licensed under the Apache License, Version 2.0 (the "License");
 // you may not use this file except in compliance with the License.
@@ -12,15 +12,11 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-//go:build !dragonboat_monkeytest
-// +build !dragonboat_monkeytest
+//go:build dragonboat_invariants
+// +build dragonboat_invariants
 
-package dragonboat
+package invariants
 
-import (
-	"sync/atomic"
-)
-
-func (nh *NodeHost) isPartitioned() bool {
-	return atomic.LoadInt32(&nh.partitioned) == 1
-}
+// SafetyCheck is a boolean flag indicating whether Raft safety properties are
+// continuously asserted at runtime.
+const SafetyCheck = true
@@ -0,0 +1,63 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logdb
+
+import (
+	"testing"
+
+	"github.com/lni/goutils/leaktest"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func saveTestEntries(t *testing.T, db raftio.ILogDB, first uint64, last uint64) {
+	ud := pb.Update{
+		ShardID:   3,
+		ReplicaID: 4,
+		State:     pb.State{Term: 2, Vote: 3, Commit: last},
+	}
+	for i := first; i <= last; i++ {
+		ud.EntriesToSave = append(ud.EntriesToSave,
+			pb.Entry{Term: 2, Index: i, Cmd: []byte("test data")})
+	}
+	require.NoError(t, db.SaveRaftState([]pb.Update{ud}, 1))
+}
+
+func TestLogDBRecoversFromCrash(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	fs := vfs.NewFaultFS(vfs.GetTestFS())
+	deleteTestDB(fs)
+	defer deleteTestDB(fs)
+	db := getNewTestDB("db-dir", "wal-db-dir", false, fs)
+	saveTestEntries(t, db, 1, 10)
+	fs.Crash()
+	saveTestEntries(t, db, 11, 20)
+	require.NoError(t, db.Close())
+	require.NoError(t, fs.Recover())
+
+	db = getNewTestDB("db-dir", "wal-db-dir", false, fs)
+	defer db.Close()
+	rs, err := db.ReadRaftState(3, 4, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), rs.State.Commit)
+	require.Equal(t, uint64(10), rs.EntryCount)
+	saveTestEntries(t, db, 11, 15)
+	rs, err = db.ReadRaftState(3, 4, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(15), rs.EntryCount)
+}
@@ -33,9 +33,9 @@ func newDefaultKVStore(config config.LogDBConfig,
 	callback kv.LogDBCallback,
 	dir string, wal string, fs vfs.IFS) (kv.IKVStore, error) {
 	if fs != vfs.DefaultFS {
-		_, isErrorFS := fs.(*vfs.ErrorFS)
-		_, isMemFS := fs.(*vfs.MemFS)
-		if !isErrorFS && !isMemFS {
+		switch fs.(type) {
+		case *vfs.ErrorFS, *vfs.FaultFS, *vfs.MemFS:
+		default:
 			panic("invalid fs")
 		}
 	}
@@ -34,10 +34,10 @@ func newDefaultKVStore(config config.LogDBConfig,
 	if fs == nil {
 		panic("nil fs")
 	}
-	if _, ok := fs.(*vfs.MemFS); !ok {
-		if _, ok := fs.(*vfs.ErrorFS); !ok {
-			panic("invalid fs")
-		}
+	switch fs.(type) {
+	case *vfs.MemFS, *vfs.ErrorFS, *vfs.FaultFS:
+	default:
+		panic("invalid fs")
 	}
 	return pebble.NewKVStore(config, callback, dir, wal, fs)
 }
@@ -114,16 +114,18 @@ func OpenShardedDB(config config.NodeHostConfig, cb config.LogDBCallback,
 	}
 	partitioner := server.NewDoubleFixedPartitioner(config.Expert.Engine.ExecShards,
 		config.Expert.LogDB.Shards)
+	// step workers dedicated to high priority shards have their own contexts
+	workers := config.Expert.Engine.ExecShards + config.Expert.Engine.PriorityShards
 	mw := &ShardedDB{
 		config:       config.Expert.LogDB,
 		shards:       shards,
-		ctxs:         make([]IContext, config.Expert.Engine.ExecShards),
+		ctxs:         make([]IContext, workers),
 		partitioner:  partitioner,
 		compactions:  newCompactions(),
 		compactionCh: make(chan struct{}, 1),
 		stopper:      syncutil.NewStopper(),
 	}
-	for i := uint64(0); i < config.Expert.Engine.ExecShards; i++ {
+	for i := uint64(0); i < workers; i++ {
 		mw.ctxs[i] = newContext(mw.config.SaveBufferSize, mw.config.MaxSaveBufferSize)
 	}
 	mw.stopper.RunWorker(func() {
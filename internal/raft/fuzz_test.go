@@ -0,0 +1,488 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/logger"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// The fuzz targets below drive a shard of raft instances using operations
+// decoded from the fuzzer generated input, e.g. message deliveries, drops,
+// ticks, proposals, config changes and restarts. Raft safety properties are
+// checked after every operation. Each operation is encoded in 4 bytes and
+// inputs longer than fuzzMaxSteps operations are rejected to keep every
+// execution, and thus input minimization, cheap. To fuzz, run
+//
+//   go test -run ^$ -fuzz FuzzRaft$ ./internal/raft
+
+const (
+	fuzzNodeCount    = 5
+	fuzzInitialNodes = 3
+	fuzzMaxSteps     = 256
+	fuzzStepSize     = 4
+	fuzzSeedSize     = 128
+)
+
+type fuzzOp uint8
+
+const (
+	fuzzTick fuzzOp = iota
+	fuzzTickAll
+	fuzzDeliver
+	fuzzDrop
+	fuzzPropose
+	fuzzLeaderTransfer
+	fuzzCrash
+	fuzzConfigChange
+)
+
+// fuzzOps maps op bytes to operations, message deliveries are more frequent
+// than other operations.
+var fuzzOps = [16]fuzzOp{
+	fuzzTick, fuzzTick, fuzzTickAll, fuzzTickAll,
+	fuzzDeliver, fuzzDeliver, fuzzDeliver, fuzzDeliver, fuzzDeliver,
+	fuzzDrop, fuzzPropose, fuzzPropose, fuzzLeaderTransfer, fuzzCrash,
+	fuzzConfigChange, fuzzConfigChange,
+}
+
+type fuzzNode struct {
+	id        uint64
+	logdb     *TestLogDB
+	peer      Peer
+	up        bool
+	salt      uint64
+	applied   uint64
+	committed uint64
+	// changed is the lowest log index appended since the last check
+	changed uint64
+	// checkedTerm and checked are the leader term and the index up to which
+	// committed entries have been found in the log of the leader
+	checkedTerm uint64
+	checked     uint64
+	members     map[uint64]bool
+	removed     map[uint64]bool
+}
+
+type committedEntry struct {
+	term uint64
+	// observed is the lowest term in which the entry is known to be committed
+	observed uint64
+}
+
+type fuzzStep struct {
+	op   fuzzOp
+	args []byte
+}
+
+type fuzzCluster struct {
+	t         testing.TB
+	config    config.Config
+	nodes     []*fuzzNode
+	msgs      []pb.Message
+	leaders   map[uint64]uint64
+	committed []committedEntry
+	applied   []pb.Entry
+	proposals uint64
+	steps     []fuzzStep
+	// matched is the length of the known matching log prefix of each pair of
+	// nodes
+	matched [fuzzNodeCount][fuzzNodeCount]uint64
+}
+
+func newFuzzCluster(t testing.TB, preVote bool, checkQuorum bool) *fuzzCluster {
+	c := &fuzzCluster{
+		t: t,
+		config: config.Config{
+			ShardID:      1,
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+			PreVote:      preVote,
+			CheckQuorum:  checkQuorum,
+		},
+		leaders: make(map[uint64]uint64),
+	}
+	for id := uint64(1); id <= fuzzNodeCount; id++ {
+		n := &fuzzNode{
+			id:      id,
+			logdb:   NewTestLogDB().(*TestLogDB),
+			changed: math.MaxUint64,
+		}
+		c.nodes = append(c.nodes, n)
+		c.launch(n, id <= fuzzInitialNodes, true)
+	}
+	return c
+}
+
+func (c *fuzzCluster) fatalf(format string, args ...interface{}) {
+	c.t.Helper()
+	for _, s := range c.steps {
+		c.t.Logf("%d %v", s.op, s.args)
+	}
+	c.t.Fatalf(format, args...)
+}
+
+func (c *fuzzCluster) noError(err error) {
+	c.t.Helper()
+	if err != nil {
+		c.fatalf("unexpected error %v", err)
+	}
+}
+
+func (c *fuzzCluster) node(b byte) *fuzzNode {
+	return c.nodes[int(b)%len(c.nodes)]
+}
+
+func (c *fuzzCluster) launch(n *fuzzNode, initial bool, newNode bool) {
+	cfg := c.config
+	cfg.ReplicaID = n.id
+	var addresses []PeerAddress
+	if initial && newNode {
+		for id := uint64(1); id <= fuzzInitialNodes; id++ {
+			addresses = append(addresses,
+				PeerAddress{ReplicaID: id, Address: fmt.Sprintf("a%d", id)})
+		}
+	}
+	n.peer = Launch(cfg, n.logdb, nil, addresses, initial, newNode)
+	n.up = true
+	n.applied = 0
+	n.committed = 0
+	n.members = make(map[uint64]bool)
+	n.removed = make(map[uint64]bool)
+	c.process(n)
+}
+
+// process persists and applies all updates of the node in the same way as
+// the node type in the dragonboat package.
+func (c *fuzzCluster) process(n *fuzzNode) {
+	for n.up && n.peer.HasUpdate(true) {
+		ud, err := n.peer.GetUpdate(true, n.applied)
+		c.noError(err)
+		c.noError(n.logdb.Append(ud.EntriesToSave))
+		if len(ud.EntriesToSave) > 0 && ud.EntriesToSave[0].Index < n.changed {
+			n.changed = ud.EntriesToSave[0].Index
+		}
+		if !pb.IsEmptyState(ud.State) {
+			n.logdb.SetState(ud.State)
+		}
+		c.msgs = append(c.msgs, ud.Messages...)
+		n.peer.Commit(ud)
+		for _, e := range ud.CommittedEntries {
+			c.apply(n, e)
+		}
+		n.peer.NotifyRaftLastApplied(n.applied)
+	}
+}
+
+func (c *fuzzCluster) apply(n *fuzzNode, e pb.Entry) {
+	if e.Index != n.applied+1 {
+		c.fatalf("%d applied %d after %d", n.id, e.Index, n.applied)
+	}
+	if e.Index <= uint64(len(c.applied)) {
+		prev := c.applied[e.Index-1]
+		if prev.Term != e.Term || prev.Type != e.Type || !bytes.Equal(prev.Cmd, e.Cmd) {
+			c.fatalf("%d applied %d term %d, applied term %d by others",
+				n.id, e.Index, e.Term, prev.Term)
+		}
+	} else {
+		c.applied = append(c.applied, e)
+	}
+	n.applied = e.Index
+	if e.Type == pb.ConfigChangeEntry {
+		c.applyConfigChange(n, e)
+	}
+}
+
+func (c *fuzzCluster) applyConfigChange(n *fuzzNode, e pb.Entry) {
+	var cc pb.ConfigChange
+	pb.MustUnmarshal(&cc, e.Cmd)
+	accepted := false
+	switch cc.Type {
+	case pb.AddNode:
+		accepted = !n.removed[cc.ReplicaID]
+		if accepted {
+			n.members[cc.ReplicaID] = true
+		}
+	case pb.RemoveNode:
+		accepted = n.members[cc.ReplicaID] && len(n.members) > 1
+		if accepted {
+			delete(n.members, cc.ReplicaID)
+			n.removed[cc.ReplicaID] = true
+		}
+	}
+	if accepted {
+		c.noError(n.peer.ApplyConfigChange(cc))
+	} else {
+		c.noError(n.peer.RejectConfigChange())
+	}
+}
+
+func (c *fuzzCluster) step(op fuzzOp, args []byte) {
+	switch op {
+	case fuzzTick:
+		if n := c.node(args[0]); n.up {
+			c.noError(n.peer.Tick())
+		}
+	case fuzzTickAll:
+		for _, n := range c.nodes {
+			if n.up {
+				c.noError(n.peer.Tick())
+			}
+		}
+	case fuzzDeliver, fuzzDrop:
+		if len(c.msgs) == 0 {
+			return
+		}
+		idx := int(args[0]) % len(c.msgs)
+		m := c.msgs[idx]
+		c.msgs = append(c.msgs[:idx], c.msgs[idx+1:]...)
+		if m.To == 0 || m.To > fuzzNodeCount {
+			return
+		}
+		if op == fuzzDeliver {
+			if n := c.nodes[m.To-1]; n.up {
+				c.noError(n.peer.Handle(m))
+			}
+		} else if m.Type == pb.Replicate {
+			if n := c.nodes[m.From-1]; n.up {
+				c.noError(n.peer.ReportUnreachableNode(m.To))
+			}
+		}
+	case fuzzPropose:
+		if n := c.node(args[0]); n.up {
+			c.proposals++
+			cmd := make([]byte, 8)
+			binary.BigEndian.PutUint64(cmd, c.proposals)
+			c.noError(n.peer.ProposeEntries([]pb.Entry{{Key: c.proposals, Cmd: cmd}}))
+		}
+	case fuzzLeaderTransfer:
+		if n := c.node(args[0]); n.up {
+			c.noError(n.peer.RequestLeaderTransfer(c.node(args[1]).id))
+		}
+	case fuzzCrash:
+		if n := c.node(args[0]); n.up {
+			n.up = false
+		} else {
+			c.launch(n, false, false)
+		}
+	case fuzzConfigChange:
+		if n := c.node(args[0]); n.up {
+			cc := pb.ConfigChange{
+				Type:      pb.AddNode,
+				ReplicaID: c.node(args[1]).id,
+			}
+			if args[2]%2 == 1 {
+				cc.Type = pb.RemoveNode
+			} else {
+				cc.Address = fmt.Sprintf("a%d", cc.ReplicaID)
+			}
+			c.proposals++
+			c.noError(n.peer.ProposeConfigChange(cc, c.proposals))
+		}
+	default:
+		panic("unknown op")
+	}
+	for _, n := range c.nodes {
+		c.process(n)
+		if n.up {
+			// the randomized election timeout is derived from the input to make
+			// the result reproducible
+			r := n.peer.raft
+			r.randomizedElectionTimeout = r.electionTimeout +
+				(n.salt+r.term*7)%r.electionTimeout
+		}
+	}
+	c.check()
+}
+
+func (c *fuzzCluster) term(n *fuzzNode, index uint64) uint64 {
+	t, err := n.peer.raft.log.term(index)
+	c.noError(err)
+	return t
+}
+
+// check checks that there is at most one leader in each term, committed
+// entries are never changed and are present in logs of all later leaders, and
+// logs satisfy the log matching property. Only entries committed or appended
+// since the last check are examined.
+func (c *fuzzCluster) check() {
+	lowered := uint64(math.MaxUint64)
+	for _, n := range c.nodes {
+		if !n.up {
+			continue
+		}
+		r := n.peer.raft
+		if r.isLeader() {
+			if leader, ok := c.leaders[r.term]; ok && leader != n.id {
+				c.fatalf("%d and %d are both leaders in term %d", leader, n.id, r.term)
+			}
+			c.leaders[r.term] = n.id
+		}
+		for index := n.committed + 1; index <= r.log.committed; index++ {
+			term := c.term(n, index)
+			if index <= uint64(len(c.committed)) {
+				ce := &c.committed[index-1]
+				if ce.term != term {
+					c.fatalf("%d committed %d term %d, committed term %d by others",
+						n.id, index, term, ce.term)
+				}
+				if r.term < ce.observed {
+					ce.observed = r.term
+					if index < lowered {
+						lowered = index
+					}
+				}
+			} else {
+				c.committed = append(c.committed,
+					committedEntry{term: term, observed: r.term})
+			}
+		}
+		n.committed = r.log.committed
+	}
+	for _, n := range c.nodes {
+		if !n.up || !n.peer.raft.isLeader() {
+			continue
+		}
+		c.checkLeaderLog(n, lowered)
+	}
+	for i := 0; i < len(c.nodes); i++ {
+		for j := i + 1; j < len(c.nodes); j++ {
+			c.checkLogMatching(c.nodes[i], c.nodes[j])
+		}
+	}
+	for _, n := range c.nodes {
+		n.changed = math.MaxUint64
+	}
+}
+
+// checkLeaderLog checks that the leader has all entries committed in earlier
+// terms. Entries already found in the log of the leader in its current term
+// are skipped unless they have since been observed as committed in an earlier
+// term, a leader never overwrites its own log entries.
+func (c *fuzzCluster) checkLeaderLog(n *fuzzNode, lowered uint64) {
+	r := n.peer.raft
+	if n.checkedTerm != r.term {
+		n.checkedTerm = r.term
+		n.checked = 0
+	}
+	if lowered <= n.checked {
+		n.checked = lowered - 1
+	}
+	for index := n.checked + 1; index <= uint64(len(c.committed)); index++ {
+		ce := c.committed[index-1]
+		if ce.observed < r.term &&
+			(index > r.log.lastIndex() || c.term(n, index) != ce.term) {
+			c.fatalf("leader %d term %d missing committed entry %d term %d",
+				n.id, r.term, index, ce.term)
+		}
+	}
+	n.checked = uint64(len(c.committed))
+}
+
+// checkLogMatching checks that logs of the two nodes stop matching at the
+// first mismatched index. The matching prefix found in earlier checks is only
+// rescanned from the lowest index appended to either log since then.
+func (c *fuzzCluster) checkLogMatching(n1 *fuzzNode, n2 *fuzzNode) {
+	matched := &c.matched[n1.id-1][n2.id-1]
+	if changed := n1.changed; changed <= *matched {
+		*matched = changed - 1
+	}
+	if changed := n2.changed; changed <= *matched {
+		*matched = changed - 1
+	}
+	if !n1.up || !n2.up {
+		return
+	}
+	last := n1.peer.raft.log.lastIndex()
+	if l := n2.peer.raft.log.lastIndex(); l < last {
+		last = l
+	}
+	mismatch := uint64(0)
+	for index := *matched + 1; index <= last; index++ {
+		t1, t2 := c.term(n1, index), c.term(n2, index)
+		if t1 != t2 {
+			if mismatch == 0 {
+				mismatch = index
+			}
+		} else if mismatch != 0 {
+			c.fatalf("%d and %d have matching entry %d term %d, mismatch at %d",
+				n1.id, n2.id, index, t1, mismatch)
+		}
+	}
+	if mismatch != 0 {
+		*matched = mismatch - 1
+	} else if last > *matched {
+		*matched = last
+	}
+}
+
+func runFuzzCluster(t testing.TB, data []byte, configChange bool) {
+	if len(data) < fuzzNodeCount+1 ||
+		len(data) > fuzzNodeCount+1+fuzzMaxSteps*fuzzStepSize {
+		return
+	}
+	c := newFuzzCluster(t, data[0]&1 == 1, data[0]&2 == 2)
+	for idx, n := range c.nodes {
+		n.salt = uint64(data[idx+1])
+	}
+	data = data[fuzzNodeCount+1:]
+	for ; len(data) >= fuzzStepSize; data = data[fuzzStepSize:] {
+		op := fuzzOps[data[0]%uint8(len(fuzzOps))]
+		if op == fuzzConfigChange && !configChange {
+			op = fuzzDeliver
+		}
+		args := data[1:fuzzStepSize]
+		c.steps = append(c.steps, fuzzStep{op: op, args: args})
+		c.step(op, args)
+	}
+}
+
+func addFuzzSeeds(f *testing.F) {
+	rng := rand.New(rand.NewSource(0))
+	for i := 0; i < 16; i++ {
+		data := make([]byte, fuzzSeedSize)
+		rng.Read(data)
+		f.Add(data)
+	}
+}
+
+func FuzzRaft(f *testing.F) {
+	plog.SetLevel(logger.WARNING)
+	defer plog.SetLevel(logger.INFO)
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		runFuzzCluster(t, data, false)
+	})
+}
+
+func FuzzRaftConfigChange(f *testing.F) {
+	plog.SetLevel(logger.WARNING)
+	defer plog.SetLevel(logger.INFO)
+	addFuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		runFuzzCluster(t, data, true)
+	})
+}
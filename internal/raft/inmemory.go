@@ -243,5 +243,5 @@ func (im *inMemory) restore(ss pb.Snapshot) {
 }
 
 func (im *inMemory) rateLimited() bool {
-	return im.rl != nil && im.rl.Enabled()
+	return im.rl != nil && im.rl.Tracked()
 }
@@ -42,6 +42,8 @@ package raft
 import (
 	"sort"
 
+	"github.com/lni/goutils/random"
+
 	"github.com/lni/dragonboat/v4/config"
 	"github.com/lni/dragonboat/v4/internal/server"
 	pb "github.com/lni/dragonboat/v4/raftpb"
@@ -249,6 +251,38 @@ func (p *Peer) RateLimited() bool {
 	return p.raft.rl.RateLimited()
 }
 
+// SetMemoryBudget sets the NodeHost wide memory budget used for tracking the
+// in memory log size.
+func (p *Peer) SetMemoryBudget(b *server.MemoryBudget) {
+	p.raft.rl.SetMemoryBudget(b)
+}
+
+// SetDeploymentID sets the deployment ID of the Raft node. It is used for
+// telling apart shards with the same shard ID in unrelated deployments when
+// Raft safety checks are enabled.
+func (p *Peer) SetDeploymentID(deploymentID uint64) {
+	p.raft.deploymentID = deploymentID
+}
+
+// SetRandomSource sets the random source used for randomizing the election
+// timeout. It allows the Raft node to make the same decisions when replayed in
+// simulation tests.
+func (p *Peer) SetRandomSource(rng random.Source) {
+	p.raft.rng = rng
+	p.raft.setRandomizedElectionTimeout()
+}
+
+// RemoteStatus returns the replication status of remote replicas when the
+// local replica is the leader, nil is returned otherwise.
+func (p *Peer) RemoteStatus() map[uint64]RemoteStatus {
+	return getRemoteStatus(p.raft)
+}
+
+// InMemLogSize returns the tracked in memory log size in bytes.
+func (p *Peer) InMemLogSize() uint64 {
+	return p.raft.rl.Get()
+}
+
 // HasUpdate returns a boolean value indicating whether there is any Update
 // ready to be processed.
 func (p *Peer) HasUpdate(moreToApply bool) bool {
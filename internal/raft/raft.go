@@ -31,6 +31,7 @@ import (
 	"github.com/lni/goutils/random"
 
 	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/invariants"
 	"github.com/lni/dragonboat/v4/internal/server"
 	"github.com/lni/dragonboat/v4/internal/settings"
 	"github.com/lni/dragonboat/v4/logger"
@@ -116,6 +117,40 @@ func (s *Status) IsFollower() bool {
 	return s.NodeState == follower
 }
 
+// RemoteStatus is the replication status of a remote replica as tracked by
+// the leader.
+type RemoteStatus struct {
+	Match         uint64
+	Next          uint64
+	InflightBytes uint64
+	Paused        bool
+}
+
+// getRemoteStatus returns the replication status of all remote replicas, nil
+// is returned when the local replica is not the leader.
+func getRemoteStatus(r *raft) map[uint64]RemoteStatus {
+	if r.state != leader {
+		return nil
+	}
+	result := make(map[uint64]RemoteStatus)
+	add := func(remotes map[uint64]*remote) {
+		for replicaID, rp := range remotes {
+			if replicaID != r.replicaID {
+				result[replicaID] = RemoteStatus{
+					Match:         rp.match,
+					Next:          rp.next,
+					InflightBytes: rp.inflights.bytes,
+					Paused:        rp.isPaused(),
+				}
+			}
+		}
+	}
+	add(r.remotes)
+	add(r.nonVotings)
+	add(r.witnesses)
+	return result
+}
+
 // getLocalStatus gets a copy of the current raft status.
 func getLocalStatus(r *raft) Status {
 	return Status{
@@ -210,6 +245,7 @@ type raft struct {
 	logQueryResult            *pb.LogQueryResult
 	leaderUpdate              *pb.LeaderUpdate
 	readIndex                 *readIndex
+	rng                       random.Source
 	matched                   []uint64
 	msgs                      []pb.Message
 	droppedReadIndexes        []pb.SystemCtx
@@ -219,6 +255,7 @@ type raft struct {
 	state                     State
 	leaderTransferTarget      uint64
 	leaderID                  uint64
+	deploymentID              uint64
 	shardID                   uint64
 	replicaID                 uint64
 	term                      uint64
@@ -230,6 +267,7 @@ type raft struct {
 	heartbeatTimeout          uint64
 	electionTimeout           uint64
 	randomizedElectionTimeout uint64
+	maxInflightBytes          uint64
 	snapshotting              bool
 	checkQuorum               bool
 	quiesce                   bool
@@ -261,7 +299,9 @@ func newRaft(c config.Config, logdb ILogDB) *raft {
 		checkQuorum:      c.CheckQuorum,
 		preVote:          c.PreVote,
 		readIndex:        newReadIndex(),
+		rng:              random.LockGuardedRand,
 		rl:               rl,
+		maxInflightBytes: c.MaxInflightBytes,
 	}
 	plog.Infof("%s raft log rate limit enabled: %t, %d",
 		dn(r.shardID, r.replicaID), r.rl.Enabled(), c.MaxInMemLogSize)
@@ -656,7 +696,7 @@ func (r *raft) quiescedTick() {
 }
 
 func (r *raft) setRandomizedElectionTimeout() {
-	randTime := random.LockGuardedRand.Uint64() % r.electionTimeout
+	randTime := r.rng.Uint64() % r.electionTimeout
 	r.randomizedElectionTimeout = r.electionTimeout + randTime
 }
 
@@ -799,7 +839,11 @@ func (r *raft) sendReplicateMessage(to uint64) {
 	if rp.isPaused() {
 		return
 	}
-	m, err := r.makeReplicateMessage(to, rp.next, maxEntrySize)
+	maxSize := maxEntrySize
+	if rp.state == remoteReplicate {
+		maxSize = rp.inflights.available(maxEntrySize)
+	}
+	m, err := r.makeReplicateMessage(to, rp.next, maxSize)
 	if err != nil {
 		// log not available due to compaction, send snapshot
 		if !rp.isActive() {
@@ -813,7 +857,7 @@ func (r *raft) sendReplicateMessage(to uint64) {
 		rp.becomeSnapshot(index)
 	} else if len(m.Entries) > 0 {
 		lastIndex := m.Entries[len(m.Entries)-1].Index
-		rp.progress(lastIndex)
+		rp.sent(lastIndex, getEntrySliceSize(m.Entries))
 	}
 	r.send(m)
 }
@@ -1038,6 +1082,9 @@ func (r *raft) becomeLeader() error {
 	r.setLeaderID(r.replicaID)
 	r.preLeaderPromotionHandleConfigChange()
 	plog.Infof("%s became leader", r.describe())
+	if invariants.SafetyCheck {
+		r.checkLeaderSafety()
+	}
 	// p72 of the raft thesis
 	return r.appendEntries([]pb.Entry{{Type: pb.ApplicationEntry, Cmd: nil}})
 }
@@ -1081,7 +1128,8 @@ func (r *raft) preLeaderPromotionHandleConfigChange() {
 func (r *raft) resetRemotes() {
 	for id := range r.remotes {
 		r.remotes[id] = &remote{
-			next: r.log.lastIndex() + 1,
+			next:      r.log.lastIndex() + 1,
+			inflights: newInflights(r.maxInflightBytes),
 		}
 		if id == r.replicaID {
 			r.remotes[id].match = r.log.lastIndex()
@@ -1092,7 +1140,8 @@ func (r *raft) resetRemotes() {
 func (r *raft) resetNonVotings() {
 	for id := range r.nonVotings {
 		r.nonVotings[id] = &remote{
-			next: r.log.lastIndex() + 1,
+			next:      r.log.lastIndex() + 1,
+			inflights: newInflights(r.maxInflightBytes),
 		}
 		if id == r.replicaID {
 			r.nonVotings[id].match = r.log.lastIndex()
@@ -1103,7 +1152,8 @@ func (r *raft) resetNonVotings() {
 func (r *raft) resetWitnesses() {
 	for id := range r.witnesses {
 		r.witnesses[id] = &remote{
-			next: r.log.lastIndex() + 1,
+			next:      r.log.lastIndex() + 1,
+			inflights: newInflights(r.maxInflightBytes),
 		}
 		if id == r.replicaID {
 			r.witnesses[id].match = r.log.lastIndex()
@@ -1311,8 +1361,9 @@ func (r *raft) setRemote(replicaID uint64, match uint64, next uint64) {
 	plog.Debugf("%s set remote %s, match %d, next %d",
 		r.describe(), ReplicaID(replicaID), match, next)
 	r.remotes[replicaID] = &remote{
-		next:  next,
-		match: match,
+		next:      next,
+		match:     match,
+		inflights: newInflights(r.maxInflightBytes),
 	}
 }
 
@@ -1320,8 +1371,9 @@ func (r *raft) setNonVoting(replicaID uint64, match uint64, next uint64) {
 	plog.Debugf("%s set nonVoting %s, match %d, next %d",
 		r.describe(), ReplicaID(replicaID), match, next)
 	r.nonVotings[replicaID] = &remote{
-		next:  next,
-		match: match,
+		next:      next,
+		match:     match,
+		inflights: newInflights(r.maxInflightBytes),
 	}
 }
 
@@ -1329,8 +1381,9 @@ func (r *raft) setWitness(replicaID uint64, match uint64, next uint64) {
 	plog.Debugf("%s set witness %s, match %d, next %d",
 		r.describe(), ReplicaID(replicaID), match, next)
 	r.witnesses[replicaID] = &remote{
-		next:  next,
-		match: match,
+		next:      next,
+		match:     match,
+		inflights: newInflights(r.maxInflightBytes),
 	}
 }
 
@@ -1456,6 +1509,9 @@ func (r *raft) handleReplicateMessage(m pb.Message) error {
 		if _, err := r.log.tryAppend(m.LogIndex, m.Entries); err != nil {
 			return err
 		}
+		if invariants.SafetyCheck {
+			r.checkReplicateSafety(m)
+		}
 		lastIdx := m.LogIndex + uint64(len(m.Entries))
 		r.log.commitTo(min(lastIdx, m.Commit))
 		resp.LogIndex = lastIdx
@@ -1594,6 +1650,9 @@ func (r *raft) Handle(m pb.Message) error {
 	if r.inconsistentRaftConfig(m) {
 		panic("received preVote message when preVote is not enabled")
 	}
+	if invariants.SafetyCheck {
+		defer r.checkCommitSafety(r.log.committed)
+	}
 	if !r.onMessageTermNotMatched(m) {
 		if !isPreVoteMessage(m.Type) {
 			r.doubleCheckTermMatched(m.Term)
@@ -1914,6 +1973,11 @@ func (r *raft) handleLeaderHeartbeatResp(m pb.Message, rp *remote) error {
 	r.mustBeLeader()
 	rp.setActive()
 	rp.waitToRetry()
+	if rp.state == remoteReplicate && rp.inflights.full() {
+		// in-flight Replicate messages might have been dropped, free a slot so
+		// the replication can make progress
+		rp.inflights.freeFirst()
+	}
 	if rp.match < r.log.lastIndex() {
 		r.sendReplicateMessage(m.From)
 	}
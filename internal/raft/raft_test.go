@@ -3453,3 +3453,74 @@ func TestSetLeaderIDWillSetLeaderInfo(t *testing.T) {
 	assert.Equal(t, uint64(100), r.leaderID)
 	assert.Equal(t, &pb.LeaderUpdate{LeaderID: 100, Term: 200}, r.leaderUpdate)
 }
+
+func TestReplicationIsLimitedByInflightBytes(t *testing.T) {
+	cfg := newTestConfig(1, 5, 1)
+	cfg.MaxInflightBytes = 2048
+	r := newRaft(cfg, NewTestLogDB())
+	r.setTestPeers([]uint64{1, 2})
+	r.hasNotAppliedConfigChange = r.testOnlyHasConfigChangeToApply
+	r.becomeCandidate()
+	ne(r.becomeLeader(), t)
+	rp := r.remotes[2]
+	rp.becomeReplicate()
+	r.readMessages()
+	for i := 0; i < 4; i++ {
+		ne(r.Handle(pb.Message{
+			From:    1,
+			To:      1,
+			Type:    pb.Propose,
+			Entries: []pb.Entry{{Cmd: make([]byte, 1024)}},
+		}), t)
+	}
+	msgs := r.readMessages()
+	if len(msgs) != 2 {
+		t.Fatalf("got %d msgs, want 2", len(msgs))
+	}
+	if !rp.isPaused() || !rp.inflights.full() {
+		t.Fatalf("replication not paused")
+	}
+	total := getEntrySliceSize(msgs[0].Entries) + getEntrySliceSize(msgs[1].Entries)
+	status := getRemoteStatus(r)[2]
+	if !status.Paused || status.InflightBytes != total {
+		t.Errorf("unexpected status %+v, want %d in-flight bytes", status, total)
+	}
+	last := msgs[0].Entries[len(msgs[0].Entries)-1].Index
+	ne(r.Handle(pb.Message{
+		From:     2,
+		To:       1,
+		Type:     pb.ReplicateResp,
+		LogIndex: last,
+	}), t)
+	if rp.inflights.bytes >= total {
+		t.Errorf("in-flight bytes not released")
+	}
+	msgs = r.readMessages()
+	if len(msgs) == 0 || msgs[0].Type != pb.Replicate ||
+		msgs[0].LogIndex <= last {
+		t.Errorf("replication not resumed, %v", msgs)
+	}
+}
+
+func TestHeartbeatRespFreesFullInflightWindow(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2}, 5, 1, NewTestLogDB())
+	r.becomeCandidate()
+	ne(r.becomeLeader(), t)
+	rp := r.remotes[2]
+	rp.becomeReplicate()
+	rp.inflights = newInflights(100)
+	rp.inflights.add(10, 60)
+	rp.inflights.add(11, 60)
+	if !rp.isPaused() {
+		t.Fatalf("not paused")
+	}
+	r.readMessages()
+	ne(r.Handle(pb.Message{From: 2, To: 1, Type: pb.HeartbeatResp}), t)
+	if len(rp.inflights.indexes) == 0 || rp.inflights.indexes[0] != 11 {
+		t.Errorf("in-flight window not freed, %v", rp.inflights.indexes)
+	}
+	msgs := r.readMessages()
+	if len(msgs) != 1 || msgs[0].Type != pb.Replicate {
+		t.Errorf("replication not resumed, %v", msgs)
+	}
+}
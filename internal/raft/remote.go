@@ -49,6 +49,76 @@ func (a *snapshotAck) tick() bool {
 	return false
 }
 
+// inflights tracks Replicate messages sent to a remote in the Replicate state
+// that have not been acknowledged yet. It implements a byte based sliding
+// window to limit the total size of in-flight entries.
+type inflights struct {
+	// limit is the max total size of in-flight entries, 0 means unlimited
+	limit uint64
+	bytes uint64
+	// last index and total entry size of each in-flight Replicate message
+	indexes []uint64
+	sizes   []uint64
+}
+
+func newInflights(limit uint64) inflights {
+	return inflights{limit: limit}
+}
+
+func (in *inflights) full() bool {
+	return in.limit > 0 && in.bytes >= in.limit
+}
+
+// available returns the max size of entries that can be sent next, it is
+// capped by the specified maxSize.
+func (in *inflights) available(maxSize uint64) uint64 {
+	if in.limit == 0 || in.bytes >= in.limit {
+		return maxSize
+	}
+	return min(maxSize, in.limit-in.bytes)
+}
+
+func (in *inflights) add(lastIndex uint64, size uint64) {
+	if in.limit == 0 {
+		return
+	}
+	in.indexes = append(in.indexes, lastIndex)
+	in.sizes = append(in.sizes, size)
+	in.bytes += size
+}
+
+// freeTo frees all in-flight messages with last index <= index.
+func (in *inflights) freeTo(index uint64) {
+	i := 0
+	for ; i < len(in.indexes) && in.indexes[i] <= index; i++ {
+		in.bytes -= in.sizes[i]
+	}
+	in.shift(i)
+}
+
+func (in *inflights) freeFirst() {
+	if len(in.indexes) > 0 {
+		in.bytes -= in.sizes[0]
+		in.shift(1)
+	}
+}
+
+func (in *inflights) shift(count int) {
+	if count == 0 {
+		return
+	}
+	n := copy(in.indexes, in.indexes[count:])
+	in.indexes = in.indexes[:n]
+	copy(in.sizes, in.sizes[count:])
+	in.sizes = in.sizes[:n]
+}
+
+func (in *inflights) reset() {
+	in.bytes = 0
+	in.indexes = in.indexes[:0]
+	in.sizes = in.sizes[:0]
+}
+
 type remoteStateType uint64
 
 const (
@@ -77,11 +147,12 @@ type remote struct {
 	state         remoteStateType
 	active        bool
 	delayed       snapshotAck
+	inflights     inflights
 }
 
 func (r *remote) String() string {
-	return fmt.Sprintf("match:%d,next:%d,state:%s,si:%d",
-		r.match, r.next, r.state, r.snapshotIndex)
+	return fmt.Sprintf("match:%d,next:%d,state:%s,si:%d,inflight:%d",
+		r.match, r.next, r.state, r.snapshotIndex, r.inflights.bytes)
 }
 
 func (r *remote) clearSnapshotAck() {
@@ -98,6 +169,7 @@ func (r *remote) setSnapshotAck(tick uint64, rejected bool) {
 
 func (r *remote) reset() {
 	r.snapshotIndex = 0
+	r.inflights.reset()
 }
 
 func (r *remote) becomeRetry() {
@@ -151,6 +223,7 @@ func (r *remote) tryUpdate(index uint64) bool {
 	if r.match < index {
 		r.waitToRetry()
 		r.match = index
+		r.inflights.freeTo(index)
 		return true
 	}
 	return false
@@ -166,6 +239,15 @@ func (r *remote) progress(lastIndex uint64) {
 	}
 }
 
+// sent records that a Replicate message with entries up to lastIndex and a
+// total entry size of size bytes has been sent to the remote.
+func (r *remote) sent(lastIndex uint64, size uint64) {
+	r.progress(lastIndex)
+	if r.state == remoteReplicate {
+		r.inflights.add(lastIndex, size)
+	}
+}
+
 func (r *remote) respondedTo() {
 	if r.state == remoteRetry {
 		r.becomeReplicate()
@@ -201,7 +283,7 @@ func (r *remote) isPaused() bool {
 	case remoteWait:
 		return true
 	case remoteReplicate:
-		return false
+		return r.inflights.full()
 	case remoteSnapshot:
 		return true
 	default:
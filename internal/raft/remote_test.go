@@ -372,3 +372,49 @@ func TestRemoteTryUpdateCauseResume(t *testing.T) {
 		t.Errorf("still paused")
 	}
 }
+
+func TestInflightsAreTrackedInBytes(t *testing.T) {
+	in := newInflights(100)
+	if in.available(1000) != 100 {
+		t.Errorf("unexpected available size %d", in.available(1000))
+	}
+	in.add(1, 30)
+	in.add(3, 30)
+	in.add(5, 50)
+	if !in.full() || in.bytes != 110 {
+		t.Errorf("unexpected state, %d", in.bytes)
+	}
+	in.freeTo(3)
+	if in.full() || in.bytes != 50 || len(in.indexes) != 1 {
+		t.Errorf("unexpected state, %d", in.bytes)
+	}
+	if in.available(1000) != 50 || in.available(10) != 10 {
+		t.Errorf("unexpected available size")
+	}
+	in.freeFirst()
+	if in.bytes != 0 || len(in.indexes) != 0 || len(in.sizes) != 0 {
+		t.Errorf("unexpected state, %d", in.bytes)
+	}
+	disabled := newInflights(0)
+	disabled.add(1, 1000)
+	if disabled.full() || disabled.bytes != 0 {
+		t.Errorf("disabled inflights tracked entries")
+	}
+}
+
+func TestRemoteInReplicateStateIsPausedWhenInflightsAreFull(t *testing.T) {
+	r := &remote{state: remoteReplicate, match: 1, next: 2,
+		inflights: newInflights(100)}
+	r.sent(5, 100)
+	if r.next != 6 || !r.isPaused() {
+		t.Errorf("remote not paused")
+	}
+	if !r.tryUpdate(5) || r.isPaused() || r.inflights.bytes != 0 {
+		t.Errorf("in-flight bytes not released")
+	}
+	r.sent(8, 100)
+	r.becomeRetry()
+	if r.inflights.bytes != 0 {
+		t.Errorf("in-flight bytes not reset")
+	}
+}
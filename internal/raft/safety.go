@@ -0,0 +1,232 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/invariants"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// safety is the process wide safety checker used when dragonboat is built
+// with the dragonboat_invariants tag. Shards are identified by their
+// deployment IDs and shard IDs, so NodeHost instances of unrelated
+// deployments in the same process never share any recorded state.
+var safety = newSafetyChecker()
+
+// RetainSafetyCheck starts asserting Raft safety properties across all
+// replicas in the process. It is called by each NodeHost when it is created
+// and is a no-op unless built with the dragonboat_invariants tag.
+func RetainSafetyCheck() {
+	if invariants.SafetyCheck {
+		safety.retain()
+	}
+}
+
+// ReleaseSafetyCheck is called by each NodeHost when it is closed, observed
+// leaders and committed entries are discarded once all NodeHost instances in
+// the process are closed.
+func ReleaseSafetyCheck() {
+	if invariants.SafetyCheck {
+		safety.release()
+	}
+}
+
+type shardKey struct {
+	deploymentID uint64
+	shardID      uint64
+}
+
+type leaderKey struct {
+	shardKey
+	term uint64
+}
+
+// termRange is a range of committed entries with the same term.
+type termRange struct {
+	first uint64
+	last  uint64
+	term  uint64
+}
+
+// safetyChecker records leaders and committed entries observed by replicas,
+// they are used for checking that there is at most one leader in each term
+// and committed entries are never changed.
+type safetyChecker struct {
+	mu        sync.Mutex
+	refs      int
+	leaders   map[leaderKey]uint64
+	committed map[shardKey][]termRange
+}
+
+func newSafetyChecker() *safetyChecker {
+	return &safetyChecker{
+		leaders:   make(map[leaderKey]uint64),
+		committed: make(map[shardKey][]termRange),
+	}
+}
+
+func (c *safetyChecker) retain() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refs++
+}
+
+func (c *safetyChecker) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refs--
+	if c.refs == 0 {
+		c.leaders = make(map[leaderKey]uint64)
+		c.committed = make(map[shardKey][]termRange)
+	}
+}
+
+func (c *safetyChecker) leaderElected(shard shardKey,
+	term uint64, replicaID uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.refs == 0 {
+		return nil
+	}
+	key := leaderKey{shardKey: shard, term: term}
+	if leader, ok := c.leaders[key]; ok && leader != replicaID {
+		return errors.Newf("%s and %s both elected as leader in term %d",
+			ReplicaID(leader), ReplicaID(replicaID), term)
+	}
+	c.leaders[key] = replicaID
+	return nil
+}
+
+// commit records that the entry with the specified index and term has been
+// committed.
+func (c *safetyChecker) commit(shard shardKey,
+	index uint64, term uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.refs == 0 {
+		return nil
+	}
+	ranges := c.committed[shard]
+	i := sort.Search(len(ranges), func(i int) bool {
+		return ranges[i].last >= index
+	})
+	if i < len(ranges) && ranges[i].first <= index {
+		if ranges[i].term != term {
+			return errors.Newf("entry %d committed in term %d and term %d",
+				index, ranges[i].term, term)
+		}
+		return nil
+	}
+	if i > 0 && ranges[i-1].term > term {
+		return errors.Newf("entry %d committed in term %d, entry %d in term %d",
+			ranges[i-1].last, ranges[i-1].term, index, term)
+	}
+	if i < len(ranges) && ranges[i].term < term {
+		return errors.Newf("entry %d committed in term %d, entry %d in term %d",
+			index, term, ranges[i].first, ranges[i].term)
+	}
+	if i > 0 && ranges[i-1].last+1 == index && ranges[i-1].term == term {
+		ranges[i-1].last = index
+		if i < len(ranges) &&
+			ranges[i].first == index+1 && ranges[i].term == term {
+			ranges[i-1].last = ranges[i].last
+			ranges = append(ranges[:i], ranges[i+1:]...)
+		}
+	} else if i < len(ranges) &&
+		ranges[i].first == index+1 && ranges[i].term == term {
+		ranges[i].first = index
+	} else {
+		ranges = append(ranges, termRange{})
+		copy(ranges[i+1:], ranges[i:])
+		ranges[i] = termRange{first: index, last: index, term: term}
+	}
+	c.committed[shard] = ranges
+	return nil
+}
+
+// checkEntry checks whether the specified entry conflicts with a committed
+// entry.
+func (c *safetyChecker) checkEntry(shard shardKey, e pb.Entry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ranges := c.committed[shard]
+	i := sort.Search(len(ranges), func(i int) bool {
+		return ranges[i].last >= e.Index
+	})
+	if i < len(ranges) && ranges[i].first <= e.Index && ranges[i].term != e.Term {
+		return errors.Newf("committed entry %d term %d overwritten by term %d",
+			e.Index, ranges[i].term, e.Term)
+	}
+	return nil
+}
+
+func (r *raft) safetyKey() shardKey {
+	return shardKey{deploymentID: r.deploymentID, shardID: r.shardID}
+}
+
+func (r *raft) mustBeSafe(err error) {
+	if err != nil {
+		plog.Panicf("%s violated raft safety, %v", r.describe(), err)
+	}
+}
+
+func (r *raft) checkLeaderSafety() {
+	r.mustBeSafe(safety.leaderElected(r.safetyKey(), r.term, r.replicaID))
+}
+
+// checkCommitSafety records entries committed since the committed index was
+// prev and checks them against entries committed by other replicas.
+func (r *raft) checkCommitSafety(prev uint64) {
+	index := prev + 1
+	if fi := r.log.firstIndex(); index+1 < fi {
+		index = fi - 1
+	}
+	for ; index <= r.log.committed; index++ {
+		term, err := r.log.term(index)
+		if errors.Is(err, ErrCompacted) || errors.Is(err, ErrUnavailable) {
+			continue
+		}
+		if err != nil {
+			plog.Panicf("%s failed to get term of %d, %v", r.describe(), index, err)
+		}
+		r.mustBeSafe(safety.commit(r.safetyKey(), index, term))
+	}
+}
+
+// checkReplicateSafety checks the log matching property and that committed
+// entries are not overwritten after entries in the Replicate message have
+// been appended.
+func (r *raft) checkReplicateSafety(m pb.Message) {
+	for _, e := range m.Entries {
+		term, err := r.log.term(e.Index)
+		if errors.Is(err, ErrCompacted) || errors.Is(err, ErrUnavailable) {
+			continue
+		}
+		if err != nil {
+			plog.Panicf("%s failed to get term of %d, %v", r.describe(), e.Index, err)
+		}
+		if term != e.Term {
+			plog.Panicf("%s violated log matching, entry %d term %d, replicated "+
+				"term %d from %s, log index %d, log term %d", r.describe(),
+				e.Index, term, e.Term, ReplicaID(m.From), m.LogIndex, m.LogTerm)
+		}
+		r.mustBeSafe(safety.checkEntry(r.safetyKey(), e))
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"reflect"
+	"testing"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func TestSafetyCheckerIsDisabledWhenNotRetained(t *testing.T) {
+	c := newSafetyChecker()
+	if err := c.leaderElected(shardKey{shardID: 1}, 2, 1); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := c.leaderElected(shardKey{shardID: 1}, 2, 2); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	c.retain()
+	if err := c.leaderElected(shardKey{shardID: 1}, 2, 1); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	c.release()
+	if len(c.leaders) != 0 {
+		t.Errorf("leaders not cleared")
+	}
+}
+
+func TestSafetyCheckerDetectsMultipleLeadersInTerm(t *testing.T) {
+	c := newSafetyChecker()
+	c.retain()
+	if err := c.leaderElected(shardKey{shardID: 1}, 2, 1); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := c.leaderElected(shardKey{shardID: 1}, 2, 1); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := c.leaderElected(shardKey{shardID: 1}, 3, 2); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := c.leaderElected(shardKey{shardID: 2}, 2, 2); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := c.leaderElected(shardKey{shardID: 1}, 2, 3); err == nil {
+		t.Fatalf("two leaders in term 2 not reported")
+	}
+}
+
+func TestSafetyCheckerSeparatesDeployments(t *testing.T) {
+	c := newSafetyChecker()
+	c.retain()
+	s1 := shardKey{deploymentID: 1, shardID: 1}
+	s2 := shardKey{deploymentID: 2, shardID: 1}
+	if err := c.leaderElected(s1, 2, 1); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := c.leaderElected(s2, 2, 2); err != nil {
+		t.Fatalf("leaders of different deployments reported, %v", err)
+	}
+	if err := c.commit(s1, 1, 2); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := c.commit(s2, 1, 3); err != nil {
+		t.Fatalf("entries of different deployments reported, %v", err)
+	}
+	if err := c.checkEntry(s2, pb.Entry{Index: 1, Term: 2}); err == nil {
+		t.Errorf("overwritten committed entry not reported")
+	}
+}
+
+func TestSafetyCheckerRecordsCommittedTerms(t *testing.T) {
+	c := newSafetyChecker()
+	c.retain()
+	commits := []struct {
+		index uint64
+		term  uint64
+	}{{1, 1}, {2, 1}, {5, 2}, {3, 1}, {2, 1}, {4, 2}, {8, 3}}
+	for _, v := range commits {
+		if err := c.commit(shardKey{shardID: 1}, v.index, v.term); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	expected := []termRange{{1, 3, 1}, {4, 5, 2}, {8, 8, 3}}
+	if !reflect.DeepEqual(expected, c.committed[shardKey{shardID: 1}]) {
+		t.Errorf("unexpected ranges %v", c.committed[shardKey{shardID: 1}])
+	}
+	// committed in a different term
+	if err := c.commit(shardKey{shardID: 1}, 4, 3); err == nil {
+		t.Errorf("conflicting term not reported")
+	}
+	// terms moving backwards
+	if err := c.commit(shardKey{shardID: 1}, 6, 1); err == nil {
+		t.Errorf("term moving backwards not reported")
+	}
+	if err := c.commit(shardKey{shardID: 1}, 7, 4); err == nil {
+		t.Errorf("term moving backwards not reported")
+	}
+	if err := c.checkEntry(shardKey{shardID: 1}, pb.Entry{Index: 5, Term: 3}); err == nil {
+		t.Errorf("overwritten committed entry not reported")
+	}
+	if err := c.checkEntry(shardKey{shardID: 1}, pb.Entry{Index: 6, Term: 3}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := c.checkEntry(shardKey{shardID: 2}, pb.Entry{Index: 5, Term: 3}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestCommitSafetyDetectsDivergedCommittedEntries(t *testing.T) {
+	safety.retain()
+	defer safety.release()
+	getRaft := func(id uint64, terms ...uint64) *raft {
+		r := newTestRaft(id, []uint64{1, 2, 3}, 10, 1, NewTestLogDB())
+		var entries []pb.Entry
+		for idx, term := range terms {
+			entries = append(entries, pb.Entry{Index: uint64(idx + 1), Term: term})
+		}
+		r.log.append(entries)
+		r.log.commitTo(uint64(len(terms)))
+		return r
+	}
+	getRaft(1, 1, 1, 2).checkCommitSafety(0)
+	getRaft(2, 1, 1).checkCommitSafety(0)
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("panic not triggered")
+		}
+	}()
+	getRaft(3, 1, 1, 3).checkCommitSafety(0)
+}
@@ -28,6 +28,7 @@ import (
 	"github.com/lni/goutils/syncutil"
 
 	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/server"
 	"github.com/lni/dragonboat/v4/logger"
 )
 
@@ -132,6 +133,24 @@ func (n *GossipRegistry) NumMembers() int {
 	return n.gossip.numMembers()
 }
 
+// AddTombstones adds the specified tombstones to the gossip view so they can
+// be shared with other NodeHost instances.
+func (n *GossipRegistry) AddTombstones(tombstones []server.Tombstone) {
+	n.gossip.view.addTombstones(tombstones)
+}
+
+// PruneTombstones removes tombstones created before the specified unix time
+// in nanoseconds from the gossip view, they are no longer shared with other
+// NodeHost instances.
+func (n *GossipRegistry) PruneTombstones(before int64) {
+	n.gossip.view.pruneTombstones(before)
+}
+
+// GetTombstones returns all tombstones known to the gossip service.
+func (n *GossipRegistry) GetTombstones() []server.Tombstone {
+	return n.gossip.view.getTombstones()
+}
+
 // Add adds a new node with its known NodeHostID to the registry.
 func (n *GossipRegistry) Add(shardID uint64,
 	replicaID uint64, target string) {
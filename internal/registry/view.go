@@ -24,6 +24,7 @@ import (
 	"github.com/pierrec/lz4/v4"
 
 	"github.com/lni/dragonboat/v4/internal/raft"
+	"github.com/lni/dragonboat/v4/internal/server"
 	sm "github.com/lni/dragonboat/v4/statemachine"
 )
 
@@ -61,6 +62,29 @@ type ShardInfo struct {
 	// is not available. The Pending flag is set to true usually because the node
 	// has not had anything applied yet.
 	Pending bool
+	// Replication contains the replication states of remote replicas keyed by
+	// their replica IDs. It is only available on the leader replica when the
+	// MaxInflightBytes field of config.Config is set.
+	Replication map[uint64]ReplicationInfo
+	// Hibernated indicates whether the replica is hibernated, see the
+	// HibernateRTT field of config.Config. Details of a hibernated replica are
+	// those observed when it was hibernated.
+	Hibernated bool
+}
+
+// ReplicationInfo is the replication state of a remote replica as tracked by
+// the leader replica.
+type ReplicationInfo struct {
+	// Match is the last Raft log index known to be replicated to the replica.
+	Match uint64
+	// Next is the Raft log index of the next entry to be sent to the replica.
+	Next uint64
+	// InflightBytes is the total size in bytes of entries sent to the replica
+	// but not yet acknowledged.
+	InflightBytes uint64
+	// Paused indicates whether the replication to the replica is paused, e.g.
+	// because of the MaxInflightBytes limit.
+	Paused bool
 }
 
 // ShardView is the view of a shard from gossip's point of view.
@@ -92,12 +116,21 @@ type sharedInfo struct {
 	ShardInfo    []ShardView
 }
 
+// fullSyncInfo is the data exchanged in full state syncs. gob matches struct
+// fields by name, sharedInfo data can be decoded as a fullSyncInfo.
+type fullSyncInfo struct {
+	DeploymentID uint64
+	ShardInfo    []ShardView
+	Tombstones   []server.Tombstone
+}
+
 type view struct {
 	deploymentID uint64
 	// shardID -> ShardView
 	mu struct {
 		sync.Mutex
-		shards map[uint64]ShardView
+		shards     map[uint64]ShardView
+		tombstones []server.Tombstone
 	}
 }
 
@@ -144,6 +177,26 @@ func (v *view) update(updates []ShardView) {
 	}
 }
 
+func (v *view) addTombstones(tombstones []server.Tombstone) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.mu.tombstones, _ = server.MergeTombstones(v.mu.tombstones, tombstones)
+}
+
+func (v *view) pruneTombstones(before int64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.mu.tombstones, _ = server.PruneTombstones(v.mu.tombstones, before)
+}
+
+func (v *view) getTombstones() []server.Tombstone {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	result := make([]server.Tombstone, len(v.mu.tombstones))
+	copy(result, v.mu.tombstones)
+	return result
+}
+
 func (v *view) toShuffledList() []ShardView {
 	ci := make([]ShardView, 0)
 	func() {
@@ -166,6 +219,10 @@ func getCompressedData(deploymentID uint64, l []ShardView, n int) []byte {
 		DeploymentID: deploymentID,
 		ShardInfo:    l[:n],
 	}
+	return compress(si)
+}
+
+func compress(si interface{}) []byte {
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
 	if err := enc.Encode(si); err != nil {
@@ -182,9 +239,19 @@ func getCompressedData(deploymentID uint64, l []ShardView, n int) []byte {
 	return compressed[:n+4]
 }
 
+// getFullSyncData returns the data used in full state sync. Tombstones are
+// only exchanged in full state syncs to keep broadcast messages small.
 func (v *view) getFullSyncData() []byte {
 	l := v.toShuffledList()
-	return getCompressedData(v.deploymentID, l, len(l))
+	tombstones := v.getTombstones()
+	if len(tombstones) == 0 {
+		return getCompressedData(v.deploymentID, l, len(l))
+	}
+	return compress(fullSyncInfo{
+		DeploymentID: v.deploymentID,
+		ShardInfo:    l,
+		Tombstones:   tombstones,
+	})
 }
 
 func (v *view) getGossipData(limit int) []byte {
@@ -227,7 +294,7 @@ func (v *view) updateFrom(data []byte) {
 	dst = dst[:n]
 	buf := bytes.NewBuffer(dst)
 	dec := gob.NewDecoder(buf)
-	si := sharedInfo{}
+	si := fullSyncInfo{}
 	if err := dec.Decode(&si); err != nil {
 		return
 	}
@@ -235,4 +302,7 @@ func (v *view) updateFrom(data []byte) {
 		return
 	}
 	v.update(si.ShardInfo)
+	if len(si.Tombstones) > 0 {
+		v.addTombstones(si.Tombstones)
+	}
 }
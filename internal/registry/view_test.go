@@ -20,6 +20,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/lni/dragonboat/v4/internal/raft"
+	"github.com/lni/dragonboat/v4/internal/server"
 )
 
 func getTestShardView() []ShardView {
@@ -229,3 +230,31 @@ func TestUnknownLeaderIsIgnored(t *testing.T) {
 	assert.True(t, ok)
 	assert.Equal(t, cv, result)
 }
+
+func TestTombstonesAreSharedInFullSyncData(t *testing.T) {
+	v := newView(123)
+	ts := []server.Tombstone{{ShardID: 100, CreatedAt: 1}}
+	v.addTombstones(ts)
+	data := v.getFullSyncData()
+	assert.NotNil(t, data)
+	assert.Nil(t, v.getGossipData(1024))
+
+	v2 := newView(123)
+	v2.updateFrom(data)
+	assert.Equal(t, ts, v2.getTombstones())
+
+	v3 := newView(321)
+	v3.updateFrom(data)
+	assert.Empty(t, v3.getTombstones())
+}
+
+func TestExpiredTombstonesCanBePruned(t *testing.T) {
+	v := newView(123)
+	v.addTombstones([]server.Tombstone{
+		{ShardID: 100, CreatedAt: 1},
+		{ShardID: 200, CreatedAt: 3},
+	})
+	v.pruneTombstones(2)
+	assert.Equal(t, []server.Tombstone{{ShardID: 200, CreatedAt: 3}},
+		v.getTombstones())
+}
@@ -38,6 +38,11 @@ type IStateMachine interface {
 	Recover(io.Reader, []sm.SnapshotFile, <-chan struct{}) error
 	Close() error
 	GetHash() (uint64, error)
+	ParallelUpdate(entries []sm.Entry) ([]sm.Entry, error)
+	Parallel() bool
+	UpdateChunk(entry sm.Entry, offset uint64, size uint64) (sm.Result, error)
+	AbortChunked() error
+	Chunked() bool
 	Concurrent() bool
 	OnDisk() bool
 	Type() pb.StateMachineType
@@ -49,6 +54,7 @@ type InMemStateMachine struct {
 	sm sm.IStateMachine
 	h  sm.IHash
 	na sm.IExtended
+	cu sm.IChunkedUpdater
 }
 
 var _ IStateMachine = (*InMemStateMachine)(nil)
@@ -62,6 +68,9 @@ func NewInMemStateMachine(s sm.IStateMachine) *InMemStateMachine {
 	if na, ok := s.(sm.IExtended); ok {
 		i.na = na
 	}
+	if cu, ok := s.(sm.IChunkedUpdater); ok {
+		i.cu = cu
+	}
 	return i
 }
 
@@ -133,6 +142,41 @@ func (i *InMemStateMachine) GetHash() (uint64, error) {
 	return h, errors.WithStack(err)
 }
 
+// ParallelUpdate is not supported by InMemStateMachine.
+func (i *InMemStateMachine) ParallelUpdate(entries []sm.Entry) ([]sm.Entry, error) {
+	return nil, sm.ErrNotImplemented
+}
+
+// Parallel returns a boolean flag indicating whether the state machine
+// supports parallel updates.
+func (i *InMemStateMachine) Parallel() bool {
+	return false
+}
+
+// UpdateChunk applies a chunk of a chunked proposal.
+func (i *InMemStateMachine) UpdateChunk(e sm.Entry,
+	offset uint64, size uint64) (sm.Result, error) {
+	if i.cu == nil {
+		return sm.Result{}, sm.ErrNotImplemented
+	}
+	r, err := i.cu.UpdateChunk(e, offset, size)
+	return r, errors.WithStack(err)
+}
+
+// AbortChunked discards chunks of the partially applied chunked proposal.
+func (i *InMemStateMachine) AbortChunked() error {
+	if i.cu == nil {
+		return sm.ErrNotImplemented
+	}
+	return errors.WithStack(i.cu.AbortChunked())
+}
+
+// Chunked returns a boolean flag indicating whether the state machine
+// supports applying chunked proposals chunk by chunk.
+func (i *InMemStateMachine) Chunked() bool {
+	return i.cu != nil
+}
+
 // Concurrent returns a boolean flag indicating whether the state machine is
 // capable of taking concurrent snapshot.
 func (i *InMemStateMachine) Concurrent() bool {
@@ -156,6 +200,8 @@ type ConcurrentStateMachine struct {
 	sm sm.IConcurrentStateMachine
 	h  sm.IHash
 	na sm.IExtended
+	pu sm.IParallelUpdater
+	cu sm.IChunkedUpdater
 }
 
 // NewConcurrentStateMachine creates a new ConcurrentStateMachine instance.
@@ -167,6 +213,12 @@ func NewConcurrentStateMachine(s sm.IConcurrentStateMachine) *ConcurrentStateMac
 	if na, ok := s.(sm.IExtended); ok {
 		v.na = na
 	}
+	if pu, ok := s.(sm.IParallelUpdater); ok {
+		v.pu = pu
+	}
+	if cu, ok := s.(sm.IChunkedUpdater); ok {
+		v.cu = cu
+	}
 	return v
 }
 
@@ -181,6 +233,45 @@ func (s *ConcurrentStateMachine) Update(entries []sm.Entry) ([]sm.Entry, error)
 	return results, errors.WithStack(err)
 }
 
+// ParallelUpdate updates the state machine, it can be invoked concurrently.
+func (s *ConcurrentStateMachine) ParallelUpdate(entries []sm.Entry) ([]sm.Entry, error) {
+	if s.pu == nil {
+		return nil, sm.ErrNotImplemented
+	}
+	results, err := s.pu.ParallelUpdate(entries)
+	return results, errors.WithStack(err)
+}
+
+// Parallel returns a boolean flag indicating whether the state machine
+// supports parallel updates.
+func (s *ConcurrentStateMachine) Parallel() bool {
+	return s.pu != nil
+}
+
+// UpdateChunk applies a chunk of a chunked proposal.
+func (s *ConcurrentStateMachine) UpdateChunk(e sm.Entry,
+	offset uint64, size uint64) (sm.Result, error) {
+	if s.cu == nil {
+		return sm.Result{}, sm.ErrNotImplemented
+	}
+	r, err := s.cu.UpdateChunk(e, offset, size)
+	return r, errors.WithStack(err)
+}
+
+// AbortChunked discards chunks of the partially applied chunked proposal.
+func (s *ConcurrentStateMachine) AbortChunked() error {
+	if s.cu == nil {
+		return sm.ErrNotImplemented
+	}
+	return errors.WithStack(s.cu.AbortChunked())
+}
+
+// Chunked returns a boolean flag indicating whether the state machine
+// supports applying chunked proposals chunk by chunk.
+func (s *ConcurrentStateMachine) Chunked() bool {
+	return s.cu != nil
+}
+
 // Lookup queries the state machine.
 func (s *ConcurrentStateMachine) Lookup(query interface{}) (interface{}, error) {
 	return s.sm.Lookup(query)
@@ -259,6 +350,8 @@ type OnDiskStateMachine struct {
 	sm     sm.IOnDiskStateMachine
 	h      sm.IHash
 	na     sm.IExtended
+	pu     sm.IParallelUpdater
+	cu     sm.IChunkedUpdater
 	opened bool
 }
 
@@ -271,6 +364,12 @@ func NewOnDiskStateMachine(s sm.IOnDiskStateMachine) *OnDiskStateMachine {
 	if na, ok := s.(sm.IExtended); ok {
 		r.na = na
 	}
+	if pu, ok := s.(sm.IParallelUpdater); ok {
+		r.pu = pu
+	}
+	if cu, ok := s.(sm.IChunkedUpdater); ok {
+		r.cu = cu
+	}
 	return r
 }
 
@@ -299,6 +398,48 @@ func (s *OnDiskStateMachine) Update(entries []sm.Entry) ([]sm.Entry, error) {
 	return results, errors.WithStack(err)
 }
 
+// ParallelUpdate updates the state machine, it can be invoked concurrently.
+func (s *OnDiskStateMachine) ParallelUpdate(entries []sm.Entry) ([]sm.Entry, error) {
+	s.ensureOpened()
+	if s.pu == nil {
+		return nil, sm.ErrNotImplemented
+	}
+	results, err := s.pu.ParallelUpdate(entries)
+	return results, errors.WithStack(err)
+}
+
+// Parallel returns a boolean flag indicating whether the state machine
+// supports parallel updates.
+func (s *OnDiskStateMachine) Parallel() bool {
+	return s.pu != nil
+}
+
+// UpdateChunk applies a chunk of a chunked proposal.
+func (s *OnDiskStateMachine) UpdateChunk(e sm.Entry,
+	offset uint64, size uint64) (sm.Result, error) {
+	s.ensureOpened()
+	if s.cu == nil {
+		return sm.Result{}, sm.ErrNotImplemented
+	}
+	r, err := s.cu.UpdateChunk(e, offset, size)
+	return r, errors.WithStack(err)
+}
+
+// AbortChunked discards chunks of the partially applied chunked proposal.
+func (s *OnDiskStateMachine) AbortChunked() error {
+	s.ensureOpened()
+	if s.cu == nil {
+		return sm.ErrNotImplemented
+	}
+	return errors.WithStack(s.cu.AbortChunked())
+}
+
+// Chunked returns a boolean flag indicating whether the state machine
+// supports applying chunked proposals chunk by chunk.
+func (s *OnDiskStateMachine) Chunked() bool {
+	return s.cu != nil
+}
+
 // Lookup queries the state machine.
 func (s *OnDiskStateMachine) Lookup(query interface{}) (interface{}, error) {
 	s.ensureOpened()
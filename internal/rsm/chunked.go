@@ -0,0 +1,261 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rsm
+
+import (
+	"encoding/binary"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/settings"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// Entry Cmd format when Type = pb.ChunkedEntry
+//
+// -------------------------------------------------
+// |Seq (4 bytes)|Count (4 bytes)|Size (8 bytes)|Data|
+// -------------------------------------------------
+//
+// A large EncodedEntry is split into Count ChunkedEntry entries, no other
+// proposal is accepted until all of them have been queued so they are always
+// contiguous in the Raft log. Seq is the
+// position of the chunk, Size is the total size of the encoded payload. All
+// chunks share the Key, ClientID, SeriesID and RespondedTo values of the
+// original entry.
+const (
+	// ChunkedEntryHeaderSize is the size of the header of each ChunkedEntry.
+	ChunkedEntryHeaderSize = 16
+)
+
+var (
+	// ErrChunkedEntryPending indicates that a snapshot can not be created as
+	// a chunked entry is partially applied.
+	ErrChunkedEntryPending = errors.Wrap(sm.ErrSnapshotAborted,
+		"chunked entry partially applied")
+)
+
+// SplitEntry splits the specified EncodedEntry into ChunkedEntry entries
+// with their payloads no larger than chunkSize bytes. The input entry is
+// returned as is when its payload is not larger than chunkSize.
+func SplitEntry(e pb.Entry, chunkSize uint64) []pb.Entry {
+	if chunkSize == 0 || uint64(len(e.Cmd)) <= chunkSize {
+		return []pb.Entry{e}
+	}
+	s := NewChunkSplitter(e, chunkSize)
+	result := make([]pb.Entry, 0, s.Count())
+	for {
+		ce, ok := s.Next()
+		if !ok {
+			return result
+		}
+		result = append(result, ce)
+	}
+}
+
+// ChunkSplitter splits an EncodedEntry into ChunkedEntry entries on demand,
+// only chunks returned by Next are allocated.
+type ChunkSplitter struct {
+	e         pb.Entry
+	chunkSize uint64
+	count     uint64
+	next      uint64
+}
+
+// NewChunkSplitter returns a ChunkSplitter for splitting the specified
+// EncodedEntry into ChunkedEntry entries with their payloads no larger than
+// chunkSize bytes.
+func NewChunkSplitter(e pb.Entry, chunkSize uint64) *ChunkSplitter {
+	if e.Type != pb.EncodedEntry {
+		panic("not an encoded entry")
+	}
+	if chunkSize == 0 {
+		panic("invalid chunk size")
+	}
+	size := uint64(len(e.Cmd))
+	count := (size + chunkSize - 1) / chunkSize
+	if count > uint64(^uint32(0)) {
+		panic("too many chunks")
+	}
+	return &ChunkSplitter{e: e, chunkSize: chunkSize, count: count}
+}
+
+// Count returns the total number of chunks.
+func (s *ChunkSplitter) Count() uint64 {
+	return s.count
+}
+
+// Done returns a boolean value indicating whether all chunks have been
+// returned by Next.
+func (s *ChunkSplitter) Done() bool {
+	return s.next >= s.count
+}
+
+// Next returns the next chunk, the returned boolean value is false when all
+// chunks have already been returned.
+func (s *ChunkSplitter) Next() (pb.Entry, bool) {
+	if s.Done() {
+		return pb.Entry{}, false
+	}
+	size := uint64(len(s.e.Cmd))
+	start := s.next * s.chunkSize
+	end := start + s.chunkSize
+	if end > size {
+		end = size
+	}
+	cmd := make([]byte, ChunkedEntryHeaderSize+end-start)
+	binary.LittleEndian.PutUint32(cmd, uint32(s.next))
+	binary.LittleEndian.PutUint32(cmd[4:], uint32(s.count))
+	binary.LittleEndian.PutUint64(cmd[8:], size)
+	copy(cmd[ChunkedEntryHeaderSize:], s.e.Cmd[start:end])
+	ce := s.e
+	ce.Type = pb.ChunkedEntry
+	ce.Cmd = cmd
+	s.next++
+	if s.Done() {
+		// the payload of the original entry is no longer required
+		s.e.Cmd = nil
+	}
+	return ce, true
+}
+
+// IsLastChunk returns a boolean value indicating whether the specified
+// ChunkedEntry is the last chunk of its original entry.
+func IsLastChunk(e pb.Entry) bool {
+	seq, count, _, _ := decodeChunk(e)
+	return seq+1 == count
+}
+
+func decodeChunk(e pb.Entry) (uint32, uint32, uint64, []byte) {
+	if e.Type != pb.ChunkedEntry || len(e.Cmd) < ChunkedEntryHeaderSize {
+		panic("invalid chunked entry")
+	}
+	seq := binary.LittleEndian.Uint32(e.Cmd)
+	count := binary.LittleEndian.Uint32(e.Cmd[4:])
+	size := binary.LittleEndian.Uint64(e.Cmd[8:])
+	return seq, count, size, e.Cmd[ChunkedEntryHeaderSize:]
+}
+
+// maxChunkedEntrySize returns the max size of the encoded payload of a chunked
+// entry that can be reassembled in memory. Proposals with payloads larger than
+// MaxChunkedProposalSize are rejected when they are proposed, the extra space
+// allows for the encoding overhead.
+func maxChunkedEntrySize() uint64 {
+	sz := settings.Soft.MaxChunkedProposalSize
+	return sz + sz/4 + 1024
+}
+
+// isStreamable returns a boolean value indicating whether the entry of the
+// specified first chunk can be applied chunk by chunk, i.e. its payload can be
+// passed to the state machine without being decoded as a whole.
+func isStreamable(e pb.Entry) bool {
+	_, _, _, data := decodeChunk(e)
+	if !e.IsNoOPSession() || len(data) == 0 {
+		return false
+	}
+	ver, ct, session := parseEncodedHeader(data)
+	return ver == EEV0 && ct == EENoCompression && !session
+}
+
+// chunkedEntry is a chunked entry being reassembled, or being applied chunk by
+// chunk when streamed is set.
+type chunkedEntry struct {
+	entry    pb.Entry
+	next     uint32
+	count    uint32
+	size     uint64
+	added    uint64
+	streamed bool
+}
+
+// add adds the specified chunk. It returns a boolean value indicating whether
+// the chunk is the expected next chunk of the entry.
+func (c *chunkedEntry) add(e pb.Entry) bool {
+	seq, count, size, data := decodeChunk(e)
+	if e.Key != c.entry.Key || e.ClientID != c.entry.ClientID ||
+		seq != c.next || count != c.count || size != c.size ||
+		c.added+uint64(len(data)) > c.size {
+		return false
+	}
+	if seq+1 == count && c.added+uint64(len(data)) != c.size {
+		return false
+	}
+	if !c.streamed {
+		c.entry.Cmd = append(c.entry.Cmd, data...)
+	}
+	c.added += uint64(len(data))
+	c.entry.Index, c.entry.Term = e.Index, e.Term
+	c.next++
+	return true
+}
+
+func (c *chunkedEntry) completed() bool {
+	return c.next == c.count
+}
+
+// newChunkedEntry returns the chunkedEntry of the specified first chunk. It
+// returns nil when the entry is too large to be reassembled in memory.
+func newChunkedEntry(e pb.Entry, streamed bool) *chunkedEntry {
+	_, count, size, _ := decodeChunk(e)
+	ce := e
+	ce.Type = pb.EncodedEntry
+	ce.Cmd = nil
+	if !streamed {
+		if size > maxChunkedEntrySize() {
+			return nil
+		}
+		ce.Cmd = make([]byte, 0, size)
+	}
+	return &chunkedEntry{entry: ce, count: count, size: size, streamed: streamed}
+}
+
+// ChunkAssembler reassembles ChunkedEntry entries back into their original
+// EncodedEntry entries. It is used for applying chunked entries outside of
+// the StateMachine, e.g. when they are mirrored to another shard.
+type ChunkAssembler struct {
+	chunked *chunkedEntry
+}
+
+// Add adds the specified ChunkedEntry. It returns the reassembled entry and
+// a boolean value true once all chunks of the entry have been added. An
+// unexpected chunk causes the partially reassembled entry to be dropped, so
+// does an entry too large to be reassembled in memory.
+func (a *ChunkAssembler) Add(e pb.Entry) (pb.Entry, bool) {
+	if seq, _, _, _ := decodeChunk(e); seq == 0 {
+		a.chunked = newChunkedEntry(e, false)
+	}
+	if a.chunked == nil || !a.chunked.add(e) {
+		a.chunked = nil
+		return pb.Entry{}, false
+	}
+	if !a.chunked.completed() {
+		return pb.Entry{}, false
+	}
+	ce := a.chunked.entry
+	a.chunked = nil
+	return ce, true
+}
+
+// Pending returns a boolean value indicating whether there is a partially
+// reassembled entry.
+func (a *ChunkAssembler) Pending() bool {
+	return a.chunked != nil
+}
+
+// Reset drops the partially reassembled entry, if any.
+func (a *ChunkAssembler) Reset() {
+	a.chunked = nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rsm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/lni/dragonboat/v4/internal/settings"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func TestSmallEntryIsNotSplit(t *testing.T) {
+	e := pb.Entry{Type: pb.EncodedEntry, Cmd: make([]byte, 16)}
+	for _, sz := range []uint64{0, 16, 17} {
+		if result := SplitEntry(e, sz); len(result) != 1 || result[0].Type != pb.EncodedEntry {
+			t.Errorf("%d, unexpectedly split", sz)
+		}
+	}
+}
+
+func TestSplitEntryCanBeReassembled(t *testing.T) {
+	data := make([]byte, 1025)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	e := pb.Entry{
+		Type:        pb.EncodedEntry,
+		Key:         1,
+		ClientID:    2,
+		SeriesID:    3,
+		RespondedTo: 2,
+		Cmd:         data,
+	}
+	chunks := SplitEntry(e, 100)
+	if len(chunks) != 11 {
+		t.Fatalf("chunk count %d, want 11", len(chunks))
+	}
+	var ce *chunkedEntry
+	for i, c := range chunks {
+		if c.Type != pb.ChunkedEntry || c.Key != 1 || c.ClientID != 2 ||
+			c.SeriesID != 3 || c.RespondedTo != 2 {
+			t.Fatalf("%d, unexpected chunk %v", i, c)
+		}
+		if IsLastChunk(c) != (i == len(chunks)-1) {
+			t.Errorf("%d, unexpected last chunk flag", i)
+		}
+		c.Index = uint64(i + 10)
+		if i == 0 {
+			ce = newChunkedEntry(c, false)
+		}
+		if !ce.add(c) {
+			t.Fatalf("%d, failed to add chunk", i)
+		}
+	}
+	if !ce.completed() {
+		t.Fatalf("not completed")
+	}
+	if ce.entry.Type != pb.EncodedEntry || ce.entry.Index != 20 ||
+		!bytes.Equal(ce.entry.Cmd, data) {
+		t.Errorf("unexpected reassembled entry")
+	}
+}
+
+func TestOutOfOrderChunkIsRejected(t *testing.T) {
+	e := pb.Entry{Type: pb.EncodedEntry, Key: 1, Cmd: make([]byte, 30)}
+	chunks := SplitEntry(e, 10)
+	ce := newChunkedEntry(chunks[0], false)
+	if ce.add(chunks[1]) {
+		t.Errorf("out of order chunk added")
+	}
+	if !ce.add(chunks[0]) {
+		t.Errorf("failed to add the first chunk")
+	}
+	other := SplitEntry(pb.Entry{Type: pb.EncodedEntry, Key: 2, Cmd: make([]byte, 30)}, 10)
+	if ce.add(other[1]) {
+		t.Errorf("chunk of another entry added")
+	}
+}
+
+func TestChunkAssembler(t *testing.T) {
+	data := make([]byte, 30)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	e := pb.Entry{Type: pb.EncodedEntry, Key: 1, Cmd: data}
+	chunks := SplitEntry(e, 10)
+	var a ChunkAssembler
+	if _, ok := a.Add(chunks[1]); ok || a.Pending() {
+		t.Errorf("unexpected chunk not dropped")
+	}
+	for i, c := range chunks {
+		ce, ok := a.Add(c)
+		if ok != (i == len(chunks)-1) {
+			t.Fatalf("%d, unexpected completed flag", i)
+		}
+		if ok && !bytes.Equal(ce.Cmd, data) {
+			t.Errorf("unexpected reassembled entry")
+		}
+	}
+	if a.Pending() {
+		t.Errorf("unexpected pending entry")
+	}
+	a.Add(chunks[0])
+	if !a.Pending() {
+		t.Errorf("no pending entry")
+	}
+	a.Reset()
+	if a.Pending() {
+		t.Errorf("pending entry not reset")
+	}
+}
+
+func TestTooLargeChunkedEntryIsNotReassembled(t *testing.T) {
+	maxSize := settings.Soft.MaxChunkedProposalSize
+	settings.Soft.MaxChunkedProposalSize = 1
+	defer func() {
+		settings.Soft.MaxChunkedProposalSize = maxSize
+	}()
+	e := pb.Entry{Type: pb.EncodedEntry, Key: 1, Cmd: make([]byte, 2048)}
+	chunks := SplitEntry(e, 256)
+	if newChunkedEntry(chunks[0], false) != nil {
+		t.Errorf("too large chunked entry not dropped")
+	}
+	if newChunkedEntry(chunks[0], true) == nil {
+		t.Errorf("chunked entry applied chunk by chunk dropped")
+	}
+	var a ChunkAssembler
+	for _, c := range chunks {
+		if _, ok := a.Add(c); ok || a.Pending() {
+			t.Fatalf("too large chunked entry reassembled")
+		}
+	}
+}
+
+func TestChunkBeyondEntrySizeIsRejected(t *testing.T) {
+	e := pb.Entry{Type: pb.EncodedEntry, Key: 1, Cmd: make([]byte, 30)}
+	chunks := SplitEntry(e, 10)
+	ce := newChunkedEntry(chunks[0], false)
+	if !ce.add(chunks[0]) {
+		t.Fatalf("failed to add the first chunk")
+	}
+	chunks[1].Cmd = append(chunks[1].Cmd, make([]byte, 20)...)
+	if ce.add(chunks[1]) {
+		t.Errorf("chunk beyond the entry size added")
+	}
+}
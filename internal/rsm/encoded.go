@@ -44,6 +44,20 @@ const (
 	EEV0SizeOffset int = 1
 )
 
+// Entry Cmd format when Type = pb.EncodedEntry and Version = EEV1
+//
+// ------------------------------------------------------
+// |Header|Count (uvarint)|Keys (Count uvarints)|Payload|
+// ------------------------------------------------------
+//
+// EEV1 is used when the entry is proposed with conflict keys. Header is the
+// same as the V0 header with its Version set to EEV1, Payload is encoded in
+// the same way as the V0 payload, i.e. it is the V0 encoded Cmd without its
+// header.
+const (
+	EEV1 uint8 = 1 << 4
+)
+
 // GetMaxBlockSize returns the maximum block length supported by the specified
 // compression type.
 func GetMaxBlockSize(ct config.CompressionType) uint64 {
@@ -76,6 +90,63 @@ func GetEncoded(ct dio.CompressionType, cmd []byte, dst []byte) []byte {
 	return getEncoded(ct, cmd, dst)
 }
 
+// GetEncodedWithKeys returns the encoded payload using the specified
+// compression type. The specified conflict keys are included when the input
+// keys slice is not empty.
+func GetEncodedWithKeys(ct dio.CompressionType,
+	cmd []byte, keys []uint64) []byte {
+	if len(keys) == 0 {
+		return GetEncoded(ct, cmd, nil)
+	}
+	v0 := GetEncoded(ct, cmd, nil)
+	result := make([]byte, 0,
+		len(v0)+binary.MaxVarintLen64*(len(keys)+1))
+	result = append(result, (v0[0]&^versionMask)|EEV1)
+	result = appendUvarint(result, uint64(len(keys)))
+	for _, key := range keys {
+		result = appendUvarint(result, key)
+	}
+	return append(result, v0[EEHeaderSize:]...)
+}
+
+// GetConflictKeys returns the conflict keys of the entry, nil is returned
+// when the entry was proposed without conflict keys.
+func GetConflictKeys(e pb.Entry) []uint64 {
+	if e.Type != pb.EncodedEntry || len(e.Cmd) == 0 {
+		return nil
+	}
+	if ver, _, _ := parseEncodedHeader(e.Cmd); ver != EEV1 {
+		return nil
+	}
+	keys, _ := getV1ConflictKeys(e.Cmd)
+	return keys
+}
+
+func getV1ConflictKeys(cmd []byte) ([]uint64, int) {
+	offset := int(EEHeaderSize)
+	count, n := binary.Uvarint(cmd[offset:])
+	if n <= 0 || count > uint64(len(cmd)) {
+		plog.Panicf("invalid conflict key count")
+	}
+	offset += n
+	keys := make([]uint64, count)
+	for i := range keys {
+		key, n := binary.Uvarint(cmd[offset:])
+		if n <= 0 {
+			plog.Panicf("invalid conflict key")
+		}
+		keys[i] = key
+		offset += n
+	}
+	return keys, offset
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
 // get v0 encoded payload
 func getEncoded(ct dio.CompressionType, cmd []byte, dst []byte) []byte {
 	if ct == dio.NoCompression {
@@ -117,12 +188,15 @@ func getEncodedHeader(version uint8, cf uint8, session bool) uint8 {
 	return result
 }
 
+const (
+	versionMask = uint8(15 << 4)
+)
+
 func parseEncodedHeader(cmd []byte) (uint8, uint8, bool) {
-	vermask := uint8(15 << 4)
 	ctmask := uint8(7 << 1)
 	sesmask := uint8(1)
 	header := cmd[0]
-	return header & vermask, header & ctmask, header&sesmask == 1
+	return header & versionMask, header & ctmask, header&sesmask == 1
 }
 
 func getDecodedPayload(cmd []byte, buf []byte) ([]byte, error) {
@@ -134,24 +208,19 @@ func getDecodedPayload(cmd []byte, buf []byte) ([]byte, error) {
 		if ct == EENoCompression {
 			return getV0NoCompressPayload(cmd), nil
 		} else if ct == EESnappy {
-			sz, offset := getV0PayloadUncompressedSize(cmd)
-			if sz == 0 {
-				plog.Panicf("empty uncompressed size found")
-			}
-			if offset == 0 {
-				plog.Panicf("zero offset found")
-			}
-			compressed := cmd[EEV0SizeOffset:]
-			var result []byte
-			if uint64(len(buf)) >= sz {
-				result = buf[:sz]
-			} else {
-				result = make([]byte, sz)
-			}
-			if err := dio.DecompressSnappyBlock(compressed, result); err != nil {
-				return nil, err
-			}
-			return result, nil
+			return getSnappyPayload(cmd[EEV0SizeOffset:], buf)
+		} else {
+			plog.Panicf("unknown compression type %d", ct)
+		}
+	} else if ver == EEV1 {
+		if hasSession {
+			plog.Panicf("v1 cmd has session info")
+		}
+		_, offset := getV1ConflictKeys(cmd)
+		if ct == EENoCompression {
+			return cmd[offset:], nil
+		} else if ct == EESnappy {
+			return getSnappyPayload(cmd[offset:], buf)
 		} else {
 			plog.Panicf("unknown compression type %d", ct)
 		}
@@ -159,10 +228,28 @@ func getDecodedPayload(cmd []byte, buf []byte) ([]byte, error) {
 	panic("unknown cmd encoding version")
 }
 
-func getV0NoCompressPayload(cmd []byte) []byte {
-	return cmd[EEHeaderSize:]
+// getSnappyPayload decompresses the snappy block, the block starts with its
+// uncompressed size encoded using binary.Uvarint.
+func getSnappyPayload(compressed []byte, buf []byte) ([]byte, error) {
+	sz, offset := binary.Uvarint(compressed)
+	if sz == 0 {
+		plog.Panicf("empty uncompressed size found")
+	}
+	if offset == 0 {
+		plog.Panicf("zero offset found")
+	}
+	var result []byte
+	if uint64(len(buf)) >= sz {
+		result = buf[:sz]
+	} else {
+		result = make([]byte, sz)
+	}
+	if err := dio.DecompressSnappyBlock(compressed, result); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-func getV0PayloadUncompressedSize(cmd []byte) (uint64, int) {
-	return binary.Uvarint(cmd[EEV0SizeOffset:])
+func getV0NoCompressPayload(cmd []byte) []byte {
+	return cmd[EEHeaderSize:]
 }
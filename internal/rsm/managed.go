@@ -58,6 +58,11 @@ type IManagedStateMachine interface {
 	Open() (uint64, error)
 	Update(sm.Entry) (sm.Result, error)
 	BatchedUpdate([]sm.Entry) ([]sm.Entry, error)
+	ParallelUpdate([]sm.Entry) ([]sm.Entry, error)
+	Parallel() bool
+	UpdateChunk(sm.Entry, uint64, uint64) (sm.Result, error)
+	AbortChunked() error
+	Chunked() bool
 	Lookup(interface{}) (interface{}, error)
 	ConcurrentLookup(interface{}) (interface{}, error)
 	NALookup([]byte) ([]byte, error)
@@ -206,6 +211,43 @@ func (ds *NativeSM) BatchedUpdate(ents []sm.Entry) ([]sm.Entry, error) {
 	return results, nil
 }
 
+// ParallelUpdate applies committed entries that don't conflict with entries
+// concurrently applied by other ParallelUpdate calls.
+func (ds *NativeSM) ParallelUpdate(ents []sm.Entry) ([]sm.Entry, error) {
+	inputLen := len(ents)
+	results, err := ds.sm.ParallelUpdate(ents)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) != inputLen {
+		panic("unexpected result length")
+	}
+	return results, nil
+}
+
+// Parallel returns a boolean flag indicating whether the managed state
+// machine supports parallel updates.
+func (ds *NativeSM) Parallel() bool {
+	return ds.sm.Parallel()
+}
+
+// UpdateChunk applies a chunk of a chunked proposal.
+func (ds *NativeSM) UpdateChunk(e sm.Entry,
+	offset uint64, size uint64) (sm.Result, error) {
+	return ds.sm.UpdateChunk(e, offset, size)
+}
+
+// AbortChunked discards chunks of the partially applied chunked proposal.
+func (ds *NativeSM) AbortChunked() error {
+	return ds.sm.AbortChunked()
+}
+
+// Chunked returns a boolean flag indicating whether the managed state machine
+// supports applying chunked proposals chunk by chunk.
+func (ds *NativeSM) Chunked() bool {
+	return ds.sm.Chunked()
+}
+
 // Lookup queries the data store.
 func (ds *NativeSM) Lookup(query interface{}) (interface{}, error) {
 	ds.mu.RLock()
@@ -64,6 +64,11 @@ func (d *dummySM) Save(interface{},
 func (d *dummySM) Recover(io.Reader, []sm.SnapshotFile, <-chan struct{}) error { return nil }
 func (d *dummySM) Close() error                                                { return nil }
 func (d *dummySM) GetHash() (uint64, error)                                    { return 0, nil }
+func (d *dummySM) ParallelUpdate(e []sm.Entry) ([]sm.Entry, error)             { return nil, nil }
+func (d *dummySM) Parallel() bool                                              { return false }
+func (d *dummySM) UpdateChunk(sm.Entry, uint64, uint64) (sm.Result, error)     { return sm.Result{}, nil }
+func (d *dummySM) AbortChunked() error                                         { return nil }
+func (d *dummySM) Chunked() bool                                               { return false }
 func (d *dummySM) Concurrent() bool                                            { return false }
 func (d *dummySM) OnDisk() bool                                                { return false }
 func (d *dummySM) Type() pb.StateMachineType                                   { return pb.OnDiskStateMachine }
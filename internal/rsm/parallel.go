@@ -0,0 +1,160 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rsm
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// batchedUpdate applies the ents into the managed state machine, input are
+// the raft entries of ents. Consecutive entries with conflict keys are
+// dispatched to concurrent ParallelUpdate calls when supported by the state
+// machine, entries without conflict keys act as barriers and are applied
+// using BatchedUpdate.
+func (s *StateMachine) batchedUpdate(input []pb.Entry,
+	ents []sm.Entry) ([]sm.Entry, error) {
+	if !s.sm.Parallel() {
+		return s.sm.BatchedUpdate(ents)
+	}
+	keys := make([][]uint64, len(input))
+	for idx := range input {
+		keys[idx] = GetConflictKeys(input[idx])
+	}
+	start := 0
+	for start < len(ents) {
+		end := start + 1
+		parallel := len(keys[start]) > 0
+		for end < len(ents) && (len(keys[end]) > 0) == parallel {
+			end++
+		}
+		var err error
+		if parallel {
+			err = s.parallelUpdate(keys[start:end], ents[start:end])
+		} else {
+			var results []sm.Entry
+			results, err = s.sm.BatchedUpdate(ents[start:end])
+			copy(ents[start:end], results)
+		}
+		if err != nil {
+			return nil, err
+		}
+		start = end
+	}
+	return ents, nil
+}
+
+// parallelUpdate applies ents in parallel, keys are conflict keys of ents.
+func (s *StateMachine) parallelUpdate(keys [][]uint64, ents []sm.Entry) error {
+	groups := getConflictGroups(keys)
+	if len(groups) == 1 {
+		results, err := s.sm.ParallelUpdate(ents)
+		if err != nil {
+			return err
+		}
+		copy(ents, results)
+		return nil
+	}
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(groups) {
+		workers = len(groups)
+	}
+	errs := make([]error, len(groups))
+	next := int64(-1)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				g := int(atomic.AddInt64(&next, 1))
+				if g >= len(groups) {
+					return
+				}
+				batch := make([]sm.Entry, len(groups[g]))
+				for i, idx := range groups[g] {
+					batch[i] = ents[idx]
+				}
+				results, err := s.sm.ParallelUpdate(batch)
+				if err != nil {
+					errs[g] = err
+					continue
+				}
+				for i, idx := range groups[g] {
+					ents[idx] = results[i]
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getConflictGroups partitions entries into groups so that entries sharing
+// any conflict key are in the same group. keys are conflict keys of entries,
+// each returned group is a list of entry positions in ascending order.
+func getConflictGroups(keys [][]uint64) [][]int {
+	parent := make([]int, len(keys))
+	for idx := range parent {
+		parent[idx] = idx
+	}
+	find := func(x int) int {
+		for parent[x] != x {
+			parent[x] = parent[parent[x]]
+			x = parent[x]
+		}
+		return x
+	}
+	owners := make(map[uint64]int)
+	for idx, kl := range keys {
+		for _, key := range kl {
+			if owner, ok := owners[key]; ok {
+				a, b := find(owner), find(idx)
+				if a != b {
+					// always keep the smaller position as the root
+					if a < b {
+						parent[b] = a
+					} else {
+						parent[a] = b
+					}
+				}
+			} else {
+				owners[key] = idx
+			}
+		}
+	}
+	var groups [][]int
+	positions := make(map[int]int)
+	for idx := range keys {
+		root := find(idx)
+		pos, ok := positions[root]
+		if !ok {
+			pos = len(groups)
+			positions[root] = pos
+			groups = append(groups, nil)
+		}
+		groups[pos] = append(groups[pos], idx)
+	}
+	return groups
+}
@@ -0,0 +1,160 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rsm
+
+import (
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/utils/dio"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+type parallelTestSM struct {
+	mu       sync.Mutex
+	parallel [][]uint64
+	updates  [][]uint64
+}
+
+func getIndexes(entries []sm.Entry) []uint64 {
+	result := make([]uint64, 0, len(entries))
+	for idx := range entries {
+		result = append(result, entries[idx].Index)
+		entries[idx].Result = sm.Result{Value: entries[idx].Index * 10}
+	}
+	return result
+}
+
+func (s *parallelTestSM) Update(entries []sm.Entry) ([]sm.Entry, error) {
+	s.updates = append(s.updates, getIndexes(entries))
+	return entries, nil
+}
+
+func (s *parallelTestSM) ParallelUpdate(entries []sm.Entry) ([]sm.Entry, error) {
+	indexes := getIndexes(entries)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.parallel = append(s.parallel, indexes)
+	return entries, nil
+}
+
+func (s *parallelTestSM) Lookup(query interface{}) (interface{}, error) {
+	return nil, nil
+}
+
+func (s *parallelTestSM) PrepareSnapshot() (interface{}, error) {
+	return nil, nil
+}
+
+func (s *parallelTestSM) SaveSnapshot(interface{},
+	io.Writer, sm.ISnapshotFileCollection, <-chan struct{}) error {
+	return nil
+}
+
+func (s *parallelTestSM) RecoverFromSnapshot(io.Reader,
+	[]sm.SnapshotFile, <-chan struct{}) error {
+	return nil
+}
+
+func (s *parallelTestSM) Close() error { return nil }
+
+func TestEncodedEntryCanHaveConflictKeys(t *testing.T) {
+	payload := []byte("test-payload-test-payload-test-payload")
+	for _, ct := range []dio.CompressionType{dio.NoCompression, dio.Snappy} {
+		keys := []uint64{1, 300, 1 << 40}
+		e := pb.Entry{
+			Type: pb.EncodedEntry,
+			Cmd:  GetEncodedWithKeys(ct, payload, keys),
+		}
+		if got := GetConflictKeys(e); !reflect.DeepEqual(got, keys) {
+			t.Errorf("got keys %v, want %v", got, keys)
+		}
+		if got := mustGetPayload(e); !reflect.DeepEqual(got, payload) {
+			t.Errorf("got payload %v, want %v", got, payload)
+		}
+		e.Cmd = GetEncodedWithKeys(ct, payload, nil)
+		if GetConflictKeys(e) != nil {
+			t.Errorf("unexpected conflict keys")
+		}
+		if got := mustGetPayload(e); !reflect.DeepEqual(got, payload) {
+			t.Errorf("got payload %v, want %v", got, payload)
+		}
+	}
+}
+
+func TestGetConflictGroups(t *testing.T) {
+	tests := []struct {
+		keys   [][]uint64
+		groups [][]int
+	}{
+		{[][]uint64{{1}, {2}, {3}}, [][]int{{0}, {1}, {2}}},
+		{[][]uint64{{1}, {2}, {1}}, [][]int{{0, 2}, {1}}},
+		{[][]uint64{{1}, {2}, {3, 1}, {2, 3}}, [][]int{{0, 1, 2, 3}}},
+		{[][]uint64{{1, 2}, {3}, {4}, {3, 5}}, [][]int{{0}, {1, 3}, {2}}},
+	}
+	for idx, tt := range tests {
+		if groups := getConflictGroups(tt.keys); !reflect.DeepEqual(groups, tt.groups) {
+			t.Errorf("%d, got %v, want %v", idx, groups, tt.groups)
+		}
+	}
+}
+
+func TestNonConflictingEntriesAreAppliedInParallel(t *testing.T) {
+	fs := vfs.GetTestFS()
+	store := &parallelTestSM{}
+	config := config.Config{ShardID: 1, ReplicaID: 1}
+	ds := NewNativeSM(config, NewConcurrentStateMachine(store), make(chan struct{}))
+	nodeProxy := newTestNodeProxy()
+	sm := NewStateMachine(ds, nil, config, nodeProxy, fs)
+	keys := [][]uint64{{1}, {2}, {1, 3}, nil, {3}, {4}}
+	entries := make([]pb.Entry, 0, len(keys))
+	for idx, kl := range keys {
+		entries = append(entries, pb.Entry{
+			Type:     pb.EncodedEntry,
+			ClientID: 123,
+			SeriesID: client.NoOPSeriesID,
+			Index:    uint64(idx + 1),
+			Term:     1,
+			Cmd:      GetEncodedWithKeys(dio.NoCompression, []byte("data"), kl),
+		})
+	}
+	sm.taskQ.Add(Task{Entries: entries})
+	if _, err := sm.Handle(make([]Task, 0, 8), nil); err != nil {
+		t.Fatalf("handle failed %v", err)
+	}
+	if sm.GetLastApplied() != 6 {
+		t.Errorf("last applied %d, want 6", sm.GetLastApplied())
+	}
+	sort.Slice(store.parallel, func(i, j int) bool {
+		return store.parallel[i][0] < store.parallel[j][0]
+	})
+	parallel := [][]uint64{{1, 3}, {2}, {5}, {6}}
+	if !reflect.DeepEqual(store.parallel, parallel) {
+		t.Errorf("parallel updates %v, want %v", store.parallel, parallel)
+	}
+	if !reflect.DeepEqual(store.updates, [][]uint64{{4}}) {
+		t.Errorf("updates %v, want [[4]]", store.updates)
+	}
+	if nodeProxy.index != 6 || nodeProxy.smResult.Value != 60 {
+		t.Errorf("unexpected result %d, %d", nodeProxy.index, nodeProxy.smResult.Value)
+	}
+}
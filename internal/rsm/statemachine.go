@@ -29,6 +29,7 @@ import (
 	"github.com/lni/goutils/logutil"
 
 	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/invariants"
 	"github.com/lni/dragonboat/v4/internal/raft"
 	"github.com/lni/dragonboat/v4/internal/server"
 	"github.com/lni/dragonboat/v4/internal/settings"
@@ -186,6 +187,7 @@ type StateMachine struct {
 	onDiskInitIndex uint64
 	onDiskIndex     uint64
 	syncedIndex     uint64
+	chunked         *chunkedEntry
 	mu              sync.RWMutex
 	sct             config.CompressionType
 	onDiskSM        bool
@@ -376,6 +378,9 @@ func (s *StateMachine) doRecover(ss pb.Snapshot, init bool) error {
 	if s.aborted {
 		return sm.ErrSnapshotStopped
 	}
+	if err := s.dropChunked(); err != nil {
+		return err
+	}
 	onDisk := s.OnDiskStateMachine()
 	shrunk, err := s.isShrunkSnapshot(ss, init)
 	if err != nil {
@@ -423,6 +428,10 @@ func (s *StateMachine) apply(ss pb.Snapshot, init bool) {
 	s.members.set(ss.Membership)
 	s.lastApplied.Lock()
 	defer s.lastApplied.Unlock()
+	if invariants.SafetyCheck && ss.Index < s.lastApplied.index {
+		plog.Panicf("%s applied index moving backwards, applied %d, %s term %d",
+			s.id(), s.lastApplied.index, s.ssid(ss.Index), ss.Term)
+	}
 	s.lastApplied.index, s.lastApplied.term = ss.Index, ss.Term
 	s.index, s.term = ss.Index, ss.Term
 }
@@ -767,6 +776,11 @@ func (s *StateMachine) checkSnapshotStatus(r SSRequest) error {
 	if s.aborted {
 		return sm.ErrSnapshotStopped
 	}
+	if s.chunked != nil {
+		// snapshots are never taken in the middle of a chunked entry as the
+		// partially reassembled payload is not included in snapshots
+		return ErrChunkedEntryPending
+	}
 	index := s.GetLastApplied()
 	if index < s.snapshotIndex {
 		panic("s.index < s.snapshotIndex")
@@ -864,7 +878,7 @@ func getEntryTypes(entries []pb.Entry) (bool, bool) {
 	allUpdate := true
 	allNoOP := true
 	for _, v := range entries {
-		if allUpdate && !v.IsUpdateEntry() {
+		if allUpdate && (!v.IsUpdateEntry() || v.Type == pb.ChunkedEntry) {
 			allUpdate = false
 		}
 		if allNoOP && !v.IsNoOPSession() {
@@ -889,6 +903,9 @@ func (s *StateMachine) handle(t []Task, a []sm.Entry) error {
 		}()
 		update, noop := getEntryTypes(entries)
 		if batch && update && noop {
+			if err := s.abortChunked(entries[0]); err != nil {
+				return err
+			}
 			if err := s.handleBatch(entries, a); err != nil {
 				return err
 			}
@@ -933,6 +950,12 @@ func (s *StateMachine) setOnDiskIndex(first uint64, last uint64) {
 }
 
 func (s *StateMachine) handleEntry(e pb.Entry, last bool) error {
+	if e.Type == pb.ChunkedEntry {
+		return s.handleChunk(e, last)
+	}
+	if err := s.abortChunked(e); err != nil {
+		return err
+	}
 	if e.IsConfigChange() {
 		return s.configChange(e)
 	}
@@ -968,6 +991,130 @@ func (s *StateMachine) handleEntry(e pb.Entry, last bool) error {
 	return nil
 }
 
+func (s *StateMachine) handleChunk(e pb.Entry, last bool) error {
+	ce, streamed, ok, err := s.addChunk(e)
+	if err != nil {
+		return err
+	}
+	if ok && streamed {
+		var r sm.Result
+		ce, r, ok, err = s.updateChunk(e)
+		if err != nil {
+			return err
+		}
+		if ok {
+			s.node.ApplyUpdate(ce, r, false, false, last)
+			return nil
+		}
+	}
+	if !ok {
+		if last {
+			s.node.ApplyUpdate(e, sm.Result{}, false, true, true)
+		}
+		return nil
+	}
+	return s.handleEntry(ce, last)
+}
+
+// addChunk adds the chunk to the chunked entry being reassembled, it returns
+// the reassembled entry once all its chunks have been added. For chunked
+// entries applied chunk by chunk, the returned boolean values are both true
+// when the chunk is expected to be applied by updateChunk.
+func (s *StateMachine) addChunk(e pb.Entry) (pb.Entry, bool, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seq, _, size, _ := decodeChunk(e); seq == 0 {
+		if s.chunked != nil {
+			plog.Warningf("%s dropped incomplete chunked entry, index %d",
+				s.id(), s.chunked.entry.Index)
+			if err := s.dropChunked(); err != nil {
+				return pb.Entry{}, false, false, err
+			}
+		}
+		streamed := s.sm.Chunked() && isStreamable(e)
+		if s.chunked = newChunkedEntry(e, streamed); s.chunked == nil {
+			plog.Warningf("%s dropped chunked entry too large to be reassembled, "+
+				"index %d, size %d", s.id(), e.Index, size)
+		}
+	}
+	if s.chunked == nil || !s.chunked.add(e) {
+		plog.Warningf("%s dropped unexpected chunk, index %d", s.id(), e.Index)
+		if err := s.dropChunked(); err != nil {
+			return pb.Entry{}, false, false, err
+		}
+		s.setApplied(e.Index, e.Term)
+		return pb.Entry{}, false, false, nil
+	}
+	if s.chunked.streamed {
+		return pb.Entry{}, true, true, nil
+	}
+	if !s.chunked.completed() {
+		s.setApplied(e.Index, e.Term)
+		return pb.Entry{}, false, false, nil
+	}
+	ce := s.chunked.entry
+	s.chunked = nil
+	return ce, false, true, nil
+}
+
+// updateChunk applies the specified chunk already added by addChunk into the
+// state machine. It returns the entry and the result of the proposal once its
+// last chunk has been applied.
+func (s *StateMachine) updateChunk(e pb.Entry) (pb.Entry, sm.Result, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.setApplied(e.Index, e.Term)
+	c := s.chunked
+	_, _, _, data := decodeChunk(e)
+	// offset and size of the payload exclude the encoded entry header
+	offset := c.added - uint64(len(data))
+	if offset == 0 {
+		data = data[EEHeaderSize:]
+	} else {
+		offset -= uint64(EEHeaderSize)
+	}
+	size := c.size - uint64(EEHeaderSize)
+	completed := c.completed()
+	if completed {
+		s.chunked = nil
+	}
+	if s.entryInInitDiskSM(e.Index) {
+		// already applied into the on disk state machine
+		return pb.Entry{}, sm.Result{}, false, nil
+	}
+	r, err := s.sm.UpdateChunk(sm.Entry{Index: e.Index, Cmd: data}, offset, size)
+	if err != nil || !completed {
+		return pb.Entry{}, sm.Result{}, false, err
+	}
+	s.setOnDiskIndex(e.Index, e.Index)
+	return c.entry, r, true, nil
+}
+
+// abortChunked drops the partially reassembled chunked entry, if any, as
+// chunks of the same entry are always contiguous in the Raft log, it means
+// the remaining chunks have been lost, e.g. during a leader change.
+func (s *StateMachine) abortChunked(e pb.Entry) error {
+	if s.chunked == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	plog.Warningf("%s dropped incomplete chunked entry, index %d, next %d",
+		s.id(), s.chunked.entry.Index, e.Index)
+	return s.dropChunked()
+}
+
+// dropChunked drops the partially reassembled chunked entry, chunks already
+// applied into the state machine are discarded by the state machine.
+func (s *StateMachine) dropChunked() error {
+	c := s.chunked
+	s.chunked = nil
+	if c != nil && c.streamed {
+		return s.sm.AbortChunked()
+	}
+	return nil
+}
+
 func (s *StateMachine) onApplied(e pb.Entry,
 	result sm.Result, ignored bool, rejected bool, last bool) {
 	if !ignored {
@@ -995,7 +1142,7 @@ func (s *StateMachine) handleBatch(input []pb.Entry, ents []sm.Entry) error {
 		}
 	}
 	if len(ents) > 0 {
-		results, err := s.sm.BatchedUpdate(ents)
+		results, err := s.batchedUpdate(input[skipped:], ents)
 		if err != nil {
 			return err
 		}
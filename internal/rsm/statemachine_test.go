@@ -28,6 +28,7 @@ import (
 	"github.com/lni/dragonboat/v4/config"
 	"github.com/lni/dragonboat/v4/internal/raft"
 	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/settings"
 	"github.com/lni/dragonboat/v4/internal/tests"
 	"github.com/lni/dragonboat/v4/internal/tests/kvpb"
 	"github.com/lni/dragonboat/v4/internal/utils/dio"
@@ -2189,6 +2190,15 @@ func (t *testManagedStateMachine) DestroyedC() <-chan struct{}         { return
 func (t *testManagedStateMachine) Concurrent() bool                    { return t.concurrent }
 func (t *testManagedStateMachine) OnDisk() bool                        { return t.onDisk }
 func (t *testManagedStateMachine) Type() pb.StateMachineType           { return t.smType }
+func (t *testManagedStateMachine) ParallelUpdate(ents []sm.Entry) ([]sm.Entry, error) {
+	return ents, nil
+}
+func (t *testManagedStateMachine) Parallel() bool { return false }
+func (t *testManagedStateMachine) UpdateChunk(sm.Entry, uint64, uint64) (sm.Result, error) {
+	return sm.Result{}, nil
+}
+func (t *testManagedStateMachine) AbortChunked() error { return nil }
+func (t *testManagedStateMachine) Chunked() bool       { return false }
 func (t *testManagedStateMachine) BatchedUpdate(ents []sm.Entry) ([]sm.Entry, error) {
 	if !t.corruptIndex {
 		t.first = ents[0].Index
@@ -2797,3 +2807,297 @@ func TestRestoreRemoteErrorIsReturned(t *testing.T) {
 	}
 	runSMTest2(t, tf, fs)
 }
+
+func getTestChunkedEntries(data []byte, index uint64) []pb.Entry {
+	e := pb.Entry{
+		Type:     pb.EncodedEntry,
+		Key:      100,
+		ClientID: 123,
+		SeriesID: client.NoOPSeriesID,
+		Cmd:      GetEncoded(dio.NoCompression, data, nil),
+	}
+	chunks := SplitEntry(e, 4)
+	for i := range chunks {
+		chunks[i].Index = index + uint64(i)
+		chunks[i].Term = 1
+	}
+	return chunks
+}
+
+func TestChunkedEntryIsReassembledBeforeUpdate(t *testing.T) {
+	tf := func(t *testing.T, sm *StateMachine, ds IManagedStateMachine,
+		nodeProxy *testNodeProxy, snapshotter *testSnapshotter, store sm.IStateMachine) {
+		chunks := getTestChunkedEntries(getTestKVData(), 236)
+		if len(chunks) < 4 {
+			t.Fatalf("unexpected chunk count %d", len(chunks))
+		}
+		sm.lastApplied.index = 235
+		sm.index = 235
+		half := len(chunks) / 2
+		sm.taskQ.Add(Task{Entries: chunks[:half]})
+		batch := make([]Task, 0, 8)
+		if _, err := sm.Handle(batch, nil); err != nil {
+			t.Fatalf("handle failed %v", err)
+		}
+		if _, ok := store.(*tests.KVTest).KVStore["test-key"]; ok {
+			t.Errorf("partially applied chunked entry updated the sm")
+		}
+		if err := sm.checkSnapshotStatus(SSRequest{}); !errors.Is(err, ErrChunkedEntryPending) {
+			t.Errorf("snapshot not blocked, %v", err)
+		}
+		sm.taskQ.Add(Task{Entries: chunks[half:]})
+		if _, err := sm.Handle(batch, nil); err != nil {
+			t.Fatalf("handle failed %v", err)
+		}
+		last := chunks[len(chunks)-1].Index
+		if sm.GetLastApplied() != last {
+			t.Errorf("last applied %d, want %d", sm.GetLastApplied(), last)
+		}
+		v, ok := store.(*tests.KVTest).KVStore["test-key"]
+		if !ok || v != "test-value" {
+			t.Errorf("unexpected value %s, %t", v, ok)
+		}
+		if nodeProxy.index != last || nodeProxy.ignored || nodeProxy.rejected {
+			t.Errorf("unexpected ApplyUpdate call, %d, %t, %t",
+				nodeProxy.index, nodeProxy.ignored, nodeProxy.rejected)
+		}
+		if err := sm.checkSnapshotStatus(SSRequest{}); err != nil {
+			t.Errorf("snapshot blocked, %v", err)
+		}
+	}
+	fs := vfs.GetTestFS()
+	runSMTest2(t, tf, fs)
+}
+
+func TestIncompleteChunkedEntryIsDropped(t *testing.T) {
+	tf := func(t *testing.T, sm *StateMachine, ds IManagedStateMachine,
+		nodeProxy *testNodeProxy, snapshotter *testSnapshotter, store sm.IStateMachine) {
+		chunks := getTestChunkedEntries(getTestKVData(), 236)
+		half := len(chunks) / 2
+		entries := append([]pb.Entry{}, chunks[:half]...)
+		entries = append(entries, pb.Entry{
+			Type:     pb.EncodedEntry,
+			Key:      200,
+			ClientID: 123,
+			SeriesID: client.NoOPSeriesID,
+			Cmd:      GetEncoded(dio.NoCompression, getTestKVData2(), nil),
+			Index:    236 + uint64(half),
+			Term:     2,
+		})
+		// remaining chunks are never expected to be seen, they are used here to
+		// check that out of order chunks are ignored
+		for _, e := range chunks[half:] {
+			e.Index = e.Index + 1
+			e.Term = 2
+			entries = append(entries, e)
+		}
+		sm.lastApplied.index = 235
+		sm.index = 235
+		sm.taskQ.Add(Task{Entries: entries})
+		batch := make([]Task, 0, 8)
+		if _, err := sm.Handle(batch, nil); err != nil {
+			t.Fatalf("handle failed %v", err)
+		}
+		last := entries[len(entries)-1].Index
+		if sm.GetLastApplied() != last {
+			t.Errorf("last applied %d, want %d", sm.GetLastApplied(), last)
+		}
+		kv := store.(*tests.KVTest).KVStore
+		if _, ok := kv["test-key"]; ok {
+			t.Errorf("incomplete chunked entry applied")
+		}
+		if _, ok := kv["test-key-2"]; !ok {
+			t.Errorf("regular entry not applied")
+		}
+		if sm.chunked != nil {
+			t.Errorf("incomplete chunked entry not dropped")
+		}
+	}
+	fs := vfs.GetTestFS()
+	runSMTest2(t, tf, fs)
+}
+
+type chunkedUpdateSM struct {
+	sm.IStateMachine
+	payload []byte
+	applied [][]byte
+	indexes []uint64
+	aborted int
+}
+
+func (c *chunkedUpdateSM) UpdateChunk(e sm.Entry,
+	offset uint64, size uint64) (sm.Result, error) {
+	if offset != uint64(len(c.payload)) {
+		return sm.Result{}, errors.New("unexpected offset")
+	}
+	c.payload = append(c.payload, e.Cmd...)
+	c.indexes = append(c.indexes, e.Index)
+	if offset+uint64(len(e.Cmd)) < size {
+		return sm.Result{}, nil
+	}
+	c.applied = append(c.applied, c.payload)
+	c.payload = nil
+	return sm.Result{Value: size}, nil
+}
+
+func (c *chunkedUpdateSM) AbortChunked() error {
+	c.payload = nil
+	c.aborted++
+	return nil
+}
+
+func runChunkedUpdateSMTest(t *testing.T,
+	tf func(t *testing.T, sm *StateMachine, nodeProxy *testNodeProxy,
+		store *chunkedUpdateSM)) {
+	fs := vfs.GetTestFS()
+	defer leaktest.AfterTest(t)()
+	createTestDir(fs)
+	defer removeTestDir(fs)
+	kv := tests.NewKVTest(1, 1)
+	kv.(*tests.KVTest).DisableLargeDelay()
+	store := &chunkedUpdateSM{IStateMachine: kv}
+	config := config.Config{ShardID: 1, ReplicaID: 1}
+	ds := NewNativeSM(config, NewInMemStateMachine(store), make(chan struct{}))
+	nodeProxy := newTestNodeProxy()
+	snapshotter := newTestSnapshotter(fs)
+	sm := NewStateMachine(ds, snapshotter, config, nodeProxy, fs)
+	sm.lastApplied.index = 235
+	sm.index = 235
+	tf(t, sm, nodeProxy, store)
+	reportLeakedFD(fs, t)
+}
+
+func TestChunkedEntryCanBeAppliedChunkByChunk(t *testing.T) {
+	tf := func(t *testing.T, sm *StateMachine,
+		nodeProxy *testNodeProxy, store *chunkedUpdateSM) {
+		data := getTestKVData()
+		chunks := getTestChunkedEntries(data, 236)
+		half := len(chunks) / 2
+		sm.taskQ.Add(Task{Entries: chunks[:half]})
+		batch := make([]Task, 0, 8)
+		if _, err := sm.Handle(batch, nil); err != nil {
+			t.Fatalf("handle failed %v", err)
+		}
+		if len(store.indexes) != half || len(store.applied) != 0 {
+			t.Errorf("chunks not applied one by one")
+		}
+		if sm.chunked == nil || sm.chunked.entry.Cmd != nil {
+			t.Errorf("chunks unexpectedly reassembled")
+		}
+		if err := sm.checkSnapshotStatus(SSRequest{}); !errors.Is(err, ErrChunkedEntryPending) {
+			t.Errorf("snapshot not blocked, %v", err)
+		}
+		sm.taskQ.Add(Task{Entries: chunks[half:]})
+		if _, err := sm.Handle(batch, nil); err != nil {
+			t.Fatalf("handle failed %v", err)
+		}
+		last := chunks[len(chunks)-1].Index
+		if sm.GetLastApplied() != last {
+			t.Errorf("last applied %d, want %d", sm.GetLastApplied(), last)
+		}
+		if len(store.applied) != 1 || !bytes.Equal(store.applied[0], data) {
+			t.Fatalf("unexpected applied payload")
+		}
+		if _, ok := store.IStateMachine.(*tests.KVTest).KVStore["test-key"]; ok {
+			t.Errorf("chunked entry applied using Update")
+		}
+		if nodeProxy.index != last || nodeProxy.ignored || nodeProxy.rejected {
+			t.Errorf("unexpected ApplyUpdate call, %d, %t, %t",
+				nodeProxy.index, nodeProxy.ignored, nodeProxy.rejected)
+		}
+		if sm.chunked != nil {
+			t.Errorf("chunked entry not completed")
+		}
+	}
+	runChunkedUpdateSMTest(t, tf)
+}
+
+func TestIncompleteChunkedEntryIsAbortedInStateMachine(t *testing.T) {
+	tf := func(t *testing.T, sm *StateMachine,
+		nodeProxy *testNodeProxy, store *chunkedUpdateSM) {
+		chunks := getTestChunkedEntries(getTestKVData(), 236)
+		half := len(chunks) / 2
+		entries := append([]pb.Entry{}, chunks[:half]...)
+		entries = append(entries, pb.Entry{
+			Type:     pb.EncodedEntry,
+			Key:      200,
+			ClientID: 123,
+			SeriesID: client.NoOPSeriesID,
+			Cmd:      GetEncoded(dio.NoCompression, getTestKVData2(), nil),
+			Index:    236 + uint64(half),
+			Term:     2,
+		})
+		sm.taskQ.Add(Task{Entries: entries})
+		batch := make([]Task, 0, 8)
+		if _, err := sm.Handle(batch, nil); err != nil {
+			t.Fatalf("handle failed %v", err)
+		}
+		if store.aborted != 1 || len(store.applied) != 0 {
+			t.Errorf("incomplete chunked entry not aborted, %d", store.aborted)
+		}
+		if _, ok := store.IStateMachine.(*tests.KVTest).KVStore["test-key-2"]; !ok {
+			t.Errorf("regular entry not applied")
+		}
+	}
+	runChunkedUpdateSMTest(t, tf)
+}
+
+func TestCompressedChunkedEntryIsReassembled(t *testing.T) {
+	tf := func(t *testing.T, sm *StateMachine,
+		nodeProxy *testNodeProxy, store *chunkedUpdateSM) {
+		e := pb.Entry{
+			Type:     pb.EncodedEntry,
+			Key:      100,
+			ClientID: 123,
+			SeriesID: client.NoOPSeriesID,
+			Cmd:      GetEncoded(dio.Snappy, getTestKVData(), nil),
+		}
+		chunks := SplitEntry(e, 4)
+		for i := range chunks {
+			chunks[i].Index = 236 + uint64(i)
+			chunks[i].Term = 1
+		}
+		sm.taskQ.Add(Task{Entries: chunks})
+		batch := make([]Task, 0, 8)
+		if _, err := sm.Handle(batch, nil); err != nil {
+			t.Fatalf("handle failed %v", err)
+		}
+		if len(store.indexes) != 0 {
+			t.Errorf("compressed chunked entry applied chunk by chunk")
+		}
+		if _, ok := store.IStateMachine.(*tests.KVTest).KVStore["test-key"]; !ok {
+			t.Errorf("compressed chunked entry not applied")
+		}
+	}
+	runChunkedUpdateSMTest(t, tf)
+}
+
+func TestTooLargeChunkedEntryIsDropped(t *testing.T) {
+	tf := func(t *testing.T, sm *StateMachine, ds IManagedStateMachine,
+		nodeProxy *testNodeProxy, snapshotter *testSnapshotter, store sm.IStateMachine) {
+		maxSize := settings.Soft.MaxChunkedProposalSize
+		settings.Soft.MaxChunkedProposalSize = 1
+		defer func() {
+			settings.Soft.MaxChunkedProposalSize = maxSize
+		}()
+		data := make([]byte, 4096)
+		copy(data, getTestKVData())
+		chunks := getTestChunkedEntries(data, 236)
+		sm.lastApplied.index = 235
+		sm.index = 235
+		sm.taskQ.Add(Task{Entries: chunks})
+		batch := make([]Task, 0, 8)
+		if _, err := sm.Handle(batch, nil); err != nil {
+			t.Fatalf("handle failed %v", err)
+		}
+		last := chunks[len(chunks)-1].Index
+		if sm.GetLastApplied() != last {
+			t.Errorf("last applied %d, want %d", sm.GetLastApplied(), last)
+		}
+		if sm.chunked != nil || !nodeProxy.ignored {
+			t.Errorf("too large chunked entry not dropped")
+		}
+	}
+	fs := vfs.GetTestFS()
+	runSMTest2(t, tf, fs)
+}
@@ -0,0 +1,125 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+)
+
+const (
+	// BackupManifestFilename is the filename of the backup manifest.
+	BackupManifestFilename    = "BACKUP"
+	backupManifestTmpFilename = "BACKUP.tmp"
+	// BackupVersion is the version of the backup format.
+	BackupVersion = 1
+)
+
+// ErrInvalidBackup indicates that the backup manifest is missing or invalid.
+var ErrInvalidBackup = errors.New("invalid backup")
+
+// BackupShard describes the exported snapshot of a replica included in a
+// backup.
+type BackupShard struct {
+	ShardID   uint64
+	ReplicaID uint64
+	Index     uint64
+	Term      uint64
+	// Dir is the directory of the exported snapshot relative to the backup
+	// directory.
+	Dir string
+	// Members, NonVotings and Witnesses are the membership of the shard at
+	// Index.
+	Members    map[uint64]string
+	NonVotings map[uint64]string `json:",omitempty"`
+	Witnesses  map[uint64]string `json:",omitempty"`
+}
+
+// BackupManifest describes a backup of all replicas hosted by a NodeHost.
+type BackupManifest struct {
+	Version      int
+	NodeHostID   string
+	RaftAddress  string
+	DeploymentID uint64
+	// CreatedAt is the unix time in nanoseconds when the backup was created.
+	CreatedAt int64
+	Shards    []BackupShard
+}
+
+// GetBackupShardDir returns the directory name used for storing the exported
+// snapshot of the specified shard.
+func GetBackupShardDir(shardID uint64) string {
+	return fmt.Sprintf("shard-%d", shardID)
+}
+
+// SaveBackupManifest saves the manifest into the specified backup directory.
+// The manifest is saved last so a backup directory with a manifest contains a
+// complete backup.
+func SaveBackupManifest(dir string, m BackupManifest, fs vfs.IFS) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	fp := fs.PathJoin(dir, backupManifestTmpFilename)
+	f, err := fs.Create(fp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		return firstError(err, f.Close())
+	}
+	if err := f.Sync(); err != nil {
+		return firstError(err, f.Close())
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := fs.Rename(fp,
+		fs.PathJoin(dir, BackupManifestFilename)); err != nil {
+		return err
+	}
+	return fileutil.SyncDir(dir, fs)
+}
+
+// LoadBackupManifest loads the manifest from the specified backup directory.
+func LoadBackupManifest(dir string, fs vfs.IFS) (BackupManifest, error) {
+	f, err := fs.Open(fs.PathJoin(dir, BackupManifestFilename))
+	if err != nil {
+		if vfs.IsNotExist(err) {
+			return BackupManifest{}, errors.Wrapf(ErrInvalidBackup,
+				"manifest not found in %s", dir)
+		}
+		return BackupManifest{}, err
+	}
+	defer f.Close()
+	data, err := fileutil.ReadAll(f)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	var m BackupManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return BackupManifest{}, errors.Wrapf(ErrInvalidBackup, "%v", err)
+	}
+	if m.Version != BackupVersion {
+		return BackupManifest{}, errors.Wrapf(ErrInvalidBackup,
+			"unknown version %d", m.Version)
+	}
+	return m, nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/vfs"
+)
+
+func TestBackupManifestCanBeSavedAndLoaded(t *testing.T) {
+	fs := vfs.NewMemFS()
+	dir := "backup"
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("failed to create dir %v", err)
+	}
+	if _, err := LoadBackupManifest(dir, fs); !errors.Is(err, ErrInvalidBackup) {
+		t.Errorf("unexpected error %v", err)
+	}
+	m := BackupManifest{
+		Version:      BackupVersion,
+		NodeHostID:   "nhid-1",
+		RaftAddress:  "localhost:9010",
+		DeploymentID: 2,
+		CreatedAt:    100,
+		Shards: []BackupShard{
+			{
+				ShardID:   1,
+				ReplicaID: 2,
+				Index:     300,
+				Term:      4,
+				Dir:       fs.PathJoin(GetBackupShardDir(1), GetSnapshotDirName(300)),
+				Members:   map[uint64]string{2: "localhost:9010"},
+				Witnesses: map[uint64]string{3: "localhost:9011"},
+			},
+		},
+	}
+	if err := SaveBackupManifest(dir, m, fs); err != nil {
+		t.Fatalf("failed to save manifest %v", err)
+	}
+	loaded, err := LoadBackupManifest(dir, fs)
+	if err != nil {
+		t.Fatalf("failed to load manifest %v", err)
+	}
+	if !reflect.DeepEqual(m, loaded) {
+		t.Errorf("got %+v, want %+v", loaded, m)
+	}
+	m.Version = BackupVersion + 1
+	if err := SaveBackupManifest(dir, m, fs); err != nil {
+		t.Fatalf("failed to save manifest %v", err)
+	}
+	if _, err := LoadBackupManifest(dir, fs); !errors.Is(err, ErrInvalidBackup) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	bucketStripes = 16
+	// buckets are garbage collected at most once every bucketGCInterval when
+	// there are more than bucketGCThreshold buckets in a stripe
+	bucketGCInterval  = 10 * time.Second
+	bucketGCThreshold = 1024
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type bucketStripe struct {
+	mu      sync.Mutex
+	buckets map[uint64]*tokenBucket
+	lastGC  time.Time
+}
+
+// TokenBuckets is a set of token buckets keyed by uint64 values, it is used
+// to limit the rate of requests made by individual clients. Idle buckets are
+// full and they are garbage collected as they are equivalent to missing ones.
+type TokenBuckets struct {
+	rate    float64
+	burst   float64
+	now     func() time.Time
+	stripes [bucketStripes]bucketStripe
+}
+
+// NewTokenBuckets creates a new TokenBuckets instance that allows rate tokens
+// to be taken per second with bursts of up to burst tokens for each key. The
+// returned instance is disabled when rate is 0.
+func NewTokenBuckets(rate uint64, burst uint64) *TokenBuckets {
+	if burst < rate {
+		burst = rate
+	}
+	t := &TokenBuckets{
+		rate:  float64(rate),
+		burst: float64(burst),
+		now:   time.Now,
+	}
+	for i := range t.stripes {
+		t.stripes[i].buckets = make(map[uint64]*tokenBucket)
+	}
+	return t
+}
+
+// Enabled returns a boolean value indicating whether rate limiting is enabled.
+func (t *TokenBuckets) Enabled() bool {
+	return t != nil && t.rate > 0
+}
+
+// Take tries to take a token from the bucket of the specified key. It returns
+// 0 when a token is taken, or the time to wait before a token becomes
+// available.
+func (t *TokenBuckets) Take(key uint64) time.Duration {
+	if !t.Enabled() {
+		return 0
+	}
+	now := t.now()
+	s := &t.stripes[key%bucketStripes]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gc(now, t.rate, t.burst)
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: t.burst, last: now}
+		s.buckets[key] = b
+	} else {
+		b.tokens = fill(b, now, t.rate, t.burst)
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	wait := time.Duration((1 - b.tokens) / t.rate * float64(time.Second))
+	if wait <= 0 {
+		wait = time.Nanosecond
+	}
+	return wait
+}
+
+// Refund returns a token previously taken from the bucket of the specified
+// key, it is used when the request charged for the token is not accepted.
+func (t *TokenBuckets) Refund(key uint64) {
+	if !t.Enabled() {
+		return
+	}
+	s := &t.stripes[key%bucketStripes]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.buckets[key]; ok {
+		b.tokens++
+		if b.tokens > t.burst {
+			b.tokens = t.burst
+		}
+	}
+}
+
+func (s *bucketStripe) gc(now time.Time, rate float64, burst float64) {
+	if len(s.buckets) < bucketGCThreshold || now.Sub(s.lastGC) < bucketGCInterval {
+		return
+	}
+	s.lastGC = now
+	for key, b := range s.buckets {
+		if fill(b, now, rate, burst) >= burst {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+func fill(b *tokenBucket, now time.Time, rate float64, burst float64) float64 {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed <= 0 {
+		return b.tokens
+	}
+	tokens := b.tokens + elapsed*rate
+	if tokens > burst {
+		return burst
+	}
+	return tokens
+}
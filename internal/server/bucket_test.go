@@ -0,0 +1,116 @@
+// Copyright 2017-2019 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketsCanBeDisabled(t *testing.T) {
+	var nilBuckets *TokenBuckets
+	if nilBuckets.Enabled() {
+		t.Errorf("nil buckets enabled")
+	}
+	tb := NewTokenBuckets(0, 10)
+	if tb.Enabled() {
+		t.Errorf("unexpectedly enabled")
+	}
+	for i := 0; i < 100; i++ {
+		if wait := tb.Take(1); wait != 0 {
+			t.Fatalf("disabled buckets returned %s", wait)
+		}
+	}
+}
+
+func TestTokenBucketsLimitRatePerKey(t *testing.T) {
+	now := time.Now()
+	tb := NewTokenBuckets(10, 20)
+	tb.now = func() time.Time { return now }
+	for i := 0; i < 20; i++ {
+		if wait := tb.Take(1); wait != 0 {
+			t.Fatalf("%d, unexpectedly limited", i)
+		}
+	}
+	wait := tb.Take(1)
+	if wait != 100*time.Millisecond {
+		t.Errorf("wait %s, want 100ms", wait)
+	}
+	if wait := tb.Take(2); wait != 0 {
+		t.Errorf("other key limited")
+	}
+	now = now.Add(50 * time.Millisecond)
+	if wait := tb.Take(1); wait != 50*time.Millisecond {
+		t.Errorf("wait %s, want 50ms", wait)
+	}
+	now = now.Add(50 * time.Millisecond)
+	if wait := tb.Take(1); wait != 0 {
+		t.Errorf("token not refilled")
+	}
+	now = now.Add(time.Hour)
+	for i := 0; i < 20; i++ {
+		if wait := tb.Take(1); wait != 0 {
+			t.Fatalf("%d, burst exceeded after refill", i)
+		}
+	}
+	if wait := tb.Take(1); wait == 0 {
+		t.Errorf("burst not limited")
+	}
+}
+
+func TestTokenCanBeRefunded(t *testing.T) {
+	now := time.Now()
+	tb := NewTokenBuckets(1, 2)
+	tb.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		if wait := tb.Take(1); wait != 0 {
+			t.Fatalf("%d, unexpectedly limited", i)
+		}
+	}
+	if wait := tb.Take(1); wait == 0 {
+		t.Fatalf("not limited")
+	}
+	tb.Refund(1)
+	if wait := tb.Take(1); wait != 0 {
+		t.Errorf("refunded token not available")
+	}
+	// refunds never take the bucket over the burst size
+	tb.Refund(1)
+	tb.Refund(1)
+	tb.Refund(1)
+	for i := 0; i < 2; i++ {
+		if wait := tb.Take(1); wait != 0 {
+			t.Fatalf("%d, unexpectedly limited", i)
+		}
+	}
+	if wait := tb.Take(1); wait == 0 {
+		t.Errorf("refunded over the burst size")
+	}
+}
+
+func TestIdleTokenBucketsAreGarbageCollected(t *testing.T) {
+	now := time.Now()
+	tb := NewTokenBuckets(10, 10)
+	tb.now = func() time.Time { return now }
+	for i := uint64(0); i < bucketGCThreshold*bucketStripes; i++ {
+		tb.Take(i)
+	}
+	now = now.Add(bucketGCInterval)
+	tb.Take(0)
+	s := &tb.stripes[0]
+	if len(s.buckets) != 1 {
+		t.Errorf("%d buckets not garbage collected", len(s.buckets))
+	}
+}
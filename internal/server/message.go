@@ -68,11 +68,25 @@ func (q *MessageQueue) Tick() {
 	atomic.AddUint64(&q.tick, 1)
 }
 
+// SetMemoryBudget sets the NodeHost wide memory budget used for tracking the
+// size of queued Replicate messages.
+func (q *MessageQueue) SetMemoryBudget(b *MemoryBudget) {
+	q.rl.SetMemoryBudget(b)
+}
+
+// MemorySize returns the tracked size of queued Replicate messages in bytes.
+func (q *MessageQueue) MemorySize() uint64 {
+	return q.rl.Get()
+}
+
 // Close closes the queue so no further messages can be added.
 func (q *MessageQueue) Close() {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 	q.stopped = true
+	if q.rl.Tracked() {
+		q.rl.Set(0)
+	}
 }
 
 // Notify notifies the notification channel listener that a new message is now
@@ -151,13 +165,17 @@ func (q *MessageQueue) MustAdd(msg pb.Message) bool {
 }
 
 func (q *MessageQueue) tryAdd(msg pb.Message) bool {
-	if !q.rl.Enabled() || msg.Type != pb.Replicate {
+	if !q.rl.Tracked() || msg.Type != pb.Replicate {
 		return true
 	}
 	if q.rl.RateLimited() {
 		plog.Warningf("rate limited dropped a Replicate msg from %d", msg.ShardID)
 		return false
 	}
+	if q.rl.budget != nil && q.rl.budget.Limited(q.rl.Get()) {
+		plog.Warningf("memory budget dropped a Replicate msg from %d", msg.ShardID)
+		return false
+	}
 	q.rl.Increase(pb.GetEntrySliceInMemSize(msg.Entries))
 	return true
 }
@@ -208,7 +226,7 @@ func (q *MessageQueue) Get() []pb.Message {
 	q.leftInWrite = !q.leftInWrite
 	q.gc()
 	q.oldIdx = sz
-	if q.rl.Enabled() {
+	if q.rl.Tracked() {
 		q.rl.Set(0)
 	}
 	if len(q.nodrop) == 0 && len(q.delayed) == 0 {
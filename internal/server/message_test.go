@@ -277,3 +277,35 @@ func TestDelayedMessage(t *testing.T) {
 	require.Equal(t, dm1, result[1])
 	require.Equal(t, rm, result[2])
 }
+
+func TestAddMessageIsLimitedByMemoryBudget(t *testing.T) {
+	b := NewMemoryBudget(1024)
+	b.AddReplica()
+	q := NewMessageQueue(10000, false, 0, 0)
+	q.SetMemoryBudget(b)
+	for i := 0; i < 10000; i++ {
+		e := pb.Entry{Index: uint64(i + 1)}
+		m := pb.Message{
+			Type:    pb.Replicate,
+			Entries: []pb.Entry{e},
+		}
+		added, stopped := q.Add(m)
+		if stopped {
+			t.Fatalf("unexpectedly stopped")
+		}
+		if !added {
+			if b.Get() <= b.MaxSize() {
+				t.Errorf("dropped before the budget is exhausted")
+			}
+			q.Get()
+			if b.Get() != 0 || q.MemorySize() != 0 {
+				t.Errorf("memory not released, %d", b.Get())
+			}
+			return
+		}
+		if b.Get() != q.MemorySize() {
+			t.Errorf("budget size %d, queue size %d", b.Get(), q.MemorySize())
+		}
+	}
+	t.Fatalf("failed to observe any message dropped by the memory budget")
+}
@@ -31,8 +31,97 @@ type followerState struct {
 	inMemLogSize uint64
 }
 
+// MemoryBudget is the struct used to keep tracking the total memory size
+// consumed by all replicas managed by a NodeHost instance.
+type MemoryBudget struct {
+	size    uint64
+	maxSize uint64
+	// shared is the part of size not owned by any replica, e.g. buffers used
+	// for transferring snapshots
+	shared   uint64
+	replicas int64
+}
+
+// NewMemoryBudget creates and returns a memory budget instance.
+func NewMemoryBudget(max uint64) *MemoryBudget {
+	return &MemoryBudget{
+		maxSize: max,
+	}
+}
+
+// Enabled returns a boolean flag indicating whether the memory budget is
+// enabled.
+func (b *MemoryBudget) Enabled() bool {
+	return b != nil && b.maxSize > 0 && b.maxSize != math.MaxUint64
+}
+
+// AddReplica records that a new replica is sharing the budget.
+func (b *MemoryBudget) AddReplica() {
+	atomic.AddInt64(&b.replicas, 1)
+}
+
+// RemoveReplica records that a replica is no longer sharing the budget.
+func (b *MemoryBudget) RemoveReplica() {
+	atomic.AddInt64(&b.replicas, -1)
+}
+
+// Increase increases the recorded memory size by sz bytes.
+func (b *MemoryBudget) Increase(sz uint64) {
+	atomic.AddUint64(&b.size, sz)
+}
+
+// Decrease decreases the recorded memory size by sz bytes.
+func (b *MemoryBudget) Decrease(sz uint64) {
+	atomic.AddUint64(&b.size, ^(sz - 1))
+}
+
+// Reserve records sz bytes of memory not owned by any replica, e.g. buffers
+// used for transferring snapshots. Such memory reduces the share of the budget
+// available to each replica.
+func (b *MemoryBudget) Reserve(sz uint64) {
+	atomic.AddUint64(&b.shared, sz)
+	b.Increase(sz)
+}
+
+// Release releases sz bytes of memory previously recorded by Reserve.
+func (b *MemoryBudget) Release(sz uint64) {
+	atomic.AddUint64(&b.shared, ^(sz - 1))
+	b.Decrease(sz)
+}
+
+// Get returns the recorded memory size.
+func (b *MemoryBudget) Get() uint64 {
+	return atomic.LoadUint64(&b.size)
+}
+
+// MaxSize returns the max memory size allowed.
+func (b *MemoryBudget) MaxSize() uint64 {
+	return b.maxSize
+}
+
+// Limited returns a boolean flag indicating whether a replica currently using
+// used bytes of memory should be throttled. Once the budget is exhausted, only
+// those replicas using at least their fair share of the budget are throttled,
+// so busy replicas can not starve the others. Memory recorded by Reserve is
+// not available to replicas, it is excluded before the budget is shared.
+func (b *MemoryBudget) Limited(used uint64) bool {
+	if !b.Enabled() || b.Get() <= b.maxSize {
+		return false
+	}
+	available := uint64(0)
+	if shared := atomic.LoadUint64(&b.shared); shared < b.maxSize {
+		available = b.maxSize - shared
+	}
+	share := available
+	if replicas := atomic.LoadInt64(&b.replicas); replicas > 1 {
+		share = available / uint64(replicas)
+	}
+	return used >= share
+}
+
 // RateLimiter is the struct used to keep tracking consumed memory size.
 type RateLimiter struct {
+	budget  *MemoryBudget
 	size    uint64
 	maxSize uint64
 }
@@ -50,19 +139,60 @@ func (r *RateLimiter) Enabled() bool {
 	return r.maxSize > 0 && r.maxSize != math.MaxUint64
 }
 
+// SetMemoryBudget sets the NodeHost wide memory budget to be updated whenever
+// the recorded size changes. It is not concurrent safe, it is expected to be
+// called before the rate limiter is used by other goroutines.
+func (r *RateLimiter) SetMemoryBudget(b *MemoryBudget) {
+	r.budget = b
+	if b != nil {
+		b.Increase(r.Get())
+	}
+}
+
+// Tracked returns a boolean flag indicating whether the consumed memory size
+// is required to be tracked.
+func (r *RateLimiter) Tracked() bool {
+	return r.Enabled() || r.budget != nil
+}
+
 // Increase increases the recorded in memory log size by sz bytes.
 func (r *RateLimiter) Increase(sz uint64) {
 	atomic.AddUint64(&r.size, sz)
+	if r.budget != nil {
+		r.budget.Increase(sz)
+	}
 }
 
 // Decrease decreases the recorded in memory log size by sz bytes.
 func (r *RateLimiter) Decrease(sz uint64) {
-	atomic.AddUint64(&r.size, ^(sz - 1))
+	if r.budget == nil {
+		atomic.AddUint64(&r.size, ^(sz - 1))
+		return
+	}
+	// sizes recorded before the budget was set are not tracked by the budget,
+	// never go below zero so the budget is not corrupted
+	for {
+		v := atomic.LoadUint64(&r.size)
+		if sz > v {
+			sz = v
+		}
+		if atomic.CompareAndSwapUint64(&r.size, v, v-sz) {
+			r.budget.Decrease(sz)
+			return
+		}
+	}
 }
 
 // Set sets the recorded in memory log size to sz bytes.
 func (r *RateLimiter) Set(sz uint64) {
-	atomic.StoreUint64(&r.size, sz)
+	v := atomic.SwapUint64(&r.size, sz)
+	if r.budget != nil {
+		if sz > v {
+			r.budget.Increase(sz - v)
+		} else if v > sz {
+			r.budget.Decrease(v - sz)
+		}
+	}
 }
 
 // Get returns the recorded in memory log size.
@@ -109,6 +239,18 @@ func (r *InMemRateLimiter) Enabled() bool {
 	return r.rl.Enabled()
 }
 
+// SetMemoryBudget sets the NodeHost wide memory budget to be updated whenever
+// the recorded in memory log size changes.
+func (r *InMemRateLimiter) SetMemoryBudget(b *MemoryBudget) {
+	r.rl.SetMemoryBudget(b)
+}
+
+// Tracked returns a boolean flag indicating whether the in memory log size is
+// required to be tracked.
+func (r *InMemRateLimiter) Tracked() bool {
+	return r.rl.Tracked()
+}
+
 // Tick advances the internal logical clock.
 func (r *InMemRateLimiter) Tick() {
 	r.tick++
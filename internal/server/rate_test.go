@@ -241,3 +241,106 @@ func TestRateLimitChangeCantChangeVeryOften(t *testing.T) {
 		t.Errorf("unexpectedly rate limited")
 	}
 }
+
+func TestMemoryBudgetCanBeEnabled(t *testing.T) {
+	var nilBudget *MemoryBudget
+	if nilBudget.Enabled() {
+		t.Errorf("nil budget enabled")
+	}
+	if NewMemoryBudget(0).Enabled() {
+		t.Errorf("budget unexpectedly enabled")
+	}
+	if !NewMemoryBudget(1).Enabled() {
+		t.Errorf("budget not enabled")
+	}
+}
+
+func TestRateLimiterUpdatesMemoryBudget(t *testing.T) {
+	b := NewMemoryBudget(1000)
+	r := NewRateLimiter(0)
+	if r.Tracked() {
+		t.Errorf("unexpectedly tracked")
+	}
+	r.Increase(100)
+	r.SetMemoryBudget(b)
+	if !r.Tracked() {
+		t.Errorf("not tracked")
+	}
+	if b.Get() != 100 {
+		t.Errorf("budget size %d, want 100", b.Get())
+	}
+	r.Increase(50)
+	r.Decrease(30)
+	if b.Get() != 120 {
+		t.Errorf("budget size %d, want 120", b.Get())
+	}
+	r.Set(200)
+	if b.Get() != 200 {
+		t.Errorf("budget size %d, want 200", b.Get())
+	}
+	r.Set(10)
+	if b.Get() != 10 {
+		t.Errorf("budget size %d, want 10", b.Get())
+	}
+	// never go below zero
+	r.Decrease(100)
+	if r.Get() != 0 || b.Get() != 0 {
+		t.Errorf("size %d, budget size %d, want 0", r.Get(), b.Get())
+	}
+}
+
+func TestMemoryBudgetIsFairlyShared(t *testing.T) {
+	b := NewMemoryBudget(1000)
+	b.AddReplica()
+	b.AddReplica()
+	b.Increase(800)
+	if b.Limited(800) {
+		t.Errorf("limited before the budget is exhausted")
+	}
+	b.Increase(400)
+	if !b.Limited(800) {
+		t.Errorf("replica over its fair share not limited")
+	}
+	if b.Limited(400) {
+		t.Errorf("replica under its fair share limited")
+	}
+	b.RemoveReplica()
+	if b.Limited(800) {
+		t.Errorf("sole replica under the budget limited")
+	}
+	b.Decrease(1200)
+	if b.Get() != 0 {
+		t.Errorf("budget size %d, want 0", b.Get())
+	}
+}
+
+func TestReservedMemoryIsNotSharedByReplicas(t *testing.T) {
+	b := NewMemoryBudget(1000)
+	b.AddReplica()
+	b.AddReplica()
+	b.Increase(200)
+	if b.Limited(200) {
+		t.Errorf("limited before the budget is exhausted")
+	}
+	b.Reserve(900)
+	if b.Get() != 1100 {
+		t.Errorf("budget size %d, want 1100", b.Get())
+	}
+	if !b.Limited(100) {
+		t.Errorf("replica over its share of the unreserved budget not limited")
+	}
+	if b.Limited(10) {
+		t.Errorf("replica under its share of the unreserved budget limited")
+	}
+	b.Reserve(200)
+	if !b.Limited(0) {
+		t.Errorf("replica not limited when the budget is fully reserved")
+	}
+	b.Release(1100)
+	if b.Limited(200) {
+		t.Errorf("limited after reserved memory is released")
+	}
+	if b.Get() != 200 {
+		t.Errorf("budget size %d, want 200", b.Get())
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+)
+
+const (
+	tombstoneFilename    = "TOMBSTONE"
+	tombstoneTmpFilename = "TOMBSTONE.tmp"
+	tombstoneRecordSize  = 24
+)
+
+// ErrCorruptedTombstone indicates that the tombstone data is corrupted.
+var ErrCorruptedTombstone = errors.New("corrupted tombstone data")
+
+// Tombstone is the record indicating that a Raft shard or one of its replicas
+// has been permanently removed. A Tombstone with its ReplicaID field set to 0
+// covers all replicas of the shard.
+type Tombstone struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// CreatedAt is the unix time in nanoseconds when the tombstone was created.
+	CreatedAt int64
+}
+
+// IsShard returns a boolean value indicating whether the tombstone covers the
+// entire shard.
+func (t Tombstone) IsShard() bool {
+	return t.ReplicaID == 0
+}
+
+// Covers returns a boolean value indicating whether the specified replica is
+// covered by the tombstone.
+func (t Tombstone) Covers(shardID uint64, replicaID uint64) bool {
+	if t.ShardID != shardID {
+		return false
+	}
+	return t.IsShard() || t.ReplicaID == replicaID
+}
+
+// TombstoneList is a list of Tombstone records.
+type TombstoneList struct {
+	Tombstones []Tombstone
+}
+
+// Size returns the size of the marshaled TombstoneList.
+func (l *TombstoneList) Size() int {
+	return 8 + len(l.Tombstones)*tombstoneRecordSize
+}
+
+// Marshal marshals the TombstoneList.
+func (l *TombstoneList) Marshal() ([]byte, error) {
+	data := make([]byte, l.Size())
+	if _, err := l.MarshalTo(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// MarshalTo marshals the TombstoneList to the specified buffer.
+func (l *TombstoneList) MarshalTo(data []byte) (int, error) {
+	if len(data) < l.Size() {
+		return 0, errors.New("buffer too small")
+	}
+	binary.BigEndian.PutUint64(data, uint64(len(l.Tombstones)))
+	offset := 8
+	for _, t := range l.Tombstones {
+		binary.BigEndian.PutUint64(data[offset:], t.ShardID)
+		binary.BigEndian.PutUint64(data[offset+8:], t.ReplicaID)
+		binary.BigEndian.PutUint64(data[offset+16:], uint64(t.CreatedAt))
+		offset += tombstoneRecordSize
+	}
+	return offset, nil
+}
+
+// Unmarshal unmarshals the TombstoneList from the input data.
+func (l *TombstoneList) Unmarshal(data []byte) error {
+	if len(data) < 8 {
+		return ErrCorruptedTombstone
+	}
+	count := binary.BigEndian.Uint64(data)
+	data = data[8:]
+	if uint64(len(data)) != count*tombstoneRecordSize {
+		return ErrCorruptedTombstone
+	}
+	l.Tombstones = make([]Tombstone, 0, count)
+	for i := uint64(0); i < count; i++ {
+		offset := i * tombstoneRecordSize
+		l.Tombstones = append(l.Tombstones, Tombstone{
+			ShardID:   binary.BigEndian.Uint64(data[offset:]),
+			ReplicaID: binary.BigEndian.Uint64(data[offset+8:]),
+			CreatedAt: int64(binary.BigEndian.Uint64(data[offset+16:])),
+		})
+	}
+	return nil
+}
+
+// MergeTombstones merges the update into the current list of tombstones, it
+// returns the merged list and a boolean flag indicating whether any new
+// tombstone has been added. The earliest CreatedAt value is kept for
+// duplicated tombstones.
+func MergeTombstones(current []Tombstone,
+	update []Tombstone) ([]Tombstone, bool) {
+	type key struct {
+		shardID   uint64
+		replicaID uint64
+	}
+	m := make(map[key]Tombstone, len(current)+len(update))
+	for _, t := range current {
+		m[key{t.ShardID, t.ReplicaID}] = t
+	}
+	changed := false
+	for _, t := range update {
+		k := key{t.ShardID, t.ReplicaID}
+		if v, ok := m[k]; !ok {
+			m[k] = t
+			changed = true
+		} else if t.CreatedAt < v.CreatedAt {
+			m[k] = t
+		}
+	}
+	result := make([]Tombstone, 0, len(m))
+	for _, t := range m {
+		result = append(result, t)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ShardID != result[j].ShardID {
+			return result[i].ShardID < result[j].ShardID
+		}
+		return result[i].ReplicaID < result[j].ReplicaID
+	})
+	return result, changed
+}
+
+// PruneTombstones removes expired tombstones, i.e. those created before the
+// specified unix time in nanoseconds. It returns the remaining tombstones and
+// a boolean flag indicating whether any tombstone has been removed.
+func PruneTombstones(current []Tombstone, before int64) ([]Tombstone, bool) {
+	result := make([]Tombstone, 0, len(current))
+	for _, t := range current {
+		if t.CreatedAt >= before {
+			result = append(result, t)
+		}
+	}
+	return result, len(result) != len(current)
+}
+
+// SaveTombstones persists the specified tombstones into the data directory of
+// the specified deployment. The existing tombstone file is atomically replaced.
+func (env *Env) SaveTombstones(did uint64, tombstones []Tombstone) error {
+	dir, _ := env.GetLogDBDirs(did)
+	l := &TombstoneList{Tombstones: tombstones}
+	if fileutil.HasFlagFile(dir, tombstoneTmpFilename, env.fs) {
+		if err := fileutil.RemoveFlagFile(dir,
+			tombstoneTmpFilename, env.fs); err != nil {
+			return err
+		}
+	}
+	if err := fileutil.CreateFlagFile(dir,
+		tombstoneTmpFilename, l, env.fs); err != nil {
+		return err
+	}
+	if err := env.fs.Rename(env.fs.PathJoin(dir, tombstoneTmpFilename),
+		env.fs.PathJoin(dir, tombstoneFilename)); err != nil {
+		return err
+	}
+	return fileutil.SyncDir(dir, env.fs)
+}
+
+// LoadTombstones loads tombstones previously saved in the data directory of
+// the specified deployment.
+func (env *Env) LoadTombstones(did uint64) ([]Tombstone, error) {
+	dir, _ := env.GetLogDBDirs(did)
+	if !fileutil.HasFlagFile(dir, tombstoneFilename, env.fs) {
+		return nil, nil
+	}
+	var l TombstoneList
+	if err := fileutil.GetFlagFileContent(dir,
+		tombstoneFilename, &l, env.fs); err != nil {
+		return nil, err
+	}
+	return l.Tombstones, nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lni/dragonboat/v4/internal/vfs"
+)
+
+func TestTombstoneCovers(t *testing.T) {
+	shard := Tombstone{ShardID: 1}
+	replica := Tombstone{ShardID: 1, ReplicaID: 2}
+	if !shard.Covers(1, 2) || !shard.Covers(1, 3) || shard.Covers(2, 2) {
+		t.Errorf("unexpected shard tombstone coverage")
+	}
+	if !replica.Covers(1, 2) || replica.Covers(1, 3) || replica.Covers(2, 2) {
+		t.Errorf("unexpected replica tombstone coverage")
+	}
+}
+
+func TestTombstoneListCanBeMarshaled(t *testing.T) {
+	l := &TombstoneList{
+		Tombstones: []Tombstone{
+			{ShardID: 1, CreatedAt: 100},
+			{ShardID: 2, ReplicaID: 3, CreatedAt: 200},
+		},
+	}
+	data, err := l.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal %v", err)
+	}
+	var l2 TombstoneList
+	if err := l2.Unmarshal(data); err != nil {
+		t.Fatalf("failed to unmarshal %v", err)
+	}
+	if !reflect.DeepEqual(l, &l2) {
+		t.Errorf("unexpected result %v, want %v", l2, l)
+	}
+	if err := l2.Unmarshal(data[:len(data)-1]); err != ErrCorruptedTombstone {
+		t.Errorf("failed to detect corrupted data, %v", err)
+	}
+}
+
+func TestMergeTombstones(t *testing.T) {
+	current := []Tombstone{{ShardID: 2, CreatedAt: 200}}
+	update := []Tombstone{
+		{ShardID: 2, CreatedAt: 100},
+		{ShardID: 1, ReplicaID: 1, CreatedAt: 300},
+	}
+	result, changed := MergeTombstones(current, update)
+	if !changed {
+		t.Errorf("changed flag not set")
+	}
+	expected := []Tombstone{
+		{ShardID: 1, ReplicaID: 1, CreatedAt: 300},
+		{ShardID: 2, CreatedAt: 100},
+	}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("unexpected result %v, want %v", result, expected)
+	}
+	if _, changed := MergeTombstones(result, update); changed {
+		t.Errorf("changed flag unexpectedly set")
+	}
+}
+
+func TestTombstonesCanBeSavedAndLoaded(t *testing.T) {
+	fs := vfs.GetTestFS()
+	defer func() {
+		if err := fs.RemoveAll(singleNodeHostTestDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	env, err := NewEnv(getTestNodeHostConfig(), fs)
+	if err != nil {
+		t.Fatalf("failed to new environment %v", err)
+	}
+	if _, _, err := env.CreateNodeHostDir(testDeploymentID); err != nil {
+		t.Fatalf("%v", err)
+	}
+	ts, err := env.LoadTombstones(testDeploymentID)
+	if err != nil || len(ts) != 0 {
+		t.Fatalf("unexpected tombstones %v, %v", ts, err)
+	}
+	for i := uint64(1); i <= 2; i++ {
+		expected := []Tombstone{{ShardID: i, CreatedAt: int64(i)}}
+		if err := env.SaveTombstones(testDeploymentID, expected); err != nil {
+			t.Fatalf("failed to save tombstones %v", err)
+		}
+		ts, err = env.LoadTombstones(testDeploymentID)
+		if err != nil {
+			t.Fatalf("failed to load tombstones %v", err)
+		}
+		if !reflect.DeepEqual(expected, ts) {
+			t.Errorf("unexpected result %v, want %v", ts, expected)
+		}
+	}
+}
+
+func TestPruneTombstones(t *testing.T) {
+	current := []Tombstone{
+		{ShardID: 1, CreatedAt: 100},
+		{ShardID: 2, ReplicaID: 1, CreatedAt: 200},
+		{ShardID: 3, CreatedAt: 300},
+	}
+	result, pruned := PruneTombstones(current, 200)
+	if !pruned {
+		t.Errorf("pruned flag not set")
+	}
+	expected := []Tombstone{
+		{ShardID: 2, ReplicaID: 1, CreatedAt: 200},
+		{ShardID: 3, CreatedAt: 300},
+	}
+	if !reflect.DeepEqual(expected, result) {
+		t.Errorf("unexpected result %v, want %v", result, expected)
+	}
+	if _, pruned := PruneTombstones(result, 200); pruned {
+		t.Errorf("pruned flag unexpectedly set")
+	}
+}
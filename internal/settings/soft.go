@@ -85,6 +85,9 @@ type soft struct {
 	// IncomingProposalQueueLength defines the number of pending proposals
 	// allowed for each raft group.
 	IncomingProposalQueueLength uint64
+	// MaxChunkedProposalSize defines the max payload size of proposals made to
+	// shards with chunked proposals enabled.
+	MaxChunkedProposalSize uint64
 	// ReceiveQueueLength is the length of the receive queue on each node.
 	ReceiveQueueLength uint64
 	// SnapshotStatusPushDelayMS is the number of millisecond delays we impose
@@ -101,6 +104,9 @@ type soft struct {
 	// LazyFreeCycle defines how often should entry queue and message queue
 	// to be freed.
 	LazyFreeCycle uint64
+	// OrphanCheckIntervalSecond defines how often in seconds NodeHost checks
+	// its LogDB for orphaned replicas.
+	OrphanCheckIntervalSecond uint64
 	// PanicOnSizeMismatch defines whether dragonboat should panic when snapshot
 	// file size doesn't match the size recorded in snapshot metadata.
 	PanicOnSizeMismatch bool
@@ -190,11 +196,13 @@ func getDefaultSoftSettings() soft {
 		MinEntrySliceFreeSize:          96,
 		IncomingReadIndexQueueLength:   4096,
 		IncomingProposalQueueLength:    2048,
+		MaxChunkedProposalSize:         4 * LargeEntitySize,
 		SnapshotStatusPushDelayMS:      1000,
 		PendingProposalShards:          16,
 		TaskQueueInitialCap:            24,
 		TaskQueueTargetLength:          64,
 		NodeHostRequestStatePoolShards: 8,
+		OrphanCheckIntervalSecond:      60,
 		TaskBatchSize:                  512,
 		NodeReloadMillisecond:          200,
 		CloseWorkerTimedWaitSecond:     5,
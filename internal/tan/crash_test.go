@@ -0,0 +1,103 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tan
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func writeTestEntries(t *testing.T, db *db, first uint64, last uint64) error {
+	buf := make([]byte, 1024)
+	for i := first; i <= last; i++ {
+		u := pb.Update{
+			ShardID:       2,
+			ReplicaID:     3,
+			State:         pb.State{Commit: i, Term: 5, Vote: 3},
+			EntriesToSave: []pb.Entry{{Index: i, Term: 5, Cmd: make([]byte, 64)}},
+		}
+		if _, err := db.write(u, buf); err != nil {
+			return err
+		}
+		if err := db.sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkTestEntries(t *testing.T, db *db, last uint64) {
+	rs, err := db.getRaftState(2, 3, 0)
+	require.NoError(t, err)
+	require.Equal(t, last, rs.State.Commit)
+	require.Equal(t, uint64(1), rs.FirstIndex)
+	require.Equal(t, last, rs.EntryCount)
+	entries, _, err := db.getEntries(2, 3, nil, 0, 1, last+1, math.MaxUint64)
+	require.NoError(t, err)
+	require.Equal(t, int(last), len(entries))
+	for i, e := range entries {
+		require.Equal(t, uint64(i+1), e.Index)
+	}
+}
+
+func getCrashTestOptions(fs vfs.IFS) *Options {
+	return &Options{
+		MaxLogFileSize:      4096,
+		MaxManifestFileSize: MaxManifestFileSize,
+		FS:                  fs,
+	}
+}
+
+func TestDBRecoversFromCrash(t *testing.T) {
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+	opts := getCrashTestOptions(fs)
+	tf := func(t *testing.T, db *db) {
+		require.NoError(t, writeTestEntries(t, db, 1, 50))
+		fs.Crash()
+		// neither the entries nor the rotated log files are durable
+		require.NoError(t, writeTestEntries(t, db, 51, 100))
+	}
+	runTanTest(t, opts, tf, fs)
+	require.NoError(t, fs.Recover())
+	tf = func(t *testing.T, db *db) {
+		checkTestEntries(t, db, 50)
+		require.NoError(t, writeTestEntries(t, db, 51, 60))
+		checkTestEntries(t, db, 60)
+	}
+	runTanTest(t, opts, tf, fs)
+}
+
+func TestDBRecoversFromTornWrite(t *testing.T) {
+	fs := vfs.NewFaultFS(vfs.NewMemFS())
+	opts := getCrashTestOptions(fs)
+	tf := func(t *testing.T, db *db) {
+		require.NoError(t, writeTestEntries(t, db, 1, 10))
+		fs.Inject("torn", vfs.Fault{Op: vfs.OpWrite, Path: ".log", Torn: true})
+		require.Error(t, writeTestEntries(t, db, 11, 11))
+		fs.Crash()
+		fs.ClearFaults()
+	}
+	runTanTest(t, opts, tf, fs)
+	require.NoError(t, fs.Recover())
+	tf = func(t *testing.T, db *db) {
+		checkTestEntries(t, db, 10)
+	}
+	runTanTest(t, opts, tf, fs)
+}
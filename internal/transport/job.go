@@ -16,11 +16,13 @@ package transport
 
 import (
 	"context"
+	"sync"
 	"sync/atomic"
 
 	"github.com/cockroachdb/errors"
 	"github.com/lni/goutils/logutil"
 
+	"github.com/lni/dragonboat/v4/internal/server"
 	"github.com/lni/dragonboat/v4/internal/vfs"
 	"github.com/lni/dragonboat/v4/raftio"
 	pb "github.com/lni/dragonboat/v4/raftpb"
@@ -81,6 +83,15 @@ type job struct {
 	replicaID    uint64
 	shardID      uint64
 	streaming    bool
+	// budget is charged for chunk data buffered by the job, charged is the
+	// size currently charged. All charged memory is released once the job is
+	// done, released is set by then.
+	budget *server.MemoryBudget
+	mu     struct {
+		sync.Mutex
+		charged  uint64
+		released bool
+	}
 }
 
 func newJob(ctx context.Context,
@@ -143,22 +154,71 @@ func (j *job) AddChunk(chunk pb.Chunk) (bool, bool) {
 		plog.Debugf("sending a poison chunk to %s", dn(j.shardID, j.replicaID))
 	}
 
+	sz := uint64(len(chunk.Data))
+	j.charge(sz)
 	select {
 	case j.ch <- chunk:
 		return true, false
 	case <-j.completed:
+		j.uncharge(sz)
 		if !chunk.IsPoisonChunk() {
 			plog.Panicf("more chunk received for completed job")
 		}
 		return true, false
 	case <-j.failed:
+		j.uncharge(sz)
 		plog.Warningf("stream snapshot to %s failed", dn(j.shardID, j.replicaID))
 		return false, false
 	case <-j.stopc:
+		j.uncharge(sz)
 		return false, true
 	}
 }
 
+// charge charges the memory budget for sz bytes of chunk data buffered by the
+// job.
+func (j *job) charge(sz uint64) {
+	if j.budget == nil || sz == 0 {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.mu.released {
+		j.mu.charged += sz
+		j.budget.Reserve(sz)
+	}
+}
+
+// uncharge releases sz bytes of chunk data charged by charge, it is a no-op
+// once all memory charged by the job has been released by releaseMemory.
+func (j *job) uncharge(sz uint64) {
+	if j.budget == nil || sz == 0 {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.mu.released {
+		j.mu.charged -= sz
+		j.budget.Release(sz)
+	}
+}
+
+// releaseMemory releases all memory charged by the job, it is called when
+// the job is completed or aborted. Chunks still buffered in ch are never
+// going to be sent.
+func (j *job) releaseMemory() {
+	if j.budget == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.mu.released {
+		j.mu.released = true
+		j.budget.Release(j.mu.charged)
+		j.mu.charged = 0
+	}
+}
+
 func (j *job) process() error {
 	if j.conn == nil {
 		panic("nil connection")
@@ -184,7 +244,9 @@ func (j *job) streamSnapshot() error {
 			if chunk.IsPoisonChunk() {
 				return ErrStreamSnapshot
 			}
-			if err := j.sendChunk(chunk, j.conn); err != nil {
+			err := j.sendChunk(chunk, j.conn)
+			j.uncharge(uint64(len(chunk.Data)))
+			if err != nil {
 				plog.Errorf("streaming snapshot chunk to %s failed, %v",
 					dn(chunk.ShardID, chunk.ReplicaID), err)
 				return err
@@ -219,6 +281,8 @@ func (j *job) sendSnapshot() error {
 
 func (j *job) sendChunks(chunks []pb.Chunk) error {
 	chunkData := make([]byte, snapshotChunkSize)
+	j.charge(snapshotChunkSize)
+	defer j.uncharge(snapshotChunkSize)
 	for _, chunk := range chunks {
 		select {
 		case <-j.stopc:
@@ -21,6 +21,7 @@ import (
 	"github.com/lni/goutils/syncutil"
 
 	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/server"
 	"github.com/lni/dragonboat/v4/internal/vfs"
 	pb "github.com/lni/dragonboat/v4/raftpb"
 )
@@ -111,6 +112,74 @@ func TestKeepSendingChunksUsingFailedJobWillNotBlock(t *testing.T) {
 	c.close()
 }
 
+func TestBufferedChunksAreChargedAgainstMemoryBudget(t *testing.T) {
+	fs := vfs.GetTestFS()
+	budget := server.NewMemoryBudget(4 * 1024 * 1024)
+	budget.AddReplica()
+	// a replica with 1MB of pending proposals is well within the budget
+	budget.Increase(1024 * 1024)
+	defer budget.Decrease(1024 * 1024)
+	transport := NewNOOPTransport(config.NodeHostConfig{}, nil, nil)
+	c := newJob(context.Background(), 1, 1, 1, true, 0, transport, nil, fs)
+	c.budget = budget
+	if budget.Limited(1024 * 1024) {
+		t.Fatalf("unexpectedly limited")
+	}
+	for i := 0; i < streamingChanLength; i++ {
+		sent, stopped := c.AddChunk(pb.Chunk{Data: make([]byte, 1024*1024)})
+		if !sent || stopped {
+			t.Fatalf("failed to add chunk")
+		}
+	}
+	if budget.Get() != 5*1024*1024 {
+		t.Errorf("budget size %d, want %d", budget.Get(), 5*1024*1024)
+	}
+	if !budget.Limited(1024 * 1024) {
+		t.Errorf("proposals not limited by buffered snapshot chunks")
+	}
+	c.releaseMemory()
+	if budget.Get() != 1024*1024 {
+		t.Errorf("budget size %d, want %d", budget.Get(), 1024*1024)
+	}
+	if budget.Limited(1024 * 1024) {
+		t.Errorf("still limited after the job is aborted")
+	}
+	c.charge(1024)
+	if budget.Get() != 1024*1024 {
+		t.Errorf("chunk charged after the job is released")
+	}
+}
+
+func TestSentChunksAreReleasedFromMemoryBudget(t *testing.T) {
+	fs := vfs.GetTestFS()
+	budget := server.NewMemoryBudget(4 * 1024 * 1024)
+	transport := NewNOOPTransport(config.NodeHostConfig{}, nil, nil)
+	c := newJob(context.Background(), 1, 1, 1, true, 0, transport, nil, fs)
+	c.budget = budget
+	if err := c.connect("a1"); err != nil {
+		t.Fatalf("connect failed %v", err)
+	}
+	stopper := syncutil.NewStopper()
+	var perr error
+	stopper.RunWorker(func() {
+		perr = c.process()
+	})
+	for i := 0; i < streamingChanLength*2; i++ {
+		sent, stopped := c.AddChunk(pb.Chunk{Data: make([]byte, 1024)})
+		if !sent || stopped {
+			t.Fatalf("failed to add chunk")
+		}
+	}
+	c.AddChunk(pb.Chunk{ChunkCount: pb.LastChunkCount})
+	stopper.Stop()
+	if perr != nil {
+		t.Fatalf("process failed %v", perr)
+	}
+	if budget.Get() != 0 {
+		t.Errorf("budget size %d, want 0", budget.Get())
+	}
+}
+
 func testSpecialChunkCanStopTheProcessLoop(t *testing.T,
 	tt uint64, experr error, fs vfs.IFS) {
 	cfg := config.NodeHostConfig{}
@@ -39,6 +39,7 @@ import (
 	"github.com/cockroachdb/errors"
 
 	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/server"
 	"github.com/lni/dragonboat/v4/internal/settings"
 	"github.com/lni/dragonboat/v4/internal/vfs"
 	"github.com/lni/dragonboat/v4/raftio"
@@ -60,6 +61,18 @@ func (t *Transport) SendSnapshot(m pb.Message) bool {
 	return true
 }
 
+// SetMemoryBudget sets the NodeHost wide memory budget to be charged for
+// snapshot chunks buffered when sending snapshots. It is expected to be called
+// before any snapshot is sent.
+func (t *Transport) SetMemoryBudget(b *server.MemoryBudget) {
+	t.budget = b
+}
+
+// SnapshotJobs returns the number of snapshot jobs in progress.
+func (t *Transport) SnapshotJobs() uint64 {
+	return atomic.LoadUint64(&t.jobs)
+}
+
 // GetStreamSink returns a connection used for streaming snapshot.
 func (t *Transport) GetStreamSink(shardID uint64, replicaID uint64) *Sink {
 	s := t.getStreamSink(shardID, replicaID)
@@ -152,6 +165,9 @@ func (t *Transport) createJob(key raftio.NodeInfo,
 		streaming, sz, t.trans, t.stopper.ShouldStop(), t.fs)
 	job.postSend = t.postSend
 	job.preSend = t.preSend
+	if t.budget.Enabled() {
+		job.budget = t.budget
+	}
 	return job
 }
 
@@ -161,6 +177,7 @@ func (t *Transport) processSnapshot(c *job, addr string) {
 	consecFailures := breaker.ConsecFailures()
 	shardID := c.shardID
 	replicaID := c.replicaID
+	defer c.releaseMemory()
 	if err := func() error {
 		if err := c.connect(addr); err != nil {
 			plog.Warningf("failed to get snapshot conn to %s", dn(shardID, replicaID))
@@ -193,6 +193,7 @@ type Transport struct {
 	cancel       context.CancelFunc
 	sourceID     string
 	nhConfig     config.NodeHostConfig
+	budget       *server.MemoryBudget
 	jobs         uint64
 }
 
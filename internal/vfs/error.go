@@ -15,6 +15,9 @@
 package vfs
 
 import (
+	"sync"
+	"time"
+
 	gvfs "github.com/lni/vfs"
 )
 
@@ -52,3 +55,66 @@ func OnIndex(index int32, op Op) *InjectIndex {
 func Wrap(fs IFS, inj Injector) *ErrorFS {
 	return gvfs.Wrap(fs, inj)
 }
+
+// FaultInjector is an Injector that injects errors and latency into FS
+// operations of selected types. It can be reconfigured at runtime.
+type FaultInjector struct {
+	mu      sync.RWMutex
+	errs    map[Op]error
+	latency map[Op]time.Duration
+}
+
+var _ Injector = (*FaultInjector)(nil)
+
+// NewFaultInjector creates a FaultInjector that doesn't inject any fault
+// until configured.
+func NewFaultInjector() *FaultInjector {
+	return &FaultInjector{
+		errs:    make(map[Op]error),
+		latency: make(map[Op]time.Duration),
+	}
+}
+
+// SetError makes all operations of the specified type fail with err, nil err
+// stops the error injection.
+func (f *FaultInjector) SetError(op Op, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		delete(f.errs, op)
+	} else {
+		f.errs[op] = err
+	}
+}
+
+// SetLatency delays all operations of the specified type by d, 0 stops the
+// latency injection.
+func (f *FaultInjector) SetLatency(op Op, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if d <= 0 {
+		delete(f.latency, op)
+	} else {
+		f.latency[op] = d
+	}
+}
+
+// Reset stops all fault injections.
+func (f *FaultInjector) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errs = make(map[Op]error)
+	f.latency = make(map[Op]time.Duration)
+}
+
+// MaybeError implements the Injector interface.
+func (f *FaultInjector) MaybeError(op Op) error {
+	f.mu.RLock()
+	err := f.errs[op]
+	d := f.latency[op]
+	f.mu.RUnlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+	return err
+}
@@ -0,0 +1,43 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFaultInjectorInjectsErrorsBySelectedOp(t *testing.T) {
+	inj := NewFaultInjector()
+	fs := Wrap(NewMemFS(), inj)
+	errTest := errors.New("test error")
+	inj.SetError(OpWrite, errTest)
+	if _, err := fs.Create("test-file"); !errors.Is(err, errTest) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := inj.MaybeError(OpRead); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	inj.SetError(OpWrite, nil)
+	writeFile(t, fs, "test-file", "data", true)
+	inj.SetError(OpRead, errTest)
+	if _, err := fs.Open("test-file"); !errors.Is(err, errTest) {
+		t.Errorf("unexpected error %v", err)
+	}
+	inj.Reset()
+	if got := readFile(t, fs, "test-file"); got != "data" {
+		t.Errorf("unexpected data %s", got)
+	}
+}
@@ -0,0 +1,515 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gvfs "github.com/lni/vfs"
+)
+
+// Fault describes a fault injected into FS operations.
+type Fault struct {
+	// Op is the type of operations affected by the fault. Operations that
+	// modify the filesystem, e.g. Create, Rename and Remove, are OpWrite
+	// operations, operations that query the filesystem, e.g. Open, List and
+	// Stat, are OpRead operations.
+	Op Op
+	// Path selects the affected files, the fault applies to all files with a
+	// path containing Path. All files are affected when Path is empty.
+	Path string
+	// Err is the error returned by affected operations.
+	Err error
+	// Latency is the delay added to affected operations.
+	Latency time.Duration
+	// Torn makes affected Write operations write only the first half of the
+	// data before failing with Err, or ErrInjected when Err is nil.
+	Torn bool
+	// Times is the number of times the fault is triggered before it is
+	// removed, 0 means the fault is never removed automatically.
+	Times int
+}
+
+// fileState tracks the synced size of a file written since the last Recover.
+type fileState struct {
+	synced  int64
+	created bool
+}
+
+// FaultFS is an IFS implementation that injects faults into operations of
+// the underlying IFS. Faults are identified by their names and can be
+// changed at runtime.
+//
+// FaultFS also simulates the loss of data not synced to disk. Once Crash is
+// called, syncs are no longer considered as durable. Recover drops all data
+// appended to files after their last durable sync and removes files that
+// have never been synced. Directory entries are not tracked, renamed and
+// removed files stay renamed and removed.
+type FaultFS struct {
+	fs      IFS
+	mu      sync.Mutex
+	faults  map[string]*Fault
+	crashed bool
+	files   map[string]*fileState
+}
+
+var _ IFS = (*FaultFS)(nil)
+
+// NewFaultFS creates a FaultFS backed by fs.
+func NewFaultFS(fs IFS) *FaultFS {
+	return &FaultFS{
+		fs:     fs,
+		faults: make(map[string]*Fault),
+		files:  make(map[string]*fileState),
+	}
+}
+
+// Inject injects the fault with the specified name, an existing fault with
+// the same name is replaced.
+func (fs *FaultFS) Inject(name string, f Fault) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.faults[name] = &f
+}
+
+// RemoveFault removes the fault with the specified name.
+func (fs *FaultFS) RemoveFault(name string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.faults, name)
+}
+
+// ClearFaults removes all faults.
+func (fs *FaultFS) ClearFaults() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.faults = make(map[string]*Fault)
+}
+
+// Crash simulates a crash, syncs made after the crash are not durable. It is
+// usually called right before closing all users of the FaultFS, followed by
+// a call to Recover.
+func (fs *FaultFS) Crash() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.crashed = true
+}
+
+// Recover drops all data not durably synced and clears the crashed state.
+func (fs *FaultFS) Recover() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for name, st := range fs.files {
+		if st.created {
+			if err := fs.fs.Remove(name); err != nil && !IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if err := fs.truncate(name, st.synced); err != nil {
+			return err
+		}
+	}
+	fs.files = make(map[string]*fileState)
+	fs.crashed = false
+	return nil
+}
+
+func (fs *FaultFS) truncate(name string, size int64) error {
+	fi, err := fs.fs.Stat(name)
+	if err != nil {
+		if IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.Size() <= size {
+		return nil
+	}
+	data := make([]byte, size)
+	if err := func() error {
+		f, err := fs.fs.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.ReadFull(f, data)
+		return err
+	}(); err != nil {
+		return err
+	}
+	f, err := fs.fs.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// fault returns a boolean value indicating whether the operation is a torn
+// write and the error to be returned by the operation.
+func (fs *FaultFS) fault(op Op, name string) (bool, error) {
+	var latency time.Duration
+	var err error
+	torn := false
+	func() {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		names := make([]string, 0, len(fs.faults))
+		for n := range fs.faults {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			f := fs.faults[n]
+			if f.Op != op || !strings.Contains(name, f.Path) {
+				continue
+			}
+			latency += f.Latency
+			if err == nil && !torn {
+				err = f.Err
+				torn = f.Torn && op == OpWrite
+			}
+			if f.Times > 0 {
+				f.Times--
+				if f.Times == 0 {
+					delete(fs.faults, n)
+				}
+			}
+		}
+	}()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if torn && err == nil {
+		err = ErrInjected
+	}
+	return torn, err
+}
+
+// opened records that the file has been opened for write.
+func (fs *FaultFS) opened(name string, created bool, f File) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if _, ok := fs.files[name]; ok {
+		return nil
+	}
+	st := &fileState{created: created}
+	if !created {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		st.synced = fi.Size()
+	}
+	fs.files[name] = st
+	return nil
+}
+
+// synced records that the file has been synced.
+func (fs *FaultFS) synced(name string, f File) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	st, ok := fs.files[name]
+	if !ok || fs.crashed {
+		return nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	st.synced = fi.Size()
+	st.created = false
+	return nil
+}
+
+func (fs *FaultFS) renamed(oldname string, newname string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if st, ok := fs.files[oldname]; ok {
+		delete(fs.files, oldname)
+		fs.files[newname] = st
+	}
+}
+
+func (fs *FaultFS) removed(name string, all bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for n := range fs.files {
+		if n == name || (all && strings.HasPrefix(n, name)) {
+			delete(fs.files, n)
+		}
+	}
+}
+
+func (fs *FaultFS) exist(name string) bool {
+	_, err := fs.fs.Stat(name)
+	return err == nil
+}
+
+// Create implements IFS.Create.
+func (fs *FaultFS) Create(name string) (File, error) {
+	if _, err := fs.fault(OpWrite, name); err != nil {
+		return nil, err
+	}
+	created := !fs.exist(name)
+	f, err := fs.fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.opened(name, created, f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &faultFile{file: f, fs: fs, name: name}, nil
+}
+
+// Link implements IFS.Link.
+func (fs *FaultFS) Link(oldname, newname string) error {
+	if _, err := fs.fault(OpWrite, newname); err != nil {
+		return err
+	}
+	return fs.fs.Link(oldname, newname)
+}
+
+// Open implements IFS.Open.
+func (fs *FaultFS) Open(name string, opts ...gvfs.OpenOption) (File, error) {
+	if _, err := fs.fault(OpRead, name); err != nil {
+		return nil, err
+	}
+	f, err := fs.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	ff := &faultFile{file: f, fs: fs, name: name}
+	for _, opt := range opts {
+		opt.Apply(ff)
+	}
+	return ff, nil
+}
+
+// OpenDir implements IFS.OpenDir.
+func (fs *FaultFS) OpenDir(name string) (File, error) {
+	if _, err := fs.fault(OpRead, name); err != nil {
+		return nil, err
+	}
+	f, err := fs.fs.OpenDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{file: f, fs: fs, name: name}, nil
+}
+
+// OpenForAppend implements IFS.OpenForAppend.
+func (fs *FaultFS) OpenForAppend(name string) (File, error) {
+	if _, err := fs.fault(OpWrite, name); err != nil {
+		return nil, err
+	}
+	created := !fs.exist(name)
+	f, err := fs.fs.OpenForAppend(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.opened(name, created, f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &faultFile{file: f, fs: fs, name: name}, nil
+}
+
+// Remove implements IFS.Remove.
+func (fs *FaultFS) Remove(name string) error {
+	if _, err := fs.fault(OpWrite, name); err != nil {
+		return err
+	}
+	if err := fs.fs.Remove(name); err != nil {
+		return err
+	}
+	fs.removed(name, false)
+	return nil
+}
+
+// RemoveAll implements IFS.RemoveAll.
+func (fs *FaultFS) RemoveAll(name string) error {
+	if _, err := fs.fault(OpWrite, name); err != nil {
+		return err
+	}
+	if err := fs.fs.RemoveAll(name); err != nil {
+		return err
+	}
+	fs.removed(name, true)
+	return nil
+}
+
+// Rename implements IFS.Rename.
+func (fs *FaultFS) Rename(oldname, newname string) error {
+	if _, err := fs.fault(OpWrite, newname); err != nil {
+		return err
+	}
+	if err := fs.fs.Rename(oldname, newname); err != nil {
+		return err
+	}
+	fs.renamed(oldname, newname)
+	return nil
+}
+
+// ReuseForWrite implements IFS.ReuseForWrite.
+func (fs *FaultFS) ReuseForWrite(oldname, newname string) (File, error) {
+	if _, err := fs.fault(OpWrite, newname); err != nil {
+		return nil, err
+	}
+	f, err := fs.fs.ReuseForWrite(oldname, newname)
+	if err != nil {
+		return nil, err
+	}
+	fs.renamed(oldname, newname)
+	if err := fs.opened(newname, false, f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &faultFile{file: f, fs: fs, name: newname}, nil
+}
+
+// MkdirAll implements IFS.MkdirAll.
+func (fs *FaultFS) MkdirAll(dir string, perm os.FileMode) error {
+	if _, err := fs.fault(OpWrite, dir); err != nil {
+		return err
+	}
+	return fs.fs.MkdirAll(dir, perm)
+}
+
+// Lock implements IFS.Lock.
+func (fs *FaultFS) Lock(name string) (io.Closer, error) {
+	if _, err := fs.fault(OpWrite, name); err != nil {
+		return nil, err
+	}
+	return fs.fs.Lock(name)
+}
+
+// List implements IFS.List.
+func (fs *FaultFS) List(dir string) ([]string, error) {
+	if _, err := fs.fault(OpRead, dir); err != nil {
+		return nil, err
+	}
+	return fs.fs.List(dir)
+}
+
+// Stat implements IFS.Stat.
+func (fs *FaultFS) Stat(name string) (os.FileInfo, error) {
+	if _, err := fs.fault(OpRead, name); err != nil {
+		return nil, err
+	}
+	return fs.fs.Stat(name)
+}
+
+// PathBase implements IFS.PathBase.
+func (fs *FaultFS) PathBase(p string) string {
+	return fs.fs.PathBase(p)
+}
+
+// PathJoin implements IFS.PathJoin.
+func (fs *FaultFS) PathJoin(elem ...string) string {
+	return fs.fs.PathJoin(elem...)
+}
+
+// PathDir implements IFS.PathDir.
+func (fs *FaultFS) PathDir(p string) string {
+	return fs.fs.PathDir(p)
+}
+
+// GetDiskUsage implements IFS.GetDiskUsage.
+func (fs *FaultFS) GetDiskUsage(path string) (gvfs.DiskUsage, error) {
+	if _, err := fs.fault(OpRead, path); err != nil {
+		return gvfs.DiskUsage{}, err
+	}
+	return fs.fs.GetDiskUsage(path)
+}
+
+type faultFile struct {
+	file File
+	fs   *FaultFS
+	name string
+}
+
+var _ File = (*faultFile)(nil)
+
+func (f *faultFile) Close() error {
+	return f.file.Close()
+}
+
+func (f *faultFile) Seek(offset int64, whence int) (int64, error) {
+	return f.file.Seek(offset, whence)
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if _, err := f.fs.fault(OpRead, f.name); err != nil {
+		return 0, err
+	}
+	return f.file.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := f.fs.fault(OpRead, f.name); err != nil {
+		return 0, err
+	}
+	return f.file.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if torn, err := f.fs.fault(OpWrite, f.name); err != nil {
+		if torn {
+			n, _ := f.file.Write(p[:len(p)/2])
+			return n, err
+		}
+		return 0, err
+	}
+	return f.file.Write(p)
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	if torn, err := f.fs.fault(OpWrite, f.name); err != nil {
+		if torn {
+			n, _ := f.file.WriteAt(p[:len(p)/2], off)
+			return n, err
+		}
+		return 0, err
+	}
+	return f.file.WriteAt(p, off)
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	if _, err := f.fs.fault(OpRead, f.name); err != nil {
+		return nil, err
+	}
+	return f.file.Stat()
+}
+
+func (f *faultFile) Sync() error {
+	if _, err := f.fs.fault(OpSync, f.name); err != nil {
+		return err
+	}
+	if err := f.file.Sync(); err != nil {
+		return err
+	}
+	return f.fs.synced(f.name, f.file)
+}
@@ -0,0 +1,166 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vfs
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, fs IFS, name string, data string, sync bool) {
+	t.Helper()
+	f, err := fs.Create(name)
+	if err != nil {
+		t.Fatalf("failed to create %s, %v", name, err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte(data)); err != nil {
+		t.Fatalf("failed to write %s, %v", name, err)
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			t.Fatalf("failed to sync %s, %v", name, err)
+		}
+	}
+}
+
+func readFile(t *testing.T, fs IFS, name string) string {
+	t.Helper()
+	f, err := fs.Open(name)
+	if err != nil {
+		t.Fatalf("failed to open %s, %v", name, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("failed to read %s, %v", name, err)
+	}
+	return string(data)
+}
+
+func TestFaultFSInjectsErrorsBySelectedPathAndOp(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	errTest := errors.New("test error")
+	fs.Inject("test", Fault{Op: OpWrite, Path: "bad", Err: errTest})
+	if _, err := fs.Create("bad-file"); !errors.Is(err, errTest) {
+		t.Errorf("unexpected error %v", err)
+	}
+	writeFile(t, fs, "good-file", "data", true)
+	if got := readFile(t, fs, "good-file"); got != "data" {
+		t.Errorf("unexpected data %s", got)
+	}
+	fs.Inject("test", Fault{Op: OpRead, Err: errTest})
+	if _, err := fs.Open("good-file"); !errors.Is(err, errTest) {
+		t.Errorf("unexpected error %v", err)
+	}
+	fs.RemoveFault("test")
+	if got := readFile(t, fs, "good-file"); got != "data" {
+		t.Errorf("unexpected data %s", got)
+	}
+}
+
+func TestFaultFSFaultIsRemovedAfterTriggeredTimes(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	fs.Inject("test", Fault{Op: OpSync, Err: ErrInjected, Times: 2})
+	f, err := fs.Create("file")
+	if err != nil {
+		t.Fatalf("failed to create file, %v", err)
+	}
+	defer f.Close()
+	for i := 0; i < 2; i++ {
+		if err := f.Sync(); !errors.Is(err, ErrInjected) {
+			t.Errorf("%d, unexpected error %v", i, err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		t.Errorf("fault not removed, %v", err)
+	}
+}
+
+func TestFaultFSLatency(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	fs.Inject("test", Fault{Op: OpWrite, Latency: 50 * time.Millisecond})
+	start := time.Now()
+	writeFile(t, fs, "file", "data", false)
+	if time.Since(start) < 100*time.Millisecond {
+		t.Errorf("latency not injected")
+	}
+	fs.ClearFaults()
+	start = time.Now()
+	writeFile(t, fs, "file", "data", false)
+	if time.Since(start) >= 100*time.Millisecond {
+		t.Errorf("latency not cleared")
+	}
+}
+
+func TestFaultFSTornWrite(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	f, err := fs.Create("file")
+	if err != nil {
+		t.Fatalf("failed to create file, %v", err)
+	}
+	fs.Inject("test", Fault{Op: OpWrite, Path: "file", Torn: true, Times: 1})
+	n, err := f.Write([]byte("12345678"))
+	if !errors.Is(err, ErrInjected) || n != 4 {
+		t.Errorf("unexpected torn write, %d, %v", n, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close, %v", err)
+	}
+	if got := readFile(t, fs, "file"); got != "1234" {
+		t.Errorf("unexpected data %s", got)
+	}
+}
+
+func TestFaultFSRecoverDropsUnsyncedData(t *testing.T) {
+	fs := NewFaultFS(NewMemFS())
+	writeFile(t, fs, "synced", "data", true)
+	writeFile(t, fs, "unsynced", "data", false)
+	f, err := fs.OpenForAppend("synced")
+	if err != nil {
+		t.Fatalf("failed to open, %v", err)
+	}
+	if _, err := f.Write([]byte("more")); err != nil {
+		t.Fatalf("failed to write, %v", err)
+	}
+	fs.Crash()
+	// syncs after the crash are not durable
+	if err := f.Sync(); err != nil {
+		t.Fatalf("failed to sync, %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("failed to close, %v", err)
+	}
+	if err := fs.Recover(); err != nil {
+		t.Fatalf("failed to recover, %v", err)
+	}
+	if got := readFile(t, fs, "synced"); got != "data" {
+		t.Errorf("unexpected data %s", got)
+	}
+	if _, err := fs.Stat("unsynced"); !IsNotExist(err) {
+		t.Errorf("never synced file not removed, %v", err)
+	}
+	// data synced after the recovery is durable again
+	writeFile(t, fs, "synced", "new", true)
+	fs.Crash()
+	if err := fs.Recover(); err != nil {
+		t.Fatalf("failed to recover, %v", err)
+	}
+	if got := readFile(t, fs, "synced"); got != "new" {
+		t.Errorf("unexpected data %s", got)
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lincheck
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Result is the result of a linearizability check.
+type Result int
+
+const (
+	// Ok indicates that the history is linearizable.
+	Ok Result = iota
+	// Illegal indicates that the history is not linearizable.
+	Illegal
+	// Unknown indicates that the check timed out.
+	Unknown
+)
+
+var resultNames = [...]string{
+	"Ok",
+	"Illegal",
+	"Unknown",
+}
+
+func (r Result) String() string {
+	return resultNames[r]
+}
+
+// how often the deadline is checked during the search
+const deadlineCheckInterval = 1024
+
+// Info contains details of a linearizability check used by Visualize.
+type Info struct {
+	// partitioned histories
+	histories [][]Operation
+	// the longest linearizable prefix found for each partitioned history,
+	// values are positions of operations in the partitioned history
+	longest [][]int
+	// results of each partitioned history
+	results []Result
+}
+
+// Check checks whether the history is linearizable with regard to the model.
+// Unknown is returned when the check can not be completed within timeout, 0
+// means no timeout.
+func Check(model Model, history []Operation,
+	timeout time.Duration) (Result, Info) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	info := Info{histories: model.partition(history)}
+	result := Ok
+	for _, h := range info.histories {
+		r, longest := checkSingle(&model, h, deadline)
+		info.longest = append(info.longest, longest)
+		info.results = append(info.results, r)
+		if r == Illegal {
+			result = Illegal
+		} else if r == Unknown && result == Ok {
+			result = Unknown
+		}
+	}
+	return result, info
+}
+
+type entry struct {
+	call  bool
+	value interface{}
+	id    int
+	time  int64
+}
+
+func getEntries(history []Operation) []entry {
+	entries := make([]entry, 0, 2*len(history))
+	for id, op := range history {
+		entries = append(entries, entry{
+			call:  true,
+			value: op.Input,
+			id:    id,
+			time:  op.Call,
+		})
+		ret := entry{value: op.Output, id: id, time: op.Return}
+		if op.Ambiguous {
+			ret.value = nil
+			ret.time = math.MaxInt64
+		}
+		entries = append(entries, ret)
+	}
+	// calls are ordered before returns with the same time so that operations
+	// touching each other are considered as concurrent
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].time != entries[j].time {
+			return entries[i].time < entries[j].time
+		}
+		return entries[i].call && !entries[j].call
+	})
+	return entries
+}
+
+// node is an element of the doubly linked list of entries.
+type node struct {
+	value interface{}
+	// match is the return node of a call node, it is nil for return nodes
+	match *node
+	id    int
+	prev  *node
+	next  *node
+}
+
+func getLinkedEntries(entries []entry) *node {
+	head := &node{id: -1}
+	returns := make(map[int]*node)
+	var next *node
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		n := &node{value: e.value, id: e.id, next: next}
+		if e.call {
+			n.match = returns[e.id]
+		} else {
+			returns[e.id] = n
+		}
+		if next != nil {
+			next.prev = n
+		}
+		next = n
+	}
+	head.next = next
+	if next != nil {
+		next.prev = head
+	}
+	return head
+}
+
+// lift removes the call node n and its return node from the list.
+func lift(n *node) {
+	n.prev.next = n.next
+	n.next.prev = n.prev
+	m := n.match
+	m.prev.next = m.next
+	if m.next != nil {
+		m.next.prev = m.prev
+	}
+}
+
+// unlift reverts the lift of the call node n.
+func unlift(n *node) {
+	m := n.match
+	m.prev.next = m
+	if m.next != nil {
+		m.next.prev = m
+	}
+	n.prev.next = n
+	n.next.prev = n
+}
+
+type bitset []uint64
+
+func newBitset(size int) bitset {
+	return make(bitset, (size+63)/64)
+}
+
+func (b bitset) clone() bitset {
+	return append(bitset{}, b...)
+}
+
+func (b bitset) set(pos int) {
+	b[pos/64] |= 1 << uint(pos%64)
+}
+
+func (b bitset) clear(pos int) {
+	b[pos/64] &^= 1 << uint(pos%64)
+}
+
+func (b bitset) equal(o bitset) bool {
+	for idx := range b {
+		if b[idx] != o[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bitset) hash() uint64 {
+	h := uint64(len(b))
+	for _, v := range b {
+		h = h*31 + v
+	}
+	return h
+}
+
+type cacheEntry struct {
+	linearized bitset
+	state      interface{}
+}
+
+type call struct {
+	n     *node
+	state interface{}
+}
+
+// checkSingle searches for a linearization of history, it returns the result
+// and the longest linearizable prefix found.
+func checkSingle(model *Model,
+	history []Operation, deadline time.Time) (Result, []int) {
+	head := getLinkedEntries(getEntries(history))
+	linearized := newBitset(len(history))
+	cache := make(map[uint64][]cacheEntry)
+	var calls []call
+	var longest []int
+	state := model.Init()
+	n := head.next
+	for iter := 0; head.next != nil; iter++ {
+		if !deadline.IsZero() && iter%deadlineCheckInterval == 0 &&
+			time.Now().After(deadline) {
+			return Unknown, longest
+		}
+		if n.match != nil {
+			ok, newState := model.Step(state, n.value, n.match.value)
+			if ok {
+				v := linearized.clone()
+				v.set(n.id)
+				if !cacheContains(model, cache, v, newState) {
+					h := v.hash()
+					cache[h] = append(cache[h], cacheEntry{v, newState})
+					calls = append(calls, call{n, state})
+					state = newState
+					linearized.set(n.id)
+					lift(n)
+					n = head.next
+					continue
+				}
+			}
+			n = n.next
+			continue
+		}
+		// n is a return node, the operation it belongs to can't be linearized
+		// given the current prefix, backtrack
+		if len(calls) > len(longest) {
+			longest = longest[:0]
+			for _, c := range calls {
+				longest = append(longest, c.n.id)
+			}
+		}
+		if len(calls) == 0 {
+			return Illegal, longest
+		}
+		top := calls[len(calls)-1]
+		calls = calls[:len(calls)-1]
+		state = top.state
+		linearized.clear(top.n.id)
+		unlift(top.n)
+		n = top.n.next
+	}
+	longest = longest[:0]
+	for _, c := range calls {
+		longest = append(longest, c.n.id)
+	}
+	return Ok, longest
+}
+
+func cacheContains(model *Model, cache map[uint64][]cacheEntry,
+	linearized bitset, state interface{}) bool {
+	for _, e := range cache[linearized.hash()] {
+		if linearized.equal(e.linearized) && model.equal(state, e.state) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,195 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lincheck
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+type kvInput struct {
+	write bool
+	key   string
+	value int
+}
+
+// kvModel is the model of a key-value store, reads return the current value
+// of the key.
+var kvModel = Model{
+	Partition: func(history []Operation) [][]Operation {
+		keys := make(map[string]int)
+		var result [][]Operation
+		for _, op := range history {
+			key := op.Input.(kvInput).key
+			idx, ok := keys[key]
+			if !ok {
+				idx = len(result)
+				keys[key] = idx
+				result = append(result, nil)
+			}
+			result[idx] = append(result[idx], op)
+		}
+		return result
+	},
+	Init: func() interface{} {
+		return 0
+	},
+	Step: func(state interface{},
+		input interface{}, output interface{}) (bool, interface{}) {
+		in := input.(kvInput)
+		if in.write {
+			return true, in.value
+		}
+		return output == nil || output.(int) == state.(int), state
+	},
+}
+
+func write(client uint64, key string, value int, call, ret int64) Operation {
+	return Operation{
+		ClientID: client,
+		Input:    kvInput{write: true, key: key, value: value},
+		Call:     call,
+		Return:   ret,
+	}
+}
+
+func read(client uint64, key string, value int, call, ret int64) Operation {
+	return Operation{
+		ClientID: client,
+		Input:    kvInput{key: key},
+		Output:   value,
+		Call:     call,
+		Return:   ret,
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		history []Operation
+		result  Result
+	}{
+		{nil, Ok},
+		// sequential
+		{[]Operation{write(1, "x", 1, 0, 10), read(2, "x", 1, 20, 30)}, Ok},
+		// stale read after the write returned
+		{[]Operation{write(1, "x", 1, 0, 10), read(2, "x", 0, 20, 30)}, Illegal},
+		// concurrent read can observe either value
+		{[]Operation{write(1, "x", 1, 0, 10), read(2, "x", 0, 5, 30)}, Ok},
+		{[]Operation{write(1, "x", 1, 0, 10), read(2, "x", 1, 5, 30)}, Ok},
+		// reads going back in time
+		{[]Operation{
+			write(1, "x", 1, 0, 100),
+			read(2, "x", 1, 10, 20),
+			read(3, "x", 0, 30, 40),
+		}, Illegal},
+		// independent keys
+		{[]Operation{
+			write(1, "x", 1, 0, 10),
+			write(2, "y", 2, 0, 10),
+			read(3, "x", 1, 20, 30),
+			read(3, "y", 2, 40, 50),
+		}, Ok},
+		{[]Operation{
+			write(1, "x", 1, 0, 10),
+			write(2, "y", 2, 0, 10),
+			read(3, "x", 1, 20, 30),
+			read(3, "y", 0, 40, 50),
+		}, Illegal},
+	}
+	for idx, tt := range tests {
+		if result, _ := Check(kvModel, tt.history, 0); result != tt.result {
+			t.Errorf("%d, got %s, want %s", idx, result, tt.result)
+		}
+	}
+}
+
+func TestAmbiguousOperationsMightTakeEffectLater(t *testing.T) {
+	ambiguous := write(1, "x", 1, 0, 0)
+	ambiguous.Ambiguous = true
+	tests := []struct {
+		history []Operation
+		result  Result
+	}{
+		// never applied
+		{[]Operation{ambiguous, read(2, "x", 0, 10, 20)}, Ok},
+		// applied
+		{[]Operation{ambiguous, read(2, "x", 1, 10, 20)}, Ok},
+		// applied long after it timed out
+		{[]Operation{
+			ambiguous,
+			read(2, "x", 0, 10, 20),
+			read(2, "x", 1, 1000, 1010),
+		}, Ok},
+		// can't be undone
+		{[]Operation{
+			ambiguous,
+			read(2, "x", 1, 10, 20),
+			read(2, "x", 0, 30, 40),
+		}, Illegal},
+		// can't be applied before it is invoked
+		{[]Operation{
+			read(2, "x", 1, 10, 20),
+			write(1, "x", 1, 30, 0),
+		}, Illegal},
+	}
+	tests[4].history[1].Ambiguous = true
+	for idx, tt := range tests {
+		if result, _ := Check(kvModel, tt.history, 0); result != tt.result {
+			t.Errorf("%d, got %s, want %s", idx, result, tt.result)
+		}
+	}
+}
+
+func TestLongestLinearizablePrefixIsReported(t *testing.T) {
+	history := []Operation{
+		write(1, "x", 1, 0, 10),
+		read(2, "x", 1, 20, 30),
+		read(2, "x", 2, 40, 50),
+	}
+	result, info := Check(kvModel, history, 0)
+	if result != Illegal {
+		t.Fatalf("unexpected result %s", result)
+	}
+	if len(info.longest) != 1 || len(info.longest[0]) != 2 ||
+		info.longest[0][0] != 0 || info.longest[0][1] != 1 {
+		t.Errorf("unexpected longest prefix %v", info.longest)
+	}
+	var buf bytes.Buffer
+	if err := Visualize(kvModel, info, &buf); err != nil {
+		t.Fatalf("failed to visualize %v", err)
+	}
+	page := buf.String()
+	for _, v := range []string{"Illegal", "linearized", "failed", "client 2"} {
+		if !strings.Contains(page, v) {
+			t.Errorf("%s not in the visualization", v)
+		}
+	}
+}
+
+func TestCheckCanTimeout(t *testing.T) {
+	// many concurrent writes followed by a read of a value never written
+	var history []Operation
+	for i := 0; i < 64; i++ {
+		history = append(history, write(uint64(i), "x", i, 0, 100))
+	}
+	history = append(history, read(100, "x", 1000, 200, 300))
+	model := kvModel
+	// disable the cache to make the search exponential
+	model.Equal = func(a interface{}, b interface{}) bool { return false }
+	if result, _ := Check(model, history, 1); result != Unknown {
+		t.Errorf("unexpected result %s", result)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package lincheck checks whether histories of client operations made against
+dragonboat shards are linearizable.
+
+Operations are recorded by a Recorder, usually through its SyncPropose and
+SyncRead methods, which record the invocation and return time of each request
+made to a NodeHost. Requests that failed with an ambiguous error, e.g. timed
+out proposals, might or might not have been applied, they are recorded as
+operations without return time and output.
+
+The recorded history is checked by Check against a Model, which is the
+sequential specification of the state machine. Check searches for a
+linearization of the history using the algorithm described in "Testing for
+Linearizability" by Gavin Lowe, as implemented by porcupine. When the history
+is not linearizable, Visualize writes a HTML page showing the operations and
+the longest linearizable prefix found.
+*/
+package lincheck
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Operation is a client operation in a history.
+type Operation struct {
+	// ClientID identifies the client that made the operation, operations of
+	// the same client are displayed in the same row by Visualize.
+	ClientID uint64
+	// Input is the input of the operation, e.g. the proposed command.
+	Input interface{}
+	// Output is the output of the operation, it is nil when Ambiguous is true.
+	Output interface{}
+	// Call is the time in nanoseconds when the operation was invoked.
+	Call int64
+	// Return is the time in nanoseconds when the operation returned, it is
+	// ignored when Ambiguous is true.
+	Return int64
+	// Ambiguous indicates that the operation has not returned a definite
+	// result, e.g. it timed out. Ambiguous operations might have taken effect
+	// at any time after Call.
+	Ambiguous bool
+}
+
+// Model is the sequential specification of a state machine.
+type Model struct {
+	// Partition optionally splits the history into independent histories,
+	// e.g. one history per key of a key-value store. Each of the returned
+	// histories is checked separately, which is usually much faster.
+	Partition func(history []Operation) [][]Operation
+	// Init returns the initial state.
+	Init func() interface{}
+	// Step returns whether output is a valid output of applying input to
+	// state, and the state after applying input. The output is nil for
+	// ambiguous operations, Step is expected to accept them.
+	Step func(state interface{},
+		input interface{}, output interface{}) (bool, interface{})
+	// Equal returns whether two states are equal. reflect.DeepEqual is used
+	// when not specified.
+	Equal func(a interface{}, b interface{}) bool
+	// DescribeOperation optionally returns a short description of the
+	// operation used by Visualize.
+	DescribeOperation func(input interface{}, output interface{}) string
+	// DescribeState optionally returns a short description of the state used
+	// by Visualize.
+	DescribeState func(state interface{}) string
+}
+
+func (m *Model) equal(a interface{}, b interface{}) bool {
+	if m.Equal != nil {
+		return m.Equal(a, b)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func (m *Model) partition(history []Operation) [][]Operation {
+	if m.Partition != nil {
+		return m.Partition(history)
+	}
+	return [][]Operation{history}
+}
+
+func (m *Model) describeOperation(op Operation) string {
+	if m.DescribeOperation != nil {
+		return m.DescribeOperation(op.Input, op.Output)
+	}
+	if op.Ambiguous {
+		return fmt.Sprintf("%v -> ?", op.Input)
+	}
+	return fmt.Sprintf("%v -> %v", op.Input, op.Output)
+}
+
+func (m *Model) describeState(state interface{}) string {
+	if m.DescribeState != nil {
+		return m.DescribeState(state)
+	}
+	return fmt.Sprintf("%v", state)
+}
@@ -0,0 +1,130 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lincheck
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/client"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// Recorder records the history of client operations. Recorder is thread
+// safe, it is expected to be shared by all clients.
+type Recorder struct {
+	start time.Time
+	mu    sync.Mutex
+	ops   []Operation
+}
+
+// NewRecorder creates a new Recorder instance.
+func NewRecorder() *Recorder {
+	return &Recorder{start: time.Now()}
+}
+
+// now returns the monotonic time elapsed since the Recorder was created.
+func (r *Recorder) now() int64 {
+	return int64(time.Since(r.start))
+}
+
+// Call is an invoked operation that has not returned yet.
+type Call struct {
+	r  *Recorder
+	op Operation
+}
+
+// Invoke records the invocation of an operation. Return or Ambiguous is
+// expected to be called once the operation completes, operations known to
+// have failed without any effect can simply be abandoned.
+func (r *Recorder) Invoke(clientID uint64, input interface{}) *Call {
+	return &Call{
+		r:  r,
+		op: Operation{ClientID: clientID, Input: input, Call: r.now()},
+	}
+}
+
+// Return records that the operation returned output.
+func (c *Call) Return(output interface{}) {
+	c.op.Return = c.r.now()
+	c.op.Output = output
+	c.r.add(c.op)
+}
+
+// Ambiguous records that the operation completed with an unknown outcome.
+func (c *Call) Ambiguous() {
+	c.op.Ambiguous = true
+	c.r.add(c.op)
+}
+
+func (r *Recorder) add(op Operation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ops = append(r.ops, op)
+}
+
+// History returns all recorded operations.
+func (r *Recorder) History() []Operation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Operation{}, r.ops...)
+}
+
+// SyncPropose makes a proposal using the SyncPropose method of nh and records
+// it as an operation with the specified input. The output of the operation
+// is returned by output from the result of the proposal.
+func (r *Recorder) SyncPropose(ctx context.Context, nh *dragonboat.NodeHost,
+	clientID uint64, session *client.Session, cmd []byte, input interface{},
+	output func(sm.Result) interface{}) (sm.Result, error) {
+	c := r.Invoke(clientID, input)
+	result, err := nh.SyncPropose(ctx, session, cmd)
+	if err == nil {
+		c.Return(output(result))
+	} else if IsAmbiguous(err) {
+		c.Ambiguous()
+	}
+	return result, err
+}
+
+// SyncRead makes a linearizable read using the SyncRead method of nh and
+// records it as an operation with the specified input. The output of the
+// operation is returned by output from the result of the read. Failed reads
+// have no effect and are not recorded.
+func (r *Recorder) SyncRead(ctx context.Context, nh *dragonboat.NodeHost,
+	clientID uint64, shardID uint64, query interface{}, input interface{},
+	output func(interface{}) interface{}) (interface{}, error) {
+	c := r.Invoke(clientID, input)
+	result, err := nh.SyncRead(ctx, shardID, query)
+	if err == nil {
+		c.Return(output(result))
+	}
+	return result, err
+}
+
+// IsAmbiguous returns a boolean value indicating whether a proposal failed
+// with err might still have been applied.
+func IsAmbiguous(err error) bool {
+	return errors.Is(err, dragonboat.ErrTimeout) ||
+		errors.Is(err, dragonboat.ErrCanceled) ||
+		errors.Is(err, dragonboat.ErrAborted) ||
+		errors.Is(err, dragonboat.ErrShardClosed) ||
+		errors.Is(err, dragonboat.ErrClosed) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, context.Canceled)
+}
@@ -0,0 +1,68 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lincheck
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+)
+
+func TestRecorderRecordsOperations(t *testing.T) {
+	r := NewRecorder()
+	c1 := r.Invoke(1, kvInput{write: true, key: "x", value: 1})
+	c2 := r.Invoke(2, kvInput{key: "x"})
+	c2.Return(1)
+	c1.Ambiguous()
+	// abandoned
+	r.Invoke(3, kvInput{key: "x"})
+	history := r.History()
+	if len(history) != 2 {
+		t.Fatalf("unexpected history %v", history)
+	}
+	if history[0].ClientID != 2 || history[0].Output != 1 ||
+		history[0].Ambiguous || history[0].Return < history[0].Call {
+		t.Errorf("unexpected operation %+v", history[0])
+	}
+	if history[1].ClientID != 1 || !history[1].Ambiguous {
+		t.Errorf("unexpected operation %+v", history[1])
+	}
+	if result, _ := Check(kvModel, history, 0); result != Ok {
+		t.Errorf("unexpected result %s", result)
+	}
+}
+
+func TestIsAmbiguous(t *testing.T) {
+	tests := []struct {
+		err       error
+		ambiguous bool
+	}{
+		{dragonboat.ErrTimeout, true},
+		{errors.Wrap(dragonboat.ErrTimeout, "wrapped"), true},
+		{context.DeadlineExceeded, true},
+		{dragonboat.ErrShardClosed, true},
+		{dragonboat.ErrSystemBusy, false},
+		{dragonboat.ErrShardNotReady, false},
+		{dragonboat.ErrPayloadTooBig, false},
+	}
+	for idx, tt := range tests {
+		if IsAmbiguous(tt.err) != tt.ambiguous {
+			t.Errorf("%d, unexpected result for %v", idx, tt.err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lincheck
+
+import (
+	"html/template"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+)
+
+var page = template.Must(template.New("lincheck").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>linearizability check</title>
+<style>
+body { font-family: monospace; font-size: 12px; }
+.timeline { position: relative; border-top: 1px solid #ccc; }
+.row { position: relative; height: 24px; border-bottom: 1px solid #eee; }
+.label { position: absolute; left: 0; width: 90px; line-height: 24px; }
+.ops { position: absolute; left: 100px; right: 0; top: 0; bottom: 0; }
+.op { position: absolute; top: 3px; height: 16px; overflow: hidden;
+  white-space: nowrap; border: 1px solid #555; box-sizing: border-box;
+  padding: 0 2px; }
+.linearized { background: #b8e6b8; }
+.failed { background: #f4b4b4; }
+.pending { background: #e0e0e0; }
+.ambiguous { border-style: dashed; }
+</style>
+</head>
+<body>
+{{range .}}
+<h3>partition {{.Index}}: {{.Result}}</h3>
+<div class="timeline">
+{{range .Rows}}
+<div class="row">
+<div class="label">client {{.ClientID}}</div>
+<div class="ops">
+{{range .Ops}}<div class="op {{.Class}}" style="left: {{.Left}}%; width: {{.Width}}%;" title="{{.Title}}">{{.Label}}</div>{{end}}
+</div>
+</div>
+{{end}}
+</div>
+<p>longest linearizable prefix:</p>
+<ol>
+{{range .Steps}}<li>{{.}}</li>{{end}}
+</ol>
+{{end}}
+</body>
+</html>
+`))
+
+type visualOp struct {
+	Class string
+	Left  float64
+	Width float64
+	Title string
+	Label string
+}
+
+type visualRow struct {
+	ClientID uint64
+	Ops      []visualOp
+}
+
+type visualPartition struct {
+	Index  int
+	Result Result
+	Rows   []visualRow
+	Steps  []string
+}
+
+// Visualize writes a HTML page showing the history checked by Check and the
+// longest linearizable prefix found for each partition. Operations in the
+// longest linearizable prefix are numbered in their linearization order,
+// operations that can not be linearized are highlighted in partitions that
+// are not linearizable.
+func Visualize(model Model, info Info, w io.Writer) error {
+	partitions := make([]visualPartition, 0, len(info.histories))
+	for idx, history := range info.histories {
+		partitions = append(partitions, getVisualPartition(&model,
+			idx, history, info.longest[idx], info.results[idx]))
+	}
+	return page.Execute(w, partitions)
+}
+
+func getVisualPartition(model *Model, idx int,
+	history []Operation, longest []int, result Result) visualPartition {
+	p := visualPartition{Index: idx, Result: result}
+	order := make(map[int]int)
+	states := make(map[int]string)
+	state := model.Init()
+	for step, id := range longest {
+		op := history[id]
+		var output interface{}
+		if !op.Ambiguous {
+			output = op.Output
+		}
+		_, state = model.Step(state, op.Input, output)
+		order[id] = step + 1
+		states[id] = model.describeState(state)
+		p.Steps = append(p.Steps, model.describeOperation(op)+", state: "+states[id])
+	}
+	start, end := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, op := range history {
+		if op.Call < start {
+			start = op.Call
+		}
+		if op.Call > end {
+			end = op.Call
+		}
+		if !op.Ambiguous && op.Return > end {
+			end = op.Return
+		}
+	}
+	span := float64(end - start)
+	if span <= 0 {
+		span = 1
+	}
+	rows := make(map[uint64]*visualRow)
+	var clients []uint64
+	for id, op := range history {
+		row, ok := rows[op.ClientID]
+		if !ok {
+			row = &visualRow{ClientID: op.ClientID}
+			rows[op.ClientID] = row
+			clients = append(clients, op.ClientID)
+		}
+		ret := end
+		if !op.Ambiguous {
+			ret = op.Return
+		}
+		v := visualOp{
+			Left:  100 * float64(op.Call-start) / span,
+			Width: math.Max(100*float64(ret-op.Call)/span, 0.2),
+			Label: model.describeOperation(op),
+		}
+		v.Title = v.Label
+		if step, ok := order[id]; ok {
+			v.Class = "linearized"
+			v.Title = v.Title + ", step " + strconv.Itoa(step) + ", state: " + states[id]
+			v.Label = "#" + strconv.Itoa(step) + " " + v.Label
+		} else if result == Illegal {
+			v.Class = "failed"
+		} else {
+			v.Class = "pending"
+		}
+		if op.Ambiguous {
+			v.Class += " ambiguous"
+		}
+		row.Ops = append(row.Ops, v)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i] < clients[j] })
+	for _, c := range clients {
+		p.Rows = append(p.Rows, *rows[c])
+	}
+	return p
+}
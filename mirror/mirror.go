@@ -0,0 +1,414 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package mirror implements asynchronous mirroring of Raft shards across
+dragonboat deployments.
+
+A Mirror continuously tails committed entries of a source shard and applies
+them to a standby shard, the standby shard is usually managed by NodeHost
+instances of another deployment with a different DeploymentID, e.g. in a
+remote data center for disaster recovery. The standby shard is not a member of
+the source shard and thus never affects the availability of the source shard.
+When the standby shard falls too far behind and the required entries have
+been compacted on the source shard, a snapshot of the source shard is exported
+and streamed to the standby shard to restore it, each proposal made to the
+standby shard carries no more than MaxBatchSize bytes of the snapshot.
+
+A Mirror requires a NodeHost with a replica of the source shard, which can be
+a non-voting replica running close to the standby shard, and a NodeHost with a
+replica of the standby shard. Replicas of the standby shard must be started
+using state machines created by the factory function returned by NewStandby.
+Only shards backed by regular sm.IStateMachine state machines are supported.
+
+The standby shard is read-only until it is promoted by the Promote method of
+the Mirror or the Promote function, after which it can be used as a regular
+shard.
+*/
+package mirror
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/lni/goutils/syncutil"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/utils/dio"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/logger"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+var plog = logger.GetLogger("mirror")
+
+const (
+	defaultMaxBatchSize = 1024 * 1024
+	defaultInterval     = 100 * time.Millisecond
+	syncTimeout         = 30 * time.Second
+)
+
+var (
+	// ErrPromoted indicates that the standby shard has already been promoted.
+	ErrPromoted = errors.New("standby shard already promoted")
+	// ErrUnsupportedSnapshot indicates that the exported snapshot of the source
+	// shard can not be used to restore the standby shard.
+	ErrUnsupportedSnapshot = errors.New("unsupported snapshot")
+	// ErrQueryFailed indicates that the source shard failed to complete the
+	// raft log query.
+	ErrQueryFailed = errors.New("raft log query failed")
+	// ErrRestoring indicates that the standby shard is being restored using a
+	// snapshot of the source shard.
+	ErrRestoring = errors.New("standby shard being restored")
+	// errRestoreAborted indicates that the ongoing restore has been aborted.
+	errRestoreAborted = errors.New("restore aborted")
+)
+
+// Config is the configuration of a Mirror.
+type Config struct {
+	// SourceShardID is the shard ID of the source shard.
+	SourceShardID uint64
+	// StandbyShardID is the shard ID of the standby shard.
+	StandbyShardID uint64
+	// ExportPath is the directory used for exporting snapshots of the source
+	// shard when the standby shard is too far behind.
+	ExportPath string
+	// MaxBatchSize is the max total size in bytes of source entries or
+	// snapshot data mirrored in each proposal made to the standby shard.
+	// 1MBytes is used by default.
+	MaxBatchSize uint64
+	// Interval is the interval between two mirroring rounds once the standby
+	// shard has caught up. 100 milliseconds is used by default.
+	Interval time.Duration
+}
+
+// Validate validates the Config instance.
+func (c *Config) Validate() error {
+	if c.SourceShardID == 0 || c.StandbyShardID == 0 {
+		return errors.New("invalid shard ID")
+	}
+	if len(c.ExportPath) == 0 {
+		return errors.New("ExportPath not set")
+	}
+	return nil
+}
+
+// Mirror mirrors the source shard to the standby shard.
+type Mirror struct {
+	source   *dragonboat.NodeHost
+	standby  *dragonboat.NodeHost
+	cfg      Config
+	fs       vfs.IFS
+	stopper  *syncutil.Stopper
+	stopOnce sync.Once
+	// mu serializes mirroring rounds
+	mu        sync.Mutex
+	loaded    bool
+	applied   uint64
+	committed uint64
+}
+
+// New creates a new Mirror instance. The source NodeHost must have a replica
+// of the source shard and the standby NodeHost must have a replica of the
+// standby shard.
+func New(source *dragonboat.NodeHost,
+	standby *dragonboat.NodeHost, cfg Config) (*Mirror, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.MaxBatchSize == 0 {
+		cfg.MaxBatchSize = defaultMaxBatchSize
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultInterval
+	}
+	fs := source.NodeHostConfig().Expert.FS
+	if fs == nil {
+		fs = vfs.DefaultFS
+	}
+	return &Mirror{
+		source:  source,
+		standby: standby,
+		cfg:     cfg,
+		fs:      fs,
+		stopper: syncutil.NewStopper(),
+	}, nil
+}
+
+// Start starts mirroring in the background.
+func (m *Mirror) Start() {
+	m.stopper.RunWorker(func() {
+		ticker := time.NewTicker(m.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := m.syncAll(); err != nil {
+					if errors.Is(err, ErrPromoted) {
+						plog.Infof("standby shard %d promoted, mirroring stopped",
+							m.cfg.StandbyShardID)
+						return
+					}
+					plog.Warningf("failed to mirror shard %d to shard %d, %v",
+						m.cfg.SourceShardID, m.cfg.StandbyShardID, err)
+				}
+			case <-m.stopper.ShouldStop():
+				return
+			}
+		}
+	})
+}
+
+// Stop stops mirroring.
+func (m *Mirror) Stop() {
+	m.stopOnce.Do(func() {
+		m.stopper.Stop()
+	})
+}
+
+// syncAll keeps mirroring until the standby shard catches up.
+func (m *Mirror) syncAll() error {
+	for {
+		select {
+		case <-m.stopper.ShouldStop():
+			return nil
+		default:
+		}
+		done, err := func() (bool, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), syncTimeout)
+			defer cancel()
+			return m.Sync(ctx)
+		}()
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// Lag returns the number of committed source entries known to the Mirror
+// but not yet mirrored to the standby shard.
+func (m *Mirror) Lag() uint64 {
+	applied := atomic.LoadUint64(&m.applied)
+	committed := atomic.LoadUint64(&m.committed)
+	if committed <= applied {
+		return 0
+	}
+	return committed - applied
+}
+
+// Promote stops mirroring and promotes the standby shard. The input context
+// object must have its deadline set.
+func (m *Mirror) Promote(ctx context.Context) error {
+	m.Stop()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loaded = false
+	return Promote(ctx, m.standby, m.cfg.StandbyShardID)
+}
+
+// Promote promotes the specified standby shard, it is typically invoked when
+// the source shard is no longer available. All replicas of the standby shard
+// stop accepting mirrored entries and start accepting regular proposals once
+// the promotion is applied. Promote should not be invoked while a Mirror is
+// still mirroring to the standby shard. ErrRestoring is returned when the
+// standby shard is in the middle of being restored from a snapshot of the
+// source shard. The input context object must have its deadline set.
+func Promote(ctx context.Context, nh *dragonboat.NodeHost, shardID uint64) error {
+	result, err := nh.SyncPropose(ctx,
+		nh.GetNoOPSession(shardID), encode(kindPromote, nil))
+	if err != nil {
+		return err
+	}
+	if result.Value == rejected {
+		return ErrRestoring
+	}
+	return nil
+}
+
+// GetStatus returns the mirroring status of the specified standby shard. The
+// input context object must have its deadline set.
+func GetStatus(ctx context.Context,
+	nh *dragonboat.NodeHost, shardID uint64) (Status, error) {
+	v, err := nh.SyncRead(ctx, shardID, statusQuery{})
+	if err != nil {
+		return Status{}, err
+	}
+	return v.(Status), nil
+}
+
+// Sync runs a single mirroring round, it mirrors a batch of committed source
+// entries to the standby shard, or restores the standby shard using an
+// exported snapshot of the source shard when required entries have been
+// compacted. It returns a boolean value indicating whether the standby shard
+// has caught up. The input context object must have its deadline set.
+func (m *Mirror) Sync(ctx context.Context) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.loaded {
+		status, err := GetStatus(ctx, m.standby, m.cfg.StandbyShardID)
+		if err != nil {
+			return false, err
+		}
+		if status.Promoted {
+			return false, ErrPromoted
+		}
+		atomic.StoreUint64(&m.applied, status.Index)
+		m.loaded = true
+		if status.Restoring {
+			return false, m.restore(ctx)
+		}
+	}
+	first := atomic.LoadUint64(&m.applied) + 1
+	rs, err := m.source.QueryRaftLog(m.cfg.SourceShardID,
+		first, math.MaxUint64, m.cfg.MaxBatchSize)
+	if err != nil {
+		return false, err
+	}
+	defer rs.Release()
+	var result dragonboat.RequestResult
+	select {
+	case result = <-rs.ResultC():
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+	if !result.Completed() && !result.RequestOutOfRange() {
+		return false, ErrQueryFailed
+	}
+	entries, lr := result.RaftLogs()
+	atomic.StoreUint64(&m.committed, lr.LastIndex-1)
+	if result.RequestOutOfRange() {
+		if lr.FirstIndex > first {
+			return false, m.restore(ctx)
+		}
+		return true, nil
+	}
+	if len(entries) == 0 {
+		return true, nil
+	}
+	cmd := entriesCmd{LastIndex: entries[len(entries)-1].Index}
+	for _, e := range entries {
+		if e.IsConfigChange() || !e.IsSessionManaged() {
+			continue
+		}
+		// payloads are mirrored as is, they are decoded and chunked entries
+		// are reassembled by the standby shard when they are applied
+		cmd.Entries = append(cmd.Entries, entry{
+			Index:       e.Index,
+			Type:        e.Type,
+			ClientID:    e.ClientID,
+			SeriesID:    e.SeriesID,
+			RespondedTo: e.RespondedTo,
+			Cmd:         e.Cmd,
+		})
+	}
+	if err := m.propose(ctx, encode(kindEntries, &cmd)); err != nil {
+		return false, err
+	}
+	atomic.StoreUint64(&m.applied, cmd.LastIndex)
+	return cmd.LastIndex >= lr.LastIndex-1, nil
+}
+
+// restore restores the standby shard using an exported snapshot of the source
+// shard, the snapshot is streamed to the standby shard in chunks.
+func (m *Mirror) restore(ctx context.Context) error {
+	opt := dragonboat.SnapshotOption{Exported: true, ExportPath: m.cfg.ExportPath}
+	index, err := m.source.SyncRequestSnapshot(ctx, m.cfg.SourceShardID, opt)
+	if err != nil {
+		return err
+	}
+	dir := m.fs.PathJoin(m.cfg.ExportPath, server.GetSnapshotDirName(index))
+	defer func() {
+		if err := m.fs.RemoveAll(dir); err != nil {
+			plog.Errorf("failed to remove %s, %v", dir, err)
+		}
+	}()
+	var ss pb.Snapshot
+	if err := fileutil.GetFlagFileContent(dir,
+		server.MetadataFilename, &ss, m.fs); err != nil {
+		return err
+	}
+	if ss.Type != pb.RegularStateMachine || len(ss.Files) > 0 {
+		return ErrUnsupportedSnapshot
+	}
+	fp := m.fs.PathJoin(dir, m.fs.PathBase(ss.Filepath))
+	plog.Infof("restoring standby shard %d using snapshot %d of shard %d",
+		m.cfg.StandbyShardID, index, m.cfg.SourceShardID)
+	if err := m.stream(ctx, fp, index); err != nil {
+		return err
+	}
+	atomic.StoreUint64(&m.applied, index)
+	return nil
+}
+
+// stream proposes the snapshot payload to the standby shard in chunks of no
+// more than MaxBatchSize bytes, only one chunk is held in memory at a time.
+func (m *Mirror) stream(ctx context.Context, fp string, index uint64) (err error) {
+	reader, header, err := rsm.NewSnapshotReader(fp, m.fs)
+	if err != nil {
+		return err
+	}
+	r := dio.NewDecompressor(header.CompressionType, reader)
+	defer func() {
+		if cerr := r.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	buf := make([]byte, m.cfg.MaxBatchSize)
+	for seq := uint64(0); ; seq++ {
+		n, err := io.ReadFull(r, buf)
+		last := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !last {
+			return err
+		}
+		cmd := restoreCmd{
+			Index:   index,
+			Version: header.Version,
+			Seq:     seq,
+			Last:    last,
+			Data:    buf[:n],
+		}
+		if err := m.propose(ctx, encode(kindRestore, &cmd)); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func (m *Mirror) propose(ctx context.Context, cmd []byte) error {
+	session := m.standby.GetNoOPSession(m.cfg.StandbyShardID)
+	result, err := m.standby.SyncPropose(ctx, session, cmd)
+	if err != nil {
+		return err
+	}
+	if result.Value == ReadOnly {
+		return ErrPromoted
+	}
+	if result.Value == rejected {
+		// the standby shard is being restored, reload its status so the
+		// restore can be restarted in the next round
+		m.loaded = false
+		return ErrRestoring
+	}
+	return nil
+}
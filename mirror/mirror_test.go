@@ -0,0 +1,429 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/client"
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/utils/dio"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+const (
+	testDataDir        = "mirror_test_safe_to_delete"
+	testSourceAddress  = "localhost:26101"
+	testStandbyAddress = "localhost:26102"
+)
+
+type testKV struct {
+	Data map[string]uint64
+}
+
+func newTestKV(shardID uint64, replicaID uint64) sm.IStateMachine {
+	return &testKV{Data: make(map[string]uint64)}
+}
+
+func (kv *testKV) Update(e sm.Entry) (sm.Result, error) {
+	kv.Data[string(e.Cmd)]++
+	return sm.Result{Value: kv.Data[string(e.Cmd)]}, nil
+}
+
+func (kv *testKV) Lookup(query interface{}) (interface{}, error) {
+	return kv.Data[query.(string)], nil
+}
+
+func (kv *testKV) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	return gob.NewEncoder(w).Encode(kv.Data)
+}
+
+func (kv *testKV) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	return gob.NewDecoder(r).Decode(&kv.Data)
+}
+
+func (kv *testKV) Close() error { return nil }
+
+func TestStandbyStateMachine(t *testing.T) {
+	s := NewStandby(newTestKV)(1, 1)
+	kv := s.(*standby).sm.(*testKV)
+	result, err := s.Update(sm.Entry{Cmd: []byte("k1")})
+	if err != nil {
+		t.Fatalf("update failed %v", err)
+	}
+	if result.Value != ReadOnly || len(kv.Data) != 0 {
+		t.Errorf("regular proposal applied before promotion")
+	}
+	cmd := entriesCmd{
+		LastIndex: 10,
+		Entries: []entry{
+			{Index: 2, ClientID: 100, SeriesID: client.SeriesIDForRegister},
+			{Index: 3, ClientID: 100, SeriesID: 1, Cmd: []byte("k1")},
+			// retried proposal
+			{Index: 4, ClientID: 100, SeriesID: 1, Cmd: []byte("k1")},
+			{Index: 5, ClientID: 200, SeriesID: client.NoOPSeriesID, Cmd: []byte("k2")},
+			// unknown client
+			{Index: 6, ClientID: 300, SeriesID: 1, Cmd: []byte("k3")},
+		},
+	}
+	if _, err := s.Update(sm.Entry{Cmd: encode(kindEntries, &cmd)}); err != nil {
+		t.Fatalf("update failed %v", err)
+	}
+	// applying the same batch again is a no-op
+	if _, err := s.Update(sm.Entry{Cmd: encode(kindEntries, &cmd)}); err != nil {
+		t.Fatalf("update failed %v", err)
+	}
+	if kv.Data["k1"] != 1 || kv.Data["k2"] != 1 || kv.Data["k3"] != 0 {
+		t.Errorf("unexpected data %v", kv.Data)
+	}
+	var buf bytes.Buffer
+	if err := s.SaveSnapshot(&buf, nil, nil); err != nil {
+		t.Fatalf("failed to save snapshot %v", err)
+	}
+	s2 := NewStandby(newTestKV)(1, 1)
+	if err := s2.RecoverFromSnapshot(&buf, nil, nil); err != nil {
+		t.Fatalf("failed to recover from snapshot %v", err)
+	}
+	v, err := s2.Lookup(statusQuery{})
+	if err != nil {
+		t.Fatalf("lookup failed %v", err)
+	}
+	if status := v.(Status); status.Index != 10 || status.Promoted {
+		t.Errorf("unexpected status %v", status)
+	}
+	if _, err := s2.Update(sm.Entry{Cmd: encode(kindPromote, nil)}); err != nil {
+		t.Fatalf("update failed %v", err)
+	}
+	result, err = s2.Update(sm.Entry{Cmd: encode(kindEntries, &cmd)})
+	if err != nil {
+		t.Fatalf("update failed %v", err)
+	}
+	if result.Value != ReadOnly {
+		t.Errorf("mirrored entries accepted after promotion")
+	}
+	result, err = s2.Update(sm.Entry{Cmd: []byte("k1")})
+	if err != nil {
+		t.Fatalf("update failed %v", err)
+	}
+	if result.Value != 2 {
+		t.Errorf("unexpected result %d", result.Value)
+	}
+}
+
+func TestStandbyReassemblesChunkedEntries(t *testing.T) {
+	s := NewStandby(newTestKV)(1, 1)
+	kv := s.(*standby).sm.(*testKV)
+	encoded := pb.Entry{
+		Type:     pb.EncodedEntry,
+		ClientID: 100,
+		SeriesID: client.NoOPSeriesID,
+		Cmd:      rsm.GetEncoded(dio.NoCompression, []byte("k1"), nil),
+	}
+	chunks := rsm.SplitEntry(encoded, 1)
+	if len(chunks) < 3 {
+		t.Fatalf("unexpected chunk count %d", len(chunks))
+	}
+	var entries []entry
+	for i, c := range chunks {
+		entries = append(entries, entry{
+			Index:    uint64(i + 1),
+			Type:     c.Type,
+			ClientID: c.ClientID,
+			SeriesID: c.SeriesID,
+			Cmd:      c.Cmd,
+		})
+	}
+	first := entriesCmd{LastIndex: 2, Entries: entries[:2]}
+	if _, err := s.Update(sm.Entry{Cmd: encode(kindEntries, &first)}); err != nil {
+		t.Fatalf("update failed %v", err)
+	}
+	if len(kv.Data) != 0 {
+		t.Errorf("partially mirrored entry applied")
+	}
+	if err := s.SaveSnapshot(&bytes.Buffer{}, nil, nil); err != sm.ErrSnapshotAborted {
+		t.Errorf("snapshot not aborted, %v", err)
+	}
+	second := entriesCmd{
+		LastIndex: uint64(len(entries)),
+		Entries:   entries[2:],
+	}
+	if _, err := s.Update(sm.Entry{Cmd: encode(kindEntries, &second)}); err != nil {
+		t.Fatalf("update failed %v", err)
+	}
+	if kv.Data["k1"] != 1 {
+		t.Errorf("chunked entry not applied, %v", kv.Data)
+	}
+}
+
+func getTestRestoreData(t *testing.T, data map[string]uint64) []byte {
+	var buf bytes.Buffer
+	if err := rsm.NewSessionManager().SaveSessions(&buf); err != nil {
+		t.Fatalf("failed to save sessions %v", err)
+	}
+	if err := gob.NewEncoder(&buf).Encode(data); err != nil {
+		t.Fatalf("failed to encode %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestStandbyRestoreIsStreamed(t *testing.T) {
+	s := NewStandby(newTestKV)(1, 1)
+	data := getTestRestoreData(t, map[string]uint64{"k1": 5})
+	restore := func(index uint64, seq uint64, v []byte, last bool) sm.Result {
+		cmd := restoreCmd{
+			Index:   index,
+			Version: uint64(rsm.DefaultVersion),
+			Seq:     seq,
+			Last:    last,
+			Data:    v,
+		}
+		result, err := s.Update(sm.Entry{Cmd: encode(kindRestore, &cmd)})
+		if err != nil {
+			t.Fatalf("update failed %v", err)
+		}
+		return result
+	}
+	status := func() Status {
+		v, err := s.Lookup(statusQuery{})
+		if err != nil {
+			t.Fatalf("lookup failed %v", err)
+		}
+		return v.(Status)
+	}
+	restore(10, 0, data[:8], false)
+	if !status().Restoring {
+		t.Errorf("not restoring")
+	}
+	if _, err := s.Lookup("k1"); err != ErrRestoring {
+		t.Errorf("lookup not rejected, %v", err)
+	}
+	if err := s.SaveSnapshot(&bytes.Buffer{}, nil, nil); err != sm.ErrSnapshotAborted {
+		t.Errorf("snapshot not aborted, %v", err)
+	}
+	// out of order chunk aborts the restore
+	if result := restore(10, 2, data[8:], true); result.Value != rejected {
+		t.Errorf("out of order chunk not rejected")
+	}
+	cmd := entriesCmd{LastIndex: 11}
+	result, err := s.Update(sm.Entry{Cmd: encode(kindEntries, &cmd)})
+	if err != nil {
+		t.Fatalf("update failed %v", err)
+	}
+	if result.Value != rejected {
+		t.Errorf("entries accepted by partially restored standby")
+	}
+	result, err = s.Update(sm.Entry{Cmd: encode(kindPromote, nil)})
+	if err != nil {
+		t.Fatalf("update failed %v", err)
+	}
+	if result.Value != rejected {
+		t.Errorf("partially restored standby promoted")
+	}
+	for seq := uint64(0); seq*8 < uint64(len(data)); seq++ {
+		end := (seq + 1) * 8
+		if end > uint64(len(data)) {
+			end = uint64(len(data))
+		}
+		restore(20, seq, data[seq*8:end], false)
+	}
+	restore(20, uint64(len(data)+7)/8, nil, true)
+	if st := status(); st.Restoring || st.Index != 20 {
+		t.Errorf("unexpected status %v", st)
+	}
+	v, err := s.Lookup("k1")
+	if err != nil {
+		t.Fatalf("lookup failed %v", err)
+	}
+	if v.(uint64) != 5 {
+		t.Errorf("unexpected value %d", v)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("close failed %v", err)
+	}
+}
+
+func newTestNodeHost(t *testing.T,
+	fs vfs.IFS, deploymentID uint64, addr string) *dragonboat.NodeHost {
+	nhc := config.NodeHostConfig{
+		DeploymentID:   deploymentID,
+		NodeHostDir:    fs.PathJoin(testDataDir, addr),
+		RTTMillisecond: 5,
+		RaftAddress:    addr,
+		Expert:         config.ExpertConfig{FS: fs},
+	}
+	nh, err := dragonboat.NewNodeHost(nhc)
+	if err != nil {
+		t.Fatalf("failed to create nodehost %v", err)
+	}
+	return nh
+}
+
+func startTestShard(t *testing.T, nh *dragonboat.NodeHost,
+	shardID uint64, create sm.CreateStateMachineFunc) {
+	rc := config.Config{
+		ShardID:      shardID,
+		ReplicaID:    1,
+		ElectionRTT:  10,
+		HeartbeatRTT: 1,
+	}
+	members := map[uint64]string{1: nh.RaftAddress()}
+	if err := nh.StartReplica(members, false, create, rc); err != nil {
+		t.Fatalf("failed to start replica %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		_, _, ok, err := nh.GetLeaderID(shardID)
+		if err != nil {
+			t.Fatalf("failed to get leader id %v", err)
+		}
+		if ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("failed to elect leader")
+}
+
+func syncMirror(ctx context.Context, t *testing.T, m *Mirror) {
+	for i := 0; i < 100; i++ {
+		done, err := m.Sync(ctx)
+		if err != nil {
+			t.Fatalf("failed to sync %v", err)
+		}
+		if done {
+			return
+		}
+	}
+	t.Fatalf("failed to catch up")
+}
+
+func readKey(ctx context.Context, t *testing.T,
+	nh *dragonboat.NodeHost, shardID uint64, key string) uint64 {
+	v, err := nh.SyncRead(ctx, shardID, key)
+	if err != nil {
+		t.Fatalf("failed to read %v", err)
+	}
+	return v.(uint64)
+}
+
+func TestShardCanBeMirroredAndPromoted(t *testing.T) {
+	fs := vfs.GetTestFS()
+	if err := fs.RemoveAll(testDataDir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(testDataDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	source := newTestNodeHost(t, fs, 1, testSourceAddress)
+	defer source.Close()
+	standby := newTestNodeHost(t, fs, 2, testStandbyAddress)
+	defer standby.Close()
+	startTestShard(t, source, 1, newTestKV)
+	startTestShard(t, standby, 1, NewStandby(newTestKV))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	propose := func(key string) {
+		_, err := source.SyncPropose(ctx, source.GetNoOPSession(1), []byte(key))
+		if err != nil {
+			t.Fatalf("failed to propose %v", err)
+		}
+	}
+	cs, err := source.SyncGetSession(ctx, 1)
+	if err != nil {
+		t.Fatalf("failed to get session %v", err)
+	}
+	if _, err := source.SyncPropose(ctx, cs, []byte("k1")); err != nil {
+		t.Fatalf("failed to propose %v", err)
+	}
+	cs.ProposalCompleted()
+	propose("k1")
+	propose("k2")
+	cfg := Config{
+		SourceShardID:  1,
+		StandbyShardID: 1,
+		ExportPath:     fs.PathJoin(testDataDir, "export"),
+		MaxBatchSize:   64,
+	}
+	if err := fs.MkdirAll(cfg.ExportPath, 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	m, err := New(source, standby, cfg)
+	if err != nil {
+		t.Fatalf("failed to create mirror %v", err)
+	}
+	syncMirror(ctx, t, m)
+	if lag := m.Lag(); lag != 0 {
+		t.Errorf("unexpected lag %d", lag)
+	}
+	if v := readKey(ctx, t, standby, 1, "k1"); v != 2 {
+		t.Errorf("unexpected value %d", v)
+	}
+	// compact the source shard, a new standby shard requires a snapshot
+	opt := dragonboat.SnapshotOption{
+		OverrideCompactionOverhead: true,
+		CompactionOverhead:         0,
+	}
+	if _, err := source.SyncRequestSnapshot(ctx, 1, opt); err != nil {
+		t.Fatalf("failed to request snapshot %v", err)
+	}
+	propose("k2")
+	startTestShard(t, standby, 2, NewStandby(newTestKV))
+	cfg.StandbyShardID = 2
+	m2, err := New(source, standby, cfg)
+	if err != nil {
+		t.Fatalf("failed to create mirror %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		rs, err := source.QueryRaftLog(1, 1, 2, 1024)
+		if err != nil {
+			t.Fatalf("failed to query raft log %v", err)
+		}
+		result := <-rs.ResultC()
+		rs.Release()
+		if result.RequestOutOfRange() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	syncMirror(ctx, t, m2)
+	if v := readKey(ctx, t, standby, 2, "k2"); v != 2 {
+		t.Errorf("unexpected value %d", v)
+	}
+	if err := m2.Promote(ctx); err != nil {
+		t.Fatalf("failed to promote %v", err)
+	}
+	if _, err := m2.Sync(ctx); err != ErrPromoted {
+		t.Errorf("ErrPromoted not returned, %v", err)
+	}
+	_, err = standby.SyncPropose(ctx, standby.GetNoOPSession(2), []byte("k2"))
+	if err != nil {
+		t.Fatalf("failed to propose %v", err)
+	}
+	if v := readKey(ctx, t, standby, 2, "k2"); v != 3 {
+		t.Errorf("unexpected value %d", v)
+	}
+}
@@ -0,0 +1,433 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mirror
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"math"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// ReadOnly is the Value of the sm.Result returned for regular proposals made
+// to a standby shard that has not been promoted yet. Such proposals are not
+// applied.
+const ReadOnly uint64 = math.MaxUint64
+
+// rejected is the Value of the sm.Result returned for mirror commands that
+// can not be applied as the standby shard is being restored.
+const rejected uint64 = math.MaxUint64 - 1
+
+// Standby shard proposal format used before the promotion
+//
+// -------------------------------
+// |  Magic  |  Kind  |  Payload  |
+// | 4Bytes  | 1Byte  |  N Bytes  |
+// -------------------------------
+var magic = []byte{0x4D, 0x49, 0x52, 0x52}
+
+type kind uint8
+
+const (
+	kindEntries kind = iota + 1
+	kindRestore
+	kindPromote
+)
+
+const headerSize = 5
+
+// entry is a mirrored entry of the source shard, Cmd is the payload of the
+// entry as stored in the Raft log of the source shard.
+type entry struct {
+	Index       uint64
+	Type        pb.EntryType
+	ClientID    uint64
+	SeriesID    uint64
+	RespondedTo uint64
+	Cmd         []byte
+}
+
+// entriesCmd is a batch of mirrored entries, LastIndex is the index of the
+// last processed source entry including those not required to be mirrored.
+type entriesCmd struct {
+	LastIndex uint64
+	Entries   []entry
+}
+
+// restoreCmd contains a chunk of the snapshot payload of the source shard,
+// the payload includes both the client sessions and the state machine data.
+// Chunks are proposed in Seq order, Last is set for the last chunk.
+type restoreCmd struct {
+	Index   uint64
+	Version uint64
+	Seq     uint64
+	Last    bool
+	Data    []byte
+}
+
+type statusQuery struct{}
+
+// Status is the mirroring status of a standby shard.
+type Status struct {
+	// Index is the index of the last source entry mirrored to the standby
+	// shard.
+	Index uint64
+	// Promoted indicates whether the standby shard has been promoted.
+	Promoted bool
+	// Restoring indicates that the standby shard is being restored using a
+	// snapshot of the source shard, it does not accept mirrored entries until
+	// the restore is completed.
+	Restoring bool
+}
+
+func encode(k kind, v interface{}) []byte {
+	var buf bytes.Buffer
+	buf.Write(magic)
+	buf.WriteByte(byte(k))
+	if v != nil {
+		if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+			panic(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func isMirrorCmd(cmd []byte) bool {
+	return len(cmd) >= headerSize && bytes.Equal(cmd[:len(magic)], magic)
+}
+
+// restore is an ongoing restore of the standby shard, the snapshot payload is
+// streamed to the RecoverFromSnapshot method of the state machine running in
+// its own goroutine.
+type restore struct {
+	index    uint64
+	next     uint64
+	w        *io.PipeWriter
+	stopC    chan struct{}
+	doneC    chan error
+	sessions *rsm.SessionManager
+}
+
+// standby is the state machine wrapper used by standby shards.
+type standby struct {
+	sm        sm.IStateMachine
+	sessions  *rsm.SessionManager
+	chunks    rsm.ChunkAssembler
+	index     uint64
+	promoted  bool
+	restoring bool
+	restore   *restore
+}
+
+var _ sm.IStateMachine = (*standby)(nil)
+var _ sm.IHash = (*standby)(nil)
+var _ sm.IExtended = (*standby)(nil)
+
+// NewStandby returns a factory function for creating state machines used by
+// replicas of standby shards. The specified factory function must create the
+// same type of state machine as the one used by the source shard.
+//
+// Before the promotion, the standby shard only accepts entries mirrored from
+// the source shard, regular proposals are not applied and get ReadOnly as
+// their result values. Once promoted, all proposals are applied as regular
+// proposals and mirrored entries are no longer accepted, proposals starting
+// with the 4 bytes "MIRR" magic are thus reserved.
+func NewStandby(f sm.CreateStateMachineFunc) sm.CreateStateMachineFunc {
+	return func(shardID uint64, replicaID uint64) sm.IStateMachine {
+		return &standby{
+			sm:       f(shardID, replicaID),
+			sessions: rsm.NewSessionManager(),
+		}
+	}
+}
+
+func (s *standby) Update(e sm.Entry) (sm.Result, error) {
+	if s.promoted {
+		if isMirrorCmd(e.Cmd) {
+			// rejected so stale mirrors are notified
+			return sm.Result{Value: ReadOnly}, nil
+		}
+		return s.sm.Update(e)
+	}
+	if !isMirrorCmd(e.Cmd) {
+		return sm.Result{Value: ReadOnly}, nil
+	}
+	payload := bytes.NewReader(e.Cmd[headerSize:])
+	switch kind(e.Cmd[len(magic)]) {
+	case kindEntries:
+		var cmd entriesCmd
+		if err := gob.NewDecoder(payload).Decode(&cmd); err != nil {
+			return sm.Result{}, errors.Wrapf(err, "invalid entries command")
+		}
+		if s.restoring {
+			return sm.Result{Value: rejected}, nil
+		}
+		return sm.Result{}, s.mirror(cmd)
+	case kindRestore:
+		var cmd restoreCmd
+		if err := gob.NewDecoder(payload).Decode(&cmd); err != nil {
+			return sm.Result{}, errors.Wrapf(err, "invalid restore command")
+		}
+		return s.restoreChunk(cmd)
+	case kindPromote:
+		if s.restoring {
+			return sm.Result{Value: rejected}, nil
+		}
+		s.promoted = true
+		return sm.Result{}, nil
+	}
+	return sm.Result{}, errors.Newf("unknown mirror command kind %d",
+		e.Cmd[len(magic)])
+}
+
+// mirror applies mirrored entries in the same way as they are applied by the
+// source shard, retried proposals are identified using the client session
+// details of the entries and they are only applied once.
+func (s *standby) mirror(cmd entriesCmd) error {
+	for _, me := range cmd.Entries {
+		if me.Index <= s.index {
+			continue
+		}
+		e := pb.Entry{
+			Index:       me.Index,
+			Type:        me.Type,
+			ClientID:    me.ClientID,
+			SeriesID:    me.SeriesID,
+			RespondedTo: me.RespondedTo,
+			Cmd:         me.Cmd,
+		}
+		if e.Type == pb.ChunkedEntry {
+			ce, ok := s.chunks.Add(e)
+			if !ok {
+				continue
+			}
+			e = ce
+		} else {
+			// chunks of the same entry are contiguous in the source Raft log,
+			// a partially reassembled entry can never be completed
+			s.chunks.Reset()
+		}
+		if e.IsNewSessionRequest() {
+			s.sessions.RegisterClientID(e.ClientID)
+		} else if e.IsEndOfSessionRequest() {
+			s.sessions.UnregisterClientID(e.ClientID)
+		} else if err := s.update(e); err != nil {
+			return err
+		}
+	}
+	if cmd.LastIndex > s.index {
+		s.index = cmd.LastIndex
+	}
+	return nil
+}
+
+func (s *standby) update(e pb.Entry) error {
+	var session *rsm.Session
+	if !e.IsNoOPSession() {
+		var ok bool
+		session, ok = s.sessions.ClientRegistered(e.ClientID)
+		if !ok {
+			return nil
+		}
+		s.sessions.UpdateRespondedTo(session, e.RespondedTo)
+		_, responded, toUpdate := s.sessions.UpdateRequired(session, e.SeriesID)
+		if responded || !toUpdate {
+			return nil
+		}
+	}
+	cmd, err := rsm.GetPayload(e)
+	if err != nil {
+		return err
+	}
+	r, err := s.sm.Update(sm.Entry{Index: e.Index, Cmd: cmd})
+	if err != nil {
+		return err
+	}
+	if session != nil {
+		s.sessions.AddResponse(session, e.SeriesID, r)
+	}
+	return nil
+}
+
+// restoreChunk applies a chunk of the snapshot payload of the source shard.
+// The first chunk starts a new restore, the state machine is considered as
+// inconsistent until the last chunk is applied. Chunks that do not belong to
+// the ongoing restore cause it to be aborted.
+func (s *standby) restoreChunk(cmd restoreCmd) (sm.Result, error) {
+	if cmd.Seq == 0 {
+		s.abortRestore()
+		s.startRestore(cmd)
+	}
+	r := s.restore
+	if r == nil || r.index != cmd.Index || r.next != cmd.Seq {
+		s.abortRestore()
+		return sm.Result{Value: rejected}, nil
+	}
+	r.next++
+	if len(cmd.Data) > 0 {
+		if _, err := r.w.Write(cmd.Data); err != nil {
+			s.abortRestore()
+			return sm.Result{}, err
+		}
+	}
+	if !cmd.Last {
+		return sm.Result{}, nil
+	}
+	if err := r.w.Close(); err != nil {
+		return sm.Result{}, err
+	}
+	s.restore = nil
+	if err := <-r.doneC; err != nil {
+		return sm.Result{}, err
+	}
+	s.sessions = r.sessions
+	s.index = r.index
+	s.restoring = false
+	return sm.Result{}, nil
+}
+
+func (s *standby) startRestore(cmd restoreCmd) {
+	pr, pw := io.Pipe()
+	r := &restore{
+		index: cmd.Index,
+		w:     pw,
+		stopC: make(chan struct{}),
+		doneC: make(chan error, 1),
+	}
+	s.chunks.Reset()
+	s.restoring = true
+	s.restore = r
+	go func() {
+		sessions := rsm.NewSessionManager()
+		err := func() error {
+			if err := sessions.LoadSessions(pr,
+				rsm.SSVersion(cmd.Version)); err != nil {
+				return err
+			}
+			if err := s.sm.RecoverFromSnapshot(pr, nil, r.stopC); err != nil {
+				return err
+			}
+			_, err := io.Copy(io.Discard, pr)
+			return err
+		}()
+		if err != nil {
+			pr.CloseWithError(err)
+		}
+		r.sessions = sessions
+		r.doneC <- err
+	}()
+}
+
+// abortRestore stops the ongoing restore, if any. The state machine is left
+// partially restored, it can only be used again after another restore.
+func (s *standby) abortRestore() {
+	r := s.restore
+	if r == nil {
+		return
+	}
+	s.restore = nil
+	close(r.stopC)
+	r.w.CloseWithError(errRestoreAborted)
+	<-r.doneC
+}
+
+func (s *standby) Lookup(query interface{}) (interface{}, error) {
+	if _, ok := query.(statusQuery); ok {
+		return Status{
+			Index:     s.index,
+			Promoted:  s.promoted,
+			Restoring: s.restoring,
+		}, nil
+	}
+	if s.restoring {
+		return nil, ErrRestoring
+	}
+	return s.sm.Lookup(query)
+}
+
+func (s *standby) NALookup(query []byte) ([]byte, error) {
+	if s.restoring {
+		return nil, ErrRestoring
+	}
+	if na, ok := s.sm.(sm.IExtended); ok {
+		return na.NALookup(query)
+	}
+	return nil, sm.ErrNotImplemented
+}
+
+func (s *standby) GetHash() (uint64, error) {
+	if s.restoring {
+		return 0, ErrRestoring
+	}
+	if h, ok := s.sm.(sm.IHash); ok {
+		return h.GetHash()
+	}
+	return 0, sm.ErrNotImplemented
+}
+
+func (s *standby) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	if s.restoring || s.chunks.Pending() {
+		// neither the partially restored state machine nor the partially
+		// reassembled entry can be included in snapshots
+		return sm.ErrSnapshotAborted
+	}
+	header := make([]byte, 16)
+	binary.BigEndian.PutUint64(header, s.index)
+	if s.promoted {
+		binary.BigEndian.PutUint64(header[8:], 1)
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if err := s.sessions.SaveSessions(w); err != nil {
+		return err
+	}
+	return s.sm.SaveSnapshot(w, fc, done)
+}
+
+func (s *standby) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	s.abortRestore()
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	sessions := rsm.NewSessionManager()
+	if err := sessions.LoadSessions(r, rsm.DefaultVersion); err != nil {
+		return err
+	}
+	if err := s.sm.RecoverFromSnapshot(r, files, done); err != nil {
+		return err
+	}
+	s.index = binary.BigEndian.Uint64(header)
+	s.promoted = binary.BigEndian.Uint64(header[8:]) != 0
+	s.sessions = sessions
+	s.restoring = false
+	s.chunks.Reset()
+	return nil
+}
+
+func (s *standby) Close() error {
+	s.abortRestore()
+	return s.sm.Close()
+}
@@ -186,8 +186,3 @@ func (nh *NodeHost) RestorePartitionedNode() {
 func (nh *NodeHost) IsPartitioned() bool {
 	return nh.isPartitioned()
 }
-
-// IsPartitioned indicates whether the local node is in partitioned mode.
-func (nh *NodeHost) isPartitioned() bool {
-	return atomic.LoadInt32(&nh.partitioned) == 1
-}
@@ -17,6 +17,7 @@ package dragonboat
 import (
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/cockroachdb/errors"
 	"github.com/lni/goutils/logutil"
@@ -77,6 +78,7 @@ type leaderInfo struct {
 type node struct {
 	shardInfo             atomic.Value
 	leaderInfo            atomic.Value
+	replication           atomic.Value
 	nodeRegistry          registry.INodeRegistry
 	logdb                 raftio.ILogDB
 	pipeline              pipeline
@@ -109,7 +111,13 @@ type node struct {
 	logReader             *logdb.LogReader
 	snapshotter           *snapshotter
 	mq                    *server.MessageQueue
+	budget                *server.MemoryBudget
 	qs                    *quiesceState
+	stub                  *replicaStub
+	batcher               *proposalBatcher
+	disk                  *diskMonitor
+	replicaRemoved        func(shardID uint64, replicaID uint64)
+	chaos                 nodeChaos
 	raftAddress           string
 	config                config.Config
 	currentTick           uint64
@@ -122,11 +130,14 @@ type node struct {
 	replicaID             uint64
 	instanceID            uint64
 	initializedFlag       uint64
+	hibernateFlag         uint32
 	closeOnce             sync.Once
+	releaseOnce           sync.Once
 	raftMu                sync.Mutex
 	new                   bool
 	logDBLimited          bool
 	rateLimited           bool
+	stepScheduled         int32
 	notifyCommit          bool
 }
 
@@ -150,6 +161,7 @@ func newNode(peers map[uint64]string,
 	pool *sync.Pool,
 	ldb raftio.ILogDB,
 	metrics *logDBMetrics,
+	budget *server.MemoryBudget,
 	sysEvents *sysEventListener) (*node, error) {
 	notifyCommit := nhConfig.NotifyCommit
 	proposals := newEntryQueue(incomingProposalsMaxLen, lazyFreeCycle)
@@ -159,6 +171,8 @@ func newNode(peers map[uint64]string,
 	stopC := make(chan struct{})
 	mq := server.NewMessageQueue(receiveQueueLen,
 		false, lazyFreeCycle, nhConfig.MaxReceiveQueueSize)
+	batcher := newProposalBatcher(config.ProposalBatchDelay,
+		config.ProposalBatchSize, incomingProposalsMaxLen/2)
 	rn := &node{
 		shardID:               config.ShardID,
 		replicaID:             config.ReplicaID,
@@ -175,6 +189,7 @@ func newNode(peers map[uint64]string,
 		handleSnapshotStatus:  handleSnapshotStatus,
 		stopC:                 stopC,
 		pendingProposals:      newPendingProposal(config, notifyCommit, pool, proposals),
+		batcher:               batcher,
 		pendingReadIndexes:    newPendingReadIndex(pool, readIndexes),
 		pendingConfigChange:   newPendingConfigChange(configChangeC, notifyCommit),
 		pendingSnapshot:       newPendingSnapshot(snapshotC),
@@ -185,6 +200,7 @@ func newNode(peers map[uint64]string,
 		logReader:             logReader,
 		sendRaftMessage:       sendMessage,
 		mq:                    mq,
+		budget:                budget,
 		logdb:                 ldb,
 		syncTask:              newTask(syncTaskInterval),
 		sysEvents:             sysEvents,
@@ -214,6 +230,11 @@ func newNode(peers map[uint64]string,
 		return nil, err
 	}
 	rn.new = new
+	rn.p.SetDeploymentID(nhConfig.GetDeploymentID())
+	if clock := nhConfig.Expert.Clock; clock != nil {
+		rn.p.SetRandomSource(newClockRandomSource(clock.Seed(),
+			config.ShardID, config.ReplicaID))
+	}
 	return rn, nil
 }
 
@@ -277,6 +298,9 @@ func (n *node) applyConfigChange(cc pb.ConfigChange) error {
 	case pb.AddNode, pb.AddNonVoting, pb.AddWitness:
 		n.nodeRegistry.Add(n.shardID, cc.ReplicaID, cc.Address)
 	case pb.RemoveNode:
+		if n.replicaRemoved != nil {
+			n.replicaRemoved(n.shardID, cc.ReplicaID)
+		}
 		if cc.ReplicaID == n.replicaID {
 			plog.Infof("%s applied ConfChange Remove for itself", n.id())
 			n.nodeRegistry.RemoveShard(n.shardID)
@@ -374,6 +398,12 @@ func (n *node) startRaft(cfg config.Config,
 		pas = append(pas, raft.PeerAddress{ReplicaID: k, Address: v})
 	}
 	n.p = raft.Launch(cfg, n.logReader, n.raftEvents, pas, initial, newNode)
+	if n.budget.Enabled() {
+		n.p.SetMemoryBudget(n.budget)
+		n.mq.SetMemoryBudget(n.budget)
+		n.incomingProposals.setMemoryBudget(n.budget)
+		n.budget.AddReplica()
+	}
 	return newNode, nil
 }
 
@@ -431,10 +461,18 @@ func (n *node) proposeSession(session *client.Session,
 	if !session.ValidForSessionOp(n.shardID) {
 		return nil, ErrInvalidSession
 	}
+	if n.disk.low() {
+		return nil, ErrDiskSpaceLow
+	}
 	return n.pendingProposals.propose(session, nil, timeout)
 }
 
 func (n *node) payloadTooBig(sz int) bool {
+	if n.config.ProposalChunkSize > 0 {
+		// chunked proposals are not stored in a single Raft log entry, but
+		// they might be reassembled in memory before being applied
+		return uint64(sz) > settings.Soft.MaxChunkedProposalSize
+	}
 	if n.config.MaxInMemLogSize == 0 {
 		return false
 	}
@@ -443,6 +481,11 @@ func (n *node) payloadTooBig(sz int) bool {
 
 func (n *node) propose(session *client.Session,
 	cmd []byte, timeout uint64) (*RequestState, error) {
+	return n.proposeWithKeys(session, cmd, nil, timeout)
+}
+
+func (n *node) proposeWithKeys(session *client.Session,
+	cmd []byte, keys []uint64, timeout uint64) (*RequestState, error) {
 	if !n.initialized() {
 		return nil, ErrShardNotReady
 	}
@@ -455,7 +498,13 @@ func (n *node) propose(session *client.Session,
 	if n.payloadTooBig(len(cmd)) {
 		return nil, ErrPayloadTooBig
 	}
-	return n.pendingProposals.propose(session, cmd, timeout)
+	if n.disk.low() {
+		return nil, ErrDiskSpaceLow
+	}
+	if n.memoryLimited() {
+		return nil, ErrMemoryBudgetExceeded
+	}
+	return n.pendingProposals.proposeWithKeys(session, cmd, keys, timeout)
 }
 
 func (n *node) read(timeout uint64) (*RequestState, error) {
@@ -581,9 +630,32 @@ func (n *node) getLeaderID() (uint64, uint64, bool) {
 }
 
 func (n *node) destroy() error {
+	n.releaseMemory()
 	return n.sm.Close()
 }
 
+// releaseMemory returns memory still accounted to the node back to the
+// NodeHost wide memory budget. Sizes of the receive queue and the incoming
+// proposal queue are released when those queues are closed.
+func (n *node) releaseMemory() {
+	if n.budget.Enabled() {
+		n.releaseOnce.Do(func() {
+			n.budget.Decrease(n.p.InMemLogSize())
+			n.budget.RemoveReplica()
+		})
+	}
+}
+
+// memoryUsage returns the memory size accounted to the node.
+func (n *node) memoryUsage() uint64 {
+	return n.p.InMemLogSize() + n.mq.MemorySize() +
+		n.incomingProposals.memorySize()
+}
+
+func (n *node) memoryLimited() bool {
+	return n.budget.Enabled() && n.budget.Limited(n.memoryUsage())
+}
+
 func (n *node) destroyed() bool {
 	select {
 	case <-n.sm.DestroyedC():
@@ -774,6 +846,10 @@ func (n *node) doSave(req rsm.SSRequest) (uint64, error) {
 	}
 	plog.Infof("%s saved %s, term %d, file count %d",
 		n.id(), n.ssid(ss.Index), ss.Term, len(ss.Files))
+	if n.chaos.crashed() {
+		plog.Warningf("%s crashed before committing %s", n.id(), n.ssid(ss.Index))
+		return 0, nil
+	}
 	if err := n.snapshotter.Commit(ss, req); err != nil {
 		if snapshotCommitAborted(err) || saveAborted(err) {
 			// saveAborted() will only be true in monkey test
@@ -917,6 +993,7 @@ func (n *node) recoverFromSnapshotDone() {
 }
 
 func (n *node) handleTask(ts []rsm.Task, es []sm.Entry) (rsm.Task, error) {
+	n.chaos.delayApply()
 	return n.sm.Handle(ts, es)
 }
 
@@ -1064,6 +1141,9 @@ func (n *node) notifyCommittedEntries() {
 	tasks := n.toCommitQ.GetAll()
 	for _, t := range tasks {
 		for _, e := range t.Entries {
+			if e.Type == pb.ChunkedEntry && !rsm.IsLastChunk(e) {
+				continue
+			}
 			if e.IsProposal() {
 				n.pendingProposals.committed(e.ClientID, e.SeriesID, e.Key)
 			} else if e.Type == pb.ConfigChangeEntry {
@@ -1284,8 +1364,22 @@ func (n *node) handleProposals() (bool, error) {
 		n.logDBLimited = logDBBusy
 		plog.Infof("%s new LogDB busy state is %t", n.id(), logDBBusy)
 	}
-	paused := logDBBusy || n.rateLimited
-	if entries := n.incomingProposals.get(paused); len(entries) > 0 {
+	paused := logDBBusy || n.rateLimited || n.memoryLimited()
+	if n.batcher != nil && !paused {
+		count, bytes := n.incomingProposals.pending()
+		if wait := n.batcher.hold(count, bytes); wait > 0 {
+			n.scheduleStep(wait)
+			return false, nil
+		}
+	}
+	entries := n.incomingProposals.get(paused)
+	if !paused && n.incomingProposals.chunking() {
+		// remaining chunks of a chunked proposal were just queued, they are
+		// picked up in the next step
+		n.pipeline.setStepReady(n.shardID)
+	}
+	if len(entries) > 0 {
+		n.batcher.released(uint64(len(entries)))
 		if err := n.p.ProposeEntries(entries); err != nil {
 			return false, err
 		}
@@ -1294,6 +1388,16 @@ func (n *node) handleProposals() (bool, error) {
 	return false, nil
 }
 
+// scheduleStep makes sure the node is stepped again after the specified delay.
+func (n *node) scheduleStep(delay time.Duration) {
+	if atomic.CompareAndSwapInt32(&n.stepScheduled, 0, 1) {
+		time.AfterFunc(delay, func() {
+			atomic.StoreInt32(&n.stepScheduled, 0)
+			n.pipeline.setStepReady(n.shardID)
+		})
+	}
+}
+
 func (n *node) handleReadIndex() (bool, error) {
 	if reqs := n.incomingReadIndexes.get(); len(reqs) > 0 {
 		n.qs.record(pb.ReadIndex)
@@ -1576,9 +1680,41 @@ func (n *node) tick(tick uint64) error {
 	n.pendingProposals.tick(tick)
 	n.pendingReadIndexes.tick(tick)
 	n.pendingConfigChange.tick(tick)
+	if n.config.MaxInflightBytes > 0 {
+		n.updateReplicationInfo()
+	}
+	if n.config.HibernateRTT > 0 {
+		due := uint32(0)
+		if n.qs.quiescedFor() > n.config.HibernateRTT {
+			due = 1
+		}
+		atomic.StoreUint32(&n.hibernateFlag, due)
+	}
 	return nil
 }
 
+func (n *node) updateReplicationInfo() {
+	var result map[uint64]ReplicationInfo
+	if rs := n.p.RemoteStatus(); rs != nil {
+		result = make(map[uint64]ReplicationInfo, len(rs))
+		for replicaID, v := range rs {
+			result[replicaID] = ReplicationInfo{
+				Match:         v.Match,
+				Next:          v.Next,
+				InflightBytes: v.InflightBytes,
+				Paused:        v.Paused,
+			}
+		}
+	}
+	n.replication.Store(result)
+}
+
+// hibernationDue returns a boolean value indicating whether the node has been
+// idle long enough to be hibernated.
+func (n *node) hibernationDue() bool {
+	return atomic.LoadUint32(&n.hibernateFlag) == 1
+}
+
 func (n *node) notifySelfRemove() {
 	n.sysEvents.Publish(server.SystemEvent{
 		Type:      server.NodeDeleted,
@@ -1631,6 +1767,11 @@ func (n *node) getShardInfo() ShardInfo {
 		term = leaderInfo.term
 	}
 
+	var replication map[uint64]ReplicationInfo
+	if rv := n.replication.Load(); rv != nil {
+		replication = rv.(map[uint64]ReplicationInfo)
+	}
+
 	return ShardInfo{
 		ShardID:           ci.ShardID,
 		ReplicaID:         ci.ReplicaID,
@@ -1640,6 +1781,7 @@ func (n *node) getShardInfo() ShardInfo {
 		ConfigChangeIndex: ci.ConfigChangeIndex,
 		Nodes:             ci.Nodes,
 		StateMachineType:  sm.Type(n.sm.Type()),
+		Replication:       replication,
 	}
 }
 
@@ -262,6 +262,7 @@ func doGetTestRaftNodes(startID uint64, count int, ordered bool,
 			requestStatePool,
 			ldb,
 			nil,
+			nil,
 			newSysEventListener(nil, nil))
 		if err != nil {
 			panic(err)
@@ -1569,6 +1570,30 @@ func TestPayloadTooBig(t *testing.T) {
 	}
 }
 
+func TestChunkedPayloadIsStillLimited(t *testing.T) {
+	cfg := config.Config{
+		ReplicaID:         1,
+		HeartbeatRTT:      1,
+		ElectionRTT:       10,
+		MaxInMemLogSize:   1024 * 1024,
+		ProposalChunkSize: 1024,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid cfg %v", err)
+	}
+	n := node{config: cfg}
+	if n.payloadTooBig(int(cfg.MaxInMemLogSize * 2)) {
+		t.Errorf("chunked payload unexpectedly limited by MaxInMemLogSize")
+	}
+	max := settings.Soft.MaxChunkedProposalSize
+	if n.payloadTooBig(int(max)) {
+		t.Errorf("payload unexpectedly too big")
+	}
+	if !n.payloadTooBig(int(max + 1)) {
+		t.Errorf("payload not limited")
+	}
+}
+
 //
 // node states
 //
@@ -1857,3 +1882,58 @@ func TestEntriesToApply(t *testing.T) {
 		}()
 	}
 }
+
+func TestDiskMonitorTracksFreeDiskSpace(t *testing.T) {
+	avail := map[string]uint64{"nh": 1000, "wal": 1000}
+	d := &diskMonitor{
+		dirs: []string{"nh", "wal"},
+		soft: 100,
+		hard: 10,
+		getAvail: func(dir string) (uint64, error) {
+			return avail[dir], nil
+		},
+		transferring: make(map[uint64]struct{}),
+	}
+	tests := []struct {
+		nh      uint64
+		wal     uint64
+		state   int32
+		changed bool
+	}{
+		{1000, 1000, diskSpaceOK, false},
+		{1000, 99, diskSpaceLow, true},
+		{50, 99, diskSpaceLow, false},
+		{50, 9, diskSpaceCritical, true},
+		{100, 100, diskSpaceOK, true},
+	}
+	for idx, tt := range tests {
+		avail["nh"], avail["wal"] = tt.nh, tt.wal
+		state, changed := d.check()
+		if state != tt.state || changed != tt.changed {
+			t.Errorf("%d, got %d/%t, want %d/%t",
+				idx, state, changed, tt.state, tt.changed)
+		}
+		if d.low() != (tt.state != diskSpaceOK) {
+			t.Errorf("%d, unexpected low value", idx)
+		}
+	}
+	var nd *diskMonitor
+	if nd.enabled() || nd.low() {
+		t.Errorf("nil disk monitor is not disabled")
+	}
+}
+
+func TestProposalIsRejectedWhenDiskSpaceIsLow(t *testing.T) {
+	d := &diskMonitor{state: diskSpaceLow}
+	n := &node{shardID: 1, disk: d, initializedC: make(chan struct{})}
+	close(n.initializedC)
+	noop := client.NewNoOPSession(1, random.LockGuardedRand)
+	if _, err := n.propose(noop, nil, 10); err != ErrDiskSpaceLow {
+		t.Errorf("failed to return ErrDiskSpaceLow, %v", err)
+	}
+	s := client.NewSession(1, random.LockGuardedRand)
+	s.PrepareForRegister()
+	if _, err := n.proposeSession(s, 10); err != ErrDiskSpaceLow {
+		t.Errorf("failed to return ErrDiskSpaceLow, %v", err)
+	}
+}
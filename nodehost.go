@@ -73,6 +73,7 @@ import (
 	"github.com/lni/dragonboat/v4/internal/id"
 	"github.com/lni/dragonboat/v4/internal/invariants"
 	"github.com/lni/dragonboat/v4/internal/logdb"
+	"github.com/lni/dragonboat/v4/internal/raft"
 	"github.com/lni/dragonboat/v4/internal/registry"
 	"github.com/lni/dragonboat/v4/internal/rsm"
 	"github.com/lni/dragonboat/v4/internal/server"
@@ -111,6 +112,9 @@ var (
 	ErrShardNotFound = errors.New("shard not found")
 	// ErrShardAlreadyExist indicates that the specified shard already exist.
 	ErrShardAlreadyExist = errors.New("shard already exist")
+	// ErrShardDeleted indicates that the specified shard has been permanently
+	// deleted by the DeleteShard method.
+	ErrShardDeleted = errors.New("shard deleted")
 	// ErrShardNotStopped indicates that the specified shard is still running
 	// and thus prevented the requested operation to be completed.
 	ErrShardNotStopped = errors.New("shard not stopped")
@@ -143,6 +147,10 @@ var (
 // on the knowledge of the local NodeHost instance.
 type ShardInfo = registry.ShardInfo
 
+// ReplicationInfo is the replication state of a remote replica as tracked by
+// the leader replica.
+type ReplicationInfo = registry.ReplicationInfo
+
 // ShardView is a record for representing the state of a Raft shard based
 // on the knowledge of distributed NodeHost instances as shared by gossip.
 type ShardView = registry.ShardView
@@ -176,6 +184,11 @@ type NodeHostInfo struct {
 	// LogInfo is a list of raftio.NodeInfo values representing all Raft logs
 	// stored on the NodeHost.
 	LogInfo []raftio.NodeInfo
+	// OrphanedLogInfo is the subset of LogInfo that belongs to replicas covered
+	// by known tombstones and no longer running on the NodeHost. Data of such
+	// orphaned replicas are scheduled to be removed, see the OrphanCleanupDelay
+	// field of NodeHostConfig for more details.
+	OrphanedLogInfo []raftio.NodeInfo
 }
 
 // NodeHostInfoOption is the option type used when querying NodeHostInfo.
@@ -287,8 +300,14 @@ type NodeHost struct {
 	msgHandler   *messageHandler
 	env          *server.Env
 	engine       *engine
+	budget       *server.MemoryBudget
+	disk         *diskMonitor
 	nhConfig     config.NodeHostConfig
 	requestPools []*sync.Pool
+	tombstones   tombstones
+	hibernated   sync.Map
+	hibernateC   chan *node
+	driver       *clockDriver
 	partitioned  int32
 	closed       int32
 }
@@ -314,13 +333,17 @@ func NewNodeHost(nhConfig config.NodeHostConfig) (*NodeHost, error) {
 		return nil, err
 	}
 	nh := &NodeHost{
-		env:      env,
-		nhConfig: nhConfig,
-		stopper:  syncutil.NewStopper(),
-		fs:       nhConfig.Expert.FS,
+		env:        env,
+		nhConfig:   nhConfig,
+		stopper:    syncutil.NewStopper(),
+		fs:         nhConfig.Expert.FS,
+		hibernateC: make(chan *node, hibernateQueueSize),
 	}
+	raft.RetainSafetyCheck()
 	// make static check happy
 	_ = nh.partitioned
+	nh.budget = newMemoryBudget(nhConfig.MaxMemoryBudget, nhConfig.EnableMetrics)
+	nh.disk = newDiskMonitor(nh.fs, nhConfig)
 	nh.events.raft = nhConfig.RaftEventListener
 	nh.events.sys = newSysEventListener(nhConfig.SystemEventListener,
 		nh.stopper.ShouldStop())
@@ -353,29 +376,56 @@ func NewNodeHost(nhConfig config.NodeHostConfig) (*NodeHost, error) {
 		nh.Close()
 		return nil, err
 	}
+	if err := nh.loadTombstones(); err != nil {
+		nh.Close()
+		return nil, err
+	}
 	plog.Infof("NodeHost ID: %s", nh.id.String())
 	if err := nh.createNodeRegistry(); err != nil {
 		nh.Close()
 		return nil, err
 	}
+	nh.shareTombstones()
 	errorInjection := false
 	if nhConfig.Expert.FS != nil {
-		_, errorInjection = nhConfig.Expert.FS.(*vfs.ErrorFS)
+		switch nhConfig.Expert.FS.(type) {
+		case *vfs.ErrorFS, *vfs.FaultFS:
+			errorInjection = true
+		}
 		plog.Infof("filesystem error injection mode enabled: %t", errorInjection)
 	}
+	clock := nhConfig.Expert.Clock
 	nh.engine = newExecEngine(nh, nhConfig.Expert.Engine,
-		nh.nhConfig.NotifyCommit, errorInjection, nh.env, nh.mu.logdb)
+		nh.nhConfig.NotifyCommit, errorInjection, clock != nil,
+		nh.env, nh.mu.logdb)
 	if err := nh.createTransport(); err != nil {
 		nh.Close()
 		return nil, err
 	}
+	if clock == nil {
+		nh.stopper.RunWorker(func() {
+			nh.nodeMonitorMain()
+		})
+		nh.stopper.RunWorker(func() {
+			nh.tickWorkerMain()
+		})
+		nh.stopper.RunWorker(func() {
+			nh.hibernateWorkerMain()
+		})
+	}
 	nh.stopper.RunWorker(func() {
-		nh.nodeMonitorMain()
-	})
-	nh.stopper.RunWorker(func() {
-		nh.tickWorkerMain()
+		nh.orphanWorkerMain()
 	})
+	if nh.disk.enabled() {
+		nh.stopper.RunWorker(func() {
+			nh.diskMonitorMain()
+		})
+	}
 	nh.logNodeHostDetails()
+	if clock != nil {
+		nh.driver = &clockDriver{nh: nh}
+		clock.Attach(nh.driver)
+	}
 	return nh, nil
 }
 
@@ -391,6 +441,9 @@ func (nh *NodeHost) Close() {
 	}
 	atomic.StoreInt32(&nh.closed, 1)
 	nh.mu.Unlock()
+	if nh.driver != nil {
+		nh.nhConfig.Expert.Clock.Detach(nh.driver)
+	}
 	nodes := make([]raftio.NodeInfo, 0)
 	nh.forEachShard(func(cid uint64, node *node) bool {
 		nodes = append(nodes, raftio.NodeInfo{
@@ -429,6 +482,7 @@ func (nh *NodeHost) Close() {
 	}
 	plog.Debugf("%s is stopping the env module", nh.describe())
 	err = firstError(err, nh.env.Close())
+	raft.ReleaseSafetyCheck()
 	plog.Debugf("NodeHost %s stopped", nh.describe())
 	if err != nil {
 		panicNow(err)
@@ -496,6 +550,10 @@ func (nh *NodeHost) GetNodeHostRegistry() (INodeHostRegistry, bool) {
 //   - restarting an crashed or stopped node, set join to false and leave the
 //     initialMembers map to be empty. This applies to both initial member nodes
 //     and those joined later.
+//   - starting a brand new Raft shard with pre-loaded state, set join to false,
+//     specify all initial member node details in the initialMembers map and set
+//     the InitialSnapshot field of cfg to the path of an exported snapshot or
+//     the InitialSnapshotStore field of cfg to its store.
 func (nh *NodeHost) StartReplica(initialMembers map[uint64]Target,
 	join bool, create sm.CreateStateMachineFunc, cfg config.Config) error {
 	cf := func(shardID uint64, replicaID uint64,
@@ -541,6 +599,9 @@ func (nh *NodeHost) StopShard(shardID uint64) error {
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return ErrClosed
 	}
+	if nh.dropHibernated(shardID, 0, false) {
+		return nil
+	}
 	return nh.stopNode(shardID, 0, false)
 }
 
@@ -552,6 +613,9 @@ func (nh *NodeHost) StopReplica(shardID uint64, replicaID uint64) error {
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return ErrClosed
 	}
+	if nh.dropHibernated(shardID, replicaID, true) {
+		return nil
+	}
 	return nh.stopNode(shardID, replicaID, true)
 }
 
@@ -591,6 +655,27 @@ func (nh *NodeHost) SyncPropose(ctx context.Context,
 	return result, nil
 }
 
+// SyncProposeWithKeys is similar to SyncPropose, it makes a synchronous
+// proposal with the specified conflict keys. See the ProposeWithKeys method
+// for more details on conflict keys.
+func (nh *NodeHost) SyncProposeWithKeys(ctx context.Context,
+	session *client.Session, cmd []byte, keys []uint64) (sm.Result, error) {
+	timeout, err := getTimeoutFromContext(ctx)
+	if err != nil {
+		return sm.Result{}, err
+	}
+	rs, err := nh.ProposeWithKeys(session, cmd, keys, timeout)
+	if err != nil {
+		return sm.Result{}, err
+	}
+	result, err := getRequestState(ctx, rs)
+	if err != nil {
+		return sm.Result{}, err
+	}
+	rs.Release()
+	return result, nil
+}
+
 // SyncRead performs a synchronous linearizable read on the specified Raft
 // shard. The specified context parameter must has the timeout value set. The
 // query interface{} specifies what to query, it will be passed to the Lookup
@@ -684,6 +769,9 @@ func (nh *NodeHost) GetLeaderID(shardID uint64) (uint64, uint64, bool, error) {
 	}
 	v, ok := nh.getShard(shardID)
 	if !ok {
+		if info, ok := nh.getHibernatedShardInfo(shardID); ok {
+			return info.LeaderID, info.Term, info.LeaderID != 0, nil
+		}
 		return 0, 0, false, ErrShardNotFound
 	}
 	leaderID, term, valid := v.getLeaderID()
@@ -807,6 +895,21 @@ func (nh *NodeHost) Propose(session *client.Session, cmd []byte,
 	return nh.propose(session, cmd, timeout)
 }
 
+// ProposeWithKeys is similar to Propose, it starts an asynchronous proposal
+// with the specified conflict keys. Conflict keys are uint64 values used for
+// describing what the proposed command touches in the state machine, e.g.
+// hashes of the keys updated by the command, two proposals sharing at least
+// one conflict key are considered as conflicting. Committed entries proposed
+// with the NoOPSession are applied in parallel when they don't conflict with
+// each other and the state machine implements the
+// statemachine.IParallelUpdater interface. Conflict keys are stored in the
+// Raft log together with the proposed command, all replicas of the shard must
+// be running a Dragonboat version that supports conflict keys.
+func (nh *NodeHost) ProposeWithKeys(session *client.Session, cmd []byte,
+	keys []uint64, timeout time.Duration) (*RequestState, error) {
+	return nh.proposeWithKeys(session, cmd, keys, timeout)
+}
+
 // ProposeSession starts an asynchronous proposal on the specified shard
 // for client session related operations. Depending on the state of the specified
 // client session object, the supported operations are for registering or
@@ -815,9 +918,9 @@ func (nh *NodeHost) Propose(session *client.Session, cmd []byte,
 // completion (RequestResult.Completed() is true) of the operation.
 func (nh *NodeHost) ProposeSession(session *client.Session,
 	timeout time.Duration) (*RequestState, error) {
-	n, ok := nh.getShard(session.ShardID)
-	if !ok {
-		return nil, ErrShardNotFound
+	n, timeout, err := nh.waitActiveShard(session.ShardID, timeout)
+	if err != nil {
+		return nil, err
 	}
 	// witness node is not expected to propose anything
 	if n.isWitness() {
@@ -899,9 +1002,9 @@ func (nh *NodeHost) StaleRead(shardID uint64,
 	if atomic.CompareAndSwapUint32(&staleReadCalled, 0, 1) {
 		plog.Warningf("StaleRead called, linearizability not guaranteed for stale read")
 	}
-	n, ok := nh.getShard(shardID)
-	if !ok {
-		return nil, ErrShardNotFound
+	n, err := nh.getActiveShard(shardID)
+	if err != nil {
+		return nil, err
 	}
 	if !n.initialized() {
 		return nil, ErrShardNotInitialized
@@ -965,9 +1068,9 @@ func (nh *NodeHost) RequestSnapshot(shardID uint64,
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return nil, ErrClosed
 	}
-	n, ok := nh.getShard(shardID)
-	if !ok {
-		return nil, ErrShardNotFound
+	n, timeout, err := nh.waitActiveShard(shardID, timeout)
+	if err != nil {
+		return nil, err
 	}
 	if err := opt.Validate(); err != nil {
 		return nil, err
@@ -997,8 +1100,11 @@ func (nh *NodeHost) RequestCompaction(shardID uint64,
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return nil, ErrClosed
 	}
-	n, ok := nh.getShard(shardID)
-	if !ok {
+	n, err := nh.getActiveShard(shardID)
+	if errors.Is(err, ErrShardNotReady) {
+		return nil, err
+	}
+	if err != nil {
 		// assume this is a node that has already been removed via RemoveData
 		done, err := nh.mu.logdb.CompactEntriesTo(shardID, replicaID, math.MaxUint64)
 		if err != nil {
@@ -1103,7 +1209,10 @@ func (nh *NodeHost) SyncRequestAddWitness(ctx context.Context,
 // have the shard node removed from its managing NodeHost instance.
 //
 // Once a node is successfully deleted from a Raft shard, it will not be
-// allowed to be added back to the shard with the same node identity.
+// allowed to be added back to the shard with the same node identity. A
+// tombstone is recorded for the deleted replica on all NodeHost instances that
+// apply the membership change, so leftover data of the replica can be cleaned
+// up, see the OrphanCleanupDelay field of NodeHostConfig for more details.
 //
 // When the Raft shard is created with the OrderedConfigChange config flag
 // set as false, the configChangeIndex parameter is ignored. Otherwise, it
@@ -1117,9 +1226,9 @@ func (nh *NodeHost) RequestDeleteReplica(shardID uint64,
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return nil, ErrClosed
 	}
-	n, ok := nh.getShard(shardID)
-	if !ok {
-		return nil, ErrShardNotFound
+	n, timeout, err := nh.waitActiveShard(shardID, timeout)
+	if err != nil {
+		return nil, err
 	}
 	tt := nh.getTimeoutTick(timeout)
 	defer nh.engine.setStepReady(shardID)
@@ -1160,9 +1269,9 @@ func (nh *NodeHost) RequestAddReplica(shardID uint64,
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return nil, ErrClosed
 	}
-	n, ok := nh.getShard(shardID)
-	if !ok {
-		return nil, ErrShardNotFound
+	n, timeout, err := nh.waitActiveShard(shardID, timeout)
+	if err != nil {
+		return nil, err
 	}
 	defer nh.engine.setStepReady(shardID)
 	return n.requestAddNodeWithOrderID(replicaID,
@@ -1192,9 +1301,9 @@ func (nh *NodeHost) RequestAddNonVoting(shardID uint64,
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return nil, ErrClosed
 	}
-	n, ok := nh.getShard(shardID)
-	if !ok {
-		return nil, ErrShardNotFound
+	n, timeout, err := nh.waitActiveShard(shardID, timeout)
+	if err != nil {
+		return nil, err
 	}
 	defer nh.engine.setStepReady(shardID)
 	return n.requestAddNonVotingWithOrderID(replicaID,
@@ -1222,9 +1331,9 @@ func (nh *NodeHost) RequestAddWitness(shardID uint64,
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return nil, ErrClosed
 	}
-	n, ok := nh.getShard(shardID)
-	if !ok {
-		return nil, ErrShardNotFound
+	n, timeout, err := nh.waitActiveShard(shardID, timeout)
+	if err != nil {
+		return nil, err
 	}
 	defer nh.engine.setStepReady(shardID)
 	return n.requestAddWitnessWithOrderID(replicaID,
@@ -1240,9 +1349,9 @@ func (nh *NodeHost) RequestLeaderTransfer(shardID uint64,
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return ErrClosed
 	}
-	n, ok := nh.getShard(shardID)
-	if !ok {
-		return ErrShardNotFound
+	n, err := nh.getActiveShard(shardID)
+	if err != nil {
+		return err
 	}
 	plog.Debugf("RequestLeaderTransfer called on shard %d target replicaID %d",
 		shardID, targetReplicaID)
@@ -1267,6 +1376,9 @@ func (nh *NodeHost) SyncRemoveData(ctx context.Context,
 	if _, ok := nh.getShard(shardID); ok {
 		return ErrShardNotStopped
 	}
+	if nh.isHibernated(shardID, replicaID) {
+		return ErrShardNotStopped
+	}
 	if ch := nh.engine.destroyedC(shardID, replicaID); ch != nil {
 		select {
 		case <-ch:
@@ -1297,6 +1409,9 @@ func (nh *NodeHost) RemoveData(shardID uint64, replicaID uint64) error {
 	if ok && n.replicaID == replicaID {
 		return ErrShardNotStopped
 	}
+	if nh.isHibernated(shardID, replicaID) {
+		return ErrShardNotStopped
+	}
 	nh.mu.Lock()
 	defer nh.mu.Unlock()
 	if atomic.LoadInt32(&nh.closed) != 0 {
@@ -1325,9 +1440,9 @@ func (nh *NodeHost) GetNodeUser(shardID uint64) (INodeUser, error) {
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return nil, ErrClosed
 	}
-	n, ok := nh.getShard(shardID)
-	if !ok {
-		return nil, ErrShardNotFound
+	n, err := nh.getActiveShard(shardID)
+	if err != nil {
+		return nil, err
 	}
 	return &nodeUser{
 		nh:           nh,
@@ -1353,6 +1468,32 @@ func (nh *NodeHost) HasNodeInfo(shardID uint64, replicaID uint64) bool {
 	return true
 }
 
+// ResizeEngine changes the numbers of execution, commit, apply, snapshot and
+// close shards of the execution engine at runtime to the values specified in
+// the ExecShards, CommitShards, ApplyShards, SnapshotShards and CloseShards
+// fields of cfg, all other fields of cfg are ignored. Raft shards are
+// reassigned to the resized shards of each stage without interrupting the
+// other stages of the execution engine. As the LogDB is partitioned based on
+// the ExecShards value the NodeHost was started with, ExecShards can not be
+// larger than that value. ErrInvalidOperation is returned when
+// AdaptiveWorkers is enabled in the EngineConfig, as the numbers of shards
+// are managed automatically.
+func (nh *NodeHost) ResizeEngine(cfg config.EngineConfig) error {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	if cfg.ExecShards == 0 || cfg.CommitShards == 0 || cfg.ApplyShards == 0 ||
+		cfg.SnapshotShards == 0 || cfg.CloseShards == 0 ||
+		cfg.ExecShards > nh.nhConfig.Expert.Engine.ExecShards {
+		return ErrInvalidOption
+	}
+	if nh.nhConfig.Expert.Engine.AdaptiveWorkers {
+		return ErrInvalidOperation
+	}
+	nh.engine.resize(cfg)
+	return nil
+}
+
 // GetNodeHostInfo returns a NodeHostInfo instance that contains all details
 // of the NodeHost, this includes details of all Raft shards managed by the
 // the NodeHost instance.
@@ -1374,6 +1515,7 @@ func (nh *NodeHost) GetNodeHostInfo(opt NodeHostInfoOption) *NodeHostInfo {
 			panicNow(err)
 		}
 		nhi.LogInfo = logInfo
+		nhi.OrphanedLogInfo = nh.getOrphans(logInfo)
 	}
 	return nhi
 }
@@ -1391,17 +1533,22 @@ func (nh *NodeHost) getGossipInfo() GossipInfo {
 
 func (nh *NodeHost) propose(s *client.Session,
 	cmd []byte, timeout time.Duration) (*RequestState, error) {
+	return nh.proposeWithKeys(s, cmd, nil, timeout)
+}
+
+func (nh *NodeHost) proposeWithKeys(s *client.Session, cmd []byte,
+	keys []uint64, timeout time.Duration) (*RequestState, error) {
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return nil, ErrClosed
 	}
-	v, ok := nh.getShard(s.ShardID)
-	if !ok {
-		return nil, ErrShardNotFound
+	v, timeout, err := nh.waitActiveShard(s.ShardID, timeout)
+	if err != nil {
+		return nil, err
 	}
 	if !v.supportClientSession() && !s.IsNoOPSession() {
 		panic("IOnDiskStateMachine based nodes must use NoOPSession")
 	}
-	req, err := v.propose(s, cmd, nh.getTimeoutTick(timeout))
+	req, err := v.proposeWithKeys(s, cmd, keys, nh.getTimeoutTick(timeout))
 	nh.engine.setStepReady(s.ShardID)
 	return req, err
 }
@@ -1411,9 +1558,9 @@ func (nh *NodeHost) readIndex(shardID uint64,
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return nil, nil, ErrClosed
 	}
-	n, ok := nh.getShard(shardID)
-	if !ok {
-		return nil, nil, ErrShardNotFound
+	n, timeout, err := nh.waitActiveShard(shardID, timeout)
+	if err != nil {
+		return nil, nil, err
 	}
 	req, err := n.read(nh.getTimeoutTick(timeout))
 	if err != nil {
@@ -1428,9 +1575,9 @@ func (nh *NodeHost) queryRaftLog(shardID uint64,
 	if atomic.LoadInt32(&nh.closed) != 0 {
 		return nil, ErrClosed
 	}
-	v, ok := nh.getShard(shardID)
-	if !ok {
-		return nil, ErrShardNotFound
+	v, err := nh.getActiveShard(shardID)
+	if err != nil {
+		return nil, err
 	}
 	if lastIndex <= firstIndex {
 		return nil, ErrInvalidRange
@@ -1535,6 +1682,11 @@ func (nh *NodeHost) startShard(initialMembers map[uint64]Target,
 		}
 	}
 
+	staged, err := nh.stageInitialSnapshot(initialMembers, join, cfg, smType)
+	if err != nil {
+		return err
+	}
+	defer nh.removeStagedSnapshot(staged)
 	doStart := func() (*node, error) {
 		nh.mu.Lock()
 		defer nh.mu.Unlock()
@@ -1545,6 +1697,9 @@ func (nh *NodeHost) startShard(initialMembers map[uint64]Target,
 		if _, ok := nh.mu.shards.Load(shardID); ok {
 			return nil, ErrShardAlreadyExist
 		}
+		if err := nh.checkTombstone(shardID, replicaID); err != nil {
+			return nil, err
+		}
 		if nh.engine.nodeLoaded(shardID, replicaID) {
 			// node is still loaded in the execution engine, e.g. processing snapshot
 			return nil, ErrShardAlreadyExist
@@ -1552,6 +1707,15 @@ func (nh *NodeHost) startShard(initialMembers map[uint64]Target,
 		if join && len(initialMembers) > 0 {
 			return nil, ErrInvalidShardSettings
 		}
+		if staged != nil {
+			if err := nh.bootstrapFromSnapshot(staged, initialMembers, cfg); err != nil {
+				return nil, err
+			}
+		}
+		if getInitialSnapshotStore(cfg, nh.fs) != nil {
+			// the membership is now recorded in the imported snapshot
+			initialMembers = nil
+		}
 		peers, im, err := nh.bootstrapShard(initialMembers, join, cfg, smType)
 		if errors.Is(err, ErrInvalidShardSettings) {
 			return nil, err
@@ -1600,11 +1764,16 @@ func (nh *NodeHost) startShard(initialMembers map[uint64]Target,
 			nh.requestPools[replicaID%requestPoolShards],
 			nh.mu.logdb,
 			nh.getLogDBMetrics(shard),
+			nh.budget,
 			nh.events.sys)
 		if err != nil {
 			panicNow(err)
 		}
+		rn.stub = newReplicaStub(createStateMachine, cfg, smType)
+		rn.disk = nh.disk
+		rn.replicaRemoved = nh.replicaRemoved
 		rn.loaded()
+		nh.engine.setPriority(shardID, cfg.Priority)
 		nh.mu.shards.Store(shardID, rn)
 		nh.mu.cci++
 		nh.cciUpdated()
@@ -1772,6 +1941,16 @@ func (nh *NodeHost) createTransport() error {
 	if err != nil {
 		return err
 	}
+	tsp.SetMemoryBudget(nh.budget)
+	if nh.nhConfig.Expert.Clock != nil {
+		sourceID := nh.nhConfig.RaftAddress
+		if nh.nhConfig.AddressByNodeHostID {
+			sourceID = nh.env.NodeHostID()
+		}
+		nh.transport = newClockTransport(tsp, nh.nodes,
+			sourceID, nh.nhConfig.GetDeploymentID())
+		return nil
+	}
 	nh.transport = tsp
 	return nil
 }
@@ -1806,38 +1985,70 @@ func (nh *NodeHost) getShardInfo() []ShardInfo {
 		shardInfoList = append(shardInfoList, node.getShardInfo())
 		return true
 	})
+	nh.hibernated.Range(func(k, v interface{}) bool {
+		shardID := k.(uint64)
+		if _, ok := nh.getShard(shardID); ok {
+			// just woken up
+			return true
+		}
+		if info, ok := nh.getHibernatedShardInfo(shardID); ok {
+			shardInfoList = append(shardInfoList, info)
+		}
+		return true
+	})
 	return shardInfoList
 }
 
+// tickState is the logical clock state of the NodeHost.
+type tickState struct {
+	tick  uint64
+	idx   uint64
+	nodes []*node
+	idle  []*node
+}
+
 func (nh *NodeHost) tickWorkerMain() {
-	tick := uint64(0)
-	idx := uint64(0)
-	nodes := make([]*node, 0)
-	tf := func() {
-		tick++
-		if idx != nh.getShardSetIndex() {
-			nodes = nodes[:0]
-			idx = nh.forEachShard(func(cid uint64, n *node) bool {
-				nodes = append(nodes, n)
-				return true
-			})
-		}
-		nh.sendTickMessage(nodes, tick)
-		nh.engine.setAllStepReady(nodes)
-	}
+	ts := &tickState{}
 	td := time.Duration(nh.nhConfig.RTTMillisecond) * time.Millisecond
 	ticker := time.NewTicker(td)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			tf()
+			nh.tickShards(ts)
 		case <-nh.stopper.ShouldStop():
 			return
 		}
 	}
 }
 
+// tickShards moves the logical clock of all managed shards forward by one
+// tick.
+func (nh *NodeHost) tickShards(ts *tickState) {
+	ts.tick++
+	if ts.idx != nh.getShardSetIndex() {
+		ts.nodes = ts.nodes[:0]
+		ts.idx = nh.forEachShard(func(cid uint64, n *node) bool {
+			ts.nodes = append(ts.nodes, n)
+			return true
+		})
+	}
+	nh.sendTickMessage(ts.nodes, ts.tick)
+	nh.engine.setAllStepReady(ts.nodes)
+	if nh.nhConfig.Expert.Clock != nil {
+		return
+	}
+	ts.idle = ts.idle[:0]
+	for _, n := range ts.nodes {
+		if n.hibernationDue() {
+			ts.idle = append(ts.idle, n)
+		}
+	}
+	for _, n := range ts.idle {
+		nh.queueHibernation(n)
+	}
+}
+
 func (nh *NodeHost) handleListenerEvents() {
 	var ch chan struct{}
 	if nh.events.leaderInfoQ != nil {
@@ -2102,6 +2313,10 @@ func (h *messageHandler) HandleMessageBatch(msg pb.MessageBatch) (uint64, uint64
 					msgCount++
 				}
 			}
+		} else {
+			// the message is dropped, it will be retried by the sender once the
+			// hibernated replica is woken up
+			nh.wakeAsync(req.ShardID, req.To)
 		}
 	}
 	nh.engine.setStepReadyByMessageBatch(msg)
@@ -2172,6 +2387,9 @@ func logBuildTagsAndVersion() {
 		plog.Warningf("unsupported OS/ARCH %s/%s, don't use for production",
 			runtime.GOOS, runtime.GOARCH)
 	}
+	if invariants.SafetyCheck {
+		plog.Warningf("raft safety checks enabled, don't use for production")
+	}
 }
 
 func panicNow(err error) {
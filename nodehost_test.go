@@ -41,6 +41,7 @@ import (
 
 	"github.com/lni/dragonboat/v4/client"
 	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/faultfs"
 	"github.com/lni/dragonboat/v4/internal/fileutil"
 	"github.com/lni/dragonboat/v4/internal/id"
 	"github.com/lni/dragonboat/v4/internal/invariants"
@@ -1598,6 +1599,318 @@ func TestJoinedShardCanBeRestartedOrJoinedAgain(t *testing.T) {
 	runNodeHostTest(t, to, fs)
 }
 
+func TestDeletedShardIsStoppedAndCleanedUp(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		updateNodeHostConfig: func(c *config.NodeHostConfig) *config.NodeHostConfig {
+			c.OrphanCleanupDelay = time.Millisecond
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			if err := nh.DeleteShard(1); err != nil {
+				t.Fatalf("failed to delete shard, %v", err)
+			}
+			if _, ok := nh.getShard(1); ok {
+				t.Fatalf("deleted shard still running")
+			}
+			if ts := nh.GetTombstones(); len(ts) != 1 || !ts[0].IsShard() {
+				t.Fatalf("unexpected tombstones %v", ts)
+			}
+			cfg := getTestConfig()
+			newPST := func(uint64, uint64) sm.IStateMachine { return &PST{} }
+			peers := map[uint64]string{1: nh.RaftAddress()}
+			if err := nh.StartReplica(peers, false, newPST, *cfg); err != ErrShardDeleted {
+				t.Fatalf("failed to return ErrShardDeleted, %v", err)
+			}
+			for i := 0; i < 1000; i++ {
+				if err := nh.cleanupOrphans(); err != nil {
+					t.Fatalf("failed to cleanup orphans, %v", err)
+				}
+				if !nh.HasNodeInfo(1, 1) {
+					nhi := nh.GetNodeHostInfo(DefaultNodeHostInfoOption)
+					if len(nhi.OrphanedLogInfo) != 0 {
+						t.Fatalf("unexpected orphans %v", nhi.OrphanedLogInfo)
+					}
+					return
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			t.Fatalf("orphaned replica not cleaned up")
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestExpiredTombstonesAreRemoved(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			before := nh.tombstoneExpiry(time.Now())
+			expired := server.Tombstone{ShardID: 100, CreatedAt: before - 1}
+			active := server.Tombstone{ShardID: 101, CreatedAt: time.Now().UnixNano()}
+			if err := nh.addTombstones([]server.Tombstone{expired, active}); err != nil {
+				t.Fatalf("failed to add tombstones, %v", err)
+			}
+			if ts := nh.GetTombstones(); len(ts) != 1 || ts[0] != active {
+				t.Fatalf("expired tombstone not removed on merge, %v", ts)
+			}
+			did := nh.nhConfig.GetDeploymentID()
+			if err := nh.env.SaveTombstones(did,
+				[]server.Tombstone{expired, active}); err != nil {
+				t.Fatalf("failed to save tombstones, %v", err)
+			}
+			if err := nh.loadTombstones(); err != nil {
+				t.Fatalf("failed to load tombstones, %v", err)
+			}
+			if ts := nh.GetTombstones(); len(ts) != 1 || ts[0] != active {
+				t.Fatalf("expired tombstone not removed on load, %v", ts)
+			}
+			ts, err := nh.env.LoadTombstones(did)
+			if err != nil {
+				t.Fatalf("failed to load tombstones, %v", err)
+			}
+			if len(ts) != 1 || ts[0] != active {
+				t.Fatalf("expired tombstone not removed from disk, %v", ts)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestTombstoneRetentionIsLongerThanOrphanCleanupDelay(t *testing.T) {
+	nh := &NodeHost{}
+	nh.nhConfig.TombstoneRetention = time.Second
+	nh.nhConfig.OrphanCleanupDelay = time.Hour
+	now := time.Now()
+	min := nh.nhConfig.OrphanCleanupDelay + tombstoneGossipDelay
+	if before := nh.tombstoneExpiry(now); before > now.Add(-min).UnixNano() {
+		t.Errorf("retention not extended")
+	}
+}
+
+func TestShardCanBeCloned(t *testing.T) {
+	fs := vfs.GetTestFS()
+	newSM := func(uint64, uint64) sm.IOnDiskStateMachine {
+		s := tests.NewFakeDiskSM(0)
+		s.SetAborted()
+		return s
+	}
+	to := &testOption{
+		createOnDiskSM: newSM,
+		tf: func(nh *NodeHost) {
+			makeProposals(nh)
+			pto := lpto(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			defer cancel()
+			members := map[uint64]string{1: nh.RaftAddress()}
+			if _, err := nh.CloneShard(ctx, 1, 1, members, ""); err != ErrInvalidOption {
+				t.Fatalf("failed to return ErrInvalidOption, %v", err)
+			}
+			remote := map[uint64]string{1: nodeHostTestAddr2}
+			if _, err := nh.CloneShard(ctx, 1, 2, remote, ""); err != ErrInvalidShardSettings {
+				t.Fatalf("failed to return ErrInvalidShardSettings, %v", err)
+			}
+			multi := map[uint64]string{1: nh.RaftAddress(), 2: nodeHostTestAddr2}
+			if _, err := nh.CloneShard(ctx, 1, 2, multi, ""); err != ErrInvalidOption {
+				t.Fatalf("failed to return ErrInvalidOption, %v", err)
+			}
+			if _, err := nh.CloneShard(ctx, 1, 2, members, ""); err != nil {
+				t.Fatalf("failed to clone shard, %v", err)
+			}
+			if _, err := nh.CloneShard(ctx, 1, 2, members, ""); err != ErrShardAlreadyExist {
+				t.Fatalf("failed to return ErrShardAlreadyExist, %v", err)
+			}
+			cfg := getTestConfig()
+			cfg.ShardID = 2
+			if err := nh.StartOnDiskReplica(nil, false, newSM, *cfg); err != nil {
+				t.Fatalf("failed to start cloned shard, %v", err)
+			}
+			waitForLeaderToBeElected(t, nh, 2)
+			src, err := nh.SyncRead(ctx, 1, nil)
+			if err != nil {
+				t.Fatalf("failed to read, %v", err)
+			}
+			dst, err := nh.SyncRead(ctx, 2, nil)
+			if err != nil {
+				t.Fatalf("failed to read, %v", err)
+			}
+			if !bytes.Equal(src.([]byte), dst.([]byte)) {
+				t.Errorf("cloned state %v, want %v", dst, src)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestShardCanBeClonedToMultipleNodeHosts(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func(t *testing.T, nh1 *NodeHost, nh2 *NodeHost) {
+		newSM := func(uint64, uint64) sm.IStateMachine {
+			return &counterSM{}
+		}
+		cfg := getTestConfig()
+		src := map[uint64]string{1: nh1.RaftAddress()}
+		if err := nh1.StartReplica(src, false, newSM, *cfg); err != nil {
+			t.Fatalf("failed to start shard, %v", err)
+		}
+		waitForLeaderToBeElected(t, nh1, 1)
+		makeProposals(nh1)
+		sspath := fs.PathJoin(singleNodeHostTestDir, "exported")
+		if err := fs.MkdirAll(sspath, 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), lpto(nh1))
+		defer cancel()
+		members := map[uint64]string{
+			1: nh1.RaftAddress(),
+			2: nh2.RaftAddress(),
+		}
+		ssdir, err := nh1.CloneShard(ctx, 1, 2, members, sspath)
+		if err != nil {
+			t.Fatalf("failed to clone shard, %v", err)
+		}
+		if _, err := fs.Stat(ssdir); err != nil {
+			t.Fatalf("exported snapshot not kept, %v", err)
+		}
+		cfg.ShardID = 2
+		if err := nh1.StartReplica(nil, false, newSM, *cfg); err != nil {
+			t.Fatalf("failed to start cloned shard, %v", err)
+		}
+		cfg.ReplicaID = 2
+		cfg.InitialSnapshot = ssdir
+		if err := nh2.StartReplica(members, false, newSM, *cfg); err != nil {
+			t.Fatalf("failed to start cloned shard, %v", err)
+		}
+		waitForLeaderToBeElected(t, nh1, 2)
+		waitForLeaderToBeElected(t, nh2, 2)
+		want, err := nh1.SyncRead(ctx, 1, nil)
+		if err != nil {
+			t.Fatalf("failed to read, %v", err)
+		}
+		if binary.LittleEndian.Uint64(want.([]byte)) == 0 {
+			t.Fatalf("no proposal applied")
+		}
+		for _, nh := range []*NodeHost{nh1, nh2} {
+			v, err := nh.SyncRead(ctx, 2, nil)
+			if err != nil {
+				t.Fatalf("failed to read, %v", err)
+			}
+			if !bytes.Equal(want.([]byte), v.([]byte)) {
+				t.Errorf("cloned state %v, want %v", v, want)
+			}
+		}
+		session := nh2.GetNoOPSession(2)
+		if _, err := nh2.SyncPropose(ctx, session, []byte("test-data")); err != nil {
+			t.Fatalf("failed to make proposal, %v", err)
+		}
+	}
+	twoFakeDiskNodeHostTest(t, tf, fs)
+}
+
+type counterSM struct {
+	count uint64
+}
+
+func (c *counterSM) Update(sm.Entry) (sm.Result, error) {
+	c.count++
+	return sm.Result{Value: c.count}, nil
+}
+
+func (c *counterSM) Lookup(interface{}) (interface{}, error) {
+	result := make([]byte, 8)
+	binary.LittleEndian.PutUint64(result, c.count)
+	return result, nil
+}
+
+func (c *counterSM) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	return binary.Write(w, binary.LittleEndian, c.count)
+}
+
+func (c *counterSM) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	return binary.Read(r, binary.LittleEndian, &c.count)
+}
+
+func (c *counterSM) Close() error { return nil }
+
+func TestShardCanBeStartedFromInitialSnapshot(t *testing.T) {
+	fs := vfs.GetTestFS()
+	newSM := func(uint64, uint64) sm.IStateMachine {
+		return &counterSM{}
+	}
+	to := &testOption{
+		createSM: newSM,
+		tf: func(nh *NodeHost) {
+			makeProposals(nh)
+			sspath := fs.PathJoin(singleNodeHostTestDir, "exported")
+			if err := fs.MkdirAll(sspath, 0755); err != nil {
+				t.Fatalf("%v", err)
+			}
+			pto := lpto(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			defer cancel()
+			opt := SnapshotOption{Exported: true, ExportPath: sspath}
+			index, err := nh.SyncRequestSnapshot(ctx, 1, opt)
+			if err != nil {
+				t.Fatalf("failed to export snapshot, %v", err)
+			}
+			src, err := nh.SyncRead(ctx, 1, nil)
+			if err != nil {
+				t.Fatalf("failed to read, %v", err)
+			}
+			if binary.LittleEndian.Uint64(src.([]byte)) == 0 {
+				t.Fatalf("no proposal applied")
+			}
+			ssdir := fs.PathJoin(sspath, server.GetSnapshotDirName(index))
+			members := map[uint64]string{1: nh.RaftAddress()}
+			start := func(cfg config.Config) {
+				for j := 0; j < 1000; j++ {
+					err := nh.StartReplica(members, false, newSM, cfg)
+					if err == nil {
+						return
+					}
+					if err != ErrShardAlreadyExist {
+						t.Fatalf("failed to start shard, %v", err)
+					}
+					time.Sleep(5 * time.Millisecond)
+				}
+				t.Fatalf("failed to start shard")
+			}
+			path := getTestConfig()
+			path.ShardID = 2
+			path.InitialSnapshot = ssdir
+			if err := nh.StartReplica(members, true, newSM, *path); err != ErrInvalidShardSettings {
+				t.Fatalf("failed to return ErrInvalidShardSettings, %v", err)
+			}
+			store := getTestConfig()
+			store.ShardID = 3
+			store.InitialSnapshotStore = &dirSnapshotStore{dir: ssdir, fs: fs}
+			for _, cfg := range []*config.Config{path, store} {
+				// the second iteration restarts the replica
+				for i := 0; i < 2; i++ {
+					start(*cfg)
+					waitForLeaderToBeElected(t, nh, cfg.ShardID)
+					dst, err := nh.SyncRead(ctx, cfg.ShardID, nil)
+					if err != nil {
+						t.Fatalf("failed to read, %v", err)
+					}
+					if !bytes.Equal(src.([]byte), dst.([]byte)) {
+						t.Errorf("shard %d, iteration %d, initial state %v, want %v",
+							cfg.ShardID, i, dst, src)
+					}
+					if err := nh.StopShard(cfg.ShardID); err != nil {
+						t.Fatalf("failed to stop shard, %v", err)
+					}
+				}
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
 func TestCompactionCanBeRequested(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
@@ -2282,6 +2595,67 @@ func TestSyncRequestDeleteReplica(t *testing.T) {
 	runNodeHostTest(t, to, fs)
 }
 
+func TestReplicaIsRestartedWhenDiskSpaceRecovers(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			avail := uint64(5)
+			nh.disk.soft, nh.disk.hard = 100, 10
+			nh.disk.getAvail = func(string) (uint64, error) {
+				return avail, nil
+			}
+			nh.checkDiskSpace()
+			if _, ok := nh.getShard(1); ok {
+				t.Fatalf("replica not stopped")
+			}
+			avail = 1000
+			for i := 0; i < 1000; i++ {
+				nh.checkDiskSpace()
+				if _, ok := nh.getShard(1); ok {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if _, ok := nh.getShard(1); !ok {
+				t.Fatalf("replica not restarted")
+			}
+			if len(nh.disk.stopped) != 0 {
+				t.Errorf("stopped replica not cleared")
+			}
+			waitForLeaderToBeElected(t, nh, 1)
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			if _, err := nh.SyncPropose(ctx, nh.GetNoOPSession(1), []byte("test")); err != nil {
+				t.Errorf("failed to make proposal, %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestRequestDeleteReplicaRecordsTombstone(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			rs, err := nh.RequestDeleteReplica(1, 2, 0, lpto(nh))
+			if err != nil {
+				t.Fatalf("failed to request node deletion %v", err)
+			}
+			defer rs.Release()
+			if v := <-rs.ResultC(); !v.Completed() {
+				t.Fatalf("delete node request failed %v", v)
+			}
+			ts := nh.GetTombstones()
+			if len(ts) != 1 || ts[0].ShardID != 1 || ts[0].ReplicaID != 2 {
+				t.Errorf("unexpected tombstones %v", ts)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
 func TestSyncRequestAddReplica(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
@@ -4334,6 +4708,103 @@ func TestImportedSnapshotIsAlwaysRestored(t *testing.T) {
 	}
 }
 
+func TestNodeHostCanBeRestoredFromBackup(t *testing.T) {
+	fs := vfs.GetTestFS()
+	tf := func() {
+		rc := config.Config{
+			ShardID:      1,
+			ReplicaID:    1,
+			ElectionRTT:  3,
+			HeartbeatRTT: 1,
+			CheckQuorum:  true,
+		}
+		peers := make(map[uint64]string)
+		peers[1] = nodeHostTestAddr1
+		nhc := config.NodeHostConfig{
+			NodeHostDir:    singleNodeHostTestDir,
+			RTTMillisecond: getRTTMillisecond(fs, singleNodeHostTestDir),
+			RaftAddress:    nodeHostTestAddr1,
+			Expert:         getTestExpertConfig(fs),
+		}
+		nh, err := NewNodeHost(nhc)
+		if err != nil {
+			t.Fatalf("failed to create node host %v", err)
+		}
+		nhID := nh.ID()
+		pto := lpto(nh)
+		newSM := func(uint64, uint64) sm.IOnDiskStateMachine {
+			return tests.NewSimDiskSM(0)
+		}
+		if err := nh.StartOnDiskReplica(peers, false, newSM, rc); err != nil {
+			t.Fatalf("failed to start shard %v", err)
+		}
+		waitForLeaderToBeElected(t, nh, 1)
+		session := nh.GetNoOPSession(1)
+		for i := 0; i < 16; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			_, err := nh.SyncPropose(ctx, session, []byte("test-data"))
+			cancel()
+			if err != nil {
+				t.Fatalf("failed to make proposal %v", err)
+			}
+		}
+		backupDir := "backup_safe_to_delete"
+		defer func() {
+			if err := fs.RemoveAll(backupDir); err != nil {
+				t.Fatalf("%v", err)
+			}
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), pto)
+		info, err := nh.Backup(ctx, backupDir)
+		cancel()
+		if err != nil {
+			t.Fatalf("failed to create backup %v", err)
+		}
+		ctx, cancel = context.WithTimeout(context.Background(), pto)
+		if _, err := nh.Backup(ctx, backupDir); !errors.Is(err, ErrBackupDirNotEmpty) {
+			t.Errorf("unexpected error %v", err)
+		}
+		cancel()
+		if info.NodeHostID != nhID || len(info.Shards) != 1 {
+			t.Fatalf("unexpected backup info %+v", info)
+		}
+		index := info.Shards[0].Index
+		if index == 0 || info.Shards[0].Members[1] != nodeHostTestAddr1 {
+			t.Fatalf("unexpected backup shard %+v", info.Shards[0])
+		}
+		nh.Close()
+		nhc.NodeHostDir = fs.PathJoin(singleNodeHostTestDir, "restored")
+		if err := tools.RestoreBackup(nhc, backupDir, nil); err != nil {
+			t.Fatalf("failed to restore backup %v", err)
+		}
+		rnh, err := NewNodeHost(nhc)
+		if err != nil {
+			t.Fatalf("failed to create node host %v", err)
+		}
+		defer rnh.Close()
+		if rnh.ID() != nhID {
+			t.Errorf("NodeHostID not restored, got %s, want %s", rnh.ID(), nhID)
+		}
+		rnewSM := func(uint64, uint64) sm.IOnDiskStateMachine {
+			return tests.NewSimDiskSM(0)
+		}
+		if err := rnh.StartOnDiskReplica(nil, false, rnewSM, rc); err != nil {
+			t.Fatalf("failed to start shard %v", err)
+		}
+		waitForLeaderToBeElected(t, rnh, 1)
+		ctx, cancel = context.WithTimeout(context.Background(), pto)
+		rv, err := rnh.SyncRead(ctx, 1, nil)
+		cancel()
+		if err != nil {
+			t.Fatalf("failed to read applied value %v", err)
+		}
+		if rv.(uint64) < index {
+			t.Errorf("applied %d, backup index %d", rv.(uint64), index)
+		}
+	}
+	runNodeHostTestDC(t, tf, true, fs)
+}
+
 func TestShardWithoutQuorumCanBeRestoreByImportingSnapshot(t *testing.T) {
 	fs := vfs.GetTestFS()
 	tf := func() {
@@ -5465,6 +5936,161 @@ func TestIOErrorIsHandled(t *testing.T) {
 	testIOErrorIsHandled(t, vfs.OpSync)
 }
 
+func TestChaosFaultFSInjectsLogDBErrors(t *testing.T) {
+	fs, inj := NewFaultFS(vfs.GetTestFS())
+	to := &testOption{
+		fsErrorInjection: true,
+		defaultTestNode:  true,
+		tf: func(nh *NodeHost) {
+			if nh.mu.logdb.Name() == "Tan" {
+				t.Skip("skipped, using tan logdb")
+			}
+			inj.FailWrites(vfs.ErrInjected)
+			pto := pto(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), pto)
+			session := nh.GetNoOPSession(1)
+			_, err := nh.SyncPropose(ctx, session, []byte("test"))
+			cancel()
+			if err != ErrTimeout {
+				t.Fatalf("proposal unexpectedly completed, %v", err)
+			}
+			select {
+			case e := <-nh.Chaos().Crashed():
+				if e.Error() != vfs.ErrInjected.Error() {
+					t.Fatalf("failed to return the expected error, %v", e)
+				}
+			default:
+				t.Fatalf("failed to trigger error")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestFaultInjectorUsesFaultFS(t *testing.T) {
+	fs, inj := NewFaultFS(vfs.NewMemFS())
+	if fs != config.IFS(inj.FS()) {
+		t.Fatalf("unexpected fs")
+	}
+	inj.FS().Inject("test",
+		faultfs.Fault{Op: faultfs.OpWrite, Path: "bad", Err: vfs.ErrInjected})
+	inj.FailSyncs(vfs.ErrInjected)
+	if _, err := fs.Create("bad-file"); err == nil {
+		t.Errorf("fault injected using FS not applied")
+	}
+	f, err := fs.Create("good-file")
+	if err != nil {
+		t.Fatalf("failed to create file, %v", err)
+	}
+	defer f.Close()
+	if err := f.Sync(); !errors.Is(err, vfs.ErrInjected) {
+		t.Errorf("unexpected error %v", err)
+	}
+	inj.Reset()
+	if _, err := fs.Create("bad-file"); err != nil {
+		t.Errorf("fault not cleared, %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Errorf("fault not cleared, %v", err)
+	}
+}
+
+func TestChaosPartitionDropsMessages(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			c := nh.Chaos()
+			c.Partition()
+			if !c.IsPartitioned() {
+				t.Fatalf("not partitioned")
+			}
+			handler := newNodeHostMessageHandler(nh)
+			msg := pb.Message{Type: pb.Heartbeat, ShardID: 1, To: 1}
+			batch := pb.MessageBatch{Requests: []pb.Message{msg}}
+			if _, m := handler.HandleMessageBatch(batch); m != 0 {
+				t.Errorf("message not dropped")
+			}
+			c.Heal()
+			if c.IsPartitioned() {
+				t.Fatalf("still partitioned")
+			}
+			if _, m := handler.HandleMessageBatch(batch); m != 1 {
+				t.Errorf("message dropped")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestChaosDelayApply(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			if err := nh.Chaos().DelayApply(2, time.Second); err != ErrShardNotFound {
+				t.Errorf("unexpected error %v", err)
+			}
+			delay := 200 * time.Millisecond
+			if err := nh.Chaos().DelayApply(1, delay); err != nil {
+				t.Fatalf("failed to delay apply %v", err)
+			}
+			start := time.Now()
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			if _, err := nh.SyncPropose(ctx, nh.GetNoOPSession(1), []byte("test")); err != nil {
+				t.Fatalf("failed to make proposal %v", err)
+			}
+			if time.Since(start) < delay {
+				t.Errorf("apply not delayed")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestChaosCrashOnSnapshot(t *testing.T) {
+	fs := vfs.GetTestFS()
+	var to *testOption
+	to = &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			if err := nh.Chaos().CrashOnSnapshot(1); err != nil {
+				t.Fatalf("failed to set crash %v", err)
+			}
+			makeProposals(nh)
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			_, err := nh.SyncRequestSnapshot(ctx, 1, SnapshotOption{})
+			cancel()
+			if err == nil {
+				t.Fatalf("snapshot unexpectedly completed")
+			}
+			stopped := func() bool {
+				_, ok := nh.getShard(1)
+				return !ok && !nh.engine.nodeLoaded(1, 1)
+			}
+			for i := 0; i < 1000; i++ {
+				if stopped() {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if !stopped() {
+				t.Fatalf("replica not stopped")
+			}
+			createSingleTestNode(t, to, nh)
+			waitForLeaderToBeElected(t, nh, 1)
+			makeProposals(nh)
+			ctx, cancel = context.WithTimeout(context.Background(), pto(nh))
+			defer cancel()
+			if _, err := nh.SyncRequestSnapshot(ctx, 1, SnapshotOption{}); err != nil {
+				t.Errorf("failed to request snapshot after restart %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
 func TestInstallSnapshotMessageIsNeverDropped(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
@@ -5709,7 +6335,7 @@ func TestGetTimeoutFromContext(t *testing.T) {
 func TestHandleSnapshotStatus(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	nh := &NodeHost{stopper: syncutil.NewStopper()}
-	engine := newExecEngine(nh, config.GetDefaultEngineConfig(), false, false, nil, nil)
+	engine := newExecEngine(nh, config.GetDefaultEngineConfig(), false, false, false, nil, nil)
 	defer func() {
 		if err := engine.close(); err != nil {
 			t.Fatalf("failed to close engine %v", err)
@@ -5737,7 +6363,7 @@ func TestHandleSnapshotStatus(t *testing.T) {
 func TestSnapshotReceivedMessageCanBeConverted(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	nh := &NodeHost{stopper: syncutil.NewStopper()}
-	engine := newExecEngine(nh, config.GetDefaultEngineConfig(), false, false, nil, nil)
+	engine := newExecEngine(nh, config.GetDefaultEngineConfig(), false, false, false, nil, nil)
 	defer func() {
 		if err := engine.close(); err != nil {
 			t.Fatalf("failed to close engine %v", err)
@@ -5771,7 +6397,7 @@ func TestSnapshotReceivedMessageCanBeConverted(t *testing.T) {
 func TestIncorrectlyRoutedMessagesAreIgnored(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	nh := &NodeHost{stopper: syncutil.NewStopper()}
-	engine := newExecEngine(nh, config.GetDefaultEngineConfig(), false, false, nil, nil)
+	engine := newExecEngine(nh, config.GetDefaultEngineConfig(), false, false, false, nil, nil)
 	defer func() {
 		if err := engine.close(); err != nil {
 			t.Fatalf("failed to close engine %v", err)
@@ -5796,6 +6422,95 @@ func TestIncorrectlyRoutedMessagesAreIgnored(t *testing.T) {
 	}
 }
 
+func TestHighPriorityShardUsesDedicatedWorkers(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		updateNodeHostConfig: func(nhc *config.NodeHostConfig) *config.NodeHostConfig {
+			nhc.Expert.Engine = config.GetDefaultEngineConfig()
+			nhc.Expert.Engine.PriorityShards = 2
+			return nhc
+		},
+		updateConfig: func(c *config.Config) *config.Config {
+			c.Priority = config.HighPriority
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			makeProposals(nh)
+			execShards := nh.nhConfig.Expert.Engine.ExecShards
+			nh.engine.loaded.mu.Lock()
+			defer nh.engine.loaded.mu.Unlock()
+			found := false
+			for nt, nodes := range nh.engine.loaded.nodes {
+				if nt.from != fromStepWorker {
+					continue
+				}
+				if _, ok := nodes[1]; ok {
+					if nt.workerID <= execShards {
+						t.Errorf("high priority shard loaded by step worker %d",
+							nt.workerID)
+					}
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("high priority shard not loaded")
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestEngineCanBeResized(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		tf: func(nh *NodeHost) {
+			execShards := nh.nhConfig.Expert.Engine.ExecShards
+			invalid := []config.EngineConfig{
+				{ExecShards: 1, CommitShards: 1, ApplyShards: 1, SnapshotShards: 1},
+				{ExecShards: execShards + 1, CommitShards: 1, ApplyShards: 1,
+					SnapshotShards: 1, CloseShards: 1},
+			}
+			for _, cfg := range invalid {
+				if err := nh.ResizeEngine(cfg); err != ErrInvalidOption {
+					t.Errorf("failed to return ErrInvalidOption, %v", err)
+				}
+			}
+			makeProposals(nh)
+			for _, sz := range []uint64{3, 32, 1} {
+				cfg := config.EngineConfig{
+					ExecShards:     sz,
+					CommitShards:   sz,
+					ApplyShards:    sz,
+					SnapshotShards: sz,
+					CloseShards:    sz,
+				}
+				if cfg.ExecShards > execShards {
+					cfg.ExecShards = execShards
+				}
+				if err := nh.ResizeEngine(cfg); err != nil {
+					t.Fatalf("failed to resize engine, %v", err)
+				}
+				pto := pto(nh)
+				ctx, cancel := context.WithTimeout(context.Background(), pto)
+				_, err := nh.SyncPropose(ctx, nh.GetNoOPSession(1), []byte("test-data"))
+				cancel()
+				if err != nil {
+					t.Fatalf("failed to make proposal after resizing, %v", err)
+				}
+				ctx, cancel = context.WithTimeout(context.Background(), pto)
+				_, err = nh.SyncRequestSnapshot(ctx, 1, DefaultSnapshotOption)
+				cancel()
+				if err != nil {
+					t.Fatalf("failed to request snapshot after resizing, %v", err)
+				}
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
 func TestProposeOnClosedNode(t *testing.T) {
 	fs := vfs.GetTestFS()
 	to := &testOption{
@@ -6037,3 +6752,191 @@ func TestSlowTestStressedSnapshotWorker(t *testing.T) {
 		}
 	}
 }
+
+func waitForHibernation(t *testing.T, nh *NodeHost, shardID uint64) {
+	for i := 0; i < 1000; i++ {
+		if nh.isHibernated(shardID, 1) {
+			if _, ok := nh.getShard(shardID); ok {
+				t.Fatalf("hibernated shard still running")
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("shard not hibernated")
+}
+
+func TestHibernationIsQueued(t *testing.T) {
+	nh := &NodeHost{hibernateC: make(chan *node, 1)}
+	n1 := &node{stub: &replicaStub{}}
+	n2 := &node{stub: &replicaStub{}}
+	nh.queueHibernation(n1)
+	nh.queueHibernation(n1)
+	if len(nh.hibernateC) != 1 {
+		t.Fatalf("node queued more than once")
+	}
+	nh.queueHibernation(n2)
+	if atomic.LoadInt32(&n2.stub.queued) != 0 {
+		t.Errorf("node not queued but marked as queued")
+	}
+	nh.queueHibernation(&node{})
+	if len(nh.hibernateC) != 1 {
+		t.Errorf("node without stub queued")
+	}
+}
+
+func TestRequestWaitsForHibernatedReplicaToBeWokenUp(t *testing.T) {
+	nh := &NodeHost{stopper: syncutil.NewStopper()}
+	defer nh.stopper.Stop()
+	s := newReplicaStub(nil, config.Config{ShardID: 1, ReplicaID: 1}, 0)
+	a := &wakeAttempt{done: make(chan struct{})}
+	s.waking = a
+	nh.hibernated.Store(uint64(1), s)
+	if _, _, err := nh.waitActiveShard(1, 0); err != ErrShardNotReady {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, _, err := nh.waitActiveShard(1,
+		10*time.Millisecond); err != ErrShardNotReady {
+		t.Errorf("unexpected error %v", err)
+	}
+	go s.complete(a, ErrClosed)
+	if _, _, err := nh.waitActiveShard(1, time.Minute); err != ErrShardNotReady {
+		t.Errorf("unexpected error %v", err)
+	}
+	s.wakeMu.Lock()
+	defer s.wakeMu.Unlock()
+	if s.waking != nil {
+		t.Errorf("failed wake attempt not cleared")
+	}
+}
+
+func TestIdleShardCanBeHibernatedAndWokenUp(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		updateConfig: func(c *config.Config) *config.Config {
+			c.Quiesce = true
+			c.HibernateRTT = 10
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			makeProposals(nh)
+			waitForHibernation(t, nh, 1)
+			leaderID, _, valid, err := nh.GetLeaderID(1)
+			if err != nil || !valid || leaderID != 1 {
+				t.Errorf("unexpected leader info %d, %t, %v", leaderID, valid, err)
+			}
+			found := false
+			nhi := nh.GetNodeHostInfo(DefaultNodeHostInfoOption)
+			for _, ci := range nhi.ShardInfoList {
+				if ci.ShardID == 1 && ci.ReplicaID == 1 && ci.Hibernated {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("hibernated shard not in NodeHostInfo")
+			}
+			session := nh.GetNoOPSession(1)
+			// requests without a timeout are not blocked while the replica is
+			// being woken up
+			if _, err := nh.StaleRead(1, nil); err != ErrShardNotReady {
+				t.Errorf("unexpected error %v", err)
+			}
+			// requests wait for the replica to be woken up, the proposal might
+			// still be dropped before the woken up replica elects a leader
+			proposed := false
+			for i := 0; i < 50 && !proposed; i++ {
+				ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+				_, err := nh.SyncPropose(ctx, session, []byte("test-data"))
+				cancel()
+				if nh.isHibernated(1, 1) {
+					t.Fatalf("request returned before the shard is woken up")
+				}
+				if err == nil {
+					proposed = true
+				} else {
+					time.Sleep(100 * time.Millisecond)
+				}
+			}
+			if !proposed {
+				t.Fatalf("failed to make proposal on woken up shard")
+			}
+			waitForHibernation(t, nh, 1)
+			if err := nh.StopShard(1); err != nil {
+				t.Fatalf("failed to stop hibernated shard, %v", err)
+			}
+			if nh.isHibernated(1, 1) {
+				t.Errorf("stopped shard still hibernated")
+			}
+			if _, err := nh.getActiveShard(1); err != ErrShardNotFound {
+				t.Errorf("stopped shard woken up, %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestProposalsCanBeBatched(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		updateConfig: func(c *config.Config) *config.Config {
+			c.ProposalBatchDelay = 2 * time.Millisecond
+			c.ProposalBatchSize = 1024
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					session := nh.GetNoOPSession(1)
+					for j := 0; j < 16; j++ {
+						ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+						_, err := nh.SyncPropose(ctx, session, []byte("test-data"))
+						cancel()
+						if err != nil {
+							t.Errorf("failed to propose, %v", err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
+
+func TestLargeProposalCanBeChunked(t *testing.T) {
+	fs := vfs.GetTestFS()
+	to := &testOption{
+		defaultTestNode: true,
+		updateConfig: func(c *config.Config) *config.Config {
+			c.ProposalChunkSize = 1024
+			return c
+		},
+		tf: func(nh *NodeHost) {
+			makeProposals(nh)
+			session := nh.GetNoOPSession(1)
+			data := make([]byte, 1024*256+1)
+			ctx, cancel := context.WithTimeout(context.Background(), pto(nh))
+			result, err := nh.SyncPropose(ctx, session, data)
+			cancel()
+			if err != nil {
+				t.Fatalf("failed to propose, %v", err)
+			}
+			if result.Value != uint64(len(data)) {
+				t.Errorf("update got %d bytes, want %d", result.Value, len(data))
+			}
+			ctx, cancel = context.WithTimeout(context.Background(), pto(nh))
+			_, err = nh.SyncRequestSnapshot(ctx, 1, DefaultSnapshotOption)
+			cancel()
+			if err != nil {
+				t.Errorf("failed to request snapshot, %v", err)
+			}
+		},
+	}
+	runNodeHostTest(t, to, fs)
+}
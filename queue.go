@@ -17,11 +17,19 @@ package dragonboat
 import (
 	"sync"
 
+	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/settings"
 	"github.com/lni/dragonboat/v4/raftio"
 	pb "github.com/lni/dragonboat/v4/raftpb"
 )
 
+// chunksPerSwap is the max number of chunks of a chunked proposal added to
+// the entry queue each time the queue is swapped.
+const chunksPerSwap uint64 = 16
+
 type entryQueue struct {
+	rl            *server.RateLimiter
 	size          uint64
 	left          []pb.Entry
 	right         []pb.Entry
@@ -29,14 +37,21 @@ type entryQueue struct {
 	stopped       bool
 	paused        bool
 	idx           uint64
+	bytes         uint64
 	oldIdx        uint64
 	cycle         uint64
 	lazyFreeCycle uint64
-	mu            sync.Mutex
+	// chunks is the chunked proposal being queued. To bound the memory used
+	// by large proposals, its chunks are added a few at a time each time the
+	// queue is swapped, other proposals are rejected until all its chunks have
+	// been added so they are contiguous in the Raft log.
+	chunks *rsm.ChunkSplitter
+	mu     sync.Mutex
 }
 
 func newEntryQueue(size uint64, lazyFreeCycle uint64) *entryQueue {
 	return &entryQueue{
+		rl:            server.NewRateLimiter(0),
 		size:          size,
 		lazyFreeCycle: lazyFreeCycle,
 		left:          make([]pb.Entry, size),
@@ -48,6 +63,18 @@ func (q *entryQueue) close() {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 	q.stopped = true
+	q.chunks = nil
+	if q.rl.Tracked() {
+		q.rl.Set(0)
+	}
+}
+
+func (q *entryQueue) setMemoryBudget(b *server.MemoryBudget) {
+	q.rl.SetMemoryBudget(b)
+}
+
+func (q *entryQueue) memorySize() uint64 {
+	return q.rl.Get()
 }
 
 func (q *entryQueue) targetQueue() []pb.Entry {
@@ -60,16 +87,71 @@ func (q *entryQueue) targetQueue() []pb.Entry {
 func (q *entryQueue) add(ent pb.Entry) (bool, bool) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	if q.paused || q.idx >= q.size {
+	if q.paused || q.chunks != nil || q.idx >= q.size {
 		return false, q.stopped
 	}
 	if q.stopped {
 		return false, true
 	}
+	q.append(ent)
+	return true, false
+}
+
+// addChunked starts adding the chunks of the specified chunked proposal, the
+// remaining chunks are added by the following get calls.
+func (q *entryQueue) addChunked(s *rsm.ChunkSplitter) (bool, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.paused || q.chunks != nil || q.idx >= q.size {
+		return false, q.stopped
+	}
+	if q.stopped {
+		return false, true
+	}
+	q.chunks = s
+	q.addChunks()
+	return true, false
+}
+
+// chunking returns a boolean value indicating whether there are chunks yet
+// to be added to the queue.
+func (q *entryQueue) chunking() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.chunks != nil
+}
+
+// addChunks adds no more than chunksPerSwap chunks of the current chunked
+// proposal to the queue.
+func (q *entryQueue) addChunks() {
+	for i := uint64(0); i < chunksPerSwap && q.idx < q.size; i++ {
+		ent, ok := q.chunks.Next()
+		if !ok {
+			break
+		}
+		q.append(ent)
+	}
+	if q.chunks.Done() {
+		q.chunks = nil
+	}
+}
+
+func (q *entryQueue) append(ent pb.Entry) {
 	w := q.targetQueue()
 	w[q.idx] = ent
 	q.idx++
-	return true, false
+	q.bytes += uint64(len(ent.Cmd))
+	if q.rl.Tracked() {
+		q.rl.Increase(uint64(len(ent.Cmd) + settings.EntryNonCmdFieldsSize))
+	}
+}
+
+// pending returns the number of queued entries and the total size of their
+// payloads.
+func (q *entryQueue) pending() (uint64, uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.idx, q.bytes
 }
 
 func (q *entryQueue) gc() {
@@ -94,10 +176,17 @@ func (q *entryQueue) get(paused bool) []pb.Entry {
 	q.cycle++
 	sz := q.idx
 	q.idx = 0
+	q.bytes = 0
 	t := q.targetQueue()
 	q.leftInWrite = !q.leftInWrite
 	q.gc()
 	q.oldIdx = sz
+	if q.rl.Tracked() {
+		q.rl.Set(0)
+	}
+	if !paused && q.chunks != nil {
+		q.addChunks()
+	}
 	return t[:sz]
 }
 
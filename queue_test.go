@@ -16,7 +16,9 @@ package dragonboat
 
 import (
 	"testing"
+	"time"
 
+	"github.com/lni/dragonboat/v4/internal/rsm"
 	"github.com/lni/dragonboat/v4/raftio"
 	"github.com/lni/dragonboat/v4/raftpb"
 )
@@ -218,6 +220,125 @@ func TestEntryQueueAllowAddedEntriesToBeReturned(t *testing.T) {
 	}
 }
 
+func TestEntryQueueTracksPendingPayloadSize(t *testing.T) {
+	q := newEntryQueue(5, 0)
+	q.add(raftpb.Entry{Cmd: make([]byte, 10)})
+	q.add(raftpb.Entry{Cmd: make([]byte, 20)})
+	q.add(raftpb.Entry{})
+	if count, bytes := q.pending(); count != 3 || bytes != 30 {
+		t.Errorf("unexpected pending %d/%d", count, bytes)
+	}
+	q.get(false)
+	if count, bytes := q.pending(); count != 0 || bytes != 0 {
+		t.Errorf("unexpected pending %d/%d", count, bytes)
+	}
+}
+
+func TestChunkedProposalIsQueuedGradually(t *testing.T) {
+	q := newEntryQueue(8, 0)
+	e := raftpb.Entry{Type: raftpb.EncodedEntry, Cmd: make([]byte, 100)}
+	s := rsm.NewChunkSplitter(e, 4)
+	if added, _ := q.addChunked(s); !added {
+		t.Fatalf("failed to add chunked proposal")
+	}
+	if added, _ := q.add(raftpb.Entry{}); added {
+		t.Errorf("proposal interleaved with chunks")
+	}
+	if added, _ := q.addChunked(rsm.NewChunkSplitter(e, 4)); added {
+		t.Errorf("concurrent chunked proposal accepted")
+	}
+	total := 0
+	for i := 0; q.chunking(); i++ {
+		if i > 25 {
+			t.Fatalf("chunks not fully queued")
+		}
+		entries := q.get(false)
+		if uint64(len(entries)) > q.size {
+			t.Fatalf("too many queued chunks %d", len(entries))
+		}
+		total += len(entries)
+	}
+	total += len(q.get(false))
+	if total != 25 {
+		t.Errorf("got %d chunks, want 25", total)
+	}
+	if added, _ := q.add(raftpb.Entry{}); !added {
+		t.Errorf("failed to add proposal")
+	}
+}
+
+func TestPausedQueueDoesNotAddChunks(t *testing.T) {
+	q := newEntryQueue(8, 0)
+	e := raftpb.Entry{Type: raftpb.EncodedEntry, Cmd: make([]byte, 100)}
+	if added, _ := q.addChunked(rsm.NewChunkSplitter(e, 4)); !added {
+		t.Fatalf("failed to add chunked proposal")
+	}
+	if entries := q.get(true); len(entries) != 8 {
+		t.Fatalf("got %d entries, want 8", len(entries))
+	}
+	if entries := q.get(true); len(entries) != 0 {
+		t.Errorf("chunks added when paused")
+	}
+	if entries := q.get(false); len(entries) != 0 {
+		t.Errorf("unexpected entries")
+	}
+	if entries := q.get(false); len(entries) != 8 {
+		t.Errorf("chunks not added after resume, %d", len(entries))
+	}
+}
+
+func TestProposalBatcherIsDisabledByDefault(t *testing.T) {
+	var b *proposalBatcher
+	if b = newProposalBatcher(0, 100, 10); b != nil {
+		t.Fatalf("unexpected proposal batcher")
+	}
+	if b.hold(5, 5) != 0 {
+		t.Errorf("proposals held by nil batcher")
+	}
+	b.released(5)
+}
+
+func TestProposalBatcherOnlyHoldsProposalsWhenBusy(t *testing.T) {
+	now := time.Unix(100, 0)
+	b := newProposalBatcher(10*time.Millisecond, 1024, 100)
+	b.now = func() time.Time { return now }
+	if b.hold(1, 1) != 0 {
+		t.Errorf("proposal held on idle shard")
+	}
+	b.released(1)
+	// 100 proposals every millisecond
+	for i := 0; i < 20; i++ {
+		now = now.Add(time.Millisecond)
+		b.released(100)
+	}
+	if wait := b.hold(1, 1); wait != 10*time.Millisecond {
+		t.Errorf("wait %s, want 10ms", wait)
+	}
+	now = now.Add(4 * time.Millisecond)
+	if wait := b.hold(2, 2); wait != 6*time.Millisecond {
+		t.Errorf("wait %s, want 6ms", wait)
+	}
+	if b.hold(2, 1024) != 0 {
+		t.Errorf("proposals held after reaching target size")
+	}
+	if b.hold(100, 2) != 0 {
+		t.Errorf("proposals held after reaching the limit")
+	}
+	now = now.Add(6 * time.Millisecond)
+	if b.hold(2, 2) != 0 {
+		t.Errorf("proposals held after the delay")
+	}
+	b.released(2)
+	// proposal rate drops once the shard becomes idle
+	for i := 0; i < 50; i++ {
+		now = now.Add(time.Second)
+		b.released(1)
+	}
+	if b.hold(1, 1) != 0 {
+		t.Errorf("proposal held on idle shard")
+	}
+}
+
 func TestShardCanBeSetAsReady(t *testing.T) {
 	rc := newReadyShard()
 	if len(rc.ready) != 0 {
@@ -58,6 +58,14 @@ func (q *quiesceState) quiesced() bool {
 	return q.enabled && q.quiescedSince > 0
 }
 
+// quiescedFor returns the number of ticks since the node entered quiesce mode.
+func (q *quiesceState) quiescedFor() uint64 {
+	if !q.quiesced() {
+		return 0
+	}
+	return q.currentTick - q.quiescedSince
+}
+
 func (q *quiesceState) record(msgType pb.MessageType) {
 	if !q.enabled {
 		return
@@ -149,3 +149,24 @@ func TestWillNotExitFromQuiesceForDelayedMsgHeartbeatMsg(t *testing.T) {
 		t.Errorf("got %t, want false", q.quiesced())
 	}
 }
+
+func TestQuiescedForIsReset(t *testing.T) {
+	q := getTestQuiesce()
+	threshold := q.threshold()
+	for k := uint64(0); k < threshold+1; k++ {
+		q.tick()
+	}
+	if q.quiescedFor() != 0 {
+		t.Errorf("unexpected quiesced for %d", q.quiescedFor())
+	}
+	for k := uint64(0); k < 5; k++ {
+		q.tick()
+	}
+	if q.quiescedFor() != 5 {
+		t.Errorf("quiesced for %d, want 5", q.quiescedFor())
+	}
+	q.record(pb.Replicate)
+	if q.quiescedFor() != 0 {
+		t.Errorf("quiesced for %d after exiting quiesce", q.quiescedFor())
+	}
+}
@@ -63,8 +63,8 @@ func isStateEqual(a State, b State) bool {
 // IsProposal returns a boolean value indicating whether the entry is a
 // regular update entry.
 func (m *Entry) IsProposal() bool {
-	return m.Type == ApplicationEntry ||
-		m.Type == EncodedEntry || m.Type == MetadataEntry
+	return m.Type == ApplicationEntry || m.Type == EncodedEntry ||
+		m.Type == MetadataEntry || m.Type == ChunkedEntry
 }
 
 // IsConfigChange returns a boolean value indicating whether the entry is for
@@ -112,6 +112,7 @@ const (
 	ConfigChangeEntry EntryType = 1
 	EncodedEntry      EntryType = 2
 	MetadataEntry     EntryType = 3
+	ChunkedEntry      EntryType = 4
 )
 
 var EntryType_name = map[int32]string{
@@ -119,6 +120,7 @@ var EntryType_name = map[int32]string{
 	1: "ConfigChangeEntry",
 	2: "EncodedEntry",
 	3: "MetadataEntry",
+	4: "ChunkedEntry",
 }
 
 var EntryType_value = map[string]int32{
@@ -126,6 +128,7 @@ var EntryType_value = map[string]int32{
 	"ConfigChangeEntry": 1,
 	"EncodedEntry":      2,
 	"MetadataEntry":     3,
+	"ChunkedEntry":      4,
 }
 
 func (x EntryType) String() string {
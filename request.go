@@ -31,6 +31,7 @@ import (
 	"github.com/lni/dragonboat/v4/config"
 	"github.com/lni/dragonboat/v4/internal/fileutil"
 	"github.com/lni/dragonboat/v4/internal/rsm"
+	"github.com/lni/dragonboat/v4/internal/server"
 	"github.com/lni/dragonboat/v4/internal/settings"
 	"github.com/lni/dragonboat/v4/logger"
 	pb "github.com/lni/dragonboat/v4/raftpb"
@@ -66,6 +67,20 @@ var (
 	// Raft config change operation, ErrSystemBusy means there is already such a
 	// request waiting to be processed.
 	ErrSystemBusy = errors.New("system is too busy try again later")
+	// ErrMemoryBudgetExceeded indicates that the proposal was rejected as the
+	// NodeHost's MaxMemoryBudget has been exhausted and the shard is already
+	// using its fair share of the budget. It is an ErrSystemBusy error, check
+	// it using errors.Is.
+	ErrMemoryBudgetExceeded = errors.Wrap(ErrSystemBusy, "memory budget exceeded")
+	// ErrRateLimited indicates that the proposal was rejected as the client
+	// session or its tenant exceeded the MaxProposalRate limit of the shard.
+	// The returned error is a *RateLimitedError, use GetRetryAfter to get the
+	// suggested delay before retrying.
+	ErrRateLimited = errors.New("proposal rate limited")
+	// ErrDiskSpaceLow indicates that the proposal was rejected as the free disk
+	// space of the NodeHost is below the MinFreeDiskSpace threshold. Reads are
+	// still allowed.
+	ErrDiskSpaceLow = errors.New("free disk space is low")
 	// ErrShardClosed indicates that the requested shard is being shut down.
 	ErrShardClosed = errors.New("raft shard already closed")
 	// ErrShardNotInitialized indicates that the requested operation can not be
@@ -94,12 +109,41 @@ var (
 // input, potentially on a more suitable NodeHost instance.
 func IsTempError(err error) bool {
 	return errors.Is(err, ErrSystemBusy) ||
+		errors.Is(err, ErrRateLimited) ||
 		errors.Is(err, ErrShardClosed) ||
 		errors.Is(err, ErrShardNotInitialized) ||
 		errors.Is(err, ErrShardNotReady) ||
 		errors.Is(err, ErrTimeout) ||
 		errors.Is(err, ErrClosed) ||
-		errors.Is(err, ErrAborted)
+		errors.Is(err, ErrAborted) ||
+		errors.Is(err, ErrDiskSpaceLow)
+}
+
+// RateLimitedError is the error returned when a proposal is rejected for
+// exceeding the MaxProposalRate limit, it is an ErrRateLimited error.
+type RateLimitedError struct {
+	// RetryAfter is the suggested delay before the proposal is retried.
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrRateLimited, e.RetryAfter)
+}
+
+// Is returns a boolean value indicating whether the target is ErrRateLimited.
+func (e *RateLimitedError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// GetRetryAfter returns the suggested delay before retrying a proposal
+// rejected with the specified error. The returned boolean value indicates
+// whether the error is an ErrRateLimited error.
+func GetRetryAfter(err error) (time.Duration, bool) {
+	var e *RateLimitedError
+	if errors.As(err, &e) {
+		return e.RetryAfter, true
+	}
+	return 0, false
 }
 
 // LogRange defines the range [FirstIndex, lastIndex) of the raft log.
@@ -500,6 +544,8 @@ func (r *RequestState) mustBeReadyForLocalRead() {
 type proposalShard struct {
 	mu             sync.Mutex
 	proposals      *entryQueue
+	limiter        *server.TokenBuckets
+	tenants        *server.TokenBuckets
 	pending        map[uint64]*RequestState
 	pool           *sync.Pool
 	cfg            config.Config
@@ -1006,8 +1052,14 @@ func newPendingProposal(cfg config.Config,
 		keyg:   make([]*keyGenerator, ps),
 		ps:     ps,
 	}
+	// limiters are shared by all shards as keys are randomly assigned to shards,
+	// tenant keys and client IDs are limited separately
+	limiter := server.NewTokenBuckets(cfg.MaxProposalRate, cfg.ProposalBurst)
+	tenants := server.NewTokenBuckets(cfg.MaxProposalRate, cfg.ProposalBurst)
 	for i := uint64(0); i < ps; i++ {
 		p.shards[i] = newPendingProposalShard(cfg, notifyCommit, pool, proposals)
+		p.shards[i].limiter = limiter
+		p.shards[i].tenants = tenants
 		p.keyg[i] = getRng(cfg.ShardID, cfg.ReplicaID, i)
 	}
 	return p
@@ -1015,9 +1067,14 @@ func newPendingProposal(cfg config.Config,
 
 func (p *pendingProposal) propose(session *client.Session,
 	cmd []byte, timeoutTick uint64) (*RequestState, error) {
+	return p.proposeWithKeys(session, cmd, nil, timeoutTick)
+}
+
+func (p *pendingProposal) proposeWithKeys(session *client.Session,
+	cmd []byte, keys []uint64, timeoutTick uint64) (*RequestState, error) {
 	key := p.nextKey(session.ClientID)
 	pp := p.shards[key%p.ps]
-	return pp.propose(session, cmd, key, timeoutTick)
+	return pp.propose(session, cmd, keys, key, timeoutTick)
 }
 
 func (p *pendingProposal) close() {
@@ -1074,14 +1131,20 @@ func newPendingProposalShard(cfg config.Config,
 	return p
 }
 
-func (p *proposalShard) propose(session *client.Session,
-	cmd []byte, key uint64, timeoutTick uint64) (*RequestState, error) {
+func (p *proposalShard) propose(session *client.Session, cmd []byte,
+	keys []uint64, key uint64, timeoutTick uint64) (*RequestState, error) {
 	if timeoutTick == 0 {
 		return nil, ErrTimeoutTooSmall
 	}
 	if rsm.GetMaxBlockSize(p.cfg.EntryCompressionType) < uint64(len(cmd)) {
 		return nil, ErrPayloadTooBig
 	}
+	limiter, rateKey := p.getLimiter(session)
+	if wait := limiter.Take(rateKey); wait > 0 {
+		plog.Debugf("%s dropped proposal, rate limited",
+			dn(p.cfg.ShardID, p.cfg.ReplicaID))
+		return nil, &RateLimitedError{RetryAfter: wait}
+	}
 	entry := pb.Entry{
 		Key:         key,
 		ClientID:    session.ClientID,
@@ -1092,7 +1155,12 @@ func (p *proposalShard) propose(session *client.Session,
 		entry.Type = pb.ApplicationEntry
 	} else {
 		entry.Type = pb.EncodedEntry
-		entry.Cmd = preparePayload(p.cfg.EntryCompressionType, cmd)
+		entry.Cmd = preparePayload(p.cfg.EntryCompressionType, cmd, keys)
+	}
+	var chunks *rsm.ChunkSplitter
+	if p.cfg.ProposalChunkSize > 0 &&
+		uint64(len(entry.Cmd)) > p.cfg.ProposalChunkSize {
+		chunks = rsm.NewChunkSplitter(entry, p.cfg.ProposalChunkSize)
 	}
 	req := p.pool.Get().(*RequestState)
 	req.reuse(p.notifyCommit)
@@ -1106,19 +1174,26 @@ func (p *proposalShard) propose(session *client.Session,
 	p.pending[entry.Key] = req
 	p.mu.Unlock()
 
-	added, stopped := p.proposals.add(entry)
+	var added, stopped bool
+	if chunks != nil {
+		added, stopped = p.proposals.addChunked(chunks)
+	} else {
+		added, stopped = p.proposals.add(entry)
+	}
 	if stopped {
 		plog.Warningf("%s dropped proposal, shard stopped",
 			dn(p.cfg.ShardID, p.cfg.ReplicaID))
 		p.mu.Lock()
 		delete(p.pending, entry.Key)
 		p.mu.Unlock()
+		limiter.Refund(rateKey)
 		return nil, ErrShardClosed
 	}
 	if !added {
 		p.mu.Lock()
 		delete(p.pending, entry.Key)
 		p.mu.Unlock()
+		limiter.Refund(rateKey)
 		plog.Debugf("%s dropped proposal, overloaded",
 			dn(p.cfg.ShardID, p.cfg.ReplicaID))
 		return nil, ErrSystemBusy
@@ -1126,6 +1201,17 @@ func (p *proposalShard) propose(session *client.Session,
 	return req, nil
 }
 
+// getLimiter returns the limiter and the key used for limiting the proposal
+// rate of the specified client session.
+func (p *proposalShard) getLimiter(
+	session *client.Session) (*server.TokenBuckets, uint64) {
+	key, tenant := session.RateLimitKey()
+	if tenant {
+		return p.tenants, key
+	}
+	return p.limiter, key
+}
+
 func (p *proposalShard) close() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -1219,8 +1305,9 @@ func (p *proposalShard) gcAt(now uint64) {
 	}
 }
 
-func preparePayload(ct config.CompressionType, cmd []byte) []byte {
-	return rsm.GetEncoded(rsm.ToDioType(ct), cmd, nil)
+func preparePayload(ct config.CompressionType,
+	cmd []byte, keys []uint64) []byte {
+	return rsm.GetEncodedWithKeys(rsm.ToDioType(ct), cmd, keys)
 }
 
 type pendingRaftLogQuery struct {
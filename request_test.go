@@ -20,7 +20,9 @@ import (
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/cockroachdb/errors"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/lni/dragonboat/v4/client"
@@ -42,6 +44,7 @@ func TestIsTempError(t *testing.T) {
 		{ErrTimeoutTooSmall, false},
 		{ErrPayloadTooBig, false},
 		{ErrSystemBusy, true},
+		{ErrRateLimited, true},
 		{ErrShardClosed, true},
 		{ErrShardNotInitialized, true},
 		{ErrTimeout, true},
@@ -51,6 +54,7 @@ func TestIsTempError(t *testing.T) {
 		{ErrShardNotReady, true},
 		{ErrInvalidTarget, false},
 		{ErrInvalidRange, false},
+		{ErrDiskSpaceLow, true},
 	}
 	for idx, tt := range tests {
 		if tmp := IsTempError(tt.err); tmp != tt.temp {
@@ -1517,3 +1521,154 @@ func TestPendingRaftLogQueryCanReturnResults(t *testing.T) {
 		t.Fatalf("no result available")
 	}
 }
+
+func TestProposalsCanBeRateLimited(t *testing.T) {
+	p := &sync.Pool{}
+	p.New = func() interface{} {
+		obj := &RequestState{}
+		obj.CompletedC = make(chan RequestResult, 1)
+		obj.pool = p
+		return obj
+	}
+	q := newEntryQueue(64, 0)
+	cfg := config.Config{
+		ShardID:         1,
+		ReplicaID:       1,
+		MaxProposalRate: 1,
+		ProposalBurst:   2,
+	}
+	pp := newPendingProposal(cfg, false, p, q)
+	s1 := client.NewTenantSession(1, 1)
+	s2 := client.NewTenantSession(1, 2)
+	for i := 0; i < 2; i++ {
+		if _, err := pp.propose(s1, nil, 100); err != nil {
+			t.Fatalf("failed to propose, %v", err)
+		}
+	}
+	_, err := pp.propose(s1, nil, 100)
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("failed to return ErrRateLimited, %v", err)
+	}
+	if !IsTempError(err) {
+		t.Errorf("ErrRateLimited is not a temp error")
+	}
+	if wait, ok := GetRetryAfter(err); !ok || wait <= 0 || wait > time.Second {
+		t.Errorf("unexpected retry after %s, %t", wait, ok)
+	}
+	if _, err := pp.propose(s2, nil, 100); err != nil {
+		t.Fatalf("other tenant limited, %v", err)
+	}
+	// sessions of the same tenant share the same limit
+	s3 := client.NewTenantSession(1, 1)
+	if _, err := pp.propose(s3, nil, 100); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("tenant not limited, %v", err)
+	}
+	// NoOP sessions are limited by their own client ids
+	noop := client.NewNoOPSession(1, random.LockGuardedRand)
+	for i := 0; i < 2; i++ {
+		if _, err := pp.propose(noop, nil, 100); err != nil {
+			t.Fatalf("failed to propose, %v", err)
+		}
+	}
+	if _, err := pp.propose(noop, nil, 100); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("NoOP session not limited, %v", err)
+	}
+	other := client.NewNoOPSession(1, random.LockGuardedRand)
+	if _, err := pp.propose(other, nil, 100); err != nil {
+		t.Fatalf("other NoOP session limited, %v", err)
+	}
+	// tenant keys are never confused with client ids, tenant 1 is limited
+	other.ClientID = 1
+	if _, err := pp.propose(other, nil, 100); err != nil {
+		t.Fatalf("client id limited as a tenant key, %v", err)
+	}
+	if _, ok := GetRetryAfter(ErrSystemBusy); ok {
+		t.Errorf("unexpected retry after for ErrSystemBusy")
+	}
+}
+
+func TestRateTokenIsRefundedWhenProposalIsDropped(t *testing.T) {
+	p := &sync.Pool{}
+	p.New = func() interface{} {
+		obj := &RequestState{}
+		obj.CompletedC = make(chan RequestResult, 1)
+		obj.pool = p
+		return obj
+	}
+	q := newEntryQueue(1, 0)
+	cfg := config.Config{
+		ShardID:         1,
+		ReplicaID:       1,
+		MaxProposalRate: 1,
+		ProposalBurst:   1,
+	}
+	pp := newPendingProposal(cfg, false, p, q)
+	s1 := client.NewNoOPSession(1, random.LockGuardedRand)
+	s2 := client.NewNoOPSession(1, random.LockGuardedRand)
+	if _, err := pp.propose(s1, nil, 100); err != nil {
+		t.Fatalf("failed to propose, %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := pp.propose(s2, nil, 100); err != ErrSystemBusy {
+			t.Fatalf("%d, failed to return ErrSystemBusy, %v", i, err)
+		}
+	}
+	if entries := q.get(false); len(entries) != 1 {
+		t.Fatalf("unexpected entry count %d", len(entries))
+	}
+	if _, err := pp.propose(s2, nil, 100); err != nil {
+		t.Fatalf("token of dropped proposal not refunded, %v", err)
+	}
+	q.close()
+	s3 := client.NewNoOPSession(1, random.LockGuardedRand)
+	for i := 0; i < 3; i++ {
+		if _, err := pp.propose(s3, nil, 100); err != ErrShardClosed {
+			t.Fatalf("%d, failed to return ErrShardClosed, %v", i, err)
+		}
+	}
+}
+
+func TestLargeProposalIsChunked(t *testing.T) {
+	p := &sync.Pool{}
+	p.New = func() interface{} {
+		obj := &RequestState{}
+		obj.CompletedC = make(chan RequestResult, 1)
+		obj.pool = p
+		return obj
+	}
+	q := newEntryQueue(8, 0)
+	cfg := config.Config{ShardID: 1, ReplicaID: 1, ProposalChunkSize: 1024}
+	pp := newPendingProposal(cfg, false, p, q)
+	session := client.NewNoOPSession(1, random.LockGuardedRand)
+	if _, err := pp.propose(session, make([]byte, 1024*20), 100); err != nil {
+		t.Fatalf("failed to propose, %v", err)
+	}
+	if _, err := pp.propose(session, make([]byte, 16), 100); err != ErrSystemBusy {
+		t.Errorf("proposal not rejected when chunks are being queued, %v", err)
+	}
+	var entries []pb.Entry
+	for i := 0; i < 3; i++ {
+		batch := q.get(false)
+		if uint64(len(batch)) > q.size {
+			t.Fatalf("too many queued entries %d", len(batch))
+		}
+		entries = append(entries, batch...)
+	}
+	if len(entries) != 21 {
+		t.Fatalf("got %d entries, want 21", len(entries))
+	}
+	for i, e := range entries {
+		if e.Type != pb.ChunkedEntry || e.Key != entries[0].Key {
+			t.Errorf("%d, unexpected entry %v", i, e)
+		}
+		if rsm.IsLastChunk(e) != (i == len(entries)-1) {
+			t.Errorf("%d, unexpected last chunk flag", i)
+		}
+	}
+	if _, err := pp.propose(session, make([]byte, 16), 100); err != nil {
+		t.Fatalf("failed to propose, %v", err)
+	}
+	if entries := q.get(false); len(entries) != 1 || entries[0].Type != pb.EncodedEntry {
+		t.Errorf("small proposal unexpectedly chunked")
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulation
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+var (
+	// ErrPartitioned indicates that the target NodeHost can not be reached
+	// because of a simulated network partition.
+	ErrPartitioned = errors.New("network partitioned")
+)
+
+// Delivery is a Raft message or a snapshot chunk handled by the simulated
+// network.
+type Delivery struct {
+	// Tick is the virtual time when the message was handled.
+	Tick uint64
+	// From is the index of the sending NodeHost.
+	From int
+	// To is the index of the receiving NodeHost.
+	To int
+	// Type is the type of the message, InstallSnapshot is used for snapshot
+	// chunks.
+	Type    pb.MessageType
+	ShardID uint64
+	Term    uint64
+	// LogIndex is the LogIndex of the message or the index of the snapshot.
+	LogIndex uint64
+	Commit   uint64
+	Entries  int
+	// Dropped indicates whether the message was dropped.
+	Dropped bool
+}
+
+// envelope is a message batch or a snapshot chunk in flight.
+type envelope struct {
+	from  string
+	to    string
+	batch pb.MessageBatch
+	chunk *pb.Chunk
+}
+
+// stream is the key of an ordered stream of envelopes.
+type stream struct {
+	from    int
+	to      int
+	shardID uint64
+	chunk   bool
+}
+
+func (s stream) less(o stream) bool {
+	if s.from != o.from {
+		return s.from < o.from
+	}
+	if s.to != o.to {
+		return s.to < o.to
+	}
+	if s.shardID != o.shardID {
+		return s.shardID < o.shardID
+	}
+	return !s.chunk && o.chunk
+}
+
+// network is the simulated network connecting all NodeHost instances of a
+// Simulator. Sent messages and snapshot chunks are held by the network until
+// they are delivered by the Simulator. Whether a message is dropped is decided
+// by hashing the seed, the current virtual tick and the message itself.
+type network struct {
+	seed     int64
+	dropRate float64
+	tick     *uint64
+	mu       sync.Mutex
+	// index of the NodeHost of each RaftAddress
+	hosts map[string]int
+	// partition ID of each RaftAddress, all NodeHosts are connected when empty
+	partitions map[string]int
+	transports map[string]*transport
+	pending    []envelope
+	trace      []Delivery
+}
+
+func newNetwork(seed int64, dropRate float64, tick *uint64) *network {
+	return &network{
+		seed:       seed,
+		dropRate:   dropRate,
+		tick:       tick,
+		hosts:      make(map[string]int),
+		partitions: make(map[string]int),
+		transports: make(map[string]*transport),
+	}
+}
+
+func (n *network) addHost(addr string, idx int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.hosts[addr] = idx
+}
+
+func (n *network) partition(groups map[string]int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partitions = groups
+}
+
+func (n *network) heal() {
+	n.partition(make(map[string]int))
+}
+
+func (n *network) connected(from string, to string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.isConnected(from, to)
+}
+
+func (n *network) isConnected(from string, to string) bool {
+	if len(n.partitions) == 0 {
+		return true
+	}
+	return n.partitions[from] == n.partitions[to]
+}
+
+func (n *network) drop(m pb.Message) bool {
+	if n.dropRate <= 0 {
+		return false
+	}
+	h := fnv.New64a()
+	var buf [8]byte
+	for _, v := range []uint64{uint64(n.seed), atomic.LoadUint64(n.tick),
+		m.ShardID, m.From, m.To, uint64(m.Type),
+		m.Term, m.LogTerm, m.LogIndex, m.Commit, uint64(len(m.Entries))} {
+		binary.LittleEndian.PutUint64(buf[:], v)
+		if _, err := h.Write(buf[:]); err != nil {
+			panic(err)
+		}
+	}
+	return float64(h.Sum64()) < n.dropRate*math.MaxUint64
+}
+
+func (n *network) register(t *transport) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.transports[t.addr] = t
+}
+
+func (n *network) unregister(t *transport) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.transports[t.addr] == t {
+		delete(n.transports, t.addr)
+	}
+}
+
+func (n *network) send(e envelope) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.pending = append(n.pending, e)
+}
+
+// deliver delivers all pending envelopes. Envelopes sent by the same NodeHost
+// to the same target shard are delivered in order, such ordered streams are
+// interleaved using rng. It returns a boolean value indicating whether there
+// was any pending envelope.
+func (n *network) deliver(rng *rand.Rand) bool {
+	n.mu.Lock()
+	pending := n.pending
+	n.pending = nil
+	n.mu.Unlock()
+	if len(pending) == 0 {
+		return false
+	}
+	queues := make(map[stream][]envelope)
+	for _, e := range pending {
+		k := n.getStream(e)
+		queues[k] = append(queues[k], e)
+	}
+	keys := make([]stream, 0, len(queues))
+	for k := range queues {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+	for len(keys) > 0 {
+		idx := rng.Intn(len(keys))
+		k := keys[idx]
+		n.handle(queues[k][0])
+		if queues[k] = queues[k][1:]; len(queues[k]) == 0 {
+			keys = append(keys[:idx], keys[idx+1:]...)
+		}
+	}
+	return true
+}
+
+func (n *network) getStream(e envelope) stream {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	k := stream{from: n.hosts[e.from], to: n.hosts[e.to]}
+	if e.chunk != nil {
+		k.shardID = e.chunk.ShardID
+		k.chunk = true
+	} else if len(e.batch.Requests) > 0 {
+		k.shardID = e.batch.Requests[0].ShardID
+	}
+	return k
+}
+
+func (n *network) handle(e envelope) {
+	n.mu.Lock()
+	t, ok := n.transports[e.to]
+	connected := ok && n.isConnected(e.from, e.to)
+	d := Delivery{
+		Tick: atomic.LoadUint64(n.tick),
+		From: n.hosts[e.from],
+		To:   n.hosts[e.to],
+	}
+	if e.chunk != nil {
+		d.Type = pb.InstallSnapshot
+		d.ShardID = e.chunk.ShardID
+		d.Term = e.chunk.Term
+		d.LogIndex = e.chunk.Index
+		d.Dropped = !connected
+		n.trace = append(n.trace, d)
+		n.mu.Unlock()
+		if connected {
+			t.chunkHandler(*e.chunk)
+		}
+		return
+	}
+	requests := make([]pb.Message, 0, len(e.batch.Requests))
+	for _, m := range e.batch.Requests {
+		d.Type = m.Type
+		d.ShardID = m.ShardID
+		d.Term = m.Term
+		d.LogIndex = m.LogIndex
+		d.Commit = m.Commit
+		d.Entries = len(m.Entries)
+		d.Dropped = !connected || n.drop(m)
+		n.trace = append(n.trace, d)
+		if !d.Dropped {
+			requests = append(requests, m)
+		}
+	}
+	n.mu.Unlock()
+	if len(requests) > 0 {
+		e.batch.Requests = requests
+		t.handler(e.batch)
+	}
+}
+
+func (n *network) getTrace() []Delivery {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]Delivery{}, n.trace...)
+}
+
+// transportFactory creates transport modules connected by the simulated
+// network.
+type transportFactory struct {
+	net *network
+}
+
+var _ config.TransportFactory = (*transportFactory)(nil)
+
+func (f *transportFactory) Create(nhConfig config.NodeHostConfig,
+	handler raftio.MessageHandler,
+	chunkHandler raftio.ChunkHandler) raftio.ITransport {
+	return &transport{
+		net:          f.net,
+		addr:         nhConfig.RaftAddress,
+		handler:      handler,
+		chunkHandler: chunkHandler,
+	}
+}
+
+func (f *transportFactory) Validate(addr string) bool {
+	return len(addr) > 0
+}
+
+type transport struct {
+	net          *network
+	addr         string
+	handler      raftio.MessageHandler
+	chunkHandler raftio.ChunkHandler
+}
+
+var _ raftio.ITransport = (*transport)(nil)
+
+func (t *transport) Name() string {
+	return "simulation-transport"
+}
+
+func (t *transport) Start() error {
+	t.net.register(t)
+	return nil
+}
+
+func (t *transport) Close() error {
+	t.net.unregister(t)
+	return nil
+}
+
+func (t *transport) GetConnection(ctx context.Context,
+	target string) (raftio.IConnection, error) {
+	return &connection{t: t, target: target}, nil
+}
+
+func (t *transport) GetSnapshotConnection(ctx context.Context,
+	target string) (raftio.ISnapshotConnection, error) {
+	if !t.net.connected(t.addr, target) {
+		return nil, ErrPartitioned
+	}
+	return &snapshotConnection{t: t, target: target}, nil
+}
+
+type connection struct {
+	t      *transport
+	target string
+}
+
+func (c *connection) Close() {}
+
+func (c *connection) SendMessageBatch(batch pb.MessageBatch) error {
+	// the batch is copied as it is delivered after the sender moves on
+	data, err := batch.Marshal()
+	if err != nil {
+		return err
+	}
+	var copied pb.MessageBatch
+	if err := copied.Unmarshal(data); err != nil {
+		return err
+	}
+	c.t.net.send(envelope{from: c.t.addr, to: c.target, batch: copied})
+	return nil
+}
+
+type snapshotConnection struct {
+	t      *transport
+	target string
+}
+
+func (c *snapshotConnection) Close() {}
+
+func (c *snapshotConnection) SendChunk(chunk pb.Chunk) error {
+	if !c.t.net.connected(c.t.addr, c.target) {
+		return ErrPartitioned
+	}
+	chunk.Data = append([]byte(nil), chunk.Data...)
+	c.t.net.send(envelope{from: c.t.addr, to: c.target, chunk: &chunk})
+	return nil
+}
@@ -0,0 +1,480 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package simulation implements a simulation testing harness for applications
+built on top of dragonboat.
+
+A Simulator runs multiple NodeHost instances in the same process. Each
+NodeHost stores its data in its own in-memory filesystem and is connected to
+other NodeHost instances by a simulated network. Each NodeHost is driven by
+its own virtual clock set as the Expert.Clock field of its NodeHostConfig, it
+doesn't run its own tick, step, commit and apply workers. Each time the
+virtual time is advanced, the Simulator ticks all running NodeHost instances
+and then repeatedly runs them and delivers the messages exchanged between them
+until there is no pending work left.
+
+All decisions are made from the seed of the Simulator. NodeHost instances are
+ticked and run in an order drawn from the seed, messages held by the network
+are delivered in an order drawn from the seed and Raft messages are dropped
+based on the seed, the virtual time and the content of each message. Faults
+are also injected based on the seed, the network is randomly partitioned and
+NodeHost instances randomly crash and restart. Crashed NodeHost instances lose
+all data that has not been synced to their filesystems. The randomized
+election timeouts of Raft nodes are drawn from the seed as well. A failing
+seed thus replays the same execution, including the fault schedule recorded
+by Events and the messages recorded by Trace, as long as the application
+itself is deterministic. Snapshots are saved, recovered and streamed by
+background workers, the Simulator waits for them to complete before moving
+on.
+
+Replicas must be started from the OnStart function in Config, it is invoked
+each time a NodeHost is started or restarted. Config.WaitReady must not be set
+for those replicas and replicas are never hibernated.
+*/
+package simulation
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/logger"
+)
+
+var plog = logger.GetLogger("simulation")
+
+const (
+	defaultRTTMillisecond = 1
+	defaultRecoveryTicks  = 100
+	nodeHostDir           = "/nodehost"
+	// maxSettleRounds is the max number of rounds of running all NodeHost
+	// instances and delivering messages on each tick
+	maxSettleRounds = 10000
+)
+
+var (
+	// ErrCrashed indicates that the NodeHost has crashed and has not been
+	// restarted yet.
+	ErrCrashed = errors.New("NodeHost crashed")
+	// ErrRunning indicates that the NodeHost is still running.
+	ErrRunning = errors.New("NodeHost running")
+)
+
+// simulatorID is used for making RaftAddresses unique across Simulator
+// instances in the same process.
+var simulatorID uint64
+
+// EventType is the type of fault injection events.
+type EventType int
+
+const (
+	// Partitioned indicates that the network has been partitioned.
+	Partitioned EventType = iota
+	// Healed indicates that the network partition has been healed.
+	Healed
+	// Crashed indicates that NodeHost instances have crashed.
+	Crashed
+	// Restarted indicates that crashed NodeHost instances have been restarted.
+	Restarted
+)
+
+var eventTypeNames = [...]string{
+	"Partitioned",
+	"Healed",
+	"Crashed",
+	"Restarted",
+}
+
+func (t EventType) String() string {
+	return eventTypeNames[t]
+}
+
+// Event is a fault injection event.
+type Event struct {
+	// Tick is the virtual time when the event happened.
+	Tick uint64
+	// Type is the type of the event.
+	Type EventType
+	// NodeHosts are indexes of the affected NodeHost instances. For Partitioned
+	// events, they are NodeHost instances separated from the rest.
+	NodeHosts []int
+}
+
+func (e Event) String() string {
+	return fmt.Sprintf("tick %d, %s %v", e.Tick, e.Type, e.NodeHosts)
+}
+
+// Config is the configuration of a Simulator.
+type Config struct {
+	// Seed is the seed used for making all fault injection decisions.
+	Seed int64
+	// NodeHosts is the number of NodeHost instances.
+	NodeHosts int
+	// NodeHostConfig is the template of the NodeHostConfig used for creating
+	// NodeHost instances. Its RaftAddress, NodeHostDir, WALDir, Expert.FS,
+	// Expert.Clock and Expert.TransportFactory fields are set by the Simulator. RTTMillisecond
+	// is set to 1 when not specified.
+	NodeHostConfig config.NodeHostConfig
+	// OnStart is invoked each time a NodeHost is started or restarted, idx is
+	// the index of the NodeHost. It is usually used for starting replicas on
+	// the NodeHost returned by the NodeHost method of s.
+	OnStart func(s *Simulator, idx int) error
+	// DropRate is the probability of each Raft message being dropped.
+	DropRate float64
+	// PartitionRate is the probability of the network being partitioned on
+	// each tick.
+	PartitionRate float64
+	// CrashRate is the probability of a NodeHost crashing on each tick. The
+	// last running NodeHost never crashes.
+	CrashRate float64
+	// RecoveryTicks is the number of ticks after which network partitions are
+	// healed and crashed NodeHost instances are restarted. 100 ticks is used
+	// by default.
+	RecoveryTicks uint64
+}
+
+// Validate validates the Config instance.
+func (c *Config) Validate() error {
+	if c.NodeHosts <= 0 {
+		return errors.New("invalid NodeHosts")
+	}
+	if c.OnStart == nil {
+		return errors.New("OnStart not set")
+	}
+	for _, v := range []float64{c.DropRate, c.PartitionRate, c.CrashRate} {
+		if v < 0 || v > 1 {
+			return errors.New("invalid rate")
+		}
+	}
+	return nil
+}
+
+// clock is the virtual clock of a NodeHost, it is driven by the Simulator.
+type clock struct {
+	seed   int64
+	driver config.IClockDriver
+}
+
+var _ config.IClock = (*clock)(nil)
+
+func (c *clock) Attach(d config.IClockDriver) {
+	c.driver = d
+}
+
+func (c *clock) Detach(d config.IClockDriver) {
+	if c.driver == d {
+		c.driver = nil
+	}
+}
+
+func (c *clock) Seed() int64 {
+	return c.seed
+}
+
+type host struct {
+	nhConfig  config.NodeHostConfig
+	fs        *vfs.MemFS
+	clock     *clock
+	nh        *dragonboat.NodeHost
+	restartAt uint64
+}
+
+// Simulator runs NodeHost instances driven by virtual time with seeded fault
+// injection. Simulator is not thread safe, it is expected to be driven by a
+// single test goroutine.
+type Simulator struct {
+	cfg         Config
+	rand        *rand.Rand
+	sched       *rand.Rand
+	tick        uint64
+	net         *network
+	hosts       []*host
+	events      []Event
+	partitioned bool
+	healAt      uint64
+}
+
+// New creates a Simulator and starts all its NodeHost instances.
+func New(cfg Config) (*Simulator, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.NodeHostConfig.RTTMillisecond == 0 {
+		cfg.NodeHostConfig.RTTMillisecond = defaultRTTMillisecond
+	}
+	if cfg.RecoveryTicks == 0 {
+		cfg.RecoveryTicks = defaultRecoveryTicks
+	}
+	s := &Simulator{
+		cfg:  cfg,
+		rand: rand.New(rand.NewSource(cfg.Seed)),
+		// scheduling decisions are drawn from their own source so they don't
+		// change the fault schedule
+		sched: rand.New(rand.NewSource(^cfg.Seed)),
+		hosts: make([]*host, cfg.NodeHosts),
+	}
+	s.net = newNetwork(cfg.Seed, cfg.DropRate, &s.tick)
+	id := atomic.AddUint64(&simulatorID, 1)
+	for idx := range s.hosts {
+		h := &host{
+			nhConfig: cfg.NodeHostConfig,
+			fs:       vfs.NewMemFS().(*vfs.MemFS),
+			clock:    &clock{seed: cfg.Seed + int64(idx)},
+		}
+		h.nhConfig.RaftAddress = fmt.Sprintf("simulation-%d-%d", id, idx)
+		h.nhConfig.NodeHostDir = nodeHostDir
+		h.nhConfig.WALDir = ""
+		h.nhConfig.Expert.FS = h.fs
+		h.nhConfig.Expert.Clock = h.clock
+		h.nhConfig.Expert.TransportFactory = &transportFactory{net: s.net}
+		s.net.addHost(h.nhConfig.RaftAddress, idx)
+		s.hosts[idx] = h
+	}
+	for idx := range s.hosts {
+		if err := s.start(idx); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Seed returns the seed of the Simulator.
+func (s *Simulator) Seed() int64 {
+	return s.cfg.Seed
+}
+
+// Now returns the current virtual time in ticks.
+func (s *Simulator) Now() uint64 {
+	return atomic.LoadUint64(&s.tick)
+}
+
+// Events returns all fault injection events so far.
+func (s *Simulator) Events() []Event {
+	return append([]Event{}, s.events...)
+}
+
+// Trace returns all Raft messages and snapshot chunks handled by the
+// simulated network so far.
+func (s *Simulator) Trace() []Delivery {
+	return s.net.getTrace()
+}
+
+// RaftAddress returns the RaftAddress of the specified NodeHost.
+func (s *Simulator) RaftAddress(idx int) string {
+	return s.hosts[idx].nhConfig.RaftAddress
+}
+
+// NodeHost returns the specified NodeHost instance, nil is returned when it
+// has crashed.
+func (s *Simulator) NodeHost(idx int) *dragonboat.NodeHost {
+	return s.hosts[idx].nh
+}
+
+// Tick advances the virtual time by one tick without injecting any new
+// faults. It returns once all running NodeHost instances have processed the
+// tick and all messages exchanged between them.
+func (s *Simulator) Tick() {
+	atomic.AddUint64(&s.tick, 1)
+	for _, idx := range s.sched.Perm(len(s.hosts)) {
+		if d := s.hosts[idx].clock.driver; d != nil {
+			d.Tick()
+		}
+	}
+	s.settle()
+}
+
+// settle runs all NodeHost instances and delivers messages held by the
+// network until there is no pending work left.
+func (s *Simulator) settle() {
+	for i := 0; i < maxSettleRounds; i++ {
+		busy := false
+		for _, idx := range s.sched.Perm(len(s.hosts)) {
+			if d := s.hosts[idx].clock.driver; d != nil && d.Run() {
+				busy = true
+			}
+		}
+		if s.net.deliver(s.sched) {
+			busy = true
+		}
+		if !busy {
+			return
+		}
+	}
+	plog.Warningf("seed %d, tick %d, not settled after %d rounds",
+		s.cfg.Seed, s.Now(), maxSettleRounds)
+}
+
+// Step injects faults based on the seed and advances the virtual time by one
+// tick.
+func (s *Simulator) Step() error {
+	if err := s.injectFaults(); err != nil {
+		return err
+	}
+	s.Tick()
+	return nil
+}
+
+// Run calls Step for the specified number of ticks.
+func (s *Simulator) Run(ticks uint64) error {
+	for i := uint64(0); i < ticks; i++ {
+		if err := s.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wait calls Step until the request tracked by rs completes or until maxTicks
+// ticks have elapsed, in which case dragonboat.ErrTimeout is returned.
+func (s *Simulator) Wait(rs *dragonboat.RequestState,
+	maxTicks uint64) (dragonboat.RequestResult, error) {
+	for i := uint64(0); ; i++ {
+		select {
+		case result := <-rs.ResultC():
+			return result, nil
+		default:
+		}
+		if i >= maxTicks {
+			return dragonboat.RequestResult{}, dragonboat.ErrTimeout
+		}
+		if err := s.Step(); err != nil {
+			return dragonboat.RequestResult{}, err
+		}
+	}
+}
+
+// Partition partitions the network, NodeHost instances in the same group
+// can communicate with each other. NodeHost instances not included in any
+// group form a group of their own.
+func (s *Simulator) Partition(groups ...[]int) {
+	partitions := make(map[string]int)
+	for gid, group := range groups {
+		for _, idx := range group {
+			partitions[s.RaftAddress(idx)] = gid + 1
+		}
+	}
+	s.net.partition(partitions)
+	s.partitioned = true
+	s.healAt = s.Now() + s.cfg.RecoveryTicks
+	var affected []int
+	for _, group := range groups {
+		affected = append(affected, group...)
+	}
+	s.record(Partitioned, affected)
+}
+
+// Heal heals the network partition.
+func (s *Simulator) Heal() {
+	s.net.heal()
+	s.partitioned = false
+	s.record(Healed, nil)
+}
+
+// Crash crashes the specified NodeHost. Data not synced to its filesystem is
+// lost.
+func (s *Simulator) Crash(idx int) error {
+	h := s.hosts[idx]
+	if h.nh == nil {
+		return ErrCrashed
+	}
+	h.fs.SetIgnoreSyncs(true)
+	h.nh.Close()
+	h.nh = nil
+	h.fs.ResetToSyncedState()
+	h.fs.SetIgnoreSyncs(false)
+	h.restartAt = s.Now() + s.cfg.RecoveryTicks
+	s.record(Crashed, []int{idx})
+	return nil
+}
+
+// Restart restarts the specified crashed NodeHost.
+func (s *Simulator) Restart(idx int) error {
+	if s.hosts[idx].nh != nil {
+		return ErrRunning
+	}
+	if err := s.start(idx); err != nil {
+		return err
+	}
+	s.record(Restarted, []int{idx})
+	return nil
+}
+
+// Close stops all running NodeHost instances.
+func (s *Simulator) Close() {
+	for _, h := range s.hosts {
+		if h.nh != nil {
+			h.nh.Close()
+			h.nh = nil
+		}
+	}
+}
+
+func (s *Simulator) start(idx int) error {
+	h := s.hosts[idx]
+	nh, err := dragonboat.NewNodeHost(h.nhConfig)
+	if err != nil {
+		return err
+	}
+	h.nh = nh
+	return s.cfg.OnStart(s, idx)
+}
+
+func (s *Simulator) record(t EventType, nodeHosts []int) {
+	e := Event{Tick: s.Now(), Type: t, NodeHosts: nodeHosts}
+	plog.Infof("seed %d, %s", s.cfg.Seed, e)
+	s.events = append(s.events, e)
+}
+
+// injectFaults makes all random decisions of the Simulator. The number of
+// values drawn from the random source only depends on the seed, so the same
+// seed always results in the same fault schedule.
+func (s *Simulator) injectFaults() error {
+	now := s.Now()
+	if s.partitioned && now >= s.healAt {
+		s.Heal()
+	}
+	for idx, h := range s.hosts {
+		if h.nh == nil && now >= h.restartAt {
+			if err := s.Restart(idx); err != nil {
+				return err
+			}
+		}
+	}
+	n := len(s.hosts)
+	if s.rand.Float64() < s.cfg.PartitionRate && !s.partitioned && n > 1 {
+		perm := s.rand.Perm(n)
+		s.Partition(perm[:1+s.rand.Intn(n/2)])
+	}
+	if s.rand.Float64() < s.cfg.CrashRate {
+		var running []int
+		for idx, h := range s.hosts {
+			if h.nh != nil {
+				running = append(running, idx)
+			}
+		}
+		if len(running) > 1 {
+			if err := s.Crash(running[s.rand.Intn(len(running))]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulation
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+const (
+	testShardID = 1
+)
+
+type testCounter struct {
+	count uint64
+}
+
+func (c *testCounter) Update(e sm.Entry) (sm.Result, error) {
+	c.count++
+	return sm.Result{Value: c.count}, nil
+}
+
+func (c *testCounter) Lookup(query interface{}) (interface{}, error) {
+	return c.count, nil
+}
+
+func (c *testCounter) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	return binary.Write(w, binary.LittleEndian, c.count)
+}
+
+func (c *testCounter) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	return binary.Read(r, binary.LittleEndian, &c.count)
+}
+
+func (c *testCounter) Close() error { return nil }
+
+func startTestReplica(s *Simulator, idx int) error {
+	members := make(map[uint64]string)
+	for i := 0; i < 3; i++ {
+		members[uint64(i+1)] = s.RaftAddress(i)
+	}
+	rc := config.Config{
+		ShardID:      testShardID,
+		ReplicaID:    uint64(idx + 1),
+		ElectionRTT:  10,
+		HeartbeatRTT: 1,
+		CheckQuorum:  true,
+	}
+	return s.NodeHost(idx).StartReplica(members, false,
+		func(uint64, uint64) sm.IStateMachine { return &testCounter{} }, rc)
+}
+
+func newTestSimulator(t *testing.T, seed int64) *Simulator {
+	s, err := New(Config{
+		Seed:          seed,
+		NodeHosts:     3,
+		OnStart:       startTestReplica,
+		DropRate:      0.05,
+		PartitionRate: 0.01,
+		CrashRate:     0.005,
+		RecoveryTicks: 50,
+	})
+	if err != nil {
+		t.Fatalf("failed to create simulator %v", err)
+	}
+	return s
+}
+
+func TestConfigValidate(t *testing.T) {
+	onStart := func(*Simulator, int) error { return nil }
+	tests := []struct {
+		cfg Config
+		ok  bool
+	}{
+		{Config{NodeHosts: 3, OnStart: onStart}, true},
+		{Config{NodeHosts: 0, OnStart: onStart}, false},
+		{Config{NodeHosts: 3}, false},
+		{Config{NodeHosts: 3, OnStart: onStart, DropRate: 1.5}, false},
+		{Config{NodeHosts: 3, OnStart: onStart, CrashRate: -0.1}, false},
+	}
+	for idx, tt := range tests {
+		if err := tt.cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%d, unexpected result %v", idx, err)
+		}
+	}
+}
+
+func TestMessageDropIsDecidedBySeed(t *testing.T) {
+	tick := uint64(0)
+	n1 := newNetwork(1, 0.5, &tick)
+	n2 := newNetwork(1, 0.5, &tick)
+	dropped := 0
+	for i := uint64(0); i < 1000; i++ {
+		m := pb.Message{ShardID: 1, From: 1, To: 2, Type: pb.Replicate, LogIndex: i}
+		if n1.drop(m) != n2.drop(m) {
+			t.Fatalf("inconsistent drop decision")
+		}
+		if n1.drop(m) {
+			dropped++
+		}
+	}
+	if dropped < 400 || dropped > 600 {
+		t.Errorf("unexpected drop count %d", dropped)
+	}
+}
+
+func TestPartitionedMessagesAreDropped(t *testing.T) {
+	tick := uint64(0)
+	n := newNetwork(1, 0, &tick)
+	received := make(map[string]int)
+	for idx, addr := range []string{"a", "b", "c"} {
+		addr := addr
+		n.addHost(addr, idx)
+		tt := &transport{
+			net:  n,
+			addr: addr,
+			handler: func(batch pb.MessageBatch) {
+				received[addr] += len(batch.Requests)
+			},
+		}
+		if err := tt.Start(); err != nil {
+			t.Fatalf("failed to start transport %v", err)
+		}
+	}
+	batch := pb.MessageBatch{Requests: []pb.Message{{Type: pb.Heartbeat}}}
+	send := func(from string, to string) {
+		n.send(envelope{from: from, to: to, batch: batch})
+		n.deliver(rand.New(rand.NewSource(1)))
+	}
+	n.partition(map[string]int{"a": 1})
+	send("a", "b")
+	if received["b"] != 0 {
+		t.Errorf("message delivered across partition")
+	}
+	send("b", "c")
+	if received["c"] != 1 {
+		t.Errorf("message not delivered")
+	}
+	n.heal()
+	send("a", "b")
+	if received["b"] != 1 {
+		t.Errorf("message not delivered after heal")
+	}
+	trace := n.getTrace()
+	if len(trace) != 3 || !trace[0].Dropped || trace[1].Dropped {
+		t.Errorf("unexpected trace %v", trace)
+	}
+}
+
+func TestStreamsAreDeliveredInOrder(t *testing.T) {
+	tick := uint64(0)
+	n := newNetwork(1, 0, &tick)
+	var received []uint64
+	for idx, addr := range []string{"a", "b", "c"} {
+		n.addHost(addr, idx)
+		tt := &transport{
+			net:  n,
+			addr: addr,
+			handler: func(batch pb.MessageBatch) {
+				received = append(received, batch.Requests[0].LogIndex)
+			},
+		}
+		if err := tt.Start(); err != nil {
+			t.Fatalf("failed to start transport %v", err)
+		}
+	}
+	for i := uint64(1); i <= 100; i++ {
+		for _, from := range []string{"a", "b"} {
+			m := pb.Message{ShardID: 1, Type: pb.Replicate, LogIndex: i}
+			n.send(envelope{from: from, to: "c",
+				batch: pb.MessageBatch{Requests: []pb.Message{m}}})
+		}
+	}
+	n.deliver(rand.New(rand.NewSource(1)))
+	if len(received) != 200 {
+		t.Fatalf("unexpected count %d", len(received))
+	}
+	interleaved := false
+	last := make(map[int]uint64)
+	counts := make(map[uint64]int)
+	for idx, v := range received {
+		counts[v]++
+		// each value is received once from a and once from b, the first one
+		// received is always from the stream that is ahead
+		if idx > 0 && received[idx-1] > v {
+			interleaved = true
+		}
+		last[counts[v]] = v
+	}
+	if !interleaved {
+		t.Errorf("streams not interleaved")
+	}
+	if last[1] != 100 || last[2] != 100 {
+		t.Errorf("unexpected order %v", received)
+	}
+}
+
+func TestSameSeedReplaysFaultSchedule(t *testing.T) {
+	var events [][]Event
+	for i := 0; i < 2; i++ {
+		s := newTestSimulator(t, 42)
+		if err := s.Run(300); err != nil {
+			t.Fatalf("run failed %v", err)
+		}
+		events = append(events, s.Events())
+		s.Close()
+	}
+	if len(events[0]) == 0 {
+		t.Fatalf("no fault injected")
+	}
+	if !reflect.DeepEqual(events[0], events[1]) {
+		t.Errorf("fault schedule changed, %v vs %v", events[0], events[1])
+	}
+}
+
+func runTestWorkload(t *testing.T, seed int64) ([]Event, []Delivery) {
+	s := newTestSimulator(t, seed)
+	defer s.Close()
+	for i := 0; i < 300; i++ {
+		if nh := s.NodeHost(i % 3); nh != nil && i%10 == 0 {
+			rs, err := nh.Propose(nh.GetNoOPSession(testShardID),
+				[]byte("inc"), 50*time.Millisecond)
+			if err == nil {
+				rs.Release()
+			}
+		}
+		if err := s.Step(); err != nil {
+			t.Fatalf("step failed %v", err)
+		}
+	}
+	return s.Events(), s.Trace()
+}
+
+func TestSameSeedReplaysTrace(t *testing.T) {
+	events1, trace1 := runTestWorkload(t, 7)
+	events2, trace2 := runTestWorkload(t, 7)
+	if len(trace1) == 0 {
+		t.Fatalf("no message exchanged")
+	}
+	replicated := false
+	for _, d := range trace1 {
+		if d.Type == pb.Replicate && d.Entries > 0 && !d.Dropped {
+			replicated = true
+		}
+	}
+	if !replicated {
+		t.Errorf("no entry replicated")
+	}
+	if !reflect.DeepEqual(events1, events2) {
+		t.Errorf("fault schedule changed, %v vs %v", events1, events2)
+	}
+	if len(trace1) != len(trace2) {
+		t.Fatalf("trace length changed, %d vs %d", len(trace1), len(trace2))
+	}
+	for i := range trace1 {
+		if trace1[i] != trace2[i] {
+			t.Fatalf("trace diverged at %d, %+v vs %+v", i, trace1[i], trace2[i])
+		}
+	}
+	_, trace3 := runTestWorkload(t, 8)
+	if reflect.DeepEqual(trace1, trace3) {
+		t.Errorf("different seeds produced the same trace")
+	}
+}
+
+func waitForTestLeader(t *testing.T, s *Simulator, maxTicks uint64) {
+	for i := uint64(0); i < maxTicks; i++ {
+		for idx := 0; idx < 3; idx++ {
+			if nh := s.NodeHost(idx); nh != nil {
+				if _, _, ok, err := nh.GetLeaderID(testShardID); err == nil && ok {
+					return
+				}
+			}
+		}
+		if err := s.Step(); err != nil {
+			t.Fatalf("step failed %v", err)
+		}
+	}
+	t.Fatalf("no leader elected")
+}
+
+func TestProposalsCanBeMadeInSimulation(t *testing.T) {
+	s := newTestSimulator(t, 1)
+	defer s.Close()
+	waitForTestLeader(t, s, 1000)
+	// RTTMillisecond is 1, the timeout below is 100 ticks
+	timeout := 100 * time.Millisecond
+	completed := 0
+	for i := 0; i < 10; i++ {
+		nh := s.NodeHost(i % 3)
+		if nh == nil {
+			if err := s.Step(); err != nil {
+				t.Fatalf("step failed %v", err)
+			}
+			continue
+		}
+		rs, err := nh.Propose(nh.GetNoOPSession(testShardID), []byte("inc"), timeout)
+		if err != nil {
+			if err := s.Step(); err != nil {
+				t.Fatalf("step failed %v", err)
+			}
+			continue
+		}
+		result, err := s.Wait(rs, 200)
+		if err == nil && result.Completed() {
+			completed++
+		}
+		rs.Release()
+	}
+	if completed == 0 {
+		t.Errorf("no proposal completed")
+	}
+}
@@ -62,6 +62,12 @@ func (sr *snapshotTask) getTask() (rsm.Task, bool) {
 	return sr.t, hasTask
 }
 
+func (sr *snapshotTask) has() bool {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	return sr.hasTask
+}
+
 type snapshotState struct {
 	snapshotIndex    uint64
 	reqSnapshotIndex uint64
@@ -214,6 +220,21 @@ func (rs *snapshotState) notifySnapshotStatus(save bool,
 	}
 }
 
+// inProgress returns a boolean value indicating whether there is any
+// requested snapshot operation not completed yet.
+func (rs *snapshotState) inProgress() bool {
+	return (rs.saving() && !rs.saveCompleted.has()) ||
+		(rs.recovering() && !rs.recoverCompleted.has()) ||
+		(rs.streaming() && !rs.streamCompleted.has())
+}
+
+// hasCompleted returns a boolean value indicating whether there is any
+// completed snapshot operation not processed yet.
+func (rs *snapshotState) hasCompleted() bool {
+	return rs.saveCompleted.has() ||
+		rs.recoverCompleted.has() || rs.streamCompleted.has()
+}
+
 func (rs *snapshotState) getStreamCompleted() (rsm.Task, bool) {
 	return rs.streamCompleted.getTask()
 }
@@ -207,6 +207,57 @@ func TestSnapshotCanBeSavedToLogDB(t *testing.T) {
 	runSnapshotterTest(t, fn, fs)
 }
 
+func createTestSnapshotData(t *testing.T, s *snapshotter, fs vfs.IFS, index uint64) {
+	env := s.getEnv(index)
+	if err := env.CreateTempDir(); err != nil {
+		t.Fatalf("create tmp snapshot dir failed %v", err)
+	}
+	f, err := fs.Create(fs.PathJoin(env.GetTempDir(), "test.data"))
+	if err != nil {
+		t.Fatalf("failed to create test file %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(make([]byte, 12)); err != nil {
+		t.Fatalf("write failed %v", err)
+	}
+}
+
+func TestSnapshotCommitFailureIsRecoverable(t *testing.T) {
+	fs := vfs.NewFaultFS(vfs.GetTestFS())
+	fn := func(t *testing.T, ldb raftio.ILogDB, s *snapshotter) {
+		ss := pb.Snapshot{Filepath: "f2", Index: 100, Term: 200}
+		env := s.getEnv(ss.Index)
+		createTestSnapshotData(t, s, fs, ss.Index)
+		// fails to sync the snapshot metadata in the temp dir
+		fs.Inject("sync", vfs.Fault{
+			Op:    vfs.OpSync,
+			Path:  tmpSnapshotDirSuffix,
+			Err:   vfs.ErrInjected,
+			Times: 1,
+		})
+		if err := s.Commit(ss, rsm.SSRequest{}); !errors.Is(err, vfs.ErrInjected) {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if _, err := s.GetSnapshotFromLogDB(); !errors.Is(err, ErrNoSnapshot) {
+			t.Errorf("unexpected snapshot record, %v", err)
+		}
+		if err := s.processOrphans(); err != nil {
+			t.Fatalf("failed to process orphans %v", err)
+		}
+		if _, err := fs.Stat(env.GetTempDir()); !vfs.IsNotExist(err) {
+			t.Errorf("tmp dir not removed, %v", err)
+		}
+		createTestSnapshotData(t, s, fs, ss.Index)
+		if err := s.Commit(ss, rsm.SSRequest{}); err != nil {
+			t.Fatalf("failed to commit snapshot %v", err)
+		}
+		if rs, err := s.GetSnapshotFromLogDB(); err != nil || rs.Index != ss.Index {
+			t.Errorf("unexpected snapshot record %v, %v", rs, err)
+		}
+	}
+	runSnapshotterTest(t, fn, fs)
+}
+
 func TestZombieSnapshotDirsCanBeRemoved(t *testing.T) {
 	fs := vfs.GetTestFS()
 	fn := func(t *testing.T, ldb raftio.ILogDB, s *snapshotter) {
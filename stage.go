@@ -0,0 +1,408 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lni/goutils/syncutil"
+)
+
+const (
+	adaptiveInterval = time.Second
+	// workers are added when the average time between a worker being notified
+	// and the worker picking up the work is longer than growLatency or when
+	// workers are busy for more than growUtilization of the time
+	growLatency     = 2 * time.Millisecond
+	growUtilization = 0.75
+	// workers are removed when they are mostly idle
+	shrinkUtilization = 0.2
+	// no worker is added when the CPU is already saturated
+	maxCPUUtilization = 0.9
+)
+
+// stageLayout is the assignment of shards to workers of a stage. A new layout
+// is created each time the stage is resized.
+type stageLayout struct {
+	work  *workReady
+	cci   *workReady
+	count uint64
+	epoch uint64
+	// active tracks passes of workers accessing their nodes in this layout
+	active sync.WaitGroup
+	// prev is the layout replaced by this one, it is reset once all passes
+	// made in prev have completed
+	prev *stageLayout
+}
+
+// workerStage is a group of step, commit or apply workers sharing the same
+// workReady instances, the number of workers in the group can be changed at
+// runtime.
+//
+// Resizing the stage swaps in a new layout with mu held for a short time
+// only. Passes of workers in the new layout wait for all passes made in the
+// previous layout to complete, so shards are only migrated between workers of
+// the stage when none of those workers is accessing its nodes in the previous
+// layout. Workers of other stages are not affected.
+type workerStage struct {
+	mu            sync.Mutex
+	layout        atomic.Value
+	priorities    *shardPriorities
+	stopper       *syncutil.Stopper
+	main          func(workerID uint64, instanceID uint64, quitC chan struct{})
+	quitC         []chan struct{}
+	priorityCount uint64
+	// instances is the number of workers ever launched, it is used for
+	// assigning unique instance IDs to workers as worker IDs are reused after
+	// the stage is shrunk and grown again
+	instances uint64
+	timed     bool
+	stopped   bool
+	// stats reset by the adaptive controller
+	busy    int64
+	latency int64
+	wakeups int64
+}
+
+func newWorkerStage(count uint64, priorityCount uint64,
+	priorities *shardPriorities, timed bool) *workerStage {
+	s := &workerStage{
+		priorities:    priorities,
+		stopper:       syncutil.NewStopper(),
+		priorityCount: priorityCount,
+		timed:         timed,
+	}
+	s.layout.Store(s.newLayout(count, 0, nil))
+	return s
+}
+
+func (s *workerStage) newLayout(count uint64,
+	epoch uint64, prev *stageLayout) *stageLayout {
+	return &stageLayout{
+		work:  s.newWorkReady(count),
+		cci:   s.newWorkReady(count),
+		count: count,
+		epoch: epoch,
+		prev:  prev,
+	}
+}
+
+func (s *workerStage) currentLayout() *stageLayout {
+	return s.layout.Load().(*stageLayout)
+}
+
+func (s *workerStage) newWorkReady(count uint64) *workReady {
+	wr := newPriorityWorkReady(count, s.priorityCount, s.priorities)
+	if s.timed {
+		wr.notified = make([]int64, len(wr.channels))
+	}
+	return wr
+}
+
+func (s *workerStage) workReady() *workReady {
+	return s.currentLayout().work
+}
+
+func (s *workerStage) cciReady() *workReady {
+	return s.currentLayout().cci
+}
+
+// ready returns IDs of all shards marked as ready on the stage in ascending
+// order, it is used when the stage is driven by a clock rather than by its
+// workers.
+func (s *workerStage) ready() []uint64 {
+	wr := s.workReady()
+	result := make([]uint64, 0)
+	for workerID := uint64(1); workerID <= wr.count; workerID++ {
+		for cid := range wr.getReadyMap(workerID) {
+			result = append(result, cid)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// start launches workers using the specified main function.
+func (s *workerStage) start(main func(workerID uint64,
+	instanceID uint64, quitC chan struct{})) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.main = main
+	s.launch(s.currentLayout().count + s.priorityCount)
+}
+
+func (s *workerStage) launch(total uint64) {
+	for uint64(len(s.quitC)) > total {
+		last := len(s.quitC) - 1
+		close(s.quitC[last])
+		s.quitC = s.quitC[:last]
+	}
+	for uint64(len(s.quitC)) < total {
+		quitC := make(chan struct{})
+		s.quitC = append(s.quitC, quitC)
+		workerID := uint64(len(s.quitC))
+		s.instances++
+		instanceID := s.instances
+		s.stopper.RunWorker(func() {
+			s.main(workerID, instanceID, quitC)
+		})
+	}
+}
+
+func (s *workerStage) stop() {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+	s.stopper.Stop()
+}
+
+func (s *workerStage) shouldStop() chan struct{} {
+	return s.stopper.ShouldStop()
+}
+
+// size returns the number of workers used by normal priority shards.
+func (s *workerStage) size() uint64 {
+	return s.currentLayout().count
+}
+
+// resize changes the number of workers used by normal priority shards. All
+// shards are reassigned to workers based on the new number of workers.
+func (s *workerStage) resize(count uint64) {
+	if count == 0 {
+		panic("resizing to 0 worker")
+	}
+	s.mu.Lock()
+	prev := s.currentLayout()
+	if s.stopped || count == prev.count {
+		s.mu.Unlock()
+		return
+	}
+	l := s.newLayout(count, prev.epoch+1, prev)
+	s.layout.Store(l)
+	if s.main != nil {
+		s.launch(count + s.priorityCount)
+	}
+	s.mu.Unlock()
+	// wake up those workers still waiting on channels of the previous layout,
+	// they all reload their nodes before accessing them again
+	prev.work.notifyAll()
+	prev.cci.notifyAll()
+	l.work.notifyAll()
+}
+
+// enter is called by workers before accessing their nodes, it returns nil
+// when the worker has been removed from the stage. Otherwise it returns the
+// current layout which is to be used by the worker until it calls exit. The
+// returned resized flag indicates that the stage has been resized since the
+// worker last entered, the worker is required to reload all its nodes and
+// check them all as ready notifications made to the previous layout are lost.
+func (s *workerStage) enter(quitC chan struct{},
+	epoch *uint64) (l *stageLayout, resized bool) {
+	s.mu.Lock()
+	select {
+	case <-quitC:
+		s.mu.Unlock()
+		return nil, false
+	default:
+	}
+	l = s.currentLayout()
+	l.active.Add(1)
+	prev := l.prev
+	s.mu.Unlock()
+	if prev != nil {
+		prev.active.Wait()
+		s.mu.Lock()
+		if l.prev == prev {
+			l.prev = nil
+		}
+		s.mu.Unlock()
+	}
+	if *epoch != l.epoch {
+		*epoch = l.epoch
+		return l, true
+	}
+	return l, false
+}
+
+// exit is called by workers once they stop accessing their nodes.
+func (s *workerStage) exit(l *stageLayout, start time.Time) {
+	if s.timed {
+		atomic.AddInt64(&s.busy, int64(time.Since(start)))
+	}
+	l.active.Done()
+}
+
+// woken is called by workers when they are notified for ready nodes.
+func (s *workerStage) woken(wr *workReady, workerID uint64) {
+	if s.timed {
+		if l := wr.waited(workerID); l > 0 {
+			atomic.AddInt64(&s.latency, int64(l))
+			atomic.AddInt64(&s.wakeups, 1)
+		}
+	}
+}
+
+// stageStats is the load observed on a stage over an adaptive interval.
+type stageStats struct {
+	utilization float64
+	latency     time.Duration
+}
+
+func (s *workerStage) getStats(interval time.Duration) stageStats {
+	busy := atomic.SwapInt64(&s.busy, 0)
+	latency := atomic.SwapInt64(&s.latency, 0)
+	wakeups := atomic.SwapInt64(&s.wakeups, 0)
+	workers := s.size() + s.priorityCount
+	st := stageStats{
+		utilization: float64(busy) / float64(int64(interval)*int64(workers)),
+	}
+	if wakeups > 0 {
+		st.latency = time.Duration(latency / wakeups)
+	}
+	return st
+}
+
+// adaptiveSize returns the number of workers to be used by the stage based on
+// its recent load and the CPU utilization of the process.
+func adaptiveSize(current uint64, min uint64, max uint64,
+	st stageStats, cpu float64) uint64 {
+	if (st.latency > growLatency || st.utilization > growUtilization) &&
+		cpu < maxCPUUtilization && current < max {
+		return current + 1
+	}
+	if st.latency < growLatency/2 && st.utilization < shrinkUtilization &&
+		current > min {
+		return current - 1
+	}
+	return current
+}
+
+// poolSize is the requested size of a snapshot or close worker pool. Those
+// pools are resized by their own pool goroutines, poolSize is used for
+// passing the requested size to them and for collecting their load.
+type poolSize struct {
+	size    uint64
+	resizeC chan struct{}
+	// stats reset by the adaptive controller
+	starved int32
+	peak    int64
+}
+
+func newPoolSize(size uint64) *poolSize {
+	return &poolSize{
+		size:    size,
+		resizeC: make(chan struct{}, 1),
+	}
+}
+
+func (p *poolSize) get() uint64 {
+	return atomic.LoadUint64(&p.size)
+}
+
+func (p *poolSize) set(size uint64) {
+	if size == 0 {
+		panic("resizing to 0 worker")
+	}
+	atomic.StoreUint64(&p.size, size)
+	select {
+	case p.resizeC <- struct{}{}:
+	default:
+	}
+}
+
+// starve is called when pending jobs can not be scheduled as all workers are
+// busy.
+func (p *poolSize) starve() {
+	atomic.StoreInt32(&p.starved, 1)
+}
+
+// observe records the number of busy workers of the pool.
+func (p *poolSize) observe(busy int) {
+	for {
+		peak := atomic.LoadInt64(&p.peak)
+		if int64(busy) <= peak ||
+			atomic.CompareAndSwapInt64(&p.peak, peak, int64(busy)) {
+			return
+		}
+	}
+}
+
+// getStats returns whether the pool has been starved and the max number of
+// busy workers since the last call.
+func (p *poolSize) getStats() (bool, uint64) {
+	starved := atomic.SwapInt32(&p.starved, 0) == 1
+	peak := atomic.SwapInt64(&p.peak, 0)
+	return starved, uint64(peak)
+}
+
+// adaptivePoolSize returns the number of workers to be used by a snapshot or
+// close worker pool based on its recent load and the CPU utilization of the
+// process.
+func adaptivePoolSize(current uint64, min uint64, max uint64,
+	starved bool, peak uint64, cpu float64) uint64 {
+	if starved && cpu < maxCPUUtilization && current < max {
+		return current + 1
+	}
+	if !starved && float64(peak) < float64(current)*shrinkUtilization &&
+		current > min {
+		return current - 1
+	}
+	return current
+}
+
+// cpuSampler reports the CPU utilization of the process based on the CPU
+// time reported by the OS. The runtime/metrics package only provides CPU
+// metrics since Go 1.20, getrusage(2) is used instead so the same figure is
+// available on all supported Go versions.
+type cpuSampler struct {
+	read func() (time.Duration, bool)
+	last time.Duration
+	at   time.Time
+}
+
+func newCPUSampler() *cpuSampler {
+	return newCPUSamplerWith(processCPUTime)
+}
+
+func newCPUSamplerWith(read func() (time.Duration, bool)) *cpuSampler {
+	c := &cpuSampler{
+		read: read,
+		at:   time.Now(),
+	}
+	c.last, _ = c.read()
+	return c
+}
+
+// utilization returns the CPU utilization since the last call, it returns 0
+// on platforms where the CPU time of the process is not available, workers
+// are then added based on their observed latency and utilization only.
+func (c *cpuSampler) utilization() float64 {
+	now := time.Now()
+	v, ok := c.read()
+	if !ok {
+		return 0
+	}
+	elapsed := now.Sub(c.at).Seconds() * float64(runtime.GOMAXPROCS(0))
+	used := (v - c.last).Seconds()
+	c.last, c.at = v, now
+	if elapsed <= 0 {
+		return 0
+	}
+	return used / elapsed
+}
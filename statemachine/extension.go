@@ -49,3 +49,92 @@ type IExtended interface {
 	// state.
 	NALookup([]byte) ([]byte, error)
 }
+
+// ITransactional is an optional interface to be implemented by a user state
+// machine type when it participates in multi-shard transactions coordinated by
+// the txn package.
+//
+// Transactions are driven by the two-phase commit protocol. In the first phase,
+// Prepare is invoked with all commands of the transaction that belong to the
+// shard. The state machine is expected to validate the commands and record them
+// as intents, keys touched by such intents are usually locked so conflicting
+// updates or transactions are rejected. In the second phase, either Commit or
+// Abort is invoked to apply or discard the recorded intents.
+//
+// All three methods are invoked from the Update method of the state machine as
+// a part of the regular apply process. They are thus required to be
+// deterministic and their effects, including recorded intents, must be
+// included in snapshots. All three methods can be invoked more than once for
+// the same transaction, repeated calls should have no further side effect and
+// repeated Prepare calls should return the same vote. Commit and Abort can
+// also be invoked for transactions never prepared by the state machine, such
+// calls should be treated as no-op.
+type ITransactional interface {
+	// Prepare records the specified commands as the intents of the specified
+	// transaction. It returns a boolean flag indicating whether the state
+	// machine votes to commit the transaction. Returned error is considered as
+	// fatal, it should not be used for rejecting the transaction.
+	Prepare(txnID string, cmds [][]byte) (bool, error)
+	// Commit applies intents recorded for the specified transaction.
+	Commit(txnID string) error
+	// Abort discards intents recorded for the specified transaction.
+	Abort(txnID string) error
+}
+
+// IParallelUpdater is an optional interface to be implemented by an
+// IConcurrentStateMachine or IOnDiskStateMachine type to allow committed
+// entries that don't conflict with each other to be applied in parallel.
+//
+// Conflict keys of an entry are specified when it is proposed using the
+// ProposeWithKeys method of NodeHost, entries sharing at least one conflict
+// key are considered as conflicting. When applying a batch of committed
+// entries proposed using the NoOPSession, non-conflicting entries are split
+// into groups passed to concurrent ParallelUpdate calls, conflicting entries
+// are always passed to the same call in their Raft log order. Entries proposed
+// without conflict keys are considered as conflicting with all other entries,
+// they are applied using the Update method.
+type IParallelUpdater interface {
+	// ParallelUpdate is similar to the Update method of the state machine, but
+	// it can be concurrently invoked from multiple goroutines, each with a
+	// different group of entries from the same batch. Entries in concurrent
+	// ParallelUpdate calls never share any conflict key, it is thus up to the
+	// user state machine to make sure that updates touching different conflict
+	// keys can be applied concurrently and in any order.
+	//
+	// ParallelUpdate is invoked with the same mutual exclusion protection as
+	// the Update method from other methods of the state machine. It returns the
+	// input entry slice with the Result field of all its members set.
+	ParallelUpdate([]Entry) ([]Entry, error)
+}
+
+// IChunkedUpdater is an optional interface to be implemented by a state machine
+// type to have large proposals split into multiple Raft log entries, see the
+// ProposalChunkSize field of config.Config, applied chunk by chunk rather than
+// being reassembled in memory first.
+//
+// Only proposals made using the NoOPSession without conflict keys or entry
+// compression are applied chunk by chunk, all other chunked proposals are
+// reassembled in memory and applied using the Update method.
+type IChunkedUpdater interface {
+	// UpdateChunk applies a chunk of a chunked proposal. Chunks of the same
+	// proposal are passed to UpdateChunk in order, the Cmd field of the entry is
+	// the payload of the chunk, offset is its position in the proposal payload
+	// and size is the total size of the proposal payload. The Index field of the
+	// entry is the index of the Raft log entry of the chunk.
+	//
+	// The proposal is considered as applied once its last chunk, i.e. the one
+	// with offset+len(Cmd) == size, has been applied, the returned Result is
+	// ignored for all other chunks. An IOnDiskStateMachine should thus only
+	// record the index of the last chunk as its applied index. A chunk with
+	// offset 0 starts a new proposal, chunks applied since the last chunk of
+	// the previous proposal should be discarded.
+	//
+	// UpdateChunk is invoked with the same mutual exclusion protection as the
+	// Update method from other methods of the state machine.
+	UpdateChunk(entry Entry, offset uint64, size uint64) (Result, error)
+	// AbortChunked discards all chunks applied since the last chunk of the
+	// previous proposal. It is invoked when the remaining chunks of the
+	// proposal are never going to be applied, e.g. they have been lost during a
+	// leader change.
+	AbortChunked() error
+}
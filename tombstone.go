@@ -0,0 +1,328 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dragonboat
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/registry"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/settings"
+	"github.com/lni/dragonboat/v4/raftio"
+)
+
+var (
+	orphanCheckInterval = time.Duration(settings.Soft.OrphanCheckIntervalSecond) * time.Second
+	// defaultTombstoneRetention is the amount of time tombstones are kept when
+	// the TombstoneRetention field of NodeHostConfig is not set.
+	defaultTombstoneRetention = 7 * 24 * time.Hour
+	// tombstoneGossipDelay is the max amount of time expected for a tombstone
+	// to be gossiped to all NodeHost instances.
+	tombstoneGossipDelay = time.Hour
+)
+
+// Tombstone is the record indicating that a Raft shard or one of its replicas
+// has been permanently removed. A Tombstone with its ReplicaID field set to 0
+// covers all replicas of the shard.
+type Tombstone = server.Tombstone
+
+// tombstones tracks known tombstones and the time when each orphaned replica
+// was first observed by the local NodeHost.
+type tombstones struct {
+	mu      sync.Mutex
+	list    []server.Tombstone
+	orphans map[raftio.NodeInfo]time.Time
+	// saveMu serializes updates of the persisted tombstone list
+	saveMu sync.Mutex
+}
+
+func (t *tombstones) get() []server.Tombstone {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := make([]server.Tombstone, len(t.list))
+	copy(result, t.list)
+	return result
+}
+
+// merge merges the update into known tombstones, tombstones created before
+// the specified unix time in nanoseconds are expired and removed. It returns
+// a boolean value indicating whether known tombstones have been changed.
+func (t *tombstones) merge(update []server.Tombstone, before int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var changed, pruned bool
+	update, _ = server.PruneTombstones(update, before)
+	t.list, changed = server.MergeTombstones(t.list, update)
+	t.list, pruned = server.PruneTombstones(t.list, before)
+	return changed || pruned
+}
+
+func (t *tombstones) covers(shardID uint64, replicaID uint64) (server.Tombstone, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, ts := range t.list {
+		if ts.Covers(shardID, replicaID) {
+			return ts, true
+		}
+	}
+	return server.Tombstone{}, false
+}
+
+// observe records the specified orphaned replicas and returns those that have
+// been continuously observed as orphaned for at least the specified delay.
+func (t *tombstones) observe(orphans []raftio.NodeInfo,
+	now time.Time, delay time.Duration) []raftio.NodeInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	seen := make(map[raftio.NodeInfo]time.Time, len(orphans))
+	result := make([]raftio.NodeInfo, 0)
+	for _, ni := range orphans {
+		since, ok := t.orphans[ni]
+		if !ok {
+			since = now
+		}
+		seen[ni] = since
+		if delay > 0 && now.Sub(since) >= delay {
+			result = append(result, ni)
+		}
+	}
+	t.orphans = seen
+	return result
+}
+
+// DeleteShard permanently deletes the specified Raft shard. A tombstone for the
+// shard is recorded on the NodeHost and the local replica of the shard, if
+// any, is stopped. Data of the stopped replica is removed once it has been
+// orphaned for NodeHostConfig.OrphanCleanupDelay.
+//
+// When NodeHostConfig.AddressByNodeHostID is enabled, the tombstone is shared
+// with other NodeHost instances via gossip so all replicas of the shard are
+// eventually stopped and cleaned up. Otherwise, DeleteShard needs to be invoked
+// on each NodeHost that hosts a replica of the shard.
+//
+// Once deleted, the shard can no longer be started on the NodeHost and
+// ErrShardDeleted is returned when trying to do so. The tombstone expires after
+// NodeHostConfig.TombstoneRetention, the shard ID can be reused after that.
+func (nh *NodeHost) DeleteShard(shardID uint64) error {
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return ErrClosed
+	}
+	if err := nh.addTombstones([]server.Tombstone{{
+		ShardID:   shardID,
+		CreatedAt: time.Now().UnixNano(),
+	}}); err != nil {
+		return err
+	}
+	return nh.stopTombstoned()
+}
+
+// GetTombstones returns all tombstones known to the NodeHost.
+func (nh *NodeHost) GetTombstones() []Tombstone {
+	return nh.tombstones.get()
+}
+
+func (nh *NodeHost) checkTombstone(shardID uint64, replicaID uint64) error {
+	ts, ok := nh.tombstones.covers(shardID, replicaID)
+	if !ok {
+		return nil
+	}
+	if ts.IsShard() {
+		return ErrShardDeleted
+	}
+	return ErrReplicaRemoved
+}
+
+// tombstoneExpiry returns the unix time in nanoseconds before which created
+// tombstones are expired. Tombstones are kept long enough for all orphaned
+// replicas to be cleaned up before their tombstones expire.
+func (nh *NodeHost) tombstoneExpiry(now time.Time) int64 {
+	retention := nh.nhConfig.TombstoneRetention
+	if retention == 0 {
+		retention = defaultTombstoneRetention
+	}
+	if min := nh.nhConfig.OrphanCleanupDelay +
+		orphanCheckInterval + tombstoneGossipDelay; retention < min {
+		retention = min
+	}
+	return now.Add(-retention).UnixNano()
+}
+
+func (nh *NodeHost) loadTombstones() error {
+	did := nh.nhConfig.GetDeploymentID()
+	ts, err := nh.env.LoadTombstones(did)
+	if err != nil {
+		return err
+	}
+	nh.tombstones.merge(ts, nh.tombstoneExpiry(time.Now()))
+	if list := nh.tombstones.get(); len(list) != len(ts) {
+		return nh.env.SaveTombstones(did, list)
+	}
+	return nil
+}
+
+func (nh *NodeHost) addTombstones(update []server.Tombstone) error {
+	nh.tombstones.saveMu.Lock()
+	defer nh.tombstones.saveMu.Unlock()
+	before := nh.tombstoneExpiry(time.Now())
+	if !nh.tombstones.merge(update, before) {
+		return nil
+	}
+	list := nh.tombstones.get()
+	if err := nh.env.SaveTombstones(nh.nhConfig.GetDeploymentID(),
+		list); err != nil {
+		return err
+	}
+	if r, ok := nh.nodes.(*registry.GossipRegistry); ok {
+		r.PruneTombstones(before)
+		r.AddTombstones(list)
+	}
+	return nil
+}
+
+// replicaRemoved records a tombstone for the replica removed from the shard
+// membership. It is invoked by the local replica when applying the membership
+// change, errors are logged as the membership change has already been made.
+func (nh *NodeHost) replicaRemoved(shardID uint64, replicaID uint64) {
+	if err := nh.addTombstones([]Tombstone{{
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+		CreatedAt: time.Now().UnixNano(),
+	}}); err != nil {
+		plog.Errorf("failed to record tombstone for %s, %v",
+			dn(shardID, replicaID), err)
+	}
+}
+
+func (nh *NodeHost) shareTombstones() {
+	if r, ok := nh.nodes.(*registry.GossipRegistry); ok {
+		r.AddTombstones(nh.tombstones.get())
+	}
+}
+
+// syncTombstones pulls tombstones received by the gossip service, expired
+// tombstones are removed.
+func (nh *NodeHost) syncTombstones() error {
+	var update []server.Tombstone
+	if r, ok := nh.nodes.(*registry.GossipRegistry); ok {
+		r.PruneTombstones(nh.tombstoneExpiry(time.Now()))
+		update = r.GetTombstones()
+	}
+	return nh.addTombstones(update)
+}
+
+// stopTombstoned stops all local replicas covered by known tombstones.
+func (nh *NodeHost) stopTombstoned() error {
+	nodes := make([]raftio.NodeInfo, 0)
+	nh.forEachShard(func(shardID uint64, n *node) bool {
+		if _, ok := nh.tombstones.covers(shardID, n.replicaID); ok {
+			nodes = append(nodes, raftio.NodeInfo{
+				ShardID:   shardID,
+				ReplicaID: n.replicaID,
+			})
+		}
+		return true
+	})
+	for _, ni := range nodes {
+		plog.Infof("%s is stopping tombstoned replica %s",
+			nh.describe(), dn(ni.ShardID, ni.ReplicaID))
+		err := nh.stopNode(ni.ShardID, ni.ReplicaID, true)
+		if err != nil && !errors.Is(err, ErrShardNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// getOrphans returns replicas found in the specified Raft Log info that are
+// covered by tombstones and are no longer running on the NodeHost.
+func (nh *NodeHost) getOrphans(logInfo []raftio.NodeInfo) []raftio.NodeInfo {
+	result := make([]raftio.NodeInfo, 0)
+	for _, ni := range logInfo {
+		if _, ok := nh.tombstones.covers(ni.ShardID, ni.ReplicaID); !ok {
+			continue
+		}
+		if n, ok := nh.getShard(ni.ShardID); ok && n.replicaID == ni.ReplicaID {
+			continue
+		}
+		if nh.engine.nodeLoaded(ni.ShardID, ni.ReplicaID) {
+			continue
+		}
+		result = append(result, ni)
+	}
+	return result
+}
+
+func (nh *NodeHost) listNodeInfo() ([]raftio.NodeInfo, error) {
+	nh.mu.Lock()
+	defer nh.mu.Unlock()
+	if atomic.LoadInt32(&nh.closed) != 0 {
+		return nil, ErrClosed
+	}
+	return nh.mu.logdb.ListNodeInfo()
+}
+
+func (nh *NodeHost) cleanupOrphans() error {
+	if err := nh.syncTombstones(); err != nil {
+		return err
+	}
+	if err := nh.stopTombstoned(); err != nil {
+		return err
+	}
+	logInfo, err := nh.listNodeInfo()
+	if err != nil {
+		return err
+	}
+	orphans := nh.getOrphans(logInfo)
+	for _, ni := range orphans {
+		plog.Debugf("%s found orphaned replica %s",
+			nh.describe(), dn(ni.ShardID, ni.ReplicaID))
+	}
+	expired := nh.tombstones.observe(orphans,
+		time.Now(), nh.nhConfig.OrphanCleanupDelay)
+	for _, ni := range expired {
+		plog.Infof("%s is removing data of orphaned replica %s",
+			nh.describe(), dn(ni.ShardID, ni.ReplicaID))
+		if err := nh.RemoveData(ni.ShardID, ni.ReplicaID); err != nil {
+			if errors.Is(err, ErrShardNotStopped) {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (nh *NodeHost) orphanWorkerMain() {
+	ticker := time.NewTicker(orphanCheckInterval)
+	defer ticker.Stop()
+	for {
+		if err := nh.cleanupOrphans(); err != nil {
+			if errors.Is(err, ErrClosed) {
+				return
+			}
+			plog.Errorf("%s failed to cleanup orphaned replicas, %v",
+				nh.describe(), err)
+		}
+		select {
+		case <-ticker.C:
+		case <-nh.stopper.ShouldStop():
+			return
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+)
+
+// RestoreBackup restores replicas from the backup created by the Backup
+// method of NodeHost into the NodeHost described by nhConfig. Each replica is
+// restored by importing its exported snapshot in the same way as
+// ImportSnapshot, the NodeHost must be stopped when invoking RestoreBackup.
+//
+// The members map optionally specifies the new membership of shards keyed by
+// their ShardID values, the membership recorded in the backup is used for
+// shards not in members. For each shard, the replica to restore is the member
+// with its address matching the RaftAddress or the NodeHostID field of
+// nhConfig. Shards without such member are skipped. When the RaftAddress
+// recorded in the backup matches nhConfig.RaftAddress and the NodeHostID field
+// of nhConfig is not set, the NodeHostID recorded in the backup is restored as
+// well.
+//
+// To rebuild a single NodeHost, call RestoreBackup with the backup of that
+// NodeHost and the same nhConfig previously used by that NodeHost. To rebuild
+// a whole cluster from a single backup, call RestoreBackup on each host with
+// the same backup directory and members values.
+func RestoreBackup(nhConfig config.NodeHostConfig,
+	backupDir string, members map[uint64]map[uint64]string) (err error) {
+	if nhConfig.DeploymentID == 0 {
+		nhConfig.DeploymentID = unmanagedDeploymentID
+	}
+	if nhConfig.Expert.FS == nil {
+		nhConfig.Expert.FS = vfs.DefaultFS
+	}
+	if err := nhConfig.Prepare(); err != nil {
+		return err
+	}
+	fs := nhConfig.Expert.FS
+	m, err := server.LoadBackupManifest(backupDir, fs)
+	if err != nil {
+		return err
+	}
+	for shardID := range members {
+		if !hasBackupShard(m, shardID) {
+			return errors.Wrapf(ErrInvalidMembers,
+				"shard %d not found in backup", shardID)
+		}
+	}
+	if m.RaftAddress == nhConfig.RaftAddress && len(nhConfig.NodeHostID) == 0 {
+		nhConfig.NodeHostID = m.NodeHostID
+		if err := restoreNodeHostID(nhConfig); err != nil {
+			return err
+		}
+	}
+	restored := 0
+	for _, shard := range m.Shards {
+		memberNodes, ok := members[shard.ShardID]
+		if !ok {
+			memberNodes = shard.Members
+		}
+		replicaID, ok := getRestoredReplicaID(nhConfig, memberNodes)
+		if !ok {
+			plog.Infof("shard %d skipped, not a member", shard.ShardID)
+			continue
+		}
+		srcDir := fs.PathJoin(backupDir, shard.Dir)
+		if err := importSnapshot(nhConfig,
+			srcDir, memberNodes, replicaID); err != nil {
+			return errors.Wrapf(err, "failed to restore shard %d", shard.ShardID)
+		}
+		plog.Infof("shard %d replica %d restored from index %d",
+			shard.ShardID, replicaID, shard.Index)
+		restored++
+	}
+	if restored == 0 {
+		return errors.Wrapf(ErrInvalidMembers,
+			"%s is not a member of any shard", nhConfig.RaftAddress)
+	}
+	return nil
+}
+
+func hasBackupShard(m server.BackupManifest, shardID uint64) bool {
+	for _, shard := range m.Shards {
+		if shard.ShardID == shardID {
+			return true
+		}
+	}
+	return false
+}
+
+func getRestoredReplicaID(nhConfig config.NodeHostConfig,
+	memberNodes map[uint64]string) (uint64, bool) {
+	for replicaID, addr := range memberNodes {
+		if addr == nhConfig.RaftAddress ||
+			(len(nhConfig.NodeHostID) > 0 && addr == nhConfig.NodeHostID) {
+			return replicaID, true
+		}
+	}
+	return 0, false
+}
+
+func restoreNodeHostID(nhConfig config.NodeHostConfig) (err error) {
+	env, err := server.NewEnv(nhConfig, nhConfig.Expert.FS)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = firstError(err, env.Close())
+	}()
+	if _, _, err := env.CreateNodeHostDir(nhConfig.DeploymentID); err != nil {
+		return err
+	}
+	_, err = env.PrepareNodeHostID(nhConfig.NodeHostID)
+	return err
+}
@@ -0,0 +1,193 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/config"
+	chantrans "github.com/lni/dragonboat/v4/plugin/chan"
+	"github.com/lni/dragonboat/v4/plugin/tan"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+const (
+	logDBPebble   = "pebble"
+	logDBTan      = "tan"
+	transportTCP  = "tcp"
+	transportChan = "chan"
+)
+
+type dummyStateMachine struct{}
+
+func newDummyStateMachine(shardID uint64, replicaID uint64) sm.IStateMachine {
+	return &dummyStateMachine{}
+}
+
+func (s *dummyStateMachine) Lookup(query interface{}) (interface{}, error) {
+	return query, nil
+}
+
+func (s *dummyStateMachine) Update(e sm.Entry) (sm.Result, error) {
+	return sm.Result{Value: uint64(len(e.Cmd))}, nil
+}
+
+func (s *dummyStateMachine) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	_, err := w.Write(make([]byte, 4))
+	return err
+}
+
+func (s *dummyStateMachine) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	_, err := io.ReadFull(r, make([]byte, 4))
+	return err
+}
+
+func (s *dummyStateMachine) Close() error { return nil }
+
+type clusterConfig struct {
+	dataDir         string
+	basePort        int
+	nodehosts       int
+	shards          int
+	replicas        int
+	snapshotEntries uint64
+	logdb           string
+	transport       string
+}
+
+// cluster is a set of local NodeHosts with each shard having its replicas
+// placed on consecutive NodeHosts.
+type cluster struct {
+	cfg clusterConfig
+	nhs []*dragonboat.NodeHost
+	// leaders contains the NodeHost hosting the leader of each shard.
+	leaders []*dragonboat.NodeHost
+}
+
+func newCluster(cfg clusterConfig) (c *cluster, err error) {
+	if cfg.replicas > cfg.nodehosts {
+		return nil, errors.Newf("%d replicas per shard requires at least "+
+			"%d NodeHosts", cfg.replicas, cfg.replicas)
+	}
+	if err := os.RemoveAll(cfg.dataDir); err != nil {
+		return nil, err
+	}
+	c = &cluster{cfg: cfg}
+	defer func() {
+		if err != nil {
+			c.close()
+		}
+	}()
+	for i := 0; i < cfg.nodehosts; i++ {
+		nhc := config.NodeHostConfig{
+			NodeHostDir:    filepath.Join(cfg.dataDir, fmt.Sprintf("nh%d", i)),
+			RTTMillisecond: 200,
+			RaftAddress:    c.getAddress(i),
+			Expert:         config.GetDefaultExpertConfig(),
+		}
+		switch cfg.logdb {
+		case logDBPebble:
+		case logDBTan:
+			nhc.Expert.LogDBFactory = tan.Factory
+		default:
+			return nil, errors.Newf("unknown logdb %s", cfg.logdb)
+		}
+		switch cfg.transport {
+		case transportTCP:
+		case transportChan:
+			nhc.Expert.TransportFactory = &chantrans.ChanTransportFactory{}
+		default:
+			return nil, errors.Newf("unknown transport %s", cfg.transport)
+		}
+		nh, err := dragonboat.NewNodeHost(nhc)
+		if err != nil {
+			return nil, err
+		}
+		c.nhs = append(c.nhs, nh)
+	}
+	for shardID := uint64(1); shardID <= uint64(cfg.shards); shardID++ {
+		members := make(map[uint64]string)
+		for replicaID := uint64(1); replicaID <= uint64(cfg.replicas); replicaID++ {
+			members[replicaID] = c.getAddress(c.getNodeHost(shardID, replicaID))
+		}
+		for replicaID := range members {
+			rc := config.Config{
+				ShardID:         shardID,
+				ReplicaID:       replicaID,
+				ElectionRTT:     10,
+				HeartbeatRTT:    1,
+				CheckQuorum:     true,
+				SnapshotEntries: cfg.snapshotEntries,
+			}
+			nh := c.nhs[c.getNodeHost(shardID, replicaID)]
+			if err := nh.StartReplica(members,
+				false, newDummyStateMachine, rc); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := c.waitForLeaders(time.Minute); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *cluster) getAddress(idx int) string {
+	return fmt.Sprintf("localhost:%d", c.cfg.basePort+idx)
+}
+
+func (c *cluster) getNodeHost(shardID uint64, replicaID uint64) int {
+	return int(shardID+replicaID-2) % c.cfg.nodehosts
+}
+
+func (c *cluster) waitForLeaders(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for shardID := uint64(1); shardID <= uint64(c.cfg.shards); shardID++ {
+		nh := c.nhs[c.getNodeHost(shardID, 1)]
+		for {
+			leaderID, _, ok, err := nh.GetLeaderID(shardID)
+			if err != nil {
+				return err
+			}
+			if ok {
+				c.leaders = append(c.leaders, c.nhs[c.getNodeHost(shardID, leaderID)])
+				break
+			}
+			if time.Now().After(deadline) {
+				return errors.Newf("failed to elect leader for shard %d", shardID)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return nil
+}
+
+func (c *cluster) close() {
+	for _, nh := range c.nhs {
+		nh.Close()
+	}
+	if err := os.RemoveAll(c.cfg.dataDir); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math/bits"
+	"time"
+)
+
+const (
+	// each power of 2 range is split into subBucketCount sub buckets, recorded
+	// values are thus accurate to within 1/subBucketCount.
+	subBucketBits  = 6
+	subBucketCount = 1 << subBucketBits
+	bucketCount    = (64 - subBucketBits + 1) * subBucketCount
+)
+
+// histogram is a log-linear histogram of latencies in nanoseconds. It has a
+// fixed size regardless of the number of recorded values.
+type histogram struct {
+	counts []uint64
+	total  uint64
+	sum    int64
+	max    int64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, bucketCount)}
+}
+
+func getBucket(v int64) int {
+	if v < subBucketCount {
+		return int(v)
+	}
+	shift := bits.Len64(uint64(v)) - subBucketBits - 1
+	return (shift+1)*subBucketCount + int(v>>uint(shift)) - subBucketCount
+}
+
+// getBucketLimit returns the largest value of the specified bucket.
+func getBucketLimit(idx int) int64 {
+	if idx < subBucketCount {
+		return int64(idx)
+	}
+	shift := uint(idx/subBucketCount - 1)
+	sub := int64(idx%subBucketCount + subBucketCount)
+	return (sub+1)<<shift - 1
+}
+
+func (h *histogram) record(d time.Duration) {
+	v := int64(d)
+	if v < 0 {
+		v = 0
+	}
+	h.counts[getBucket(v)]++
+	h.total++
+	h.sum += v
+	if v > h.max {
+		h.max = v
+	}
+}
+
+func (h *histogram) merge(o *histogram) {
+	for idx, c := range o.counts {
+		h.counts[idx] += c
+	}
+	h.total += o.total
+	h.sum += o.sum
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
+
+func (h *histogram) mean() time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	return time.Duration(h.sum / int64(h.total))
+}
+
+// percentile returns the smallest recorded latency, rounded up to its bucket
+// limit, with at least p percent of recorded latencies not exceeding it.
+func (h *histogram) percentile(p float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	target := uint64(p / 100 * float64(h.total))
+	if target == 0 {
+		target = 1
+	}
+	var count uint64
+	for idx, c := range h.counts {
+		count += c
+		if count >= target {
+			if v := getBucketLimit(idx); v < h.max {
+				return time.Duration(v)
+			}
+			break
+		}
+	}
+	return time.Duration(h.max)
+}
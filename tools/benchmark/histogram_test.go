@@ -0,0 +1,97 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+	last := -1
+	for _, v := range []int64{0, 1, 63, 64, 65, 127, 128, 129, 1000, 1 << 40,
+		math.MaxInt64} {
+		idx := getBucket(v)
+		if idx < last || idx >= bucketCount {
+			t.Fatalf("%d, unexpected bucket %d", v, idx)
+		}
+		last = idx
+		limit := getBucketLimit(idx)
+		if limit < v {
+			t.Errorf("%d, limit %d", v, limit)
+		}
+		if float64(limit-v) > float64(v)/subBucketCount {
+			t.Errorf("%d, limit %d is not accurate", v, limit)
+		}
+		if getBucket(limit) != idx {
+			t.Errorf("%d, limit %d in bucket %d", v, limit, getBucket(limit))
+		}
+	}
+}
+
+func TestHistogramPercentiles(t *testing.T) {
+	h := newHistogram()
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i) * time.Microsecond)
+	}
+	tests := []struct {
+		p        float64
+		expected time.Duration
+	}{
+		{50, 500 * time.Microsecond},
+		{99, 990 * time.Microsecond},
+		{99.9, 999 * time.Microsecond},
+		{100, 1000 * time.Microsecond},
+	}
+	for _, tt := range tests {
+		v := h.percentile(tt.p)
+		if v < tt.expected || float64(v-tt.expected) > float64(tt.expected)/subBucketCount {
+			t.Errorf("p%v, got %v, want %v", tt.p, v, tt.expected)
+		}
+	}
+	if h.mean() != 500500*time.Nanosecond {
+		t.Errorf("unexpected mean %v", h.mean())
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	h1 := newHistogram()
+	h2 := newHistogram()
+	all := newHistogram()
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		v := time.Duration(r.Int63n(int64(time.Second)))
+		if i%2 == 0 {
+			h1.record(v)
+		} else {
+			h2.record(v)
+		}
+		all.record(v)
+	}
+	h1.merge(h2)
+	if h1.total != all.total || h1.max != all.max || h1.sum != all.sum {
+		t.Fatalf("unexpected merged histogram")
+	}
+	for _, p := range []float64{50, 99, 99.9} {
+		if h1.percentile(p) != all.percentile(p) {
+			t.Errorf("p%v, got %v, want %v", p, h1.percentile(p), all.percentile(p))
+		}
+	}
+	if newHistogram().percentile(99) != 0 {
+		t.Errorf("unexpected percentile of empty histogram")
+	}
+}
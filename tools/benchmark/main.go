@@ -0,0 +1,207 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// benchmark runs a configurable workload against shards replicated across
+// multiple local NodeHosts and reports the throughput and latency percentiles
+// in JSON format.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/logger"
+)
+
+var shardcount = flag.Int("num-of-shards", 16, "number of raft shards")
+var replicas = flag.Int("replicas", 3, "number of replicas per shard")
+var nodehosts = flag.Int("num-of-nodehosts", 3, "number of local NodeHosts")
+var payload = flag.String("payload", "16",
+	"payload size distribution, e.g. 16, 16-1024 or 64:9,4096:1")
+var readRatio = flag.Float64("read-ratio", 0, "ratio of linearizable reads")
+var rate = flag.Float64("rate", 0,
+	"open-loop arrival rate in ops per second, 0 for closed-loop")
+var arrival = flag.String("arrival", "poisson",
+	"open-loop arrival process, poisson or uniform")
+var clientcount = flag.Int("num-of-clients", 1000, "number of clients to use")
+var seconds = flag.Int("seconds-to-run", 60, "number of seconds to measure")
+var warmup = flag.Int("warmup-seconds", 5, "number of seconds to warm up")
+var timeout = flag.Duration("timeout", 4*time.Second, "timeout of each op")
+var ckpt = flag.Uint64("snapshot-entries", 0, "snapshot interval")
+var logdbs = flag.String("logdb", logDBPebble,
+	"comma separated LogDB types to compare, pebble or tan")
+var transports = flag.String("transport", transportTCP,
+	"comma separated transport types to compare, tcp or chan")
+var dataDir = flag.String("data-dir", "benchmark-data-safe-to-delete",
+	"data directory")
+var basePort = flag.Int("base-port", 26000, "RaftAddress port of the first NodeHost")
+var output = flag.String("output", "", "output file, default to stdout")
+
+type latencyStats struct {
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P99  float64 `json:"p99"`
+	P999 float64 `json:"p999"`
+	Max  float64 `json:"max"`
+}
+
+type opStats struct {
+	Count      uint64  `json:"count"`
+	Errors     uint64  `json:"errors"`
+	Throughput float64 `json:"throughput"`
+	// Latency is in milliseconds.
+	Latency latencyStats `json:"latency_ms"`
+}
+
+type result struct {
+	LogDB       string  `json:"logdb"`
+	Transport   string  `json:"transport"`
+	Shards      int     `json:"shards"`
+	Replicas    int     `json:"replicas"`
+	NodeHosts   int     `json:"nodehosts"`
+	Payload     string  `json:"payload"`
+	ReadRatio   float64 `json:"read_ratio"`
+	Rate        float64 `json:"rate"`
+	Arrival     string  `json:"arrival"`
+	Concurrency int     `json:"concurrency"`
+	Seconds     int     `json:"seconds"`
+	Writes      opStats `json:"writes"`
+	Reads       opStats `json:"reads"`
+	Total       opStats `json:"total"`
+	// Dropped is the number of open-loop ops not started before the end of
+	// the run.
+	Dropped uint64 `json:"dropped"`
+}
+
+func getOpStats(h *histogram, errCount uint64, d time.Duration) opStats {
+	ms := func(v time.Duration) float64 {
+		return float64(v) / float64(time.Millisecond)
+	}
+	return opStats{
+		Count:      h.total,
+		Errors:     errCount,
+		Throughput: float64(h.total) / d.Seconds(),
+		Latency: latencyStats{
+			Mean: ms(h.mean()),
+			P50:  ms(h.percentile(50)),
+			P99:  ms(h.percentile(99)),
+			P999: ms(h.percentile(99.9)),
+			Max:  ms(time.Duration(h.max)),
+		},
+	}
+}
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "benchmark failed, %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	pd, err := parsePayloadDist(*payload)
+	if err != nil {
+		return err
+	}
+	if *readRatio < 0 || *readRatio > 1 {
+		return errors.Newf("invalid read ratio %f", *readRatio)
+	}
+	if *arrival != "poisson" && *arrival != "uniform" {
+		return errors.Newf("unknown arrival process %s", *arrival)
+	}
+	if *shardcount <= 0 || *replicas <= 0 || *clientcount <= 0 || *seconds <= 0 {
+		return errors.New("invalid workload settings")
+	}
+	w := &workload{
+		payload:     pd,
+		readRatio:   *readRatio,
+		rate:        *rate,
+		poisson:     *arrival == "poisson",
+		concurrency: *clientcount,
+		duration:    time.Duration(*seconds) * time.Second,
+		warmup:      time.Duration(*warmup) * time.Second,
+		timeout:     *timeout,
+	}
+	logger.GetLogger("raft").SetLevel(logger.WARNING)
+	logger.GetLogger("rsm").SetLevel(logger.WARNING)
+	logger.GetLogger("logdb").SetLevel(logger.WARNING)
+	logger.GetLogger("tan").SetLevel(logger.WARNING)
+	logger.GetLogger("transport").SetLevel(logger.WARNING)
+	logger.GetLogger("dragonboat").SetLevel(logger.WARNING)
+	var results []result
+	for _, logdb := range strings.Split(*logdbs, ",") {
+		for _, transport := range strings.Split(*transports, ",") {
+			cfg := clusterConfig{
+				dataDir:         *dataDir,
+				basePort:        *basePort,
+				nodehosts:       *nodehosts,
+				shards:          *shardcount,
+				replicas:        *replicas,
+				snapshotEntries: *ckpt,
+				logdb:           strings.TrimSpace(logdb),
+				transport:       strings.TrimSpace(transport),
+			}
+			r, err := runBenchmark(cfg, w)
+			if err != nil {
+				return err
+			}
+			results = append(results, r)
+		}
+	}
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if len(*output) > 0 {
+		return os.WriteFile(*output, data, 0644)
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+func runBenchmark(cfg clusterConfig, w *workload) (result, error) {
+	log.Printf("starting %d shards on %d NodeHosts, logdb %s, transport %s",
+		cfg.shards, cfg.nodehosts, cfg.logdb, cfg.transport)
+	c, err := newCluster(cfg)
+	if err != nil {
+		return result{}, err
+	}
+	defer c.close()
+	log.Printf("shards are ready, will run for %d seconds",
+		int((w.warmup + w.duration).Seconds()))
+	r := runWorkload(c, w)
+	r.LogDB = cfg.logdb
+	r.Transport = cfg.transport
+	r.Shards = cfg.shards
+	r.Replicas = cfg.replicas
+	r.NodeHosts = cfg.nodehosts
+	r.Payload = *payload
+	r.ReadRatio = w.readRatio
+	r.Rate = w.rate
+	r.Concurrency = w.concurrency
+	r.Seconds = int(w.duration.Seconds())
+	if w.rate > 0 {
+		r.Arrival = *arrival
+	}
+	return r, nil
+}
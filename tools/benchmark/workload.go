@@ -0,0 +1,296 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/client"
+)
+
+// payloadDist is the distribution of proposal payload sizes. It is specified
+// as a fixed size such as "16", a uniform range such as "16-1024" or a list
+// of weighted sizes such as "64:9,4096:1".
+type payloadDist struct {
+	min     int
+	max     int
+	sizes   []int
+	weights []float64
+}
+
+func parsePayloadDist(v string) (payloadDist, error) {
+	v = strings.TrimSpace(v)
+	if strings.Contains(v, ":") {
+		return parseWeightedPayloadDist(v)
+	}
+	if parts := strings.SplitN(v, "-", 2); len(parts) == 2 {
+		min, err := parsePayloadSize(parts[0])
+		if err != nil {
+			return payloadDist{}, err
+		}
+		max, err := parsePayloadSize(parts[1])
+		if err != nil {
+			return payloadDist{}, err
+		}
+		if min > max {
+			return payloadDist{}, errors.Newf("invalid payload range %s", v)
+		}
+		return payloadDist{min: min, max: max}, nil
+	}
+	sz, err := parsePayloadSize(v)
+	if err != nil {
+		return payloadDist{}, err
+	}
+	return payloadDist{min: sz, max: sz}, nil
+}
+
+func parseWeightedPayloadDist(v string) (payloadDist, error) {
+	d := payloadDist{}
+	total := float64(0)
+	for _, item := range strings.Split(v, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		if len(parts) != 2 {
+			return payloadDist{}, errors.Newf("invalid payload size %s", item)
+		}
+		sz, err := parsePayloadSize(parts[0])
+		if err != nil {
+			return payloadDist{}, err
+		}
+		w, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || w <= 0 {
+			return payloadDist{}, errors.Newf("invalid payload weight %s", item)
+		}
+		total += w
+		d.sizes = append(d.sizes, sz)
+		d.weights = append(d.weights, total)
+		if sz > d.max {
+			d.max = sz
+		}
+	}
+	for idx := range d.weights {
+		d.weights[idx] /= total
+	}
+	return d, nil
+}
+
+func parsePayloadSize(v string) (int, error) {
+	sz, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || sz <= 0 {
+		return 0, errors.Newf("invalid payload size %s", v)
+	}
+	return sz, nil
+}
+
+func (d payloadDist) sample(r *rand.Rand) int {
+	if len(d.sizes) > 0 {
+		p := r.Float64()
+		for idx, w := range d.weights {
+			if p < w {
+				return d.sizes[idx]
+			}
+		}
+		return d.sizes[len(d.sizes)-1]
+	}
+	if d.min == d.max {
+		return d.min
+	}
+	return d.min + r.Intn(d.max-d.min+1)
+}
+
+type workload struct {
+	payload     payloadDist
+	readRatio   float64
+	rate        float64
+	poisson     bool
+	concurrency int
+	duration    time.Duration
+	warmup      time.Duration
+	timeout     time.Duration
+}
+
+type op struct {
+	shard int
+	read  bool
+	size  int
+	// start is the time when the op is scheduled to start, latencies are
+	// measured from it so queueing delays of open-loop ops are included.
+	start time.Time
+}
+
+func (w *workload) getOp(r *rand.Rand, shards int, start time.Time) op {
+	return op{
+		shard: r.Intn(shards),
+		read:  r.Float64() < w.readRatio,
+		size:  w.payload.sample(r),
+		start: start,
+	}
+}
+
+type worker struct {
+	c           *cluster
+	w           *workload
+	sessions    []*client.Session
+	r           *rand.Rand
+	buf         []byte
+	measureFrom time.Time
+	writes      *histogram
+	reads       *histogram
+	writeErrors uint64
+	readErrors  uint64
+	dropped     uint64
+}
+
+func (wk *worker) run(o op) {
+	ctx, cancel := context.WithTimeout(context.Background(), wk.w.timeout)
+	defer cancel()
+	shardID := uint64(o.shard + 1)
+	nh := wk.c.leaders[o.shard]
+	var err error
+	if o.read {
+		_, err = nh.SyncRead(ctx, shardID, nil)
+	} else {
+		_, err = nh.SyncPropose(ctx, wk.sessions[o.shard], wk.buf[:o.size])
+	}
+	if o.start.Before(wk.measureFrom) {
+		return
+	}
+	if o.read {
+		if err != nil {
+			wk.readErrors++
+		} else {
+			wk.reads.record(time.Since(o.start))
+		}
+	} else {
+		if err != nil {
+			wk.writeErrors++
+		} else {
+			wk.writes.record(time.Since(o.start))
+		}
+	}
+}
+
+// runWorkload runs the workload against the cluster. When the arrival rate
+// is set, ops are scheduled by a single dispatcher regardless of how fast
+// earlier ops complete, ops that can not be queued or are not started before
+// the end of the run are dropped. Otherwise each worker issues its next op
+// once the previous one completes.
+func runWorkload(c *cluster, w *workload) result {
+	start := time.Now()
+	measureFrom := start.Add(w.warmup)
+	end := measureFrom.Add(w.duration)
+	sessions := make([]*client.Session, len(c.leaders))
+	for idx, nh := range c.leaders {
+		sessions[idx] = nh.GetNoOPSession(uint64(idx + 1))
+	}
+	workers := make([]*worker, w.concurrency)
+	for idx := range workers {
+		r := rand.New(rand.NewSource(start.UnixNano() + int64(idx)))
+		buf := make([]byte, w.payload.max)
+		r.Read(buf)
+		workers[idx] = &worker{
+			c:           c,
+			w:           w,
+			sessions:    sessions,
+			r:           r,
+			buf:         buf,
+			measureFrom: measureFrom,
+			writes:      newHistogram(),
+			reads:       newHistogram(),
+		}
+	}
+	var dropped uint64
+	var ch chan op
+	if w.rate > 0 {
+		ch = make(chan op, 64*1024)
+		go func() {
+			dropped = dispatch(c, w, ch, start, end)
+			close(ch)
+		}()
+	}
+	var wg sync.WaitGroup
+	for _, wk := range workers {
+		wg.Add(1)
+		go func(wk *worker) {
+			defer wg.Done()
+			if ch == nil {
+				for time.Now().Before(end) {
+					wk.run(w.getOp(wk.r, len(c.leaders), time.Now()))
+				}
+				return
+			}
+			for o := range ch {
+				if time.Now().After(end) {
+					wk.dropped++
+					continue
+				}
+				wk.run(o)
+			}
+		}(wk)
+	}
+	wg.Wait()
+	writes := newHistogram()
+	reads := newHistogram()
+	var writeErrors, readErrors uint64
+	for _, wk := range workers {
+		writes.merge(wk.writes)
+		reads.merge(wk.reads)
+		writeErrors += wk.writeErrors
+		readErrors += wk.readErrors
+		dropped += wk.dropped
+	}
+	total := newHistogram()
+	total.merge(writes)
+	total.merge(reads)
+	return result{
+		Writes:  getOpStats(writes, writeErrors, w.duration),
+		Reads:   getOpStats(reads, readErrors, w.duration),
+		Total:   getOpStats(total, writeErrors+readErrors, w.duration),
+		Dropped: dropped,
+	}
+}
+
+// dispatch schedules ops at the arrival rate until the end of the run. It
+// returns the number of ops dropped as the queue is full.
+func dispatch(c *cluster, w *workload,
+	ch chan op, start time.Time, end time.Time) (dropped uint64) {
+	r := rand.New(rand.NewSource(start.UnixNano() - 1))
+	interval := float64(time.Second) / w.rate
+	next := start
+	for {
+		if w.poisson {
+			next = next.Add(time.Duration(r.ExpFloat64() * interval))
+		} else {
+			next = next.Add(time.Duration(interval))
+		}
+		if !next.Before(end) {
+			return dropped
+		}
+		if d := time.Until(next); d > 0 {
+			time.Sleep(d)
+		}
+		select {
+		case ch <- w.getOp(r, len(c.leaders), next):
+		default:
+			dropped++
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestParsePayloadDist(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	d, err := parsePayloadDist("16")
+	if err != nil {
+		t.Fatalf("failed to parse, %v", err)
+	}
+	if d.max != 16 || d.sample(r) != 16 {
+		t.Errorf("unexpected fixed size dist %+v", d)
+	}
+	d, err = parsePayloadDist("16-1024")
+	if err != nil {
+		t.Fatalf("failed to parse, %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		if sz := d.sample(r); sz < 16 || sz > 1024 {
+			t.Fatalf("unexpected size %d", sz)
+		}
+	}
+	d, err = parsePayloadDist("64:9, 4096:1")
+	if err != nil {
+		t.Fatalf("failed to parse, %v", err)
+	}
+	if d.max != 4096 {
+		t.Errorf("unexpected max %d", d.max)
+	}
+	large := 0
+	for i := 0; i < 10000; i++ {
+		if d.sample(r) == 4096 {
+			large++
+		}
+	}
+	if large < 800 || large > 1200 {
+		t.Errorf("unexpected weighted sampling, %d", large)
+	}
+	for _, v := range []string{"", "0", "-1", "x", "1024-16", "64:0", "64:x"} {
+		if _, err := parsePayloadDist(v); err == nil {
+			t.Errorf("%q, error not reported", v)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// configcheck validates NodeHostConfig and Config files and prints the
+// effective values after applying defaults, LogDB presets and environment
+// variable overrides.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/logger"
+)
+
+var nodehost = flag.String("nodehost", "", "NodeHostConfig file to check")
+var shard = flag.String("shard", "", "Config file to check")
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func main() {
+	flag.Parse()
+	if len(*nodehost) == 0 && len(*shard) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: configcheck -nodehost nh.toml -shard shard.toml\n")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	logger.GetLogger("config").SetLevel(logger.ERROR)
+	ok := true
+	if len(*nodehost) > 0 {
+		nhConfig, err := config.LoadNodeHostConfig(*nodehost)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid NodeHostConfig, %v\n", err)
+			ok = false
+		} else {
+			fmt.Printf("# NodeHostConfig %s\n", *nodehost)
+			printFields(os.Stdout, reflect.ValueOf(nhConfig), "")
+			fmt.Printf("# estimated LogDB memory size %dMB\n",
+				nhConfig.Expert.LogDB.MemorySizeMB())
+		}
+	}
+	if len(*shard) > 0 {
+		cfg, err := config.LoadConfig(*shard)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid Config, %v\n", err)
+			ok = false
+		} else {
+			fmt.Printf("# Config %s\n", *shard)
+			printFields(os.Stdout, reflect.ValueOf(cfg), "")
+		}
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// printFields prints all exported fields of the struct, fields that can not be set
+// in configuration files are skipped.
+func printFields(w io.Writer, v reflect.Value, path string) {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := path + f.Name
+		fv := v.Field(i)
+		switch {
+		case f.Type == durationType:
+			fmt.Fprintf(w, "%s = %s\n", name, time.Duration(fv.Int()))
+		case f.Type.Kind() == reflect.Struct:
+			printFields(w, fv, name+".")
+		case f.Type.Kind() == reflect.String:
+			fmt.Fprintf(w, "%s = %q\n", name, fv.String())
+		case f.Type.Kind() == reflect.Slice &&
+			f.Type.Elem().Kind() == reflect.Uint8:
+			fmt.Fprintf(w, "%s = %q\n", name, fv.Bytes())
+		case f.Type.Kind() == reflect.Func ||
+			f.Type.Kind() == reflect.Interface || f.Type.Kind() == reflect.Chan:
+		default:
+			fmt.Fprintf(w, "%s = %v\n", name, fv.Interface())
+		}
+	}
+}
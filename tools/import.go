@@ -132,6 +132,14 @@ var firstError = utils.FirstError
 // It is your applications's responsibility to let m4 and m5 to be aware that
 // node 4 and 5 are now running there.
 func ImportSnapshot(nhConfig config.NodeHostConfig,
+	srcDir string, memberNodes map[uint64]string, replicaID uint64) error {
+	if err := checkImportSettings(nhConfig, memberNodes, replicaID); err != nil {
+		return err
+	}
+	return importSnapshot(nhConfig, srcDir, memberNodes, replicaID)
+}
+
+func importSnapshot(nhConfig config.NodeHostConfig,
 	srcDir string, memberNodes map[uint64]string, replicaID uint64) (err error) {
 	if nhConfig.DeploymentID == 0 {
 		plog.Infof("NodeHostConfig.DeploymentID not set, default to %d",
@@ -145,9 +153,6 @@ func ImportSnapshot(nhConfig config.NodeHostConfig,
 		return err
 	}
 	fs := nhConfig.Expert.FS
-	if err := checkImportSettings(nhConfig, memberNodes, replicaID); err != nil {
-		return err
-	}
 	ssfp, err := getSnapshotFilepath(srcDir, fs)
 	if err != nil {
 		return err
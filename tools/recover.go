@@ -0,0 +1,209 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"sort"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	"github.com/lni/dragonboat/v4/raftio"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+// ReplicaState is the state of a replica persisted by a stopped NodeHost. It
+// is used for selecting the replica to recover a shard from after the shard
+// permanently lost its quorum.
+type ReplicaState struct {
+	ShardID   uint64
+	ReplicaID uint64
+	// RaftAddress is the RaftAddress of the NodeHost hosting the replica.
+	RaftAddress string
+	// Term, Vote and Committed are the persisted Raft state of the replica.
+	Term      uint64
+	Vote      uint64
+	Committed uint64
+	// LastIndex is the index of the last Raft log entry of the replica.
+	LastIndex uint64
+	// Snapshot is the latest snapshot of the replica.
+	Snapshot pb.Snapshot
+	// SnapshotDir is the directory of the latest snapshot. It can be used as
+	// the srcDir parameter of ImportSnapshot when the snapshot is importable.
+	SnapshotDir string
+}
+
+// Importable returns a boolean value indicating whether the latest snapshot
+// of the replica can be imported by ImportSnapshot. Snapshots of
+// IOnDiskStateMachine based state machines and witnesses do not contain the
+// state machine state unless they are exported, they are not importable.
+func (s *ReplicaState) Importable() bool {
+	return !pb.IsEmptySnapshot(s.Snapshot) &&
+		!s.Snapshot.Dummy && !s.Snapshot.Witness
+}
+
+// GetReplicaStates returns the persisted states of all replicas of the
+// specified shard found in the data directories of the NodeHost described by
+// nhConfig. The NodeHost must be stopped when invoking GetReplicaStates.
+func GetReplicaStates(nhConfig config.NodeHostConfig,
+	shardID uint64) (result []ReplicaState, err error) {
+	if nhConfig.DeploymentID == 0 {
+		nhConfig.DeploymentID = unmanagedDeploymentID
+	}
+	if nhConfig.Expert.FS == nil {
+		nhConfig.Expert.FS = vfs.DefaultFS
+	}
+	if err := nhConfig.Prepare(); err != nil {
+		return nil, err
+	}
+	env, err := server.NewEnv(nhConfig, nhConfig.Expert.FS)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = firstError(err, env.Close())
+	}()
+	if err := env.LockNodeHostDir(); err != nil {
+		return nil, err
+	}
+	logdb, err := getLogDB(*env, nhConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err = firstError(err, logdb.Close())
+	}()
+	if err := env.CheckNodeHostDir(nhConfig,
+		logdb.BinaryFormat(), logdb.Name()); err != nil {
+		return nil, err
+	}
+	nodes, err := logdb.ListNodeInfo()
+	if err != nil {
+		return nil, err
+	}
+	for _, ni := range nodes {
+		if ni.ShardID != shardID {
+			continue
+		}
+		state, err := getReplicaState(logdb, ni.ShardID, ni.ReplicaID)
+		if err != nil {
+			return nil, err
+		}
+		state.RaftAddress = nhConfig.RaftAddress
+		if !pb.IsEmptySnapshot(state.Snapshot) {
+			dir := env.GetSnapshotDir(nhConfig.DeploymentID,
+				ni.ShardID, ni.ReplicaID)
+			state.SnapshotDir = nhConfig.Expert.FS.PathJoin(dir,
+				server.GetSnapshotDirName(state.Snapshot.Index))
+		}
+		result = append(result, state)
+	}
+	return result, nil
+}
+
+func getReplicaState(logdb raftio.ILogDB,
+	shardID uint64, replicaID uint64) (ReplicaState, error) {
+	ss, err := logdb.GetSnapshot(shardID, replicaID)
+	if err != nil {
+		return ReplicaState{}, err
+	}
+	state := ReplicaState{
+		ShardID:   shardID,
+		ReplicaID: replicaID,
+		LastIndex: ss.Index,
+		Snapshot:  ss,
+	}
+	rs, err := logdb.ReadRaftState(shardID, replicaID, ss.Index)
+	if errors.Is(err, raftio.ErrNoSavedLog) {
+		return state, nil
+	}
+	if err != nil {
+		return ReplicaState{}, err
+	}
+	state.Term = rs.State.Term
+	state.Vote = rs.State.Vote
+	state.Committed = rs.State.Commit
+	if rs.EntryCount > 0 {
+		state.LastIndex = rs.FirstIndex + rs.EntryCount - 1
+	}
+	return state, nil
+}
+
+var (
+	// ErrNoReplica indicates that no replica is available for recovery.
+	ErrNoReplica = errors.New("no replica")
+	// ErrStaleSnapshot indicates that the latest snapshot of the most up to
+	// date replica does not cover all entries committed by that replica.
+	ErrStaleSnapshot = errors.New("snapshot behind committed index")
+)
+
+// SelectRecoverySource returns the most up to date replica to recover the
+// shard from. Replicas are ranked by their committed indexes, ties are broken
+// by their last indexes and then by their snapshot indexes. ErrStaleSnapshot
+// is returned along with the selected replica when its latest snapshot is not
+// importable or does not cover all its committed entries, importing such a
+// snapshot loses committed entries. In that case, the caller is expected to
+// restart the selected replica, export a snapshot using the Exported field of
+// the SnapshotOption and recover from that exported snapshot instead.
+func SelectRecoverySource(states []ReplicaState) (ReplicaState, error) {
+	if len(states) == 0 {
+		return ReplicaState{}, ErrNoReplica
+	}
+	candidates := append([]ReplicaState{}, states...)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		ci, cj := candidates[i], candidates[j]
+		if ci.Committed != cj.Committed {
+			return ci.Committed > cj.Committed
+		}
+		if ci.LastIndex != cj.LastIndex {
+			return ci.LastIndex > cj.LastIndex
+		}
+		return ci.Snapshot.Index > cj.Snapshot.Index
+	})
+	source := candidates[0]
+	if !source.Importable() {
+		return source, errors.Wrapf(ErrStaleSnapshot,
+			"replica %d committed index %d, no importable snapshot",
+			source.ReplicaID, source.Committed)
+	}
+	if source.Snapshot.Index < source.Committed {
+		return source, errors.Wrapf(ErrStaleSnapshot,
+			"replica %d committed index %d, snapshot index %d",
+			source.ReplicaID, source.Committed, source.Snapshot.Index)
+	}
+	return source, nil
+}
+
+// CopySnapshot copies the snapshot in srcDir, including its metadata and
+// external files, to the dstDir directory. The dstDir directory must exist.
+// The copied snapshot can be used as the srcDir parameter of ImportSnapshot,
+// it is required when the source snapshot is owned by a replica that is going
+// to have its snapshots overwritten by ImportSnapshot.
+func CopySnapshot(srcDir string, dstDir string, fs vfs.IFS) error {
+	if fs == nil {
+		fs = vfs.DefaultFS
+	}
+	ss, err := getSnapshotRecord(srcDir, server.MetadataFilename, fs)
+	if err != nil {
+		return err
+	}
+	if err := copySnapshot(ss, srcDir, dstDir, fs); err != nil {
+		return err
+	}
+	return copyFile(fs.PathJoin(srcDir, server.MetadataFilename),
+		fs.PathJoin(dstDir, server.MetadataFilename), fs)
+}
@@ -0,0 +1,324 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// recover repairs a shard that permanently lost its quorum. It inspects the
+// data directories of the stopped NodeHosts hosting the surviving replicas,
+// selects the most up to date replica and imports its snapshot with the new
+// membership on all involved hosts using tools.ImportSnapshot. The recovery
+// is refused when the snapshot does not cover all entries committed by the
+// selected replica, unless -force is specified.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+	"github.com/lni/dragonboat/v4/tools"
+)
+
+var nodehost = flag.String("nodehost", "",
+	"comma separated NodeHostConfig files of the surviving NodeHosts")
+var shard = flag.Uint64("shard", 0, "ShardID of the shard to recover")
+var members = flag.String("members", "",
+	"new membership, e.g. 1=m1:5012,4=m4:5012, "+
+		"default to the surviving replicas")
+var snapshot = flag.String("snapshot", "",
+	"optional exported snapshot directory to import")
+var dryRun = flag.Bool("dry-run", false,
+	"only report the recovery plan, no change is made")
+var force = flag.Bool("force", false,
+	"recover even when committed entries not in the snapshot will be lost")
+
+type host struct {
+	file     string
+	nhConfig config.NodeHostConfig
+	states   []tools.ReplicaState
+}
+
+func main() {
+	flag.Parse()
+	if len(*nodehost) == 0 || *shard == 0 {
+		fmt.Fprintf(os.Stderr,
+			"usage: recover -nodehost nh1.toml,nh2.toml -shard 100 "+
+				"[-dry-run] [-force]\n")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	if err := recoverShard(); err != nil {
+		fmt.Fprintf(os.Stderr, "recover failed, %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func recoverShard() error {
+	hosts, err := getHosts(strings.Split(*nodehost, ","))
+	if err != nil {
+		return err
+	}
+	var states []tools.ReplicaState
+	for _, h := range hosts {
+		states = append(states, h.states...)
+	}
+	if len(states) == 0 {
+		return errors.Newf("no replica of shard %d found", *shard)
+	}
+	reportReplicas(states)
+	source, srcDir, err := getSource(states)
+	if err != nil {
+		return err
+	}
+	if err := checkSnapshot(source, states); err != nil {
+		return err
+	}
+	memberNodes, err := getMembers(source.Snapshot.Membership, states)
+	if err != nil {
+		return err
+	}
+	plan := getPlan(hosts, memberNodes)
+	reportPlan(source, srcDir, states, memberNodes, plan)
+	if *dryRun {
+		return nil
+	}
+	return execute(srcDir, memberNodes, plan)
+}
+
+func getHosts(files []string) ([]*host, error) {
+	var hosts []*host
+	for _, file := range files {
+		nhConfig, err := config.LoadNodeHostConfig(strings.TrimSpace(file))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load %s", file)
+		}
+		for _, h := range hosts {
+			if h.nhConfig.RaftAddress == nhConfig.RaftAddress {
+				return nil, errors.Newf("duplicated RaftAddress %s",
+					nhConfig.RaftAddress)
+			}
+		}
+		states, err := tools.GetReplicaStates(nhConfig, *shard)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to inspect %s", file)
+		}
+		hosts = append(hosts, &host{
+			file:     file,
+			nhConfig: nhConfig,
+			states:   states,
+		})
+	}
+	return hosts, nil
+}
+
+// getSource returns the replica to recover from and the directory of the
+// snapshot to import.
+func getSource(states []tools.ReplicaState) (tools.ReplicaState, string, error) {
+	if len(*snapshot) > 0 {
+		var ss pb.Snapshot
+		if err := fileutil.GetFlagFileContent(*snapshot,
+			server.MetadataFilename, &ss, vfs.DefaultFS); err != nil {
+			return tools.ReplicaState{}, "", err
+		}
+		if ss.ShardID != *shard {
+			return tools.ReplicaState{}, "", errors.Newf(
+				"snapshot is for shard %d", ss.ShardID)
+		}
+		return tools.ReplicaState{ShardID: ss.ShardID, Snapshot: ss}, *snapshot, nil
+	}
+	source, err := tools.SelectRecoverySource(states)
+	if errors.Is(err, tools.ErrStaleSnapshot) {
+		return tools.ReplicaState{}, "", errors.Wrapf(err, "replica %d on %s "+
+			"is the most up to date replica but its snapshot does not contain "+
+			"all its committed entries, snapshots of on-disk state machines and "+
+			"witnesses do not contain state machine data either. Restart replica "+
+			"%d alone, export a snapshot by calling SyncRequestSnapshot with the "+
+			"Exported and ExportPath fields of the SnapshotOption set, stop it and "+
+			"specify the exported snapshot using -snapshot",
+			source.ReplicaID, source.RaftAddress, source.ReplicaID)
+	}
+	if err != nil {
+		return tools.ReplicaState{}, "", err
+	}
+	return source, source.SnapshotDir, nil
+}
+
+// checkSnapshot returns an error when importing the selected snapshot loses
+// entries committed by any surviving replica and -force is not specified.
+func checkSnapshot(source tools.ReplicaState,
+	states []tools.ReplicaState) error {
+	committed := getCommitted(states)
+	if committed <= source.Snapshot.Index {
+		return nil
+	}
+	if *force {
+		fmt.Printf("WARNING: up to %d committed entries after index %d "+
+			"will be lost\n", committed-source.Snapshot.Index, source.Snapshot.Index)
+		return nil
+	}
+	return errors.Newf("snapshot index %d is behind committed index %d, up to "+
+		"%d committed entries will be lost, specify a more recent exported "+
+		"snapshot using -snapshot or use -force to recover anyway",
+		source.Snapshot.Index, committed, committed-source.Snapshot.Index)
+}
+
+func getCommitted(states []tools.ReplicaState) uint64 {
+	var committed uint64
+	for _, s := range states {
+		if s.Committed > committed {
+			committed = s.Committed
+		}
+	}
+	return committed
+}
+
+// getMembers returns the membership specified by -members, or the surviving
+// voting members of the shard.
+func getMembers(m pb.Membership,
+	states []tools.ReplicaState) (map[uint64]string, error) {
+	result := make(map[uint64]string)
+	if len(*members) > 0 {
+		for _, v := range strings.Split(*members, ",") {
+			parts := strings.SplitN(strings.TrimSpace(v), "=", 2)
+			if len(parts) != 2 {
+				return nil, errors.Newf("invalid member %s", v)
+			}
+			replicaID, err := strconv.ParseUint(parts[0], 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid member %s", v)
+			}
+			result[replicaID] = parts[1]
+		}
+		return result, nil
+	}
+	for _, s := range states {
+		if addr, ok := m.Addresses[s.ReplicaID]; ok {
+			result[s.ReplicaID] = addr
+		}
+	}
+	if len(result) == 0 {
+		return nil, errors.New("no surviving voting member, specify -members")
+	}
+	return result, nil
+}
+
+type importTask struct {
+	h         *host
+	replicaID uint64
+}
+
+// getPlan returns the import task of each member with its RaftAddress
+// matching one of the specified NodeHosts.
+func getPlan(hosts []*host, memberNodes map[uint64]string) []importTask {
+	var plan []importTask
+	for replicaID, addr := range memberNodes {
+		for _, h := range hosts {
+			if h.nhConfig.RaftAddress == addr {
+				plan = append(plan, importTask{h: h, replicaID: replicaID})
+			}
+		}
+	}
+	sort.Slice(plan, func(i, j int) bool {
+		return plan[i].replicaID < plan[j].replicaID
+	})
+	return plan
+}
+
+func reportReplicas(states []tools.ReplicaState) {
+	fmt.Printf("replicas of shard %d:\n", *shard)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "REPLICA\tADDRESS\tTERM\tCOMMITTED\tLAST\tSNAPSHOT\tIMPORTABLE\n")
+	for _, s := range states {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%d\t%d\t%t\n", s.ReplicaID, s.RaftAddress,
+			s.Term, s.Committed, s.LastIndex, s.Snapshot.Index, s.Importable())
+	}
+	w.Flush()
+}
+
+func reportPlan(source tools.ReplicaState, srcDir string,
+	states []tools.ReplicaState, memberNodes map[uint64]string,
+	plan []importTask) {
+	fmt.Printf("\nsnapshot to import: %s\n", srcDir)
+	if source.ReplicaID != 0 {
+		fmt.Printf("  owned by replica %d on %s\n",
+			source.ReplicaID, source.RaftAddress)
+	}
+	fmt.Printf("  index %d, term %d, committed index %d\n", source.Snapshot.Index,
+		source.Snapshot.Term, getCommitted(states))
+	fmt.Printf("\nnew membership:\n")
+	ids := make([]uint64, 0, len(memberNodes))
+	for replicaID := range memberNodes {
+		ids = append(ids, replicaID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, replicaID := range ids {
+		imported := false
+		for _, t := range plan {
+			if t.replicaID == replicaID {
+				imported = true
+			}
+		}
+		note := ""
+		if !imported {
+			note = " (not a specified NodeHost, import it separately)"
+		}
+		fmt.Printf("  replica %d on %s%s\n", replicaID, memberNodes[replicaID], note)
+	}
+	for _, s := range states {
+		if _, ok := memberNodes[s.ReplicaID]; !ok {
+			fmt.Printf("  replica %d on %s is removed, never restart it\n",
+				s.ReplicaID, s.RaftAddress)
+		}
+	}
+	if *dryRun {
+		fmt.Printf("\ndry run, no change made\n")
+	}
+}
+
+func execute(srcDir string,
+	memberNodes map[uint64]string, plan []importTask) (err error) {
+	// the source snapshot might be owned by one of the replicas being
+	// overwritten, it is staged in a temp dir first.
+	stageDir, err := os.MkdirTemp("", "dragonboat-recover-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := os.RemoveAll(stageDir); err == nil {
+			err = rerr
+		}
+	}()
+	if err := tools.CopySnapshot(srcDir, stageDir, vfs.DefaultFS); err != nil {
+		return errors.Wrapf(err, "failed to copy snapshot %s", srcDir)
+	}
+	for _, t := range plan {
+		if err := tools.ImportSnapshot(t.h.nhConfig,
+			stageDir, memberNodes, t.replicaID); err != nil {
+			return errors.Wrapf(err, "failed to import replica %d on %s",
+				t.replicaID, t.h.nhConfig.RaftAddress)
+		}
+		fmt.Printf("replica %d imported on %s\n",
+			t.replicaID, t.h.nhConfig.RaftAddress)
+	}
+	return nil
+}
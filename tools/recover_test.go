@@ -0,0 +1,123 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tools
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4/internal/fileutil"
+	"github.com/lni/dragonboat/v4/internal/server"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	pb "github.com/lni/dragonboat/v4/raftpb"
+)
+
+func TestReplicaStateImportable(t *testing.T) {
+	tests := []struct {
+		ss         pb.Snapshot
+		importable bool
+	}{
+		{pb.Snapshot{}, false},
+		{pb.Snapshot{Index: 100, Term: 2}, true},
+		{pb.Snapshot{Index: 100, Term: 2, Dummy: true}, false},
+		{pb.Snapshot{Index: 100, Term: 2, Witness: true}, false},
+	}
+	for idx, tt := range tests {
+		s := ReplicaState{Snapshot: tt.ss}
+		if s.Importable() != tt.importable {
+			t.Errorf("%d, got %t, want %t", idx, s.Importable(), tt.importable)
+		}
+	}
+}
+
+func TestSelectRecoverySource(t *testing.T) {
+	states := []ReplicaState{
+		{ReplicaID: 1, Committed: 250, LastIndex: 260, Snapshot: pb.Snapshot{Index: 250, Term: 2}},
+		{ReplicaID: 2, Committed: 150, LastIndex: 400, Snapshot: pb.Snapshot{Index: 300, Term: 2}},
+		{ReplicaID: 3, Committed: 250, LastIndex: 270, Snapshot: pb.Snapshot{Index: 250, Term: 2}},
+	}
+	source, err := SelectRecoverySource(states)
+	if err != nil {
+		t.Fatalf("failed to select source, %v", err)
+	}
+	if source.ReplicaID != 3 {
+		t.Errorf("selected replica %d, want 3", source.ReplicaID)
+	}
+	if _, err := SelectRecoverySource(nil); !errors.Is(err, ErrNoReplica) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestSelectRecoverySourceRejectsStaleSnapshot(t *testing.T) {
+	tests := []ReplicaState{
+		{ReplicaID: 1, Committed: 300, Snapshot: pb.Snapshot{Index: 200, Term: 2}},
+		{ReplicaID: 1, Committed: 300, Snapshot: pb.Snapshot{Index: 300, Term: 2, Dummy: true}},
+		{ReplicaID: 1, Committed: 300},
+	}
+	for idx, tt := range tests {
+		// the less up to date replica 2 has an importable snapshot
+		states := []ReplicaState{tt,
+			{ReplicaID: 2, Committed: 250, Snapshot: pb.Snapshot{Index: 250, Term: 2}},
+		}
+		source, err := SelectRecoverySource(states)
+		if !errors.Is(err, ErrStaleSnapshot) {
+			t.Errorf("%d, unexpected error %v", idx, err)
+		}
+		if source.ReplicaID != 1 {
+			t.Errorf("%d, selected replica %d, want 1", idx, source.ReplicaID)
+		}
+	}
+}
+
+func TestCopySnapshotIncludesMetadata(t *testing.T) {
+	fs := vfs.GetTestFS()
+	src := "recover_test_src_safe_to_delete"
+	dst := "recover_test_dst_safe_to_delete"
+	for _, dir := range []string{src, dst} {
+		if err := fs.RemoveAll(dir); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if err := fs.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer func(dir string) {
+			if err := fs.RemoveAll(dir); err != nil {
+				t.Fatalf("%v", err)
+			}
+		}(dir)
+	}
+	ss := pb.Snapshot{ShardID: 100, Index: 200, Term: 2}
+	if err := fileutil.CreateFlagFile(src,
+		server.MetadataFilename, &ss, fs); err != nil {
+		t.Fatalf("failed to create metadata, %v", err)
+	}
+	if err := createTestDataFile(fs.PathJoin(src, "test.gbsnap"), 1024, fs); err != nil {
+		t.Fatalf("failed to create test file %v", err)
+	}
+	if err := CopySnapshot(src, dst, fs); err != nil {
+		t.Fatalf("failed to copy snapshot, %v", err)
+	}
+	copied, err := getSnapshotRecord(dst, server.MetadataFilename, fs)
+	if err != nil {
+		t.Fatalf("failed to get metadata, %v", err)
+	}
+	if copied.Index != ss.Index || copied.ShardID != ss.ShardID {
+		t.Errorf("unexpected metadata %+v", copied)
+	}
+	if _, err := getSnapshotFilepath(dst, fs); err != nil {
+		t.Errorf("snapshot file not copied, %v", err)
+	}
+}
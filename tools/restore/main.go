@@ -0,0 +1,64 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// restore restores replicas of a stopped NodeHost from a backup created by
+// NodeHost.Backup, see the RestoreBackup function in the tools package.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/tools"
+)
+
+var nodehost = flag.String("nodehost", "", "NodeHostConfig file of the NodeHost")
+var backup = flag.String("backup", "", "backup directory")
+var members = flag.String("members", "",
+	"optional JSON file with new shard memberships, "+
+		`e.g. {"100": {"1": "m1:5012", "4": "m4:5012"}}`)
+
+func main() {
+	flag.Parse()
+	if len(*nodehost) == 0 || len(*backup) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: restore -nodehost nh.toml -backup dir\n")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	if err := restore(); err != nil {
+		fmt.Fprintf(os.Stderr, "restore failed, %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func restore() error {
+	nhConfig, err := config.LoadNodeHostConfig(*nodehost)
+	if err != nil {
+		return err
+	}
+	var m map[uint64]map[uint64]string
+	if len(*members) > 0 {
+		data, err := os.ReadFile(*members)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &m); err != nil {
+			return err
+		}
+	}
+	return tools.RestoreBackup(nhConfig, *backup, m)
+}
@@ -0,0 +1,239 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package txn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+
+	"github.com/cockroachdb/errors"
+
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// Participant shard proposal format
+//
+// ---------------------
+// |  Kind  |  Payload  |
+// | 1Byte  |  N Bytes  |
+// ---------------------
+type kind uint8
+
+const (
+	kindUpdate kind = iota + 1
+	kindPrepare
+	kindCommit
+	kindAbort
+)
+
+const (
+	voteAbort  uint64 = 0
+	voteCommit uint64 = 1
+)
+
+type prepareCmd struct {
+	TxnID string
+	Cmds  [][]byte
+}
+
+// finishCmd notifies the participant of the decision of a transaction. Time
+// is the unix time in nanoseconds when the command was issued by the
+// coordinator, finished transactions are remembered by the participant until
+// they finished before the Before value of a later finishCmd.
+type finishCmd struct {
+	TxnID  string
+	Time   int64
+	Before int64
+}
+
+// Update returns the proposal payload for making a regular, non-transactional
+// update to a participant shard. All regular proposals made to participant
+// shards must be encoded by Update.
+func Update(cmd []byte) []byte {
+	return encode(kindUpdate, cmd)
+}
+
+func encode(k kind, payload []byte) []byte {
+	result := make([]byte, len(payload)+1)
+	result[0] = byte(k)
+	copy(result[1:], payload)
+	return result
+}
+
+func encodePrepare(txnID string, cmds [][]byte) []byte {
+	return encodeCmd(kindPrepare, &prepareCmd{TxnID: txnID, Cmds: cmds})
+}
+
+func encodeFinish(k kind, cmd finishCmd) []byte {
+	return encodeCmd(k, &cmd)
+}
+
+func encodeCmd(k kind, v interface{}) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(k))
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// participant is the state machine wrapper used by participant shards.
+// Finished transactions are remembered so Prepare commands applied after the
+// transaction has been committed or aborted, e.g. a delayed Prepare of a
+// transaction aborted by the Recover method of the Coordinator, are rejected
+// without leaving any intent behind.
+type participant struct {
+	sm       sm.IStateMachine
+	t        sm.ITransactional
+	finished map[string]int64
+}
+
+var _ sm.IStateMachine = (*participant)(nil)
+var _ sm.IHash = (*participant)(nil)
+var _ sm.IExtended = (*participant)(nil)
+
+// NewParticipant returns a factory function for creating state machines that
+// can participate in transactions. The state machine created by the specified
+// factory function must implement the statemachine.ITransactional interface.
+func NewParticipant(f sm.CreateStateMachineFunc) sm.CreateStateMachineFunc {
+	return func(shardID uint64, replicaID uint64) sm.IStateMachine {
+		s := f(shardID, replicaID)
+		t, ok := s.(sm.ITransactional)
+		if !ok {
+			panic("state machine does not implement ITransactional")
+		}
+		return &participant{sm: s, t: t, finished: make(map[string]int64)}
+	}
+}
+
+func (p *participant) Update(e sm.Entry) (sm.Result, error) {
+	if len(e.Cmd) == 0 {
+		return sm.Result{}, errors.New("empty participant proposal")
+	}
+	payload := e.Cmd[1:]
+	switch kind(e.Cmd[0]) {
+	case kindUpdate:
+		return p.sm.Update(sm.Entry{Index: e.Index, Cmd: payload})
+	case kindPrepare:
+		var cmd prepareCmd
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&cmd); err != nil {
+			return sm.Result{}, errors.Wrapf(err, "invalid prepare command")
+		}
+		if _, ok := p.finished[cmd.TxnID]; ok {
+			return sm.Result{Value: voteAbort}, nil
+		}
+		ok, err := p.t.Prepare(cmd.TxnID, cmd.Cmds)
+		if err != nil {
+			return sm.Result{}, err
+		}
+		if ok {
+			return sm.Result{Value: voteCommit}, nil
+		}
+		return sm.Result{Value: voteAbort}, nil
+	case kindCommit, kindAbort:
+		var cmd finishCmd
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&cmd); err != nil {
+			return sm.Result{}, errors.Wrapf(err, "invalid finish command")
+		}
+		return sm.Result{}, p.finish(kind(e.Cmd[0]), cmd)
+	}
+	return sm.Result{}, errors.Newf("unknown participant proposal kind %d",
+		e.Cmd[0])
+}
+
+func (p *participant) finish(k kind, cmd finishCmd) error {
+	var err error
+	if k == kindCommit {
+		err = p.t.Commit(cmd.TxnID)
+	} else {
+		err = p.t.Abort(cmd.TxnID)
+	}
+	if err != nil {
+		return err
+	}
+	for txnID, t := range p.finished {
+		if t < cmd.Before {
+			delete(p.finished, txnID)
+		}
+	}
+	if cmd.Time >= cmd.Before {
+		p.finished[cmd.TxnID] = cmd.Time
+	}
+	return nil
+}
+
+func (p *participant) Lookup(query interface{}) (interface{}, error) {
+	return p.sm.Lookup(query)
+}
+
+func (p *participant) NALookup(query []byte) ([]byte, error) {
+	if na, ok := p.sm.(sm.IExtended); ok {
+		return na.NALookup(query)
+	}
+	return nil, sm.ErrNotImplemented
+}
+
+func (p *participant) GetHash() (uint64, error) {
+	if h, ok := p.sm.(sm.IHash); ok {
+		return h.GetHash()
+	}
+	return 0, sm.ErrNotImplemented
+}
+
+// SaveSnapshot saves the finished transactions as a length prefixed header
+// followed by the snapshot of the user state machine.
+func (p *participant) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(p.finished); err != nil {
+		return err
+	}
+	sz := make([]byte, 8)
+	binary.BigEndian.PutUint64(sz, uint64(buf.Len()))
+	if _, err := w.Write(sz); err != nil {
+		return err
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return p.sm.SaveSnapshot(w, fc, done)
+}
+
+func (p *participant) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	sz := make([]byte, 8)
+	if _, err := io.ReadFull(r, sz); err != nil {
+		return err
+	}
+	data := make([]byte, binary.BigEndian.Uint64(sz))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	finished := make(map[string]int64)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&finished); err != nil {
+		return err
+	}
+	if err := p.sm.RecoverFromSnapshot(r, files, done); err != nil {
+		return err
+	}
+	p.finished = finished
+	return nil
+}
+
+func (p *participant) Close() error {
+	return p.sm.Close()
+}
@@ -0,0 +1,227 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package txn
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"sort"
+
+	"github.com/cockroachdb/errors"
+
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+// State is the state of a transaction.
+type State uint64
+
+const (
+	// Unknown indicates that the transaction is unknown to the transaction
+	// record shard, it has either never been started or has been completed
+	// for longer than the retention period of the Coordinator.
+	Unknown State = iota
+	// Pending indicates that the commit decision of the transaction has not
+	// been made yet.
+	Pending
+	// Committed indicates that the transaction has been decided to commit.
+	Committed
+	// Aborted indicates that the transaction has been decided to abort.
+	Aborted
+)
+
+func (s State) String() string {
+	switch s {
+	case Pending:
+		return "Pending"
+	case Committed:
+		return "Committed"
+	case Aborted:
+		return "Aborted"
+	}
+	return "Unknown"
+}
+
+// Record is the transaction record stored in the transaction record shard.
+type Record struct {
+	// ID is the unique ID of the transaction.
+	ID string
+	// Participants is the list of participant shard IDs.
+	Participants []uint64
+	// State is the current state of the transaction.
+	State State
+	// CreatedAt is the unix time in nanoseconds when the transaction record was
+	// created by the coordinator.
+	CreatedAt int64
+	// CompletedAt is the unix time in nanoseconds when all participant shards
+	// were notified of the decision, it is 0 when the transaction has not been
+	// completed yet.
+	CompletedAt int64
+}
+
+func (r *Record) completed() bool {
+	return r.CompletedAt != 0
+}
+
+type recordOp uint8
+
+const (
+	opCreate recordOp = iota + 1
+	opDecide
+	opComplete
+	opGC
+)
+
+// recordCmd is the command applied by the transaction record shard. Before is
+// only used by opGC, records of transactions completed before Before are
+// removed.
+type recordCmd struct {
+	Op     recordOp
+	Record Record
+	Before int64
+}
+
+func (c *recordCmd) marshal() []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(c); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func (c *recordCmd) unmarshal(data []byte) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(c)
+}
+
+type recordQuery struct {
+	ID string
+}
+
+type listQuery struct{}
+
+// recordStateMachine is the state machine used by the transaction record shard.
+type recordStateMachine struct {
+	records map[string]Record
+}
+
+var _ sm.IStateMachine = (*recordStateMachine)(nil)
+
+// NewRecordStateMachine creates the state machine used by the transaction
+// record shard. The returned state machine should be used to start all
+// replicas of the transaction record shard.
+func NewRecordStateMachine(shardID uint64, replicaID uint64) sm.IStateMachine {
+	return &recordStateMachine{records: make(map[string]Record)}
+}
+
+// Update applies the record command. The Value field of the returned result is
+// the state of the transaction after the update.
+func (s *recordStateMachine) Update(e sm.Entry) (sm.Result, error) {
+	var cmd recordCmd
+	if err := cmd.unmarshal(e.Cmd); err != nil {
+		return sm.Result{}, errors.Wrapf(err, "invalid record command")
+	}
+	r := cmd.Record
+	current, ok := s.records[r.ID]
+	switch cmd.Op {
+	case opCreate:
+		if !ok {
+			r.State = Pending
+			s.records[r.ID] = r
+			return sm.Result{Value: uint64(Pending)}, nil
+		}
+	case opDecide:
+		if !ok {
+			return sm.Result{Value: uint64(Unknown)}, nil
+		}
+		// the first decision wins
+		if current.State == Pending {
+			current.State = r.State
+			s.records[r.ID] = current
+		}
+	case opComplete:
+		if !ok {
+			return sm.Result{Value: uint64(Unknown)}, nil
+		}
+		// the decision is kept so it can still be queried until the record is
+		// garbage collected
+		if !current.completed() && current.State != Pending {
+			current.CompletedAt = r.CompletedAt
+			s.records[r.ID] = current
+		}
+	case opGC:
+		for id, r := range s.records {
+			if r.completed() && r.CompletedAt < cmd.Before {
+				delete(s.records, id)
+			}
+		}
+		return sm.Result{Value: uint64(Unknown)}, nil
+	default:
+		return sm.Result{}, errors.Newf("unknown record op %d", cmd.Op)
+	}
+	return sm.Result{Value: uint64(current.State)}, nil
+}
+
+// Lookup returns a Record for a recordQuery or all records of transactions
+// not completed yet for a listQuery.
+func (s *recordStateMachine) Lookup(query interface{}) (interface{}, error) {
+	switch q := query.(type) {
+	case recordQuery:
+		r, ok := s.records[q.ID]
+		if !ok {
+			return Record{ID: q.ID, State: Unknown}, nil
+		}
+		return r, nil
+	case listQuery:
+		result := make([]Record, 0)
+		for _, r := range s.list() {
+			if !r.completed() {
+				result = append(result, r)
+			}
+		}
+		return result, nil
+	}
+	return nil, errors.New("unknown query type")
+}
+
+func (s *recordStateMachine) list() []Record {
+	result := make([]Record, 0, len(s.records))
+	for _, r := range s.records {
+		result = append(result, r)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+func (s *recordStateMachine) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	return gob.NewEncoder(w).Encode(s.list())
+}
+
+func (s *recordStateMachine) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	var records []Record
+	if err := gob.NewDecoder(r).Decode(&records); err != nil {
+		return err
+	}
+	s.records = make(map[string]Record, len(records))
+	for _, r := range records {
+		s.records[r.ID] = r
+	}
+	return nil
+}
+
+func (s *recordStateMachine) Close() error { return nil }
@@ -0,0 +1,312 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package txn implements multi-shard atomic transactions on top of NodeHost.
+
+Transactions are coordinated by the Coordinator type using the two-phase
+commit protocol. The state of each transaction is stored in a dedicated
+transaction record shard, its replicas must be started using the state machine
+returned by NewRecordStateMachine. Shards updated by transactions are called
+participant shards, their replicas must be started using state machines
+created by the factory function returned by NewParticipant and all regular
+proposals made to participant shards must be encoded by the Update function.
+
+Once the transaction record shard has the decision of a transaction recorded,
+the decision is final. The decision is kept after the transaction is completed
+so it can still be queried, it is garbage collected once the transaction has
+been completed for longer than the retention period of the Coordinator. When the coordinator fails before completing the
+transaction, the transaction becomes in-doubt. The Recover method of the
+Coordinator type should be periodically invoked to resolve such in-doubt
+transactions, pending transactions are aborted and decided transactions are
+completed by notifying all participant shards.
+*/
+package txn
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/internal/id"
+	"github.com/lni/dragonboat/v4/logger"
+)
+
+var plog = logger.GetLogger("txn")
+
+var (
+	// ErrEmptyTransaction indicates that the transaction has no command.
+	ErrEmptyTransaction = errors.New("empty transaction")
+	// ErrTransactionDone indicates that the transaction has already been
+	// committed or aborted.
+	ErrTransactionDone = errors.New("transaction already done")
+	// ErrAborted indicates that the transaction has been aborted.
+	ErrAborted = errors.New("transaction aborted")
+	// ErrInDoubt indicates that the outcome of the transaction is unknown to
+	// the coordinator, the transaction will be resolved by the Recover method
+	// of the Coordinator. Use the Status method of the Coordinator to query
+	// the outcome of the transaction.
+	ErrInDoubt = errors.New("transaction in doubt")
+)
+
+// Coordinator coordinates multi-shard transactions on the NodeHost.
+type Coordinator struct {
+	nh             *dragonboat.NodeHost
+	shardID        uint64
+	pendingTimeout time.Duration
+	retention      time.Duration
+}
+
+// NewCoordinator creates a new Coordinator instance. The shardID parameter is
+// the shard ID of the transaction record shard. Pending transactions older
+// than pendingTimeout are considered as abandoned by their coordinators and
+// they will be aborted by the Recover method. The pendingTimeout value should
+// be much larger than the time required to complete a transaction and the
+// max clock difference between NodeHost instances.
+//
+// Completed transactions have their decisions retained for the retention
+// period, during which Status reports their outcomes and participant shards
+// reject delayed Prepare commands of such transactions. The retention value
+// should be much larger than the time a proposal can be delayed before it is
+// applied.
+func NewCoordinator(nh *dragonboat.NodeHost, shardID uint64,
+	pendingTimeout time.Duration, retention time.Duration) *Coordinator {
+	return &Coordinator{
+		nh:             nh,
+		shardID:        shardID,
+		pendingTimeout: pendingTimeout,
+		retention:      retention,
+	}
+}
+
+// Txn is a multi-shard transaction. Txn is not thread safe.
+type Txn struct {
+	c    *Coordinator
+	id   string
+	cmds map[uint64][][]byte
+	done bool
+}
+
+// Begin starts a new transaction.
+func (c *Coordinator) Begin() *Txn {
+	return &Txn{
+		c:    c,
+		id:   id.New().String(),
+		cmds: make(map[uint64][][]byte),
+	}
+}
+
+// ID returns the unique ID of the transaction.
+func (t *Txn) ID() string {
+	return t.id
+}
+
+// Add adds a command to be applied on the specified participant shard. The
+// command is passed to the Prepare method of the participant's state machine.
+func (t *Txn) Add(shardID uint64, cmd []byte) {
+	t.cmds[shardID] = append(t.cmds[shardID], cmd)
+}
+
+func (t *Txn) participants() []uint64 {
+	result := make([]uint64, 0, len(t.cmds))
+	for shardID := range t.cmds {
+		result = append(result, shardID)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// Commit tries to atomically commit the transaction. It returns nil when the
+// transaction is committed, ErrAborted when any participant shard voted to
+// abort the transaction and ErrInDoubt when the outcome of the transaction is
+// unknown. The input context object must have its deadline set.
+//
+// When Commit returns nil, all participant shards are guaranteed to eventually
+// apply their intents. Participant shards not reachable when Commit returns
+// will have their intents applied by the Recover method.
+func (t *Txn) Commit(ctx context.Context) error {
+	if t.done {
+		return ErrTransactionDone
+	}
+	if len(t.cmds) == 0 {
+		return ErrEmptyTransaction
+	}
+	t.done = true
+	r := Record{
+		ID:           t.id,
+		Participants: t.participants(),
+		CreatedAt:    time.Now().UnixNano(),
+	}
+	if _, err := t.c.updateRecord(ctx, opCreate, r); err != nil {
+		return errors.Wrapf(ErrInDoubt, "failed to create record, %v", err)
+	}
+	r.State = Committed
+	if !t.prepare(ctx, r.Participants) {
+		r.State = Aborted
+	}
+	state, err := t.c.updateRecord(ctx, opDecide, r)
+	if err != nil {
+		return errors.Wrapf(ErrInDoubt, "failed to decide, %v", err)
+	}
+	r.State = state
+	if err := t.c.complete(ctx, r); err != nil {
+		plog.Warningf("failed to complete transaction %s, %v", t.id, err)
+	}
+	switch state {
+	case Committed:
+		return nil
+	case Aborted:
+		return ErrAborted
+	}
+	return ErrInDoubt
+}
+
+// Abort aborts the transaction before it is committed.
+func (t *Txn) Abort() {
+	t.done = true
+}
+
+func (t *Txn) prepare(ctx context.Context, participants []uint64) bool {
+	var wg sync.WaitGroup
+	votes := make([]bool, len(participants))
+	for idx, shardID := range participants {
+		wg.Add(1)
+		go func(idx int, shardID uint64) {
+			defer wg.Done()
+			cmd := encodePrepare(t.id, t.cmds[shardID])
+			result, err := t.c.propose(ctx, shardID, cmd)
+			if err != nil {
+				plog.Warningf("failed to prepare transaction %s on shard %d, %v",
+					t.id, shardID, err)
+				return
+			}
+			votes[idx] = result == voteCommit
+		}(idx, shardID)
+	}
+	wg.Wait()
+	for _, v := range votes {
+		if !v {
+			return false
+		}
+	}
+	return true
+}
+
+// Status returns the state of the specified transaction as recorded in the
+// transaction record shard. Unknown is returned for transactions that have
+// never been started or have been garbage collected after the retention
+// period.
+func (c *Coordinator) Status(ctx context.Context, txnID string) (State, error) {
+	v, err := c.nh.SyncRead(ctx, c.shardID, recordQuery{ID: txnID})
+	if err != nil {
+		return Unknown, err
+	}
+	return v.(Record).State, nil
+}
+
+// Recover resolves in-doubt transactions. Pending transactions older than the
+// pendingTimeout value specified when creating the Coordinator are aborted,
+// decided transactions are completed by notifying all their participant
+// shards. Records of transactions completed for longer than the retention
+// period are garbage collected. It returns the number of resolved
+// transactions. The input context object must have its deadline set.
+func (c *Coordinator) Recover(ctx context.Context) (int, error) {
+	v, err := c.nh.SyncRead(ctx, c.shardID, listQuery{})
+	if err != nil {
+		return 0, err
+	}
+	resolved := 0
+	now := time.Now()
+	for _, r := range v.([]Record) {
+		if r.State == Pending {
+			if now.Sub(time.Unix(0, r.CreatedAt)) < c.pendingTimeout {
+				continue
+			}
+			r.State = Aborted
+			state, err := c.updateRecord(ctx, opDecide, r)
+			if err != nil {
+				return resolved, err
+			}
+			r.State = state
+		}
+		plog.Infof("resolving in-doubt transaction %s, state %s", r.ID, r.State)
+		if err := c.complete(ctx, r); err != nil {
+			return resolved, err
+		}
+		resolved++
+	}
+	return resolved, c.gc(ctx)
+}
+
+// gc removes records of transactions completed for longer than the retention
+// period.
+func (c *Coordinator) gc(ctx context.Context) error {
+	cmd := &recordCmd{
+		Op:     opGC,
+		Before: time.Now().Add(-c.retention).UnixNano(),
+	}
+	_, err := c.propose(ctx, c.shardID, cmd.marshal())
+	return err
+}
+
+// complete notifies all participants of the decided transaction and marks the
+// transaction record as completed.
+func (c *Coordinator) complete(ctx context.Context, r Record) error {
+	var k kind
+	switch r.State {
+	case Committed:
+		k = kindCommit
+	case Aborted:
+		k = kindAbort
+	default:
+		return errors.Newf("transaction %s not decided, state %s", r.ID, r.State)
+	}
+	now := time.Now()
+	cmd := encodeFinish(k, finishCmd{
+		TxnID:  r.ID,
+		Time:   now.UnixNano(),
+		Before: now.Add(-c.retention).UnixNano(),
+	})
+	for _, shardID := range r.Participants {
+		if _, err := c.propose(ctx, shardID, cmd); err != nil {
+			return err
+		}
+	}
+	r.CompletedAt = now.UnixNano()
+	_, err := c.updateRecord(ctx, opComplete, r)
+	return err
+}
+
+func (c *Coordinator) updateRecord(ctx context.Context,
+	op recordOp, r Record) (State, error) {
+	cmd := &recordCmd{Op: op, Record: r}
+	v, err := c.propose(ctx, c.shardID, cmd.marshal())
+	if err != nil {
+		return Unknown, err
+	}
+	return State(v), nil
+}
+
+func (c *Coordinator) propose(ctx context.Context,
+	shardID uint64, cmd []byte) (uint64, error) {
+	result, err := c.nh.SyncPropose(ctx, c.nh.GetNoOPSession(shardID), cmd)
+	if err != nil {
+		return 0, err
+	}
+	return result.Value, nil
+}
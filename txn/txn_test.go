@@ -0,0 +1,419 @@
+// Copyright 2017-2022 Lei Ni (nilei81@gmail.com) and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package txn
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lni/dragonboat/v4"
+	"github.com/lni/dragonboat/v4/config"
+	"github.com/lni/dragonboat/v4/internal/vfs"
+	sm "github.com/lni/dragonboat/v4/statemachine"
+)
+
+const (
+	testDataDir     = "txn_test_safe_to_delete"
+	testRaftAddress = "localhost:26001"
+	testRecordShard = 1
+)
+
+type testKV struct {
+	data     map[string]string
+	intents  map[string][][]byte
+	rejected map[string]bool
+}
+
+func newTestKV(shardID uint64, replicaID uint64) sm.IStateMachine {
+	return &testKV{
+		data:     make(map[string]string),
+		intents:  make(map[string][][]byte),
+		rejected: make(map[string]bool),
+	}
+}
+
+func (kv *testKV) Update(e sm.Entry) (sm.Result, error) {
+	kv.data[string(e.Cmd)] = string(e.Cmd)
+	return sm.Result{Value: 1}, nil
+}
+
+func (kv *testKV) Lookup(query interface{}) (interface{}, error) {
+	v, ok := kv.data[query.(string)]
+	if !ok {
+		return "", nil
+	}
+	return v, nil
+}
+
+func (kv *testKV) Prepare(txnID string, cmds [][]byte) (bool, error) {
+	for _, cmd := range cmds {
+		if string(cmd) == "reject" {
+			kv.rejected[txnID] = true
+			return false, nil
+		}
+	}
+	kv.intents[txnID] = cmds
+	return true, nil
+}
+
+func (kv *testKV) Commit(txnID string) error {
+	for _, cmd := range kv.intents[txnID] {
+		kv.data[string(cmd)] = string(cmd)
+	}
+	delete(kv.intents, txnID)
+	return nil
+}
+
+func (kv *testKV) Abort(txnID string) error {
+	delete(kv.intents, txnID)
+	return nil
+}
+
+func (kv *testKV) SaveSnapshot(w io.Writer,
+	fc sm.ISnapshotFileCollection, done <-chan struct{}) error {
+	return nil
+}
+
+func (kv *testKV) RecoverFromSnapshot(r io.Reader,
+	files []sm.SnapshotFile, done <-chan struct{}) error {
+	return nil
+}
+
+func (kv *testKV) Close() error { return nil }
+
+func updateRecord(t *testing.T, s sm.IStateMachine, op recordOp, r Record) State {
+	cmd := &recordCmd{Op: op, Record: r}
+	result, err := s.Update(sm.Entry{Cmd: cmd.marshal()})
+	if err != nil {
+		t.Fatalf("update failed %v", err)
+	}
+	return State(result.Value)
+}
+
+func TestRecordStateMachine(t *testing.T) {
+	s := NewRecordStateMachine(1, 1)
+	r := Record{ID: "txn1", Participants: []uint64{2, 3}, CreatedAt: 100}
+	if state := updateRecord(t, s, opDecide, r); state != Unknown {
+		t.Errorf("unexpected state %s", state)
+	}
+	if state := updateRecord(t, s, opCreate, r); state != Pending {
+		t.Errorf("unexpected state %s", state)
+	}
+	r.State = Aborted
+	if state := updateRecord(t, s, opDecide, r); state != Aborted {
+		t.Errorf("unexpected state %s", state)
+	}
+	r.State = Committed
+	if state := updateRecord(t, s, opDecide, r); state != Aborted {
+		t.Errorf("decision changed, %s", state)
+	}
+	v, err := s.Lookup(recordQuery{ID: "txn1"})
+	if err != nil {
+		t.Fatalf("lookup failed %v", err)
+	}
+	if rec := v.(Record); rec.State != Aborted ||
+		!reflect.DeepEqual(rec.Participants, r.Participants) {
+		t.Errorf("unexpected record %v", rec)
+	}
+	var buf bytes.Buffer
+	if err := s.SaveSnapshot(&buf, nil, nil); err != nil {
+		t.Fatalf("failed to save snapshot %v", err)
+	}
+	s2 := NewRecordStateMachine(1, 1)
+	if err := s2.RecoverFromSnapshot(&buf, nil, nil); err != nil {
+		t.Fatalf("failed to recover from snapshot %v", err)
+	}
+	v2, err := s2.Lookup(listQuery{})
+	if err != nil {
+		t.Fatalf("lookup failed %v", err)
+	}
+	if l := v2.([]Record); len(l) != 1 || l[0].State != Aborted {
+		t.Errorf("unexpected records %v", l)
+	}
+	r.CompletedAt = 200
+	if state := updateRecord(t, s2, opComplete, r); state != Aborted {
+		t.Errorf("unexpected state %s", state)
+	}
+	v2, err = s2.Lookup(listQuery{})
+	if err != nil {
+		t.Fatalf("lookup failed %v", err)
+	}
+	if l := v2.([]Record); len(l) != 0 {
+		t.Errorf("unexpected records %v", l)
+	}
+	// the decision is retained until garbage collected
+	v, err = s2.Lookup(recordQuery{ID: "txn1"})
+	if err != nil {
+		t.Fatalf("lookup failed %v", err)
+	}
+	if rec := v.(Record); rec.State != Aborted || rec.CompletedAt != 200 {
+		t.Errorf("unexpected record %v", rec)
+	}
+	gc := func(before int64) {
+		cmd := &recordCmd{Op: opGC, Before: before}
+		if _, err := s2.Update(sm.Entry{Cmd: cmd.marshal()}); err != nil {
+			t.Fatalf("update failed %v", err)
+		}
+	}
+	gc(200)
+	if v, _ := s2.Lookup(recordQuery{ID: "txn1"}); v.(Record).State != Aborted {
+		t.Errorf("record removed before the retention period")
+	}
+	gc(201)
+	if v, _ := s2.Lookup(recordQuery{ID: "txn1"}); v.(Record).State != Unknown {
+		t.Errorf("record not garbage collected")
+	}
+}
+
+func TestParticipantRequiresITransactional(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("panic not triggered")
+		}
+	}()
+	f := NewParticipant(func(uint64, uint64) sm.IStateMachine {
+		return NewRecordStateMachine(1, 1)
+	})
+	f(1, 1)
+}
+
+func TestParticipantStateMachine(t *testing.T) {
+	p := NewParticipant(newTestKV)(1, 1)
+	kv := p.(*participant).sm.(*testKV)
+	if _, err := p.Update(sm.Entry{Cmd: Update([]byte("k1"))}); err != nil {
+		t.Fatalf("update failed %v", err)
+	}
+	if _, ok := kv.data["k1"]; !ok {
+		t.Errorf("regular update not applied")
+	}
+	cmds := [][]byte{[]byte("k2"), []byte("k3")}
+	result, err := p.Update(sm.Entry{Cmd: encodePrepare("txn1", cmds)})
+	if err != nil {
+		t.Fatalf("prepare failed %v", err)
+	}
+	if result.Value != voteCommit {
+		t.Errorf("unexpected vote")
+	}
+	if _, ok := kv.data["k2"]; ok {
+		t.Errorf("intent applied before commit")
+	}
+	commit := encodeFinish(kindCommit, finishCmd{TxnID: "txn1", Time: 100})
+	if _, err := p.Update(sm.Entry{Cmd: commit}); err != nil {
+		t.Fatalf("commit failed %v", err)
+	}
+	if _, ok := kv.data["k3"]; !ok {
+		t.Errorf("intent not applied")
+	}
+	// late prepare of the finished transaction is rejected
+	result, err = p.Update(sm.Entry{Cmd: encodePrepare("txn1", cmds)})
+	if err != nil {
+		t.Fatalf("prepare failed %v", err)
+	}
+	if result.Value != voteAbort || len(kv.intents) != 0 {
+		t.Errorf("late prepare not rejected")
+	}
+	var buf bytes.Buffer
+	if err := p.SaveSnapshot(&buf, nil, nil); err != nil {
+		t.Fatalf("failed to save snapshot %v", err)
+	}
+	p2 := NewParticipant(newTestKV)(1, 1)
+	if err := p2.RecoverFromSnapshot(&buf, nil, nil); err != nil {
+		t.Fatalf("failed to recover from snapshot %v", err)
+	}
+	if _, ok := p2.(*participant).finished["txn1"]; !ok {
+		t.Errorf("finished transaction not recovered")
+	}
+	abort := encodeFinish(kindAbort,
+		finishCmd{TxnID: "txn3", Time: 300, Before: 200})
+	if _, err := p2.Update(sm.Entry{Cmd: abort}); err != nil {
+		t.Fatalf("abort failed %v", err)
+	}
+	finished := p2.(*participant).finished
+	if _, ok := finished["txn1"]; ok || len(finished) != 1 {
+		t.Errorf("finished transactions not garbage collected, %v", finished)
+	}
+	result, err = p.Update(sm.Entry{
+		Cmd: encodePrepare("txn2", [][]byte{[]byte("reject")}),
+	})
+	if err != nil {
+		t.Fatalf("prepare failed %v", err)
+	}
+	if result.Value != voteAbort {
+		t.Errorf("unexpected vote")
+	}
+	if _, err := p.Update(sm.Entry{Cmd: []byte{0xFF}}); err == nil {
+		t.Errorf("unknown kind not reported")
+	}
+}
+
+func runTxnTest(t *testing.T, f func(nh *dragonboat.NodeHost)) {
+	fs := vfs.GetTestFS()
+	if err := fs.RemoveAll(testDataDir); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer func() {
+		if err := fs.RemoveAll(testDataDir); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}()
+	nhc := config.NodeHostConfig{
+		NodeHostDir:    testDataDir,
+		RTTMillisecond: 5,
+		RaftAddress:    testRaftAddress,
+		Expert:         config.ExpertConfig{FS: fs},
+	}
+	nh, err := dragonboat.NewNodeHost(nhc)
+	if err != nil {
+		t.Fatalf("failed to create nodehost %v", err)
+	}
+	defer nh.Close()
+	members := map[uint64]string{1: testRaftAddress}
+	for shardID := uint64(1); shardID <= 3; shardID++ {
+		rc := config.Config{
+			ShardID:      shardID,
+			ReplicaID:    1,
+			ElectionRTT:  10,
+			HeartbeatRTT: 1,
+		}
+		create := NewParticipant(newTestKV)
+		if shardID == testRecordShard {
+			create = NewRecordStateMachine
+		}
+		if err := nh.StartReplica(members, false, create, rc); err != nil {
+			t.Fatalf("failed to start replica %v", err)
+		}
+		for i := 0; i < 1000; i++ {
+			_, _, ok, err := nh.GetLeaderID(shardID)
+			if err != nil {
+				t.Fatalf("failed to get leader id %v", err)
+			}
+			if ok {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	f(nh)
+}
+
+func TestTransactionCanBeCommittedOrAborted(t *testing.T) {
+	runTxnTest(t, func(nh *dragonboat.NodeHost) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		c := NewCoordinator(nh, testRecordShard, time.Minute, time.Minute)
+		txn := c.Begin()
+		txn.Add(2, []byte("k1"))
+		txn.Add(3, []byte("k2"))
+		if err := txn.Commit(ctx); err != nil {
+			t.Fatalf("failed to commit %v", err)
+		}
+		state, err := c.Status(ctx, txn.ID())
+		if err != nil {
+			t.Fatalf("failed to get status %v", err)
+		}
+		if state != Committed {
+			t.Errorf("decision not retained, %s", state)
+		}
+		if err := txn.Commit(ctx); err != ErrTransactionDone {
+			t.Errorf("ErrTransactionDone not returned, %v", err)
+		}
+		for shardID, key := range map[uint64]string{2: "k1", 3: "k2"} {
+			v, err := nh.SyncRead(ctx, shardID, key)
+			if err != nil {
+				t.Fatalf("failed to read %v", err)
+			}
+			if v.(string) != key {
+				t.Errorf("committed intent not applied on shard %d", shardID)
+			}
+		}
+		txn = c.Begin()
+		txn.Add(2, []byte("k3"))
+		txn.Add(3, []byte("reject"))
+		if err := txn.Commit(ctx); err != ErrAborted {
+			t.Fatalf("failed to abort, %v", err)
+		}
+		v, err := nh.SyncRead(ctx, 2, "k3")
+		if err != nil {
+			t.Fatalf("failed to read %v", err)
+		}
+		if v.(string) != "" {
+			t.Errorf("aborted intent applied")
+		}
+		state, err = c.Status(ctx, txn.ID())
+		if err != nil {
+			t.Fatalf("failed to get status %v", err)
+		}
+		if state != Aborted {
+			t.Errorf("decision not retained, %s", state)
+		}
+	})
+}
+
+func TestInDoubtTransactionIsRecovered(t *testing.T) {
+	runTxnTest(t, func(nh *dragonboat.NodeHost) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		c := NewCoordinator(nh, testRecordShard, time.Millisecond, time.Minute)
+		txn := c.Begin()
+		txn.Add(2, []byte("k1"))
+		// simulate a coordinator failure after the prepare phase
+		r := Record{ID: txn.ID(), Participants: txn.participants()}
+		if _, err := c.updateRecord(ctx, opCreate, r); err != nil {
+			t.Fatalf("failed to create record %v", err)
+		}
+		if !txn.prepare(ctx, r.Participants) {
+			t.Fatalf("failed to prepare")
+		}
+		n, err := c.Recover(ctx)
+		if err != nil {
+			t.Fatalf("failed to recover %v", err)
+		}
+		if n != 1 {
+			t.Errorf("unexpected resolved count %d", n)
+		}
+		state, err := c.Status(ctx, txn.ID())
+		if err != nil {
+			t.Fatalf("failed to get status %v", err)
+		}
+		if state != Aborted {
+			t.Errorf("transaction not aborted, %s", state)
+		}
+		// delayed prepare applied after the abort is rejected
+		if txn.prepare(ctx, r.Participants) {
+			t.Errorf("late prepare not rejected")
+		}
+		v, err := nh.SyncRead(ctx, 2, "k1")
+		if err != nil {
+			t.Fatalf("failed to read %v", err)
+		}
+		if v.(string) != "" {
+			t.Errorf("in-doubt transaction not aborted")
+		}
+		if n, err := c.Recover(ctx); err != nil || n != 0 {
+			t.Errorf("completed transaction resolved again, %d, %v", n, err)
+		}
+		c.retention = 0
+		if _, err := c.Recover(ctx); err != nil {
+			t.Fatalf("failed to recover %v", err)
+		}
+		if state, err := c.Status(ctx, txn.ID()); err != nil || state != Unknown {
+			t.Errorf("record not garbage collected, %s, %v", state, err)
+		}
+	})
+}